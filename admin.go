@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// AdminAPI manages route configs stored in Redis. Every change is recorded by
+// the AuditLogger and the route table is reloaded straight away, without
+// waiting on keyspace notifications
+type AdminAPI struct {
+	redis   *Redis
+	routes  *RouteManager
+	audit   *AuditLogger
+	capture *RequestCapture
+	state   *StateMonitor
+	replay  *http.Client
+	logger  *zap.SugaredLogger
+	token   string
+}
+
+func NewAdminAPI(redis *Redis, routes *RouteManager, audit *AuditLogger, capture *RequestCapture, state *StateMonitor, logger *zap.SugaredLogger, token string) *AdminAPI {
+	return &AdminAPI{
+		redis:   redis,
+		routes:  routes,
+		audit:   audit,
+		capture: capture,
+		state:   state,
+		replay:  &http.Client{Timeout: 30 * time.Second},
+		logger:  logger,
+		token:   token,
+	}
+}
+
+func (a *AdminAPI) Register(mux *http.ServeMux) {
+	mux.Handle("GET /admin/routes", a.requireAdmin(http.HandlerFunc(a.listRoutes)))
+	mux.Handle("PUT /admin/routes", a.requireAdmin(http.HandlerFunc(a.putRoute)))
+	mux.Handle("DELETE /admin/routes", a.requireAdmin(http.HandlerFunc(a.deleteRoute)))
+	mux.Handle("POST /admin/replay/{id}", a.requireAdmin(http.HandlerFunc(a.replayRequest)))
+	mux.Handle("GET /admin/state", a.requireAdmin(http.HandlerFunc(a.gatewayState)))
+	mux.Handle("GET /admin/slo", a.requireAdmin(http.HandlerFunc(a.listSLOs)))
+	mux.Handle("GET /admin/breakers", a.requireAdmin(http.HandlerFunc(a.listBreakers)))
+	mux.Handle("POST /admin/reload", a.requireAdmin(http.HandlerFunc(a.forceReload)))
+	mux.Handle("GET /admin/reload/status", a.requireAdmin(http.HandlerFunc(a.reloadStatus)))
+}
+
+// Admins authenticate with the admin token only. LoginHandler's JWTs are
+// signed with a built-in key, so anyone could mint one
+func (a *AdminAPI) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request, rc := ensureRequestContext(request)
+		if !validAdminToken(request.Header.Get(AdminTokenHeader), a.token) {
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rc.SetIdentity("admin-token")
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func adminIdentity(request *http.Request) string {
+	return RequestContextFrom(request.Context()).Identity()
+}
+
+func (a *AdminAPI) listRoutes(writer http.ResponseWriter, request *http.Request) {
+	configs, err := a.redis.ListConfs()
+	if err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("listing route configs", "error", err)
+		http.Error(writer, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, configs)
+}
+
+// Sends a captured request to the target query parameter and relays the
+// response. The captured URI is resolved against target, so target only
+// needs its scheme and host
+func (a *AdminAPI) replayRequest(writer http.ResponseWriter, request *http.Request) {
+	target, err := url.Parse(request.URL.Query().Get("target"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(writer, "target must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+
+	captured, err := a.capture.Get(request.PathValue("id"))
+	if errors.Is(err, ErrCaptureNotFound) {
+		http.Error(writer, "Captured request not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("loading captured request", "error", err)
+		http.Error(writer, "Failed to load captured request", http.StatusInternalServerError)
+		return
+	}
+
+	uri, err := url.ParseRequestURI(captured.URI)
+	if err != nil {
+		http.Error(writer, "Captured request has an invalid URI", http.StatusInternalServerError)
+		return
+	}
+	replay, err := http.NewRequestWithContext(request.Context(), captured.Method, target.ResolveReference(uri).String(), bytes.NewReader(captured.Body))
+	if err != nil {
+		http.Error(writer, "Failed to build replayed request", http.StatusInternalServerError)
+		return
+	}
+	replay.Header = captured.Header.Clone()
+	replay.Header.Del("Content-Length")
+
+	requestLogger(a.logger, request.Context()).Infow("replaying captured request",
+		"identity", adminIdentity(request),
+		"capture_id", captured.ID,
+		"target", target.String())
+
+	response, err := a.replay.Do(replay)
+	if err != nil {
+		http.Error(writer, "Replayed request failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	for name, values := range response.Header {
+		writer.Header()[name] = values
+	}
+	writer.WriteHeader(response.StatusCode)
+	io.Copy(writer, response.Body)
+}
+
+func (a *AdminAPI) gatewayState(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, a.state.State())
+}
+
+func (a *AdminAPI) listSLOs(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, a.routes.SLOs())
+}
+
+func (a *AdminAPI) listBreakers(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, a.routes.Breakers())
+}
+
+// Rebuilds the route table from Redis now, for deployments where keyspace
+// notifications can't be enabled
+func (a *AdminAPI) forceReload(writer http.ResponseWriter, request *http.Request) {
+	status := http.StatusOK
+	if err := a.routes.Reload(); err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("manual route reload failed", "identity", adminIdentity(request), "error", err)
+		status = http.StatusInternalServerError
+	}
+	writeJSON(writer, status, a.routes.ReloadStatus())
+}
+
+func (a *AdminAPI) reloadStatus(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, a.routes.ReloadStatus())
+}
+
+func (a *AdminAPI) putRoute(writer http.ResponseWriter, request *http.Request) {
+	var config RouteConfig
+	if err := decodeJSONBody(writer, request, &config); err != nil {
+		requestLogger(a.logger, request.Context()).Debugw("rejected route config", "error", err)
+		return
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		http.Error(writer, "Route path must start with /", http.StatusBadRequest)
+		return
+	}
+	// Once stored, a route that doesn't build would get every later reload
+	// rejected
+	if _, err := a.routes.buildRoute(config); err != nil {
+		http.Error(writer, "Invalid route: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := config.Key()
+	before, err := a.currentConfig(key)
+	if err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("reading route config", "key", key, "error", err)
+		http.Error(writer, "Failed to read route", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.redis.SetConf(key, config); err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("storing route config", "key", key, "error", err)
+		http.Error(writer, "Failed to store route", http.StatusInternalServerError)
+		return
+	}
+	config.SchemaVersion = currentSchemaVersion
+
+	a.audit.Record(adminIdentity(request), key, before, &config)
+	a.reload()
+
+	status := http.StatusOK
+	if before == nil {
+		status = http.StatusCreated
+	}
+	writeJSON(writer, status, config)
+}
+
+// The route is named by the host and path query parameters
+func (a *AdminAPI) deleteRoute(writer http.ResponseWriter, request *http.Request) {
+	key := RouteConfig{
+		Host: request.URL.Query().Get("host"),
+		Path: request.URL.Query().Get("path"),
+	}.Key()
+
+	before, err := a.currentConfig(key)
+	if err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("reading route config", "key", key, "error", err)
+		http.Error(writer, "Failed to read route", http.StatusInternalServerError)
+		return
+	}
+	if before == nil {
+		http.Error(writer, "Route not found", http.StatusNotFound)
+		return
+	}
+
+	if err := a.redis.DeleteConf(key); err != nil {
+		requestLogger(a.logger, request.Context()).Errorw("deleting route config", "key", key, "error", err)
+		http.Error(writer, "Failed to delete route", http.StatusInternalServerError)
+		return
+	}
+
+	a.audit.Record(adminIdentity(request), key, before, nil)
+	a.reload()
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// nil if no config is stored under key
+func (a *AdminAPI) currentConfig(key string) (*RouteConfig, error) {
+	config, err := a.redis.GetRouteConfig(key)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (a *AdminAPI) reload() {
+	if err := a.routes.Reload(); err != nil {
+		a.logger.Errorw("reloading routes after admin change", "error", err)
+	}
+}
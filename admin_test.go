@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAdminConfigChangeIsAudited(t *testing.T) {
+	r, server := newTestRedis(t)
+	core, logs := observer.New(zap.InfoLevel)
+	audit := NewAuditLogger(zap.New(core).Sugar(), r, "audit")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	mux := http.NewServeMux()
+	NewAdminAPI(r, m, audit, nil, nil, testLogger(), "admin-secret").Register(mux)
+
+	put := func(body string) int {
+		request := httptest.NewRequest(http.MethodPut, "/admin/routes", strings.NewReader(body))
+		request.Header.Set(AdminTokenHeader, "admin-secret")
+		request.Header.Set("Content-Type", "application/json")
+		return serve(mux, request).Code
+	}
+
+	if got := put(`{"path": "/svc", "targets": ["http://old.internal"]}`); got != http.StatusCreated {
+		t.Fatalf("creating route: status %d", got)
+	}
+	if got := put(`{"path": "/svc", "targets": ["http://new.internal"]}`); got != http.StatusOK {
+		t.Fatalf("updating route: status %d", got)
+	}
+
+	entries := logs.FilterMessage("route config changed").All()
+	if len(entries) != 2 {
+		t.Fatalf("logged %d audit entries, want one per change", len(entries))
+	}
+	update := entries[1].ContextMap()
+	if update["identity"] != "admin-token" || update["action"] != "update" || update["key"] != "/svc" {
+		t.Errorf("audit entry identity=%v action=%v key=%v, want the admin token updating /svc", update["identity"], update["action"], update["key"])
+	}
+
+	stream, err := server.Stream("audit")
+	if err != nil || len(stream) != 2 {
+		t.Fatalf("audit stream has %d entries (%v), want 2", len(stream), err)
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(stream[1].Values[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Identity != "admin-token" || entry.Action != "update" {
+		t.Errorf("stream entry = %s %s, want the admin token's update", entry.Identity, entry.Action)
+	}
+	want := map[string]ConfigDelta{"targets": {
+		Before: []interface{}{"http://old.internal"},
+		After:  []interface{}{"http://new.internal"},
+	}}
+	if !reflect.DeepEqual(entry.Diff, want) {
+		t.Errorf("diff = %v, want only the targets change", entry.Diff)
+	}
+}
+
+func TestAdminRequiresCredentials(t *testing.T) {
+	r, _ := newTestRedis(t)
+	mux := http.NewServeMux()
+	NewAdminAPI(r, NewRouteManager(Config{}, r, testLogger(), nil), NewAuditLogger(testLogger(), nil, ""), nil, nil, testLogger(), "admin-secret").Register(mux)
+
+	request := httptest.NewRequest(http.MethodPut, "/admin/routes", strings.NewReader(`{"path": "/svc"}`))
+	request.Header.Set(AdminTokenHeader, "guess")
+	if got := serve(mux, request).Code; got != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", got)
+	}
+	if stored, _ := r.GetConf("/svc"); stored != "" {
+		t.Error("unauthenticated change was stored")
+	}
+
+	// Anyone can mint a LoginHandler token, so they're no admin credentials
+	forged, err := createToken("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/admin/routes", "/admin/state", "/admin/reload"} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if path == "/admin/reload" {
+			request.Method = http.MethodPost
+		}
+		request.Header.Set("Authorization", "Bearer "+forged)
+		if got := serve(mux, request).Code; got != http.StatusUnauthorized {
+			t.Errorf("%s with a forged JWT: status %d, want 401", path, got)
+		}
+	}
+}
+
+func TestAdminForceReload(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "proxied")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewAdminAPI(r, m, NewAuditLogger(testLogger(), nil, ""), nil, nil, testLogger(), "admin-secret").Register(mux)
+
+	// Written behind the manager's back, as if no notification arrived
+	if err := r.SetConf("/svc", testRoute("/svc", upstream.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil)).Code; got != http.StatusNotFound {
+		t.Fatalf("status before reload = %d, want 404", got)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+	request.Header.Set(AdminTokenHeader, "admin-secret")
+	response := serve(mux, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("reload status %d: %s", response.Code, response.Body)
+	}
+	var status ReloadStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Succeeded != 2 || status.LastError != "" {
+		t.Errorf("reload result = %+v, want a second successful reload", status)
+	}
+
+	response = serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "proxied" {
+		t.Errorf("after reload: status %d body %q, want the new route proxied", response.Code, response.Body)
+	}
+}
+
+func TestAdminBreakersShowTrippedBreaker(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusInternalServerError, &calls)
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.CircuitBreaker = CircuitBreakerConfig{Enabled: true, Failures: 2, Cooldown: 60}
+	route := buildTestRoute(t, m, cfg)
+
+	for range 2 {
+		serve(route, httptest.NewRequest(http.MethodGet, "/svc", nil))
+	}
+	if got := serve(route, httptest.NewRequest(http.MethodGet, "/svc", nil)).Code; got != http.StatusServiceUnavailable {
+		t.Fatalf("status with the breaker open = %d, want 503", got)
+	}
+
+	mux := http.NewServeMux()
+	NewAdminAPI(nil, m, NewAuditLogger(testLogger(), nil, ""), nil, nil, testLogger(), "admin-secret").Register(mux)
+	request := httptest.NewRequest(http.MethodGet, "/admin/breakers", nil)
+	request.Header.Set(AdminTokenHeader, "admin-secret")
+	response := serve(mux, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", response.Code, response.Body)
+	}
+	var breakers []struct {
+		Target              string     `json:"target"`
+		State               string     `json:"state"`
+		ConsecutiveFailures int        `json:"consecutive_failures"`
+		Trips               int64      `json:"trips"`
+		LastTrip            *time.Time `json:"last_trip"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &breakers); err != nil {
+		t.Fatal(err)
+	}
+	if len(breakers) != 1 {
+		t.Fatalf("got %d breakers, want 1", len(breakers))
+	}
+	b := breakers[0]
+	if b.Target != upstream.URL || b.State != "open" || b.ConsecutiveFailures != 2 || b.Trips != 1 || b.LastTrip == nil {
+		t.Errorf("breaker = %+v, want %s open after 2 failures and 1 trip", b, upstream.URL)
+	}
+	if got := testutil.ToFloat64(breakerState.WithLabelValues(upstream.URL)); got != float64(BreakerOpen) {
+		t.Errorf("circuit_breaker_state = %v, want open", got)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream got %d calls, want none once the breaker opened", got)
+	}
+}
+
+func TestAdminAPIOffWithoutToken(t *testing.T) {
+	for token, want := range map[string]int{"": http.StatusNotFound, "admin-secret": http.StatusOK} {
+		r, _ := newTestRedis(t)
+		s := NewServer(Config{AdminToken: token}, *testLogger(), r)
+		s.InitializeRoutes()
+
+		request := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+		request.Header.Set(AdminTokenHeader, token)
+		if got := serve(s.router, request).Code; got != want {
+			t.Errorf("admin token %q: status %d, want %d", token, got, want)
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// An invalid route is turned away before it's stored, where it would block
+// every later reload
+func TestAdminRejectsInvalidRoute(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "proxied")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewAdminAPI(r, m, NewAuditLogger(testLogger(), nil, ""), nil, nil, testLogger(), "admin-secret").Register(mux)
+	put := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPut, "/admin/routes", strings.NewReader(body))
+		request.Header.Set(AdminTokenHeader, "admin-secret")
+		request.Header.Set("Content-Type", "application/json")
+		return serve(mux, request)
+	}
+
+	response := put(`{"path": "/broken", "targets": []}`)
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "Invalid route") {
+		t.Fatalf("got %d %q, want a 400 with the build error", response.Code, response.Body)
+	}
+	if stored, _ := r.GetConf("/broken"); stored != "" {
+		t.Error("invalid route was stored")
+	}
+
+	if got := put(`{"path": "/svc", "targets": ["` + upstream.URL + `"]}`).Code; got != http.StatusCreated {
+		t.Fatalf("valid route after the invalid one: status %d, want 201", got)
+	}
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil)); got.Code != http.StatusOK || got.Body.String() != "proxied" {
+		t.Errorf("got %d %q, want the valid route served", got.Code, got.Body)
+	}
+	if status := m.ReloadStatus(); status.LastError != "" {
+		t.Errorf("reload error %q, want none", status.LastError)
+	}
+}
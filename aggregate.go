@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Fans a request out to several upstreams and merges their JSON responses
+// under the configured keys
+type Aggregator struct {
+	upstreams map[string]string
+	timeout   time.Duration
+	client    *http.Client
+	logger    *zap.SugaredLogger
+}
+
+type aggregateResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors map[string]string          `json:"errors,omitempty"`
+}
+
+type aggregatePart struct {
+	key  string
+	body json.RawMessage
+	err  string
+}
+
+func NewAggregator(cfg Aggregate, transport http.RoundTripper, logger *zap.SugaredLogger) *Aggregator {
+	timeout := secondsToDuration(float64(cfg.Timeout))
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Aggregator{
+		upstreams: cfg.Upstreams,
+		timeout:   timeout,
+		client:    &http.Client{Transport: transport},
+		logger:    logger,
+	}
+}
+
+// ServeHTTP GETs every upstream concurrently. Whatever has arrived by the
+// deadline is returned; the rest are reported in errors as "timeout" so one
+// slow upstream can't hold up or fail the whole response. Only when every
+// part fails is the response a 502
+func (a *Aggregator) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), a.timeout)
+	defer cancel()
+
+	parts := make(chan aggregatePart, len(a.upstreams))
+	var wg sync.WaitGroup
+	for key, target := range a.upstreams {
+		wg.Add(1)
+		go func(key, target string) {
+			defer wg.Done()
+			parts <- a.fetch(ctx, request, key, target)
+		}(key, target)
+	}
+	go func() {
+		wg.Wait()
+		close(parts)
+	}()
+
+	response := aggregateResponse{
+		Data:   make(map[string]json.RawMessage),
+		Errors: make(map[string]string),
+	}
+	for part := range parts {
+		if part.err != "" {
+			response.Errors[part.key] = part.err
+			continue
+		}
+		response.Data[part.key] = part.body
+	}
+
+	status := http.StatusOK
+	if len(response.Data) == 0 && len(response.Errors) > 0 {
+		status = http.StatusBadGateway
+	}
+	if len(response.Errors) > 0 {
+		requestLogger(a.logger, request.Context()).Warnw("partial aggregate response", "path", request.URL.Path, "errors", response.Errors)
+	}
+
+	writeJSON(writer, status, response)
+}
+
+func (a *Aggregator) fetch(ctx context.Context, incoming *http.Request, key string, target string) aggregatePart {
+	part := aggregatePart{key: key}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		part.err = "invalid upstream"
+		return part
+	}
+	request.URL.RawQuery = incoming.URL.RawQuery
+	request.Header.Set("Accept", "application/json")
+	if id := CorrelationID(incoming.Context()); id != "" {
+		request.Header.Set(RequestIDHeader, id)
+	}
+
+	response, err := a.client.Do(request)
+	if err == nil {
+		defer response.Body.Close()
+		var body []byte
+		body, err = io.ReadAll(response.Body)
+		switch {
+		case err != nil:
+		case !isSuccessStatus(response.StatusCode):
+			part.err = fmt.Sprintf("status %d", response.StatusCode)
+			return part
+		case !json.Valid(body):
+			part.err = "invalid json"
+			return part
+		default:
+			part.body = body
+			return part
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		part.err = "timeout"
+	} else {
+		part.err = "unavailable"
+		requestLogger(a.logger, incoming.Context()).Debugw("aggregate upstream failed", "key", key, "error", err)
+	}
+	return part
+}
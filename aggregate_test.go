@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func jsonUpstream(t *testing.T, body string, delay time.Duration) string {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-request.Context().Done():
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.URL
+}
+
+func TestAggregatorPartialResponseOnTimeout(t *testing.T) {
+	aggregator := NewAggregator(Aggregate{
+		Timeout: 0.1,
+		Upstreams: map[string]string{
+			"user":   jsonUpstream(t, `{"name": "alice"}`, 0),
+			"orders": jsonUpstream(t, `[1, 2]`, 0),
+			"slow":   jsonUpstream(t, `{}`, 2*time.Second),
+		},
+	}, http.DefaultTransport, testLogger())
+
+	started := time.Now()
+	response := serve(aggregator, httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("took %v, want the slow upstream cut off at the 100ms deadline", elapsed)
+	}
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200 for a partial response", response.Code)
+	}
+
+	var body aggregateResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if string(body.Data["user"]) != `{"name":"alice"}` || string(body.Data["orders"]) != `[1,2]` {
+		t.Errorf("data = %s, want the fast upstreams' bodies", body.Data)
+	}
+	if _, ok := body.Data["slow"]; ok {
+		t.Error("slow upstream's part is in data")
+	}
+	if body.Errors["slow"] != "timeout" || len(body.Errors) != 1 {
+		t.Errorf("errors = %v, want only slow timing out", body.Errors)
+	}
+}
+
+func TestAggregatorAllPartsFailing(t *testing.T) {
+	aggregator := NewAggregator(Aggregate{
+		Timeout:   0.05,
+		Upstreams: map[string]string{"slow": jsonUpstream(t, `{}`, time.Second), "broken": jsonUpstream(t, `not json`, 0)},
+	}, http.DefaultTransport, testLogger())
+
+	response := serve(aggregator, httptest.NewRequest(http.MethodGet, "/", nil))
+	if response.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", response.Code)
+	}
+	var body aggregateResponse
+	json.Unmarshal(response.Body.Bytes(), &body)
+	if body.Errors["slow"] != "timeout" || body.Errors["broken"] != "invalid json" {
+		t.Errorf("errors = %v", body.Errors)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// One change to a route config, as made through the admin API
+type AuditEntry struct {
+	Time     time.Time              `json:"time"`
+	Identity string                 `json:"identity"`
+	Action   string                 `json:"action"` // create, update or delete
+	Key      string                 `json:"key"`
+	Before   *RouteConfig           `json:"before,omitempty"`
+	After    *RouteConfig           `json:"after,omitempty"`
+	Diff     map[string]ConfigDelta `json:"diff"`
+}
+
+// A top-level RouteConfig field's value before and after a change
+type ConfigDelta struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditLogger records config changes at info level and, when stream is set,
+// also appends them to that Redis stream for change tracking
+type AuditLogger struct {
+	logger *zap.SugaredLogger
+	redis  *Redis
+	stream string
+}
+
+func NewAuditLogger(logger *zap.SugaredLogger, redis *Redis, stream string) *AuditLogger {
+	return &AuditLogger{
+		logger: logger,
+		redis:  redis,
+		stream: stream,
+	}
+}
+
+// Record logs a change. before is nil for creates and after is nil for deletes
+func (a *AuditLogger) Record(identity string, key string, before *RouteConfig, after *RouteConfig) AuditEntry {
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		Identity: identity,
+		Key:      key,
+		Before:   before,
+		After:    after,
+		Diff:     diffConfigs(before, after),
+	}
+	switch {
+	case before == nil:
+		entry.Action = "create"
+	case after == nil:
+		entry.Action = "delete"
+	default:
+		entry.Action = "update"
+	}
+
+	a.logger.Infow("route config changed",
+		"identity", entry.Identity,
+		"action", entry.Action,
+		"key", entry.Key,
+		"diff", entry.Diff)
+
+	if a.stream != "" && a.redis != nil {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			err = a.redis.AppendStream(a.stream, map[string]interface{}{"entry": data})
+		}
+		if err != nil {
+			a.logger.Warnw("writing audit entry to redis", "stream", a.stream, "error", err)
+		}
+	}
+
+	return entry
+}
+
+// Compares the configs' JSON forms field by field, keyed by JSON name
+func diffConfigs(before *RouteConfig, after *RouteConfig) map[string]ConfigDelta {
+	beforeFields := configFields(before)
+	afterFields := configFields(after)
+
+	diff := make(map[string]ConfigDelta)
+	for name, value := range beforeFields {
+		if !reflect.DeepEqual(value, afterFields[name]) {
+			diff[name] = ConfigDelta{Before: value, After: afterFields[name]}
+		}
+	}
+	for name, value := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			diff[name] = ConfigDelta{After: value}
+		}
+	}
+	return diff
+}
+
+func configFields(config *RouteConfig) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if config == nil {
+		return fields
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(data, &fields)
+	return fields
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -26,17 +30,177 @@ func createToken(username string) (string, error) {
 }
 
 func verifyToken(tokenString string) error {
+	_, err := parseToken(tokenString)
+	return err
+}
+
+func parseToken(tokenString string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return secretKey, nil
 	})
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !token.Valid || !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return claims, nil
+}
+
+// Verifiers for each Authorization scheme ProtectedHandler accepts, keyed by
+// lowercased scheme name
+var authVerifiers = map[string]func(credentials string) error{
+	"bearer": verifyToken,
+	"basic":  verifyBasic,
+}
+
+// Splits an Authorization header into its scheme and credentials. Scheme
+// names are case-insensitive, so the scheme is returned lowercased
+func parseAuthorization(header string) (scheme string, credentials string, ok bool) {
+	scheme, credentials, ok = strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || scheme == "" {
+		return "", "", false
+	}
+
+	credentials = strings.TrimSpace(credentials)
+	if credentials == "" {
+		return "", "", false
+	}
+
+	return strings.ToLower(scheme), credentials, true
+}
+
+// TODO: adapt to reading auth from a configurable database
+func checkCredentials(username, password string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte("admin")) == 1
+	passOk := subtle.ConstantTimeCompare([]byte(password), []byte("123456")) == 1
+	return userOk && passOk
+}
+
+func verifyBasic(credentials string) error {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return fmt.Errorf("decoding basic credentials: %w", err)
 	}
 
-	if !token.Valid {
-		return fmt.Errorf("invalid token")
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return fmt.Errorf("malformed basic credentials")
+	}
+
+	if !checkCredentials(username, password) {
+		return fmt.Errorf("invalid credentials")
 	}
 
 	return nil
 }
+
+// Admin features are off entirely when no admin token is configured
+func validAdminToken(given string, adminToken string) bool {
+	if adminToken == "" || given == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) == 1
+}
+
+// Ways a route can require clients to authenticate, see AuthConfig
+const (
+	AuthJWT    = "jwt"
+	AuthBasic  = "basic"
+	AuthAPIKey = "api_key"
+)
+
+type authMethod struct {
+	challenge string // WWW-Authenticate value sent when every method fails
+	check     func(*http.Request) bool
+}
+
+func newAuthMethod(cfg AuthConfig) (authMethod, error) {
+	realm := cfg.Realm
+	if realm == "" {
+		realm = "lattice"
+	}
+
+	switch cfg.Type {
+	case AuthJWT:
+		return authMethod{
+			challenge: fmt.Sprintf("Bearer realm=%q", realm),
+			check: func(request *http.Request) bool {
+				claims, ok := verifiedClaims(request)
+				if ok {
+					username, _ := claims["username"].(string)
+					RequestContextFrom(request.Context()).SetIdentity(username)
+				}
+				return ok
+			},
+		}, nil
+	case AuthBasic:
+		return authMethod{
+			challenge: fmt.Sprintf("Basic realm=%q", realm),
+			check: func(request *http.Request) bool {
+				given, credentials, ok := parseAuthorization(request.Header.Get("Authorization"))
+				return ok && given == "basic" && verifyBasic(credentials) == nil
+			},
+		}, nil
+	case AuthAPIKey:
+		if len(cfg.Keys) == 0 {
+			return authMethod{}, fmt.Errorf("api_key auth needs keys")
+		}
+		header := cfg.Header
+		if header == "" {
+			header = "X-API-Key"
+		}
+		return authMethod{
+			challenge: fmt.Sprintf("APIKey realm=%q, header=%q", realm, header),
+			check: func(request *http.Request) bool {
+				given := request.Header.Get(header)
+				if given == "" {
+					return false
+				}
+				valid := false
+				for _, key := range cfg.Keys {
+					// Check every key so timing doesn't reveal which matched
+					if subtle.ConstantTimeCompare([]byte(given), []byte(key)) == 1 {
+						valid = true
+					}
+				}
+				return valid
+			},
+		}, nil
+	}
+	return authMethod{}, fmt.Errorf("unknown auth type %q", cfg.Type)
+}
+
+// AuthMiddleware lets a request through if it satisfies any of the
+// configured methods, tried in order. Otherwise it answers 401 with a
+// WWW-Authenticate challenge for each method
+func AuthMiddleware(methods []AuthConfig, errorPages *ErrorRenderer) (Middleware, error) {
+	authMethods := make([]authMethod, 0, len(methods))
+	for _, cfg := range methods {
+		method, err := newAuthMethod(cfg)
+		if err != nil {
+			return nil, err
+		}
+		authMethods = append(authMethods, method)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			for _, method := range authMethods {
+				if method.check(request) {
+					next.ServeHTTP(writer, request)
+					return
+				}
+			}
+
+			for _, method := range authMethods {
+				writer.Header().Add("WWW-Authenticate", method.challenge)
+			}
+			errorPages.Render(writer, request, http.StatusUnauthorized, "Authentication required")
+		})
+	}, nil
+}
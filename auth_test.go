@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A route taking either a JWT or an API key
+func TestAuthMethodsFallBack(t *testing.T) {
+	upstream := newTestUpstream(t, "proxied")
+	cfg := testRoute("/api", upstream.URL)
+	cfg.AuthMethods = []AuthConfig{
+		{Type: AuthJWT},
+		{Type: AuthAPIKey, Keys: []string{"key-one", "key-two"}, Realm: "partners"},
+	}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	token, err := createToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"jwt", map[string]string{"Authorization": "Bearer " + token}, http.StatusOK},
+		{"api key", map[string]string{"X-API-Key": "key-two"}, http.StatusOK},
+		{"bad jwt, good key", map[string]string{"Authorization": "Bearer not-a-jwt", "X-API-Key": "key-one"}, http.StatusOK},
+		{"neither", nil, http.StatusUnauthorized},
+		{"wrong key", map[string]string{"X-API-Key": "key-three"}, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api", nil)
+			for name, value := range tc.headers {
+				request.Header.Set(name, value)
+			}
+			response := serve(handler, request)
+			if response.Code != tc.want {
+				t.Fatalf("status = %d, want %d", response.Code, tc.want)
+			}
+			if tc.want == http.StatusOK {
+				if response.Body.String() != "proxied" {
+					t.Errorf("body = %q, want the upstream's", response.Body)
+				}
+				return
+			}
+
+			// One challenge per method, in the configured order
+			challenges := response.Header().Values("WWW-Authenticate")
+			want := []string{`Bearer realm="lattice"`, `APIKey realm="partners", header="X-API-Key"`}
+			if len(challenges) != len(want) || challenges[0] != want[0] || challenges[1] != want[1] {
+				t.Errorf("WWW-Authenticate = %q, want %q", challenges, want)
+			}
+		})
+	}
+}
+
+func TestAuthMethodsInvalidConfig(t *testing.T) {
+	for _, methods := range [][]AuthConfig{
+		{{Type: AuthJWT}, {Type: "oauth"}},
+		{{Type: AuthAPIKey}},
+	} {
+		if _, err := AuthMiddleware(methods, nil); err == nil {
+			t.Errorf("%+v accepted", methods)
+		}
+	}
+}
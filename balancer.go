@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How a route spreads requests across its targets
+type LoadBalanceStrategy string
+
+const (
+	RoundRobin         LoadBalanceStrategy = "round_robin"
+	WeightedRoundRobin LoadBalanceStrategy = "weighted"
+	WeightedRandom     LoadBalanceStrategy = "weighted_random"
+	LeastConn          LoadBalanceStrategy = "least_conn"
+	PowerOfTwoChoices  LoadBalanceStrategy = "p2c"
+)
+
+func (s LoadBalanceStrategy) valid() bool {
+	switch s {
+	case RoundRobin, WeightedRoundRobin, WeightedRandom, LeastConn, PowerOfTwoChoices:
+		return true
+	}
+	return false
+}
+
+type upstream struct {
+	url      *url.URL
+	weight   int
+	proxy    http.Handler
+	breaker  *CircuitBreaker  // nil unless the route has circuit breaking
+	outlier  *OutlierDetector // nil unless the route has outlier detection
+	inFlight atomic.Int64
+
+	// Slow start ramps the weight up over slowStart after the target is
+	// first seen (addedAt) or recovers from a breaker trip or ejection
+	slowStart time.Duration
+	addedAt   time.Time
+
+	current int // Smooth weighted round robin state, guarded by Balancer.mu
+}
+
+// Upstreams whose breaker is open are skipped until their cooldown is over,
+// and ejected outliers until their ejection ends
+func (u *upstream) available() bool {
+	if u.outlier != nil && !u.outlier.Available() {
+		return false
+	}
+	return u.breaker == nil || u.breaker.Available()
+}
+
+// Weights are scaled by this internally so a weight of 1 can still ramp
+const weightScale = 100
+
+// Share of its weight a target starts slow start with
+const slowStartFloor = 0.1
+
+// Weight in weightScale units, reduced while the target is in slow start
+func (u *upstream) effectiveWeight(now time.Time) int {
+	full := u.weight * weightScale
+	if u.slowStart <= 0 {
+		return full
+	}
+
+	since := u.addedAt
+	if u.outlier != nil {
+		if admitted := u.outlier.AdmittedAt(); admitted.After(since) {
+			since = admitted
+		}
+	}
+	if u.breaker != nil {
+		if recovered := u.breaker.RecoveredAt(); recovered.After(since) {
+			since = recovered
+		}
+	}
+
+	elapsed := now.Sub(since)
+	if elapsed >= u.slowStart {
+		return full
+	}
+	factor := math.Max(float64(elapsed)/float64(u.slowStart), slowStartFloor)
+	return max(int(float64(full)*factor), 1)
+}
+
+// Randomness behind the random strategies' picks. Swappable so selection can
+// be made reproducible, see NewSeededSource
+type SelectionSource interface {
+	// A number in [0, n)
+	Intn(n int) int
+}
+
+type realSelectionSource struct{}
+
+func (realSelectionSource) Intn(n int) int { return rand.Intn(n) }
+
+// Picks the same sequence every time for the same seed. Safe for concurrent
+// use, though concurrent requests then take numbers in whatever order they
+// get to it
+func NewSeededSource(seed int64) SelectionSource {
+	return &seededSource{rand: rand.New(rand.NewSource(seed))}
+}
+
+type seededSource struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (s *seededSource) Intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Intn(n)
+}
+
+// Balancer proxies each request to one of a route's targets
+type Balancer struct {
+	strategy  LoadBalanceStrategy
+	upstreams []*upstream
+	next      atomic.Uint64 // Round robin position, starting at the first target
+	source    SelectionSource
+	logger    *zap.SugaredLogger // Logs each selection when set
+
+	// Distinct targets a failing request is tried on, as many as a keyed
+	// request has attempts if that's more, and whether requests with bodies
+	// may be failed over too
+	failoverTargets int
+	keyedTargets    int
+	bufferBodies    bool
+
+	mu sync.Mutex
+}
+
+// Set on the request context of every attempt but the last, so the proxy's
+// error handler leaves the response to the balancer
+type failover struct {
+	err error
+}
+
+type failoverKey struct{}
+
+// Whether ctx belongs to an attempt the balancer will follow with another
+// target if it fails
+func failingOver(ctx context.Context) bool {
+	_, ok := ctx.Value(failoverKey{}).(*failover)
+	return ok
+}
+
+// Which target handles a request, and why
+type selection struct {
+	upstream *upstream
+	reason   string
+	healthy  int // Candidates that were available
+}
+
+func NewBalancer(strategy LoadBalanceStrategy, upstreams []*upstream) *Balancer {
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	return &Balancer{strategy: strategy, upstreams: upstreams, source: realSelectionSource{}}
+}
+
+// SetSelectionSource replaces the randomness weighted_random and p2c pick
+// with
+func (b *Balancer) SetSelectionSource(source SelectionSource) {
+	b.source = source
+}
+
+// SetSelectionLogger logs, at debug level, which target each request went
+// to and why. Meant for debugging, it adds a log line per request
+func (b *Balancer) SetSelectionLogger(logger *zap.SugaredLogger) {
+	b.logger = logger
+}
+
+// SetFailover tries requests that fail outright against a target on up to
+// cfg.Targets distinct targets, after the target's own retries. Requests
+// carrying an Idempotency-Key that get a 5xx move on to another target
+// straight away, across as many targets as they have attempts if that's
+// more. Only safe methods and Idempotency-Key requests fail over. Requests
+// with bodies also need bufferBodies, their body is held in memory for the
+// next target
+func (b *Balancer) SetFailover(cfg RetryConfig, bufferBodies bool) {
+	b.failoverTargets = cfg.Targets
+	b.keyedTargets = cfg.attempts()
+	b.bufferBodies = bufferBodies
+}
+
+func (b *Balancer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	keyed := request.Header.Get(IdempotencyKeyHeader) != ""
+	targets := b.failoverTargets
+	if keyed {
+		targets = max(targets, b.keyedTargets)
+	}
+	targets = min(targets, len(b.upstreams))
+	hasBody := request.Body != nil && request.Body != http.NoBody
+	if targets < 2 || (!keyed && !isSafeMethod(request.Method)) || (hasBody && !b.bufferBodies) {
+		b.serve(b.pick(nil), writer, request)
+		return
+	}
+
+	body, replayable, err := bufferBody(request)
+	if err != nil || !replayable {
+		b.serve(b.pick(nil), writer, request)
+		return
+	}
+
+	tried := make(map[*upstream]bool, targets)
+	for attempt := 0; ; attempt++ {
+		picked := b.pick(tried)
+		attemptRequest := request
+		if attempt < targets-1 {
+			attemptRequest = request.WithContext(context.WithValue(request.Context(), failoverKey{}, &failover{}))
+		}
+		if body != nil {
+			attemptRequest.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		b.serve(picked, writer, attemptRequest)
+
+		f, ok := attemptRequest.Context().Value(failoverKey{}).(*failover)
+		if !ok || f.err == nil {
+			return
+		}
+		if b.logger != nil {
+			requestLogger(b.logger, request.Context()).Debugw("failing over to another target",
+				"target", picked.upstream.url.String(),
+				"attempt", attempt+1,
+				"error", f.err)
+		}
+		tried[picked.upstream] = true
+	}
+}
+
+func (b *Balancer) serve(picked selection, writer http.ResponseWriter, request *http.Request) {
+	u := picked.upstream
+	if b.logger != nil {
+		requestLogger(b.logger, request.Context()).Debugw("upstream selected",
+			"target", u.url.String(),
+			"strategy", b.strategy,
+			"reason", picked.reason,
+			"weight", u.weight,
+			"in_flight", u.inFlight.Load(),
+			"healthy", picked.healthy,
+			"targets", len(b.upstreams))
+	}
+
+	u.inFlight.Add(1)
+	defer u.inFlight.Add(-1)
+
+	u.proxy.ServeHTTP(writer, request)
+}
+
+// Targets in exclude, which may be nil, are never picked
+func (b *Balancer) pick(exclude map[*upstream]bool) selection {
+	if len(b.upstreams) == 1 {
+		return selection{upstream: b.upstreams[0], reason: "only target", healthy: 1}
+	}
+
+	candidates, healthy := b.healthy(exclude)
+	var picked selection
+	switch b.strategy {
+	case WeightedRoundRobin:
+		picked = selection{upstream: b.pickWeightedRoundRobin(candidates, weights(candidates)), reason: "smooth weighted round robin"}
+	case WeightedRandom:
+		picked = selection{upstream: pickWeightedRandom(b.source, candidates, weights(candidates)), reason: "random by weight"}
+	case LeastConn:
+		picked = selection{upstream: pickLeastConn(candidates, weights(candidates)), reason: "fewest in-flight relative to weight"}
+	case PowerOfTwoChoices:
+		picked = selection{upstream: pickTwoChoices(b.source, candidates, weights(candidates)), reason: "less loaded of two random targets"}
+	default:
+		// Failover picks leave the rotation alone, otherwise each failed-over
+		// request would advance it twice and skew the spread
+		n := b.next.Load()
+		if len(exclude) == 0 {
+			n = b.next.Add(1) - 1
+		}
+		picked = selection{upstream: candidates[n%uint64(len(candidates))], reason: "round robin"}
+	}
+
+	picked.healthy = healthy
+	if healthy == 0 {
+		picked.reason += ", no healthy targets"
+	}
+	return picked
+}
+
+// With no healthy targets every target not excluded is a candidate, and the
+// open breakers answer for themselves. Also returns how many were healthy
+func (b *Balancer) healthy(exclude map[*upstream]bool) ([]*upstream, int) {
+	remaining := b.upstreams
+	if len(exclude) > 0 {
+		remaining = make([]*upstream, 0, len(b.upstreams))
+		for _, u := range b.upstreams {
+			if !exclude[u] {
+				remaining = append(remaining, u)
+			}
+		}
+	}
+
+	healthy := make([]*upstream, 0, len(remaining))
+	for _, u := range remaining {
+		if u.available() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return remaining, 0
+	}
+	return healthy, len(healthy)
+}
+
+// Effective weights of candidates, index for index
+func weights(candidates []*upstream) []int {
+	now := time.Now()
+	weights := make([]int, len(candidates))
+	for i, u := range candidates {
+		weights[i] = u.effectiveWeight(now)
+	}
+	return weights
+}
+
+// nginx's smooth weighted round robin: heavier targets are picked more often
+// without being picked in bursts
+func (b *Balancer) pickWeightedRoundRobin(candidates []*upstream, weights []int) *upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *upstream
+	total := 0
+	for i, u := range candidates {
+		u.current += weights[i]
+		total += weights[i]
+		if best == nil || u.current > best.current {
+			best = u
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func pickWeightedRandom(source SelectionSource, candidates []*upstream, weights []int) *upstream {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	n := source.Intn(total)
+	for i, u := range candidates {
+		if n < weights[i] {
+			return u
+		}
+		n -= weights[i]
+	}
+	return candidates[len(candidates)-1]
+}
+
+func pickLeastConn(candidates []*upstream, weights []int) *upstream {
+	best := 0
+	for i := 1; i < len(candidates); i++ {
+		if lessLoaded(candidates[i], weights[i], candidates[best], weights[best]) {
+			best = i
+		}
+	}
+	return candidates[best]
+}
+
+// Two distinct targets at random, keeping the less loaded. Nearly as even as
+// least-conn while only looking at two counters
+func pickTwoChoices(source SelectionSource, candidates []*upstream, weights []int) *upstream {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := source.Intn(len(candidates))
+	j := source.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	if lessLoaded(candidates[j], weights[j], candidates[i], weights[i]) {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// In-flight requests relative to weight, compared without dividing
+func lessLoaded(a *upstream, aWeight int, b *upstream, bWeight int) bool {
+	return a.inFlight.Load()*int64(bWeight) < b.inFlight.Load()*int64(aWeight)
+}
+
+// When each target first appeared in the route table. Kept across reloads so
+// slow start only applies to targets that are actually new
+type targetRegistry struct {
+	mu        sync.Mutex
+	firstSeen map[string]time.Time
+}
+
+func newTargetRegistry() *targetRegistry {
+	return &targetRegistry{firstSeen: make(map[string]time.Time)}
+}
+
+func (r *targetRegistry) seen(target string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if at, ok := r.firstSeen[target]; ok {
+		return at
+	}
+	now := time.Now()
+	r.firstSeen[target] = now
+	return now
+}
+
+// Targets are weighted 1 unless weights says otherwise
+func parseUpstreams(targets []string, weights map[string]int) ([]*upstream, error) {
+	upstreams := make([]*upstream, 0, len(targets))
+	for _, target := range targets {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target URL: %w", err)
+		}
+		weight := 1
+		if w, ok := weights[target]; ok {
+			if w <= 0 {
+				return nil, fmt.Errorf("weight for %s must be positive", target)
+			}
+			weight = w
+		}
+		upstreams = append(upstreams, &upstream{url: parsed, weight: weight})
+	}
+	return upstreams, nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// A target that holds each request briefly, counting requests and the most
+// it had in flight at once
+type loadedTarget struct {
+	served   atomic.Int32
+	inFlight atomic.Int32
+	peak     atomic.Int32
+}
+
+func (l *loadedTarget) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	l.served.Add(1)
+	now := l.inFlight.Add(1)
+	defer l.inFlight.Add(-1)
+	for {
+		peak := l.peak.Load()
+		if now <= peak || l.peak.CompareAndSwap(peak, now) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+}
+
+func TestTwoChoicesBalancesConcurrentLoad(t *testing.T) {
+	const targets, workers, perWorker = 4, 8, 50
+
+	loaded := make([]*loadedTarget, targets)
+	upstreams := make([]*upstream, targets)
+	for i := range upstreams {
+		loaded[i] = &loadedTarget{}
+		upstreams[i] = &upstream{url: &url.URL{Scheme: "http", Host: "target" + string(rune('a'+i))}, weight: 1, proxy: loaded[i]}
+	}
+	balancer := NewBalancer(PowerOfTwoChoices, upstreams)
+	balancer.SetSelectionSource(NewSeededSource(1))
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	fair := workers * perWorker / targets
+	for i, l := range loaded {
+		served := int(l.served.Load())
+		if served < fair*6/10 || served > fair*14/10 {
+			t.Errorf("target %d served %d requests, want close to %d", i, served, fair)
+		}
+		// Two of eight concurrent requests each is even; the less loaded of
+		// two picks keeps any one target well short of all of them
+		if peak := l.peak.Load(); peak > workers*3/4 {
+			t.Errorf("target %d had %d requests in flight at once, want at most %d", i, peak, workers*3/4)
+		}
+	}
+}
+
+func TestSelectionLogging(t *testing.T) {
+	upstreams := []*upstream{
+		{url: &url.URL{Scheme: "http", Host: "target-a"}, weight: 1, proxy: okHandler()},
+		{url: &url.URL{Scheme: "http", Host: "target-b"}, weight: 3, proxy: okHandler()},
+	}
+	balancer := NewBalancer(RoundRobin, upstreams)
+
+	// Off by default
+	core, logs := observer.New(zap.DebugLevel)
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	balancer.SetSelectionLogger(zap.New(core).Sugar())
+
+	handler := RequestID(balancer)
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set(RequestIDHeader, "selection-test")
+	serve(handler, request)
+
+	entries := logs.FilterMessage("upstream selected").AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("logged %d selections, want only the one after enabling", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	want := map[string]any{
+		"target":     "http://target-b",
+		"strategy":   RoundRobin,
+		"reason":     "round robin",
+		"weight":     int64(3),
+		"healthy":    int64(2),
+		"targets":    int64(2),
+		"request_id": "selection-test",
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, fields[key], value)
+		}
+	}
+	if entries[0].Level != zap.DebugLevel {
+		t.Errorf("logged at %v, want debug", entries[0].Level)
+	}
+}
+
+// A target added partway through its neighbour's life gets a growing share of
+// the traffic until its slow start is over
+func TestSlowStartRampsNewTarget(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name  string
+		age   time.Duration
+		share float64
+	}{
+		// Weight 10 of 100 at the floor, then half of it, then all of it
+		{"just added", 0, 10.0 / 110},
+		{"half way", 50 * time.Second, 50.0 / 150},
+		{"warmed up", 2 * time.Minute, 0.5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			established := &upstream{url: &url.URL{Scheme: "http", Host: "established"}, weight: 1, slowStart: 100 * time.Second, addedAt: now.Add(-time.Hour)}
+			added := &upstream{url: &url.URL{Scheme: "http", Host: "added"}, weight: 1, slowStart: 100 * time.Second, addedAt: now.Add(-tc.age)}
+			balancer := NewBalancer(WeightedRoundRobin, []*upstream{established, added})
+
+			const picks = 3000
+			got := 0
+			for range picks {
+				if balancer.pick(nil).upstream == added {
+					got++
+				}
+			}
+			if share := float64(got) / picks; share < tc.share-0.02 || share > tc.share+0.02 {
+				t.Errorf("new target got %.1f%% of picks, want %.1f%%", share*100, tc.share*100)
+			}
+		})
+	}
+}
+
+// Re-admission after an ejection starts the ramp over
+func TestSlowStartRestartsAfterEjection(t *testing.T) {
+	const ejection = 20 * time.Millisecond
+	detector := NewOutlierDetector("http://flaky.internal", OutlierDetection{
+		Enabled:      true,
+		ErrorPercent: 50,
+		MinRequests:  2,
+		EjectionTime: float32(ejection.Seconds()),
+	})
+	u := &upstream{weight: 2, slowStart: time.Hour, addedAt: time.Now().Add(-2 * time.Hour), outlier: detector}
+	if got := u.effectiveWeight(time.Now()); got != 2*weightScale {
+		t.Fatalf("long-standing target weight = %d, want %d", got, 2*weightScale)
+	}
+
+	detector.Record(false)
+	detector.Record(false)
+	time.Sleep(ejection + 10*time.Millisecond)
+	if !u.available() {
+		t.Fatal("target wasn't re-admitted")
+	}
+	if got := u.effectiveWeight(time.Now()); got != int(2*weightScale*slowStartFloor) {
+		t.Errorf("re-admitted target weight = %d, want the floor %d", got, int(2*weightScale*slowStartFloor))
+	}
+
+	// Slow start off is always the full weight
+	fresh := &upstream{weight: 2, addedAt: time.Now()}
+	if got := fresh.effectiveWeight(time.Now()); got != 2*weightScale {
+		t.Errorf("weight without slow start = %d, want %d", got, 2*weightScale)
+	}
+}
+
+// Hands out fractions of n in order, so tests decide each random pick
+type scriptedSource struct {
+	fractions []float64
+	calls     int
+}
+
+func (s *scriptedSource) Intn(n int) int {
+	fraction := s.fractions[s.calls%len(s.fractions)]
+	s.calls++
+	return int(fraction * float64(n))
+}
+
+// Targets answering with their name, a light one and one three times heavier
+func namedUpstreams() []*upstream {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(name))
+		})
+	}
+	return []*upstream{
+		{url: &url.URL{Scheme: "http", Host: "a"}, weight: 1, proxy: named("a")},
+		{url: &url.URL{Scheme: "http", Host: "b"}, weight: 3, proxy: named("b")},
+	}
+}
+
+// The targets handler sends requests to, in order
+func selections(handler http.Handler, requests int) []string {
+	picked := make([]string, requests)
+	for i := range picked {
+		picked[i] = serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Body.String()
+	}
+	return picked
+}
+
+func TestScriptedSelectionSequence(t *testing.T) {
+	balancer := NewBalancer(WeightedRandom, namedUpstreams())
+	// a owns the first quarter of the weight, b the rest
+	balancer.SetSelectionSource(&scriptedSource{fractions: []float64{0, 0.5, 0.24, 0.26, 0.99}})
+	if got, want := selections(balancer, 5), []string{"a", "b", "a", "b", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("picked %v, want %v", got, want)
+	}
+
+	// Round robin needs no source and starts at the first target
+	if got, want := selections(NewBalancer(RoundRobin, namedUpstreams()), 4), []string{"a", "b", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("round robin picked %v, want %v", got, want)
+	}
+}
+
+func TestSeededSelectionRepeats(t *testing.T) {
+	for _, strategy := range []LoadBalanceStrategy{WeightedRandom, PowerOfTwoChoices} {
+		run := func(seed int64) []string {
+			balancer := NewBalancer(strategy, namedUpstreams())
+			balancer.SetSelectionSource(NewSeededSource(seed))
+			return selections(balancer, 20)
+		}
+		first := run(7)
+		if again := run(7); !reflect.DeepEqual(first, again) {
+			t.Errorf("%s: seed 7 picked %v, then %v", strategy, first, again)
+		}
+		if other := run(8); reflect.DeepEqual(first, other) {
+			t.Errorf("%s: seeds 7 and 8 both picked %v", strategy, first)
+		}
+	}
+}
+
+// A route's selection_seed gives every rebuild of it the same sequence
+func TestRouteSelectionSeed(t *testing.T) {
+	a, b := newTestUpstream(t, "a"), newTestUpstream(t, "b")
+	cfg := testRoute("/api", a.URL, b.URL)
+	cfg.LoadBalance = string(WeightedRandom)
+	cfg.SelectionSeed = 42
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+
+	first := selections(buildTestRoute(t, m, cfg), 20)
+	if again := selections(buildTestRoute(t, m, cfg), 20); !reflect.DeepEqual(first, again) {
+		t.Errorf("rebuilt route picked %v, then %v", first, again)
+	}
+}
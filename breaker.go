@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for requests to a target whose breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Point-in-time view of a breaker, as served on /admin/breakers
+type BreakerSnapshot struct {
+	Target              string       `json:"target"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	TotalFailures       int64        `json:"total_failures"`
+	Trips               int64        `json:"trips"`
+	LastTrip            *time.Time   `json:"last_trip,omitempty"`
+}
+
+// CircuitBreaker stops sending traffic to a target after threshold failures
+// in a row. Once cooldown has passed a single probe request is let through:
+// success closes the breaker, failure re-opens it for another cooldown
+type CircuitBreaker struct {
+	target string
+
+	mu                  sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	state               BreakerState
+	consecutiveFailures int
+	totalFailures       int64
+	trips               int64
+	lastTrip            time.Time
+	recoveredAt         time.Time
+	probing             bool
+}
+
+func NewCircuitBreaker(target string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	b := &CircuitBreaker{target: target}
+	b.configure(threshold, cooldown)
+	breakerState.WithLabelValues(target).Set(float64(BreakerClosed))
+	return b
+}
+
+func (b *CircuitBreaker) configure(threshold int, cooldown time.Duration) {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	b.mu.Lock()
+	b.threshold, b.cooldown = threshold, cooldown
+	b.mu.Unlock()
+}
+
+// Allow reports whether a request may be sent. Every allowed request must be
+// followed by exactly one call to Record or Forget
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.lastTrip) < b.cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.consecutiveFailures = 0
+		if b.state != BreakerClosed {
+			b.recoveredAt = time.Now()
+		}
+		b.setState(BreakerClosed)
+		return
+	}
+
+	b.consecutiveFailures++
+	b.totalFailures++
+	if b.state == BreakerHalfOpen || b.consecutiveFailures >= b.threshold {
+		b.trip()
+	}
+}
+
+// Available reports whether Allow could let a request through now, without
+// claiming the half-open probe
+func (b *CircuitBreaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return time.Since(b.lastTrip) >= b.cooldown
+	case BreakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// When the breaker last closed after tripping, zero if it never has
+func (b *CircuitBreaker) RecoveredAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.recoveredAt
+}
+
+// Forget counts an allowed request as neither success nor failure, for
+// requests the client gave up on
+func (b *CircuitBreaker) Forget() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := BreakerSnapshot{
+		Target:              b.target,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		TotalFailures:       b.totalFailures,
+		Trips:               b.trips,
+	}
+	if !b.lastTrip.IsZero() {
+		lastTrip := b.lastTrip
+		snapshot.LastTrip = &lastTrip
+	}
+	return snapshot
+}
+
+// Callers hold mu
+func (b *CircuitBreaker) trip() {
+	b.trips++
+	b.lastTrip = time.Now()
+	b.setState(BreakerOpen)
+	breakerTrips.WithLabelValues(b.target).Inc()
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	breakerState.WithLabelValues(b.target).Set(float64(state))
+}
+
+// Breakers shared by every route, one per target URL. They outlive reloads so
+// rebuilding the route table doesn't close a breaker on a failing upstream
+type BreakerRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func NewBreakerRegistry() *BreakerRegistry {
+	return &BreakerRegistry{breakers: make(map[string]*CircuitBreaker)}
+}
+
+// The most recently built route's settings apply when several routes share a
+// target
+func (r *BreakerRegistry) Get(target string, cfg CircuitBreakerConfig) *CircuitBreaker {
+	threshold := cfg.Failures
+	cooldown := secondsToDuration(float64(cfg.Cooldown))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.breakers[target]; ok {
+		b.configure(threshold, cooldown)
+		return b
+	}
+	b := NewCircuitBreaker(target, threshold, cooldown)
+	r.breakers[target] = b
+	return b
+}
+
+// Sorted by target
+func (r *BreakerRegistry) Snapshots() []BreakerSnapshot {
+	r.mu.Lock()
+	snapshots := make([]BreakerSnapshot, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		snapshots = append(snapshots, b.Snapshot())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Target < snapshots[j].Target })
+	return snapshots
+}
+
+// Counts transport errors and 5xx responses against the breaker
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if !t.breaker.Allow() {
+		if request.Body != nil {
+			request.Body.Close()
+		}
+		return nil, fmt.Errorf("%s: %w", t.breaker.target, ErrCircuitOpen)
+	}
+
+	response, err := t.next.RoundTrip(request)
+	if err != nil && request.Context().Err() != nil {
+		t.breaker.Forget()
+		return response, err
+	}
+	t.breaker.Record(err == nil && response.StatusCode < 500)
+	return response, err
+}
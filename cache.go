@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type CacheMiddleware struct {
+	redis       *Redis
+	logger      *zap.SugaredLogger
+	route       string // RouteConfig.Key(), namespaces the route's entries
+	perHost     bool   // Wildcard host routes keep entries per request host
+	config      Cache
+	readTimeout time.Duration
+	serializer  CacheSerializer
+	debug       bool // See SetDebugHeaders
+
+	mu      sync.Mutex
+	flights map[string]*cacheFlight
+}
+
+// An upstream fetch for a missed key that other requests for it wait on
+type cacheFlight struct {
+	done  chan struct{}
+	entry *CacheEntry // Set before done closes, nil if it can't be shared
+}
+
+// route is the RouteConfig.Key() of the route being cached, so routes for
+// different hosts sharing a path don't share entries
+func NewCacheMiddleware(redis *Redis, logger *zap.SugaredLogger, route string, config Cache, readTimeout time.Duration) *CacheMiddleware {
+	if readTimeout <= 0 {
+		readTimeout = 50 * time.Millisecond
+	}
+	return &CacheMiddleware{
+		redis:       redis,
+		logger:      logger,
+		route:       route,
+		perHost:     strings.HasPrefix(route, "*."),
+		config:      config,
+		readTimeout: readTimeout,
+		serializer:  GobSerializer{},
+		flights:     make(map[string]*cacheFlight),
+	}
+}
+
+// SetSerializer replaces the default gob encoding of stored responses.
+// Entries written by a different serializer are treated as misses
+func (c *CacheMiddleware) SetSerializer(serializer CacheSerializer) {
+	c.serializer = serializer
+}
+
+// SetDebugHeaders adds X-Cache-Key to every response the cache handles, and
+// X-Cache-TTL-Remaining, seconds until the entry expires, to those served
+// from it
+func (c *CacheMiddleware) SetDebugHeaders(enabled bool) {
+	c.debug = enabled
+}
+
+// CacheHandler serves GET responses from Redis when present and stores
+// successful upstream responses, status and headers included, for
+// Cache.ExpiresIn seconds. The lookup is on
+// the hot path, so a read slower than readTimeout is treated as a miss rather
+// than holding up the request. With Cache.Coalesce, concurrent misses for a
+// key wait for the first one's upstream fetch and are served its response
+// rather than each going upstream
+func (c *CacheMiddleware) CacheHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		// The cache is shared by every client, so one's credentialed response
+		// mustn't reach another
+		if hasCredentials(request) && !c.config.PerIdentity {
+			cacheLookups.WithLabelValues(c.route, "bypass").Inc()
+			writer.Header().Set("X-Cache", "BYPASS")
+			RequestContextFrom(request.Context()).SetCacheStatus("BYPASS")
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		key := c.key(request)
+		logger := requestLogger(c.logger, request.Context())
+		if c.debug {
+			writer.Header().Set("X-Cache-Key", key)
+		}
+
+		ctx, cancel := context.WithTimeout(request.Context(), c.readTimeout)
+		deadline, _ := ctx.Deadline()
+		cached, err := c.redis.GetContext(ctx, key)
+		// go-redis turns the deadline into one on the connection, so a
+		// stalled read fails with an i/o timeout rather than ctx's error,
+		// sometimes just before ctx's own timer has fired
+		timedOut := err != nil && (errors.Is(ctx.Err(), context.DeadlineExceeded) || !time.Now().Before(deadline))
+		cancel()
+
+		switch {
+		case request.Context().Err() != nil:
+			// The client went away during the lookup, there's no one to
+			// serve and nothing worth fetching
+			cacheLookups.WithLabelValues(c.route, "canceled").Inc()
+			logger.Debugw("client canceled during cache read", "key", key)
+			return
+		case timedOut:
+			cacheLookups.WithLabelValues(c.route, "timeout").Inc()
+			logger.Warnw("cache read timed out, treating as miss", "key", key, "timeout", c.readTimeout)
+		case err != nil:
+			cacheLookups.WithLabelValues(c.route, "error").Inc()
+			logger.Warnw("cache read failed, treating as miss", "key", key, "error", err)
+		case cached != "":
+			entry, err := c.serializer.Decode([]byte(cached))
+			if err != nil {
+				cacheLookups.WithLabelValues(c.route, "error").Inc()
+				logger.Warnw("undecodable cache entry, treating as miss", "key", key, "error", err)
+				break
+			}
+			cacheLookups.WithLabelValues(c.route, "hit").Inc()
+			writer.Header().Set("X-Cache", "HIT")
+			RequestContextFrom(request.Context()).SetCacheStatus("HIT")
+			c.setTTLRemaining(writer, entry)
+			entry.writeTo(writer, request)
+			return
+		default:
+			cacheLookups.WithLabelValues(c.route, "miss").Inc()
+		}
+
+		if !c.config.Coalesce {
+			c.fetch(next, writer, request, key, logger)
+			return
+		}
+		flight, leader := c.joinFlight(key)
+		if leader {
+			started := time.Now()
+			var entry *CacheEntry
+			// Deferred, ReverseProxy panics to abort truncated responses and
+			// the waiters still need releasing
+			defer func() { c.land(key, flight, entry, started) }()
+			entry = c.fetch(next, writer, request, key, logger)
+			return
+		}
+
+		select {
+		case <-flight.done:
+		case <-request.Context().Done():
+			return
+		}
+		if flight.entry == nil {
+			// The leader's response couldn't be shared, fetch our own
+			c.fetch(next, writer, request, key, logger)
+			return
+		}
+		cacheLookups.WithLabelValues(c.route, "coalesced").Inc()
+		writer.Header().Set("X-Cache", "COALESCED")
+		RequestContextFrom(request.Context()).SetCacheStatus("COALESCED")
+		c.setTTLRemaining(writer, *flight.entry)
+		flight.entry.writeTo(writer, request)
+	})
+}
+
+// Entries are namespaced by route, and for wildcard host routes by the host
+// the request was for, since each subdomain may be served different content.
+// Credentialed requests on PerIdentity routes are namespaced by a digest of
+// their credentials too
+func (c *CacheMiddleware) key(request *http.Request) string {
+	namespace := c.route
+	if c.perHost {
+		namespace = normalizeHost(request.Host) + "|" + namespace
+	}
+	if hasCredentials(request) {
+		namespace += "|" + credentialsDigest(request)
+	}
+	return "cache:" + namespace + ":" + request.URL.RequestURI()
+}
+
+func hasCredentials(request *http.Request) bool {
+	return request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != ""
+}
+
+func credentialsDigest(request *http.Request) string {
+	digest := sha256.New()
+	digest.Write([]byte(request.Header.Get("Authorization")))
+	digest.Write([]byte{0})
+	digest.Write([]byte(strings.Join(request.Header.Values("Cookie"), "; ")))
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// Whether a shared cache may keep a response with header
+func sharedCacheable(header http.Header) bool {
+	cacheControl := strings.ToLower(strings.Join(header.Values("Cache-Control"), ","))
+	return !strings.Contains(cacheControl, "no-store") && !strings.Contains(cacheControl, "private")
+}
+
+func (c *CacheMiddleware) setTTLRemaining(writer http.ResponseWriter, entry CacheEntry) {
+	if !c.debug || entry.TTL <= 0 {
+		return
+	}
+	remaining := max(time.Until(entry.StoredAt.Add(entry.TTL)), 0)
+	writer.Header().Set("X-Cache-TTL-Remaining", strconv.Itoa(ceilSeconds(remaining)))
+}
+
+// Proxies a miss and stores the response if it's cacheable. Returns what was
+// stored, nil if nothing was
+func (c *CacheMiddleware) fetch(next http.Handler, writer http.ResponseWriter, request *http.Request, key string, logger *zap.SugaredLogger) *CacheEntry {
+	writer.Header().Set("X-Cache", "MISS")
+	RequestContextFrom(request.Context()).SetCacheStatus("MISS")
+	fetched := time.Now()
+	crw := &cacheWriter{ResponseWriter: writer, status: http.StatusOK}
+	next.ServeHTTP(crw, request)
+
+	if !crw.cacheable(c.config.AllowUnknownLength) {
+		return nil
+	}
+	// The upstream call is canceled along with the request, so whatever
+	// body was copied may be incomplete
+	if request.Context().Err() != nil {
+		logger.Debugw("client canceled during upstream fetch, not caching", "key", key)
+		return nil
+	}
+
+	expiration := jitterTTL(time.Duration(float64(c.config.ExpiresIn)*float64(time.Second)), float64(c.config.TTLJitter))
+	entry := newCacheEntry(crw.status, crw.header, crw.body.Bytes(), expiration, c.config.StoreSetCookie)
+	entry.Trailer = trailerValues(crw.Header(), announcedTrailers(crw.header))
+	data, err := c.serializer.Encode(entry)
+	if err == nil {
+		err = c.store(key, data, fetched, expiration, logger)
+	}
+	if err != nil {
+		logger.Warnw("storing cached response", "key", key, "error", err)
+	}
+	return &entry
+}
+
+// Writes an encoded entry under the route's write policy. fetched is when
+// its upstream request was sent
+func (c *CacheMiddleware) store(key string, data []byte, fetched time.Time, expiration time.Duration, logger *zap.SugaredLogger) error {
+	var set bool
+	var err error
+	switch c.config.WritePolicy {
+	case CacheWriteFirst:
+		set, err = c.redis.SetNX(key, data, expiration)
+	case CacheWriteNewest:
+		set, err = c.redis.SetNewer(key, data, fetched.UnixNano(), expiration)
+	default:
+		return c.redis.Set(key, data, expiration)
+	}
+	if err == nil && !set {
+		logger.Debugw("kept concurrently cached response", "key", key, "policy", c.config.WritePolicy)
+	}
+	return err
+}
+
+// The flight fetching key, and whether the caller starts it and so must
+// land it
+func (c *CacheMiddleware) joinFlight(key string) (*cacheFlight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if flight, ok := c.flights[key]; ok {
+		return flight, false
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	c.flights[key] = flight
+	return flight, true
+}
+
+// Hands entry to the flight's waiters. The flight stays joinable until the
+// coalescing window after started has passed
+func (c *CacheMiddleware) land(key string, flight *cacheFlight, entry *CacheEntry, started time.Time) {
+	flight.entry = entry
+	close(flight.done)
+
+	remove := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.flights[key] == flight {
+			delete(c.flights, key)
+		}
+	}
+	window := secondsToDuration(float64(c.config.CoalesceWindow))
+	if remaining := window - time.Since(started); entry != nil && remaining > 0 {
+		time.AfterFunc(remaining, remove)
+		return
+	}
+	remove()
+}
+
+// Spreads ttl uniformly over ±percent of itself
+func jitterTTL(ttl time.Duration, percent float64) time.Duration {
+	if percent <= 0 || ttl <= 0 {
+		return ttl
+	}
+	percent = math.Min(percent, 100)
+	spread := float64(ttl) * percent / 100
+	jittered := time.Duration(float64(ttl) + (rand.Float64()*2-1)*spread)
+	// Redis treats a zero expiration as none at all
+	return max(jittered, time.Millisecond)
+}
+
+// Passes the response through while keeping a copy of the body for the cache
+type cacheWriter struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header // As sent, before later middleware could change it
+	body        bytes.Buffer
+	knownLength bool
+	wroteHeader bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.status = code
+		cw.header = cw.Header().Clone()
+		cw.knownLength = cw.Header().Get("Content-Length") != ""
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses streaming, the copy is still taken
+func (cw *cacheWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Only complete 200s the upstream allows shared caches to keep are stored.
+// Responses without a Content-Length (chunked, streams) are skipped unless the
+// route opts in, since they may be unbounded
+func (cw *cacheWriter) cacheable(allowUnknownLength bool) bool {
+	if cw.status != http.StatusOK || !sharedCacheable(cw.header) {
+		return false
+	}
+	return cw.knownLength || allowUnknownLength
+}
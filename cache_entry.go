@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// A cached upstream response, complete enough to replay it. Header keeps
+// every value of multi-valued headers, each Set-Cookie and Vary line included
+type CacheEntry struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	Trailer  http.Header // Sent after the body, as the upstream did
+	StoredAt time.Time
+	TTL      time.Duration
+}
+
+// Headers that describe one particular response or client rather than the
+// resource, and so are never stored. Set-Cookie is also dropped unless the
+// route opts in, see Cache.StoreSetCookie
+var uncachedHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Transfer-Encoding",
+	"Trailer",
+	"Date",
+	RequestIDHeader,
+	"X-Cache",
+	"X-Cache-Key",
+	"X-Cache-TTL-Remaining",
+	"X-Upstream-Duration",
+	"X-Ratelimit-Limit",
+	"X-Ratelimit-Remaining",
+	"X-Ratelimit-Reset",
+}
+
+func newCacheEntry(status int, header http.Header, body []byte, ttl time.Duration, keepCookies bool) CacheEntry {
+	stored := header.Clone()
+	for _, name := range uncachedHeaders {
+		stored.Del(name)
+	}
+	if !keepCookies {
+		stored.Del("Set-Cookie")
+	}
+	return CacheEntry{
+		Status:   status,
+		Header:   stored,
+		Body:     body,
+		StoredAt: time.Now(),
+		TTL:      ttl,
+	}
+}
+
+// Writes the entry as the response, with an Age header for its time in the
+// cache. Entries are stored as the upstream encoded them; clients that can't
+// decode that encoding get the body decoded
+func (e CacheEntry) writeTo(writer http.ResponseWriter, request *http.Request) {
+	header := writer.Header()
+	for name, values := range e.Header {
+		if name == "Vary" {
+			// Middleware ahead of the cache (Compress) may already have
+			// added its own
+			header[name] = mergeTokens(header[name], values)
+			continue
+		}
+		header[name] = append([]string(nil), values...)
+	}
+
+	body := e.Body
+	if encoding := e.Header.Get("Content-Encoding"); !acceptsEncoding(request.Header.Get("Accept-Encoding"), encoding) {
+		if decoded, err := decodeBody(encoding, body); err == nil {
+			body = decoded
+			header.Del("Content-Encoding")
+		}
+	}
+	// Trailers need a chunked body, which a Content-Length would rule out
+	if len(e.Trailer) > 0 {
+		names := make([]string, 0, len(e.Trailer))
+		for name := range e.Trailer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		header.Set("Trailer", strings.Join(names, ", "))
+	} else {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.StoredAt).Seconds())))
+
+	writer.WriteHeader(e.Status)
+	writer.Write(body)
+	for name, values := range e.Trailer {
+		header[name] = append([]string(nil), values...)
+	}
+}
+
+// Appends the lines of extra to lines, leaving out comma-separated tokens
+// already present (case-insensitively). Lines stay separate values
+func mergeTokens(lines []string, extra []string) []string {
+	seen := make(map[string]bool)
+	merged := make([]string, 0, len(lines)+len(extra))
+	for _, line := range append(append([]string(nil), lines...), extra...) {
+		var kept []string
+		for _, token := range strings.Split(line, ",") {
+			token = strings.TrimSpace(token)
+			key := strings.ToLower(token)
+			if token == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept = append(kept, token)
+		}
+		if len(kept) > 0 {
+			merged = append(merged, strings.Join(kept, ", "))
+		}
+	}
+	return merged
+}
+
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gr
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case "deflate":
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = zr
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	return io.ReadAll(reader)
+}
+
+// Converts cache entries to and from the bytes stored in Redis
+type CacheSerializer interface {
+	Encode(CacheEntry) ([]byte, error)
+	Decode([]byte) (CacheEntry, error)
+}
+
+type GobSerializer struct{}
+
+func (GobSerializer) Encode(entry CacheEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return nil, fmt.Errorf("encoding cache entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobSerializer) Decode(data []byte) (CacheEntry, error) {
+	var entry CacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		return CacheEntry{}, fmt.Errorf("decoding cache entry: %w", err)
+	}
+	return entry, nil
+}
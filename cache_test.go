@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// A Redis that accepts connections and never answers, as one stalled on a
+// slow command would look to the gateway
+func newStalledRedis(t *testing.T) *Redis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	r := &Redis{
+		cacheDb: redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ContextTimeoutEnabled: true, MaxRetries: -1}),
+		ctx:     context.Background(),
+		logger:  testLogger(),
+	}
+	t.Cleanup(func() { r.cacheDb.Close() })
+	return r
+}
+
+func TestCacheReadTimeoutIsMiss(t *testing.T) {
+	const readTimeout = 50 * time.Millisecond
+	cache := NewCacheMiddleware(newStalledRedis(t), testLogger(), "/slow", Cache{Enabled: true, ExpiresIn: 60}, readTimeout)
+	handler := cache.CacheHandler(okHandler())
+	timeouts := testutil.ToFloat64(cacheLookups.WithLabelValues("/slow", "timeout"))
+
+	started := time.Now()
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	elapsed := time.Since(started)
+
+	if response.Code != http.StatusOK || response.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want the upstream's response", response.Code, response.Body.String())
+	}
+	if got := response.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS", got)
+	}
+	if elapsed < readTimeout || elapsed > readTimeout+time.Second {
+		t.Errorf("request took %v, want it to wait out the %v read timeout and no longer", elapsed, readTimeout)
+	}
+	if got := testutil.ToFloat64(cacheLookups.WithLabelValues("/slow", "timeout")) - timeouts; got != 1 {
+		t.Errorf("counted %v timed out lookups, want 1", got)
+	}
+}
+
+func TestCacheHitReplaysResponse(t *testing.T) {
+	r, _ := newTestRedis(t)
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "public, max-age=60")
+		writer.Header().Set("ETag", `"v1"`)
+		writer.Header().Add("X-Tag", "a")
+		writer.Header().Add("X-Tag", "b")
+		writer.Header().Set("Set-Cookie", "session=abc")
+		writer.Header().Set("Content-Length", "11")
+		writer.Write([]byte(`{"id": 42}` + "\n"))
+	})
+	handler := NewCacheMiddleware(r, testLogger(), "/items", Cache{Enabled: true, ExpiresIn: 60}, time.Second).CacheHandler(upstream)
+
+	miss := serve(handler, httptest.NewRequest(http.MethodGet, "/items/42", nil))
+	hit := serve(handler, httptest.NewRequest(http.MethodGet, "/items/42", nil))
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("second request X-Cache = %q, want HIT", got)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstream called %d times, want once", calls.Load())
+	}
+
+	if hit.Code != miss.Code || hit.Body.String() != miss.Body.String() {
+		t.Errorf("hit = %d %q, want the original %d %q", hit.Code, hit.Body, miss.Code, miss.Body)
+	}
+	for _, name := range []string{"Content-Type", "Cache-Control", "ETag", "Content-Length"} {
+		if got, want := hit.Header().Get(name), miss.Header().Get(name); got != want {
+			t.Errorf("hit %s = %q, want %q", name, got, want)
+		}
+	}
+	if got := hit.Header().Values("X-Tag"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("hit X-Tag = %q, want both values", got)
+	}
+	if got := hit.Header().Get("Set-Cookie"); got != "" {
+		t.Errorf("hit replayed Set-Cookie %q", got)
+	}
+	if hit.Header().Get("Age") == "" {
+		t.Error("hit has no Age header")
+	}
+}
+
+func TestGobSerializerRoundTrip(t *testing.T) {
+	entry := CacheEntry{
+		Status:   http.StatusNonAuthoritativeInfo,
+		Header:   http.Header{"Content-Type": {"text/plain"}, "Vary": {"Accept", "Accept-Language"}},
+		Body:     []byte("cached body"),
+		Trailer:  http.Header{"X-Checksum": {"abc"}},
+		StoredAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		TTL:      time.Minute,
+	}
+	data, err := GobSerializer{}.Encode(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := GobSerializer{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, entry) {
+		t.Errorf("decoded %+v, want %+v", decoded, entry)
+	}
+	if _, err := (GobSerializer{}).Decode([]byte("plain string entry")); err == nil {
+		t.Error("decoded garbage without an error")
+	}
+}
+
+func TestCachedGzipServedToEveryClient(t *testing.T) {
+	r, _ := newTestRedis(t)
+	body := strings.Repeat("cached and compressed. ", 50)
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(body))
+	gw.Close()
+
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.Header().Set("Content-Encoding", "gzip")
+		writer.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		writer.Write(compressed.Bytes())
+	})
+	handler := NewCacheMiddleware(r, testLogger(), "/doc", Cache{Enabled: true, ExpiresIn: 60}, time.Second).CacheHandler(upstream)
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/doc", nil)
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		return serve(handler, request)
+	}
+	get("gzip")
+
+	plain := get("identity")
+	if got := plain.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache = %q, want HIT", got)
+	}
+	if got := plain.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q for a client without gzip", got)
+	}
+	if got := plain.Body.String(); got != body {
+		t.Errorf("body = %q, want it decoded", got)
+	}
+	if got := plain.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %q, want the decoded %d", got, len(body))
+	}
+
+	encoded := get("gzip, br")
+	if got := encoded.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+	if !bytes.Equal(encoded.Body.Bytes(), compressed.Bytes()) {
+		t.Error("gzip client didn't get the stored gzip body")
+	}
+	if got := encoded.Header().Get("Content-Length"); got != strconv.Itoa(compressed.Len()) {
+		t.Errorf("Content-Length = %q, want the compressed %d", got, compressed.Len())
+	}
+}
+
+// Signals the first body write
+type firstWriteSignal struct {
+	*httptest.ResponseRecorder
+	once    sync.Once
+	written chan struct{}
+}
+
+func (w *firstWriteSignal) Write(b []byte) (int, error) {
+	n, err := w.ResponseRecorder.Write(b)
+	w.once.Do(func() { close(w.written) })
+	return n, err
+}
+
+// A client hanging up mid-fetch cancels the upstream call, and the partial
+// response isn't cached
+func TestCacheClientCancelMidFetch(t *testing.T) {
+	r, server := newTestRedis(t)
+	upstreamCanceled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Length", "100")
+		writer.Write([]byte("partial..."))
+		writer.(http.Flusher).Flush()
+		<-request.Context().Done()
+		close(upstreamCanceled)
+	}))
+	defer upstream.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	m := NewRouteManager(Config{}, r, zap.New(core).Sugar(), nil)
+	cfg := testRoute("/report", upstream.URL)
+	cfg.Cache = Cache{Enabled: true, ExpiresIn: 60}
+	route := buildTestRoute(t, m, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &firstWriteSignal{ResponseRecorder: httptest.NewRecorder(), written: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		route.ServeHTTP(writer, httptest.NewRequest(http.MethodGet, "/report", nil).WithContext(ctx))
+	}()
+	// Hang up once the partial body has reached the client
+	<-writer.written
+	cancel()
+
+	select {
+	case <-upstreamCanceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request wasn't canceled")
+	}
+	<-done
+
+	server.Select(0)
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("cached %v after the client canceled", keys)
+	}
+	if logs.FilterMessage("client canceled during upstream fetch, not caching").Len() != 1 {
+		t.Error("cancellation wasn't logged as a client cancel")
+	}
+	if logs.FilterMessage("storing cached response").Len() != 0 {
+		t.Error("cancellation was logged as a store failure")
+	}
+}
+
+// Entries stored together get TTLs spread across the jitter band
+func TestCacheTTLJitter(t *testing.T) {
+	r, server := newTestRedis(t)
+	cfg := Cache{Enabled: true, ExpiresIn: 100, TTLJitter: 20, AllowUnknownLength: true}
+	handler := NewCacheMiddleware(r, testLogger(), "/items", cfg, time.Second).CacheHandler(okHandler())
+
+	const entries = 50
+	for i := range entries {
+		serve(handler, httptest.NewRequest(http.MethodGet, "/items/"+strconv.Itoa(i), nil))
+	}
+
+	keys := server.DB(0).Keys()
+	if len(keys) != entries {
+		t.Fatalf("stored %d entries, want %d", len(keys), entries)
+	}
+	distinct := make(map[time.Duration]bool)
+	for _, key := range keys {
+		ttl := server.DB(0).TTL(key)
+		if ttl < 80*time.Second || ttl > 120*time.Second {
+			t.Errorf("%s TTL = %v, want within 20%% of 100s", key, ttl)
+		}
+		distinct[ttl] = true
+	}
+	if len(distinct) < entries/2 {
+		t.Errorf("%d entries share %d TTLs, want them spread out", entries, len(distinct))
+	}
+}
+
+func TestJitterTTL(t *testing.T) {
+	for range 100 {
+		if got := jitterTTL(time.Minute, 10); got < 54*time.Second || got > 66*time.Second {
+			t.Fatalf("jittered TTL = %v, want within 10%% of 1m", got)
+		}
+		// Over 100% is capped, and a TTL never reaches zero
+		if got := jitterTTL(time.Second, 500); got < time.Millisecond || got > 2*time.Second {
+			t.Fatalf("TTL jittered by 500%% = %v, want within (0, 2s]", got)
+		}
+	}
+	if got := jitterTTL(time.Minute, 0); got != time.Minute {
+		t.Errorf("no jitter = %v, want the TTL unchanged", got)
+	}
+}
+
+// Each Set-Cookie and Vary line comes back on a hit as its own value, and
+// Vary tokens added ahead of the cache aren't repeated
+func TestCacheKeepsMultiValuedHeaders(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Set-Cookie", "theme=dark; Path=/")
+		writer.Header().Add("Set-Cookie", "lang=en; Path=/")
+		writer.Header().Add("Vary", "Accept-Encoding, Accept")
+		writer.Header().Add("Vary", "Accept-Language")
+		writer.Header().Set("Content-Length", "2")
+		writer.Write([]byte("ok"))
+	})
+	cache := NewCacheMiddleware(r, testLogger(), "/items", Cache{Enabled: true, ExpiresIn: 60, StoreSetCookie: true}, time.Second)
+	// Stands in for Compress, which adds its own Vary before the cache runs
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		cache.CacheHandler(upstream).ServeHTTP(writer, request)
+	})
+
+	serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+	hit := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache = %q, want HIT", got)
+	}
+
+	if got, want := hit.Header().Values("Set-Cookie"), []string{"theme=dark; Path=/", "lang=en; Path=/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+	if got, want := hit.Header().Values("Vary"), []string{"Accept-Encoding", "Accept", "Accept-Language"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Vary = %q, want %q", got, want)
+	}
+}
+
+// Requests arriving within the coalescing window after a fetch started share
+// it, even once it's done and the cache has nothing for them, as when the
+// entry is evicted or a replica hasn't caught up
+func TestCacheCoalesceWindow(t *testing.T) {
+	r, server := newTestRedis(t)
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		writer.Header().Set("Content-Length", "5")
+		writer.Write([]byte("fresh"))
+	})
+	const window = 300 * time.Millisecond
+	cfg := Cache{Enabled: true, ExpiresIn: 60, Coalesce: true, CoalesceWindow: float32(window.Seconds())}
+	handler := NewCacheMiddleware(r, testLogger(), "/items", cfg, time.Second).CacheHandler(upstream)
+
+	started := time.Now()
+	var statuses []string
+	for range 4 {
+		server.FlushAll()
+		response := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+		if response.Body.String() != "fresh" {
+			t.Fatalf("body = %q, want the upstream's", response.Body)
+		}
+		statuses = append(statuses, response.Header().Get("X-Cache"))
+		time.Sleep(window / 6)
+	}
+	if time.Since(started) >= window {
+		t.Skip("too slow to land every request inside the window")
+	}
+	if want := []string{"MISS", "COALESCED", "COALESCED", "COALESCED"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("X-Cache = %q, want %q", statuses, want)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream called %d times, want the requests to share 1 fetch", got)
+	}
+
+	// Past the window a miss fetches again
+	time.Sleep(window)
+	server.FlushAll()
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil)).Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("after the window X-Cache = %q, want MISS", got)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream called %d times, want a second fetch", got)
+	}
+}
+
+func TestCacheCoalescesConcurrentMisses(t *testing.T) {
+	r, _ := newTestRedis(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		<-release
+		writer.Header().Set("Content-Length", "5")
+		writer.Write([]byte("fresh"))
+	})
+	cfg := Cache{Enabled: true, ExpiresIn: 60, Coalesce: true}
+	handler := NewCacheMiddleware(r, testLogger(), "/items", cfg, time.Second).CacheHandler(upstream)
+
+	const requests = 10
+	var wg sync.WaitGroup
+	bodies := make(chan string, requests)
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies <- serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil)).Body.String()
+		}()
+	}
+	// Give the followers time to join before the leader's fetch lands
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	for body := range bodies {
+		if body != "fresh" {
+			t.Errorf("body = %q, want the shared fetch's", body)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("%d concurrent misses made %d upstream calls, want 1", requests, got)
+	}
+}
+
+// An older request whose response lands after a newer one's. Coalescing is
+// off, so both miss and both try to store
+func TestCacheWritePolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   string
+	}{
+		{"", "old"},
+		{CacheWriteOverwrite, "old"},
+		{CacheWriteFirst, "new"},
+		{CacheWriteNewest, "new"},
+	} {
+		t.Run("policy "+tc.policy, func(t *testing.T) {
+			r, _ := newTestRedis(t)
+			var calls atomic.Int32
+			entered := make(chan struct{})
+			release := make(chan struct{})
+			upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.Header().Set("Content-Length", "3")
+				if calls.Add(1) == 1 {
+					close(entered)
+					<-release
+					writer.Write([]byte("old"))
+					return
+				}
+				writer.Write([]byte("new"))
+			})
+			cfg := Cache{Enabled: true, ExpiresIn: 60, WritePolicy: tc.policy}
+			handler := NewCacheMiddleware(r, testLogger(), "/items", cfg, time.Second).CacheHandler(upstream)
+
+			slow := make(chan struct{})
+			go func() {
+				defer close(slow)
+				serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+			}()
+			<-entered
+			if got := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil)).Body.String(); got != "new" {
+				t.Fatalf("newer request got %q, want new", got)
+			}
+			close(release)
+			<-slow
+
+			response := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+			if response.Header().Get("X-Cache") != "HIT" || response.Body.String() != tc.want {
+				t.Errorf("cached %q (X-Cache %s), want %q", response.Body.String(), response.Header().Get("X-Cache"), tc.want)
+			}
+		})
+	}
+}
+
+func TestSetNewer(t *testing.T) {
+	r, server := newTestRedis(t)
+	for _, write := range []struct {
+		value   string
+		version int64
+		want    bool
+	}{
+		{"v2", 2, true},
+		{"v1", 1, false},
+		{"v2 again", 2, false},
+		{"v3", 3, true},
+	} {
+		set, err := r.SetNewer("key", write.value, write.version, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set != write.want {
+			t.Errorf("writing %s at version %d: set = %v, want %v", write.value, write.version, set, write.want)
+		}
+	}
+	if got, _ := r.Get("key"); got != "v3" {
+		t.Errorf("stored %q, want v3", got)
+	}
+	// The version expires with the value, so a later write isn't blocked by it
+	if server.TTL("key") != server.TTL("cachever:key") || server.TTL("key") <= 0 {
+		t.Errorf("TTLs %v and %v, want the value and its version to expire together", server.TTL("key"), server.TTL("cachever:key"))
+	}
+
+	// A request URI ending in :version names a cache entry, never another
+	// entry's version
+	entry, colliding := "cache:/items:/items/1", "cache:/items:/items/1:version"
+	for _, write := range []struct {
+		key     string
+		value   string
+		version int64
+	}{
+		{entry, "item", 10},
+		{colliding, "other", 1},
+		{entry, "newer item", 11},
+	} {
+		if set, err := r.SetNewer(write.key, write.value, write.version, time.Minute); err != nil || !set {
+			t.Errorf("writing %s at version %d: set = %v, err %v, want it set", write.key, write.version, set, err)
+		}
+	}
+	if got, _ := r.Get(entry); got != "newer item" {
+		t.Errorf("stored %q, want newer item", got)
+	}
+	if got, _ := r.Get(colliding); got != "other" {
+		t.Errorf("colliding URI's entry = %q, want other", got)
+	}
+}
+
+// Counts the round trips a client makes, single commands and pipelines alike
+type roundTripCounter struct {
+	commands, pipelines atomic.Int32
+}
+
+func (c *roundTripCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (c *roundTripCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.commands.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (c *roundTripCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.pipelines.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func TestBatchCacheOperations(t *testing.T) {
+	r, server := newTestRedis(t)
+	counter := &roundTripCounter{}
+	r.cacheDb.AddHook(counter)
+
+	err := r.MSet(map[string]interface{}{"a": "1", "b": "2", "c": "3"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.pipelines.Load() != 1 || counter.commands.Load() != 0 {
+		t.Errorf("MSet made %d pipelines and %d single commands, want 1 pipeline", counter.pipelines.Load(), counter.commands.Load())
+	}
+	if server.TTL("b") != time.Minute {
+		t.Errorf("TTL = %v, want every key set to expire", server.TTL("b"))
+	}
+
+	values, err := r.MGet([]string{"c", "missing", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "1", "c": "3"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("MGet = %v, want %v with the miss left out", values, want)
+	}
+	if counter.pipelines.Load() != 2 || counter.commands.Load() != 0 {
+		t.Errorf("MGet made %d pipelines and %d single commands, want 1 more pipeline", counter.pipelines.Load()-1, counter.commands.Load())
+	}
+
+	// Nothing to do, nothing sent
+	if values, err := r.MGet(nil); err != nil || len(values) != 0 {
+		t.Errorf("MGet(nil) = %v, %v, want an empty map", values, err)
+	}
+	if err := r.MSet(nil, time.Minute); err != nil || counter.pipelines.Load() != 2 {
+		t.Errorf("empty batches sent %d pipelines, want none", counter.pipelines.Load()-2)
+	}
+}
+
+func TestBatchCacheErrors(t *testing.T) {
+	r, server := newTestRedis(t)
+	server.Lpush("list", "not a string")
+	if _, err := r.MGet([]string{"list"}); err == nil {
+		t.Error("MGet of a list succeeded")
+	}
+	server.Close()
+	if err := r.MSet(map[string]interface{}{"a": "1"}, time.Minute); err == nil {
+		t.Error("MSet with redis down succeeded")
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	debugHeaders := []string{"X-Cache-Key", "X-Cache-TTL-Remaining", "X-Upstream-Duration"}
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprintf("debug %v", debug), func(t *testing.T) {
+			r, _ := newTestRedis(t)
+			cfg := testRoute("/items", newTestUpstream(t, "ok").URL)
+			cfg.Cache = Cache{Enabled: true, ExpiresIn: 60}
+			cfg.DebugHeaders = debug
+			handler := buildTestRoute(t, NewRouteManager(Config{}, r, testLogger(), nil), cfg)
+
+			miss := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+			hit := serve(handler, httptest.NewRequest(http.MethodGet, "/items/1", nil))
+			if hit.Header().Get("X-Cache") != "HIT" {
+				t.Fatalf("X-Cache = %q, want the second request served from the cache", hit.Header().Get("X-Cache"))
+			}
+			if !debug {
+				for _, response := range []*httptest.ResponseRecorder{miss, hit} {
+					for _, header := range debugHeaders {
+						if got := response.Header().Get(header); got != "" {
+							t.Errorf("%s = %q with debug headers off", header, got)
+						}
+					}
+				}
+				return
+			}
+
+			if miss.Header().Get("X-Cache-Key") == "" || miss.Header().Get("X-Cache-Key") != hit.Header().Get("X-Cache-Key") {
+				t.Errorf("X-Cache-Key %q on the miss and %q on the hit, want the same key on both", miss.Header().Get("X-Cache-Key"), hit.Header().Get("X-Cache-Key"))
+			}
+			if _, err := strconv.ParseFloat(miss.Header().Get("X-Upstream-Duration"), 64); err != nil {
+				t.Errorf("miss X-Upstream-Duration = %q, want milliseconds", miss.Header().Get("X-Upstream-Duration"))
+			}
+			if got := miss.Header().Get("X-Cache-TTL-Remaining"); got != "" {
+				t.Errorf("miss X-Cache-TTL-Remaining = %q, want none", got)
+			}
+			if ttl, err := strconv.Atoi(hit.Header().Get("X-Cache-TTL-Remaining")); err != nil || ttl <= 0 || ttl > 60 {
+				t.Errorf("hit X-Cache-TTL-Remaining = %q, want up to 60 seconds", hit.Header().Get("X-Cache-TTL-Remaining"))
+			}
+			// The stored entry doesn't bring the miss's upstream timing along
+			if got := hit.Header().Get("X-Upstream-Duration"); got != "" {
+				t.Errorf("hit X-Upstream-Duration = %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestCacheSkipsPrivateResponses(t *testing.T) {
+	r, _ := newTestRedis(t)
+	var calls atomic.Int32
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		writer.Header().Set("Cache-Control", request.URL.Query().Get("cc"))
+		writer.Header().Set("Content-Length", "2")
+		writer.Write([]byte("ok"))
+	})
+	handler := NewCacheMiddleware(r, testLogger(), "/items", Cache{Enabled: true, ExpiresIn: 60}, time.Second).CacheHandler(upstream)
+
+	for cacheControl, wantStored := range map[string]bool{
+		"no-store":             false,
+		"private, max-age=60":  false,
+		"max-age=60, No-Store": false,
+		"public, max-age=60":   true,
+	} {
+		calls.Store(0)
+		uri := "/items?cc=" + url.QueryEscape(cacheControl)
+		serve(handler, httptest.NewRequest(http.MethodGet, uri, nil))
+		second := serve(handler, httptest.NewRequest(http.MethodGet, uri, nil))
+		if stored := second.Header().Get("X-Cache") == "HIT"; stored != wantStored || int(calls.Load()) != map[bool]int{true: 1, false: 2}[wantStored] {
+			t.Errorf("Cache-Control %q: stored %v with %d upstream calls, want stored %v", cacheControl, stored, calls.Load(), wantStored)
+		}
+	}
+}
+
+// Responses to credentialed requests never reach other clients
+func TestCacheCredentialedRequests(t *testing.T) {
+	// Answers with whoever asked
+	upstream := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		who := request.Header.Get("Authorization") + request.Header.Get("Cookie")
+		writer.Header().Set("Content-Length", strconv.Itoa(len(who)))
+		writer.Write([]byte(who))
+	})
+	get := func(handler http.Handler, header, value string) (string, string) {
+		request := httptest.NewRequest(http.MethodGet, "/me", nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		response := serve(handler, request)
+		return response.Header().Get("X-Cache"), response.Body.String()
+	}
+
+	t.Run("bypassed", func(t *testing.T) {
+		r, _ := newTestRedis(t)
+		handler := NewCacheMiddleware(r, testLogger(), "/me", Cache{Enabled: true, ExpiresIn: 60}, time.Second).CacheHandler(upstream)
+		for _, tc := range [][3]string{
+			{"Authorization", "Bearer alice", "BYPASS"},
+			{"Authorization", "Bearer alice", "BYPASS"},
+			{"Cookie", "session=bob", "BYPASS"},
+			{"", "", "MISS"},
+			{"", "", "HIT"},
+		} {
+			if status, body := get(handler, tc[0], tc[1]); status != tc[2] || body != tc[1] {
+				t.Errorf("%s %q: got X-Cache %s and %q, want %s and the caller's own response", tc[0], tc[1], status, body, tc[2])
+			}
+		}
+		if keys := r.cacheDb.Keys(context.Background(), "cache:*").Val(); len(keys) != 1 {
+			t.Errorf("stored %v, want only the anonymous response", keys)
+		}
+	})
+
+	t.Run("per identity", func(t *testing.T) {
+		r, _ := newTestRedis(t)
+		handler := NewCacheMiddleware(r, testLogger(), "/me", Cache{Enabled: true, ExpiresIn: 60, PerIdentity: true}, time.Second).CacheHandler(upstream)
+		for _, tc := range [][3]string{
+			{"Authorization", "Bearer alice", "MISS"},
+			{"Authorization", "Bearer bob", "MISS"},
+			{"Authorization", "Bearer alice", "HIT"},
+			{"Cookie", "session=alice", "MISS"},
+			{"", "", "MISS"},
+			{"Authorization", "Bearer bob", "HIT"},
+		} {
+			if status, body := get(handler, tc[0], tc[1]); status != tc[2] || body != tc[1] {
+				t.Errorf("%s %q: got X-Cache %s and %q, want %s and the caller's own response", tc[0], tc[1], status, body, tc[2])
+			}
+		}
+	})
+}
+
+func TestInvalidCacheSettingsRejected(t *testing.T) {
+	r, _ := newTestRedis(t)
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	for name, cache := range map[string]Cache{
+		"no expiry":       {Enabled: true},
+		"negative expiry": {Enabled: true, ExpiresIn: -5},
+		"unknown policy":  {Enabled: true, ExpiresIn: 60, WritePolicy: "last"},
+	} {
+		cfg := testRoute("/api", "http://upstream.internal")
+		cfg.Cache = cache
+		if _, err := m.buildRoute(cfg); err == nil {
+			t.Errorf("%s: route built", name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Credentials aren't worth the risk of keeping, even briefly
+var uncapturedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", AdminTokenHeader}
+
+var ErrCaptureNotFound = errors.New("captured request not found")
+
+// A request as the gateway received it, for replaying later
+type CapturedRequest struct {
+	ID         string      `json:"id"`
+	Route      string      `json:"route"`
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Truncated  bool        `json:"truncated,omitempty"` // Body was cut at the size limit
+	CapturedAt time.Time   `json:"captured_at"`
+}
+
+// RequestCapture samples incoming requests into the Redis cache DB, where
+// they expire after the route's TTL
+type RequestCapture struct {
+	redis  *Redis
+	logger *zap.SugaredLogger
+}
+
+func NewRequestCapture(redis *Redis, logger *zap.SugaredLogger) *RequestCapture {
+	return &RequestCapture{redis: redis, logger: logger}
+}
+
+// Middleware stores the configured share of the route's requests, keyed by
+// their correlation ID. The upstream still receives the whole body. Without
+// captureBody only the method, URI and headers are kept
+func (c *RequestCapture) Middleware(route string, cfg Capture, captureBody bool) Middleware {
+	ttl := secondsToDuration(float64(cfg.TTL))
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = 64 << 10 // 64kb
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if rand.Float32() >= cfg.SampleRate {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			captured := CapturedRequest{
+				ID:         CorrelationID(request.Context()),
+				Route:      route,
+				Method:     request.Method,
+				URI:        request.URL.RequestURI(),
+				Header:     request.Header.Clone(),
+				CapturedAt: time.Now(),
+			}
+			if captured.ID == "" {
+				captured.ID = newRequestID()
+			}
+			for _, name := range uncapturedHeaders {
+				captured.Header.Del(name)
+			}
+
+			hasBody := request.Body != nil && request.Body != http.NoBody
+			captured.Truncated = hasBody && !captureBody
+			if captureBody && hasBody {
+				body, err := io.ReadAll(io.LimitReader(request.Body, maxBody+1))
+				if err != nil {
+					http.Error(writer, "Failed to read request body", http.StatusBadRequest)
+					return
+				}
+				captured.Truncated = int64(len(body)) > maxBody
+				captured.Body = body[:min(int64(len(body)), maxBody)]
+				request.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+			}
+
+			if err := c.store(captured, ttl); err != nil {
+				requestLogger(c.logger, request.Context()).Warnw("capturing request", "error", err)
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func (c *RequestCapture) store(captured CapturedRequest, ttl time.Duration) error {
+	data, err := json.Marshal(captured)
+	if err != nil {
+		return fmt.Errorf("encoding captured request: %w", err)
+	}
+	return c.redis.Set(captureKey(captured.ID), data, ttl)
+}
+
+// Get returns ErrCaptureNotFound once the capture has expired
+func (c *RequestCapture) Get(id string) (CapturedRequest, error) {
+	data, err := c.redis.Get(captureKey(id))
+	if err != nil {
+		return CapturedRequest{}, fmt.Errorf("reading captured request: %w", err)
+	}
+	if data == "" {
+		return CapturedRequest{}, ErrCaptureNotFound
+	}
+
+	var captured CapturedRequest
+	if err := json.Unmarshal([]byte(data), &captured); err != nil {
+		return CapturedRequest{}, fmt.Errorf("decoding captured request: %w", err)
+	}
+	return captured, nil
+}
+
+func captureKey(id string) string {
+	return "capture:" + id
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	r, _ := newTestRedis(t)
+	capture := NewRequestCapture(r, testLogger())
+	var upstreamBody string
+	captured := RequestID(capture.Middleware("/orders", Capture{Enabled: true, SampleRate: 1}, true)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		upstreamBody = string(body)
+	})))
+
+	request := httptest.NewRequest(http.MethodPost, "/orders?dry_run=1", strings.NewReader(`{"item": 7}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer secret")
+	response := serve(captured, request)
+	if upstreamBody != `{"item": 7}` {
+		t.Fatalf("upstream got %q, want the whole body", upstreamBody)
+	}
+	id := response.Header().Get(RequestIDHeader)
+
+	// Echoes what it received
+	target := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]string{
+			"method":        request.Method,
+			"uri":           request.URL.RequestURI(),
+			"body":          string(body),
+			"content_type":  request.Header.Get("Content-Type"),
+			"authorization": request.Header.Get("Authorization"),
+		})
+	}))
+	defer target.Close()
+
+	mux := http.NewServeMux()
+	NewAdminAPI(r, NewRouteManager(Config{}, r, testLogger(), nil), NewAuditLogger(testLogger(), nil, ""), capture, nil, testLogger(), "admin-secret").Register(mux)
+	replay := func(id string, target string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/admin/replay/"+id+"?target="+target, nil)
+		request.Header.Set(AdminTokenHeader, "admin-secret")
+		return serve(mux, request)
+	}
+
+	replayed := replay(id, target.URL)
+	if replayed.Code != http.StatusAccepted {
+		t.Fatalf("replay status %d: %s", replayed.Code, replayed.Body)
+	}
+	var echoed map[string]string
+	if err := json.Unmarshal(replayed.Body.Bytes(), &echoed); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"method":        http.MethodPost,
+		"uri":           "/orders?dry_run=1",
+		"body":          `{"item": 7}`,
+		"content_type":  "application/json",
+		"authorization": "",
+	}
+	for field, value := range want {
+		if echoed[field] != value {
+			t.Errorf("replayed %s = %q, want %q", field, echoed[field], value)
+		}
+	}
+
+	if got := replay("unknown", target.URL).Code; got != http.StatusNotFound {
+		t.Errorf("unknown capture: status %d, want 404", got)
+	}
+	if got := replay(id, "ftp://example.com").Code; got != http.StatusBadRequest {
+		t.Errorf("non-http target: status %d, want 400", got)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Used when a route enables checksums without naming any headers
+var defaultChecksumHeaders = map[string]string{
+	"Content-MD5":       "md5",
+	"X-Checksum-SHA256": "sha256",
+}
+
+type checksumHeader struct {
+	name string
+	new  func() hash.Hash
+}
+
+// ChecksumMiddleware verifies request bodies against the digests clients send
+// in checksum headers, mapped from header name to algorithm. Digests may be
+// hex or base64 (as Content-MD5 is). Bodies are buffered up to maxBody bytes
+// to be hashed and then forwarded unchanged
+func ChecksumMiddleware(cfg Checksum) (Middleware, error) {
+	names := cfg.Headers
+	if len(names) == 0 {
+		names = defaultChecksumHeaders
+	}
+
+	headers := make([]checksumHeader, 0, len(names))
+	for name, algorithm := range names {
+		newHash, ok := checksumAlgorithms[strings.ToLower(algorithm)]
+		if !ok {
+			return nil, fmt.Errorf("unknown checksum algorithm %q for %s", algorithm, name)
+		}
+		headers = append(headers, checksumHeader{name: http.CanonicalHeaderKey(name), new: newHash})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = 10 << 20 // 10mb
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var present []checksumHeader
+			for _, h := range headers {
+				if request.Header.Get(h.name) != "" {
+					present = append(present, h)
+				}
+			}
+			if len(present) == 0 {
+				if cfg.Required {
+					http.Error(writer, "Missing body checksum", http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			var body []byte
+			if request.Body != nil {
+				var err error
+				body, err = io.ReadAll(http.MaxBytesReader(writer, request.Body, maxBody))
+				var sizeErr *http.MaxBytesError
+				if errors.As(err, &sizeErr) {
+					http.Error(writer, "Request body too large to checksum", http.StatusRequestEntityTooLarge)
+					return
+				}
+				if err != nil {
+					http.Error(writer, "Failed to read request body", http.StatusBadRequest)
+					return
+				}
+			}
+
+			for _, h := range present {
+				expected, ok := decodeDigest(request.Header.Get(h.name))
+				digest := h.new()
+				digest.Write(body)
+				if !ok || !bytes.Equal(expected, digest.Sum(nil)) {
+					http.Error(writer, h.name+" does not match request body", http.StatusBadRequest)
+					return
+				}
+			}
+
+			request.Body = io.NopCloser(bytes.NewReader(body))
+			request.ContentLength = int64(len(body))
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
+
+func decodeDigest(value string) ([]byte, bool) {
+	value = strings.TrimSpace(value)
+	if decoded, err := hex.DecodeString(value); err == nil {
+		return decoded, true
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+		return decoded, true
+	}
+	return nil, false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChecksumMiddleware(t *testing.T) {
+	body := `{"amount": 100}`
+	md5Sum := md5.Sum([]byte(body))
+	sha256Sum := sha256.Sum256([]byte(body))
+	otherSum := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name       string
+		cfg        Checksum
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"base64 Content-MD5", Checksum{Enabled: true}, map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])}, http.StatusOK},
+		{"hex SHA-256", Checksum{Enabled: true}, map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha256Sum[:])}, http.StatusOK},
+		{"both match", Checksum{Enabled: true}, map[string]string{
+			"Content-MD5":       base64.StdEncoding.EncodeToString(md5Sum[:]),
+			"X-Checksum-SHA256": hex.EncodeToString(sha256Sum[:]),
+		}, http.StatusOK},
+		{"mismatch", Checksum{Enabled: true}, map[string]string{"X-Checksum-SHA256": hex.EncodeToString(otherSum[:])}, http.StatusBadRequest},
+		{"one of two mismatches", Checksum{Enabled: true}, map[string]string{
+			"Content-MD5":       base64.StdEncoding.EncodeToString(md5Sum[:]),
+			"X-Checksum-SHA256": hex.EncodeToString(otherSum[:]),
+		}, http.StatusBadRequest},
+		{"undecodable digest", Checksum{Enabled: true}, map[string]string{"Content-MD5": "not a digest!"}, http.StatusBadRequest},
+		{"custom header", Checksum{Enabled: true, Headers: map[string]string{"X-Body-Hash": "sha256"}}, map[string]string{"X-Body-Hash": hex.EncodeToString(sha256Sum[:])}, http.StatusOK},
+		{"no checksum", Checksum{Enabled: true}, nil, http.StatusOK},
+		{"no checksum when required", Checksum{Enabled: true, Required: true}, nil, http.StatusBadRequest},
+		{"body over the limit", Checksum{Enabled: true, MaxBodyBytes: 4}, map[string]string{"X-Checksum-SHA256": hex.EncodeToString(sha256Sum[:])}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checksums, err := ChecksumMiddleware(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var forwarded string
+			handler := checksums(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				read, _ := io.ReadAll(request.Body)
+				forwarded = string(read)
+			}))
+
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			for name, value := range tt.headers {
+				request.Header.Set(name, value)
+			}
+			response := serve(handler, request)
+			if response.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.Code, tt.wantStatus, response.Body)
+			}
+			if tt.wantStatus == http.StatusOK && forwarded != body {
+				t.Errorf("forwarded body = %q, want it unchanged", forwarded)
+			}
+		})
+	}
+}
+
+func TestChecksumMiddlewareUnknownAlgorithm(t *testing.T) {
+	if _, err := ChecksumMiddleware(Checksum{Enabled: true, Headers: map[string]string{"X-Hash": "crc32"}}); err == nil {
+		t.Error("accepted an unknown checksum algorithm")
+	}
+}
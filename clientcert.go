@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+)
+
+const (
+	defaultClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	defaultClientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// ClientCertMiddleware tells the upstream who the client is when mutual TLS
+// terminates at the gateway: the verified leaf certificate's subject DN and
+// its SHA-256 fingerprint (hex) are sent in the configured headers. Nothing is
+// sent for certificates the TLS config didn't verify. Values a
+// client sent in those headers itself are always removed, so upstreams can
+// trust them
+func ClientCertMiddleware(cfg ClientCert) Middleware {
+	subjectHeader := cfg.SubjectHeader
+	if subjectHeader == "" {
+		subjectHeader = defaultClientCertSubjectHeader
+	}
+	fingerprintHeader := cfg.FingerprintHeader
+	if fingerprintHeader == "" {
+		fingerprintHeader = defaultClientCertFingerprintHeader
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request.Header.Del(subjectHeader)
+			request.Header.Del(fingerprintHeader)
+
+			// PeerCertificates is set for unverified certificates too, only
+			// a verified chain says who the client is
+			if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 && len(request.TLS.VerifiedChains[0]) > 0 {
+				cert := request.TLS.VerifiedChains[0][0]
+				fingerprint := sha256.Sum256(cert.Raw)
+
+				// Subjects can contain characters that aren't valid in a
+				// header value
+				request.Header.Set(subjectHeader, url.PathEscape(cert.Subject.String()))
+				request.Header.Set(fingerprintHeader, hex.EncodeToString(fingerprint[:]))
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
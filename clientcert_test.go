@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A self-signed client certificate for subject
+func newClientCert(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// The headers an mTLS server with tlsConfig passes upstream for a client
+// presenting cert, which also sends spoofed values for them
+func clientCertHeaders(t *testing.T, tlsConfig *tls.Config, cert tls.Certificate) http.Header {
+	t.Helper()
+	headers := make(chan http.Header, 1)
+	forward := ClientCertMiddleware(ClientCert{Enabled: true})
+	server := httptest.NewUnstartedServer(forward(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		headers <- request.Header.Clone()
+	})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set(defaultClientCertSubjectHeader, "CN=admin")
+	request.Header.Set(defaultClientCertFingerprintHeader, "spoofed")
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return <-headers
+}
+
+func TestClientCertForwarded(t *testing.T) {
+	cert := newClientCert(t, pkix.Name{CommonName: "alice", Organization: []string{"Acme Corp"}})
+	// Self-signed, so trusting it makes it its own CA
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	got := clientCertHeaders(t, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}, cert)
+	if subject := got.Get(defaultClientCertSubjectHeader); subject != "CN=alice%2CO=Acme%20Corp" {
+		t.Errorf("subject header = %q, want the certificate's escaped subject", subject)
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	if want := hex.EncodeToString(fingerprint[:]); got.Get(defaultClientCertFingerprintHeader) != want {
+		t.Errorf("fingerprint header = %q, want %q", got.Get(defaultClientCertFingerprintHeader), want)
+	}
+}
+
+// A certificate nothing vouched for proves nothing, so its subject isn't
+// forwarded and the spoofed values are still dropped
+func TestUnverifiedClientCertNotForwarded(t *testing.T) {
+	cert := newClientCert(t, pkix.Name{CommonName: "admin"})
+	got := clientCertHeaders(t, &tls.Config{ClientAuth: tls.RequireAnyClientCert}, cert)
+	if got.Get(defaultClientCertSubjectHeader) != "" || got.Get(defaultClientCertFingerprintHeader) != "" {
+		t.Errorf("unverified certificate's headers reached the upstream: %v", got)
+	}
+}
+
+// Without a certificate the client's own values are dropped, not forwarded
+func TestClientCertHeadersStrippedWithoutCert(t *testing.T) {
+	cfg := ClientCert{Enabled: true, SubjectHeader: "X-Subject", FingerprintHeader: "X-Fingerprint"}
+	var got http.Header
+	handler := ClientCertMiddleware(cfg)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		got = request.Header.Clone()
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("X-Subject", "CN=admin")
+	request.Header.Set("X-Fingerprint", "spoofed")
+	serve(handler, request)
+	if got.Get("X-Subject") != "" || got.Get("X-Fingerprint") != "" {
+		t.Errorf("spoofed headers reached the upstream: %v", got)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings the gateway can produce, in order of preference. The order breaks
+// ties between encodings the client only accepts through "*"
+var supportedEncodings = []string{"br", "gzip"}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+var brotliWriterPool = sync.Pool{
+	New: func() interface{} { return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression) },
+}
+
+// Compress encodes response bodies with the best encoding the client accepts,
+// based on the quality values in Accept-Encoding. Responses the upstream has
+// already encoded are passed through untouched
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"))
+		if encoding == "" || request.Method == http.MethodHead {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: writer, encoding: encoding}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, request)
+	})
+}
+
+// negotiateEncoding picks the supported encoding with the highest quality
+// value, unlisted ones taking the quality of "*". Ties go to the one the
+// client listed first, and between encodings only "*" matched to the
+// gateway's preference. An empty string means the response should be sent
+// uncompressed
+func negotiateEncoding(header string) string {
+	if header == "" {
+		return ""
+	}
+
+	listed, wildcard, order := parseAcceptEncoding(header)
+
+	// The client's listed encodings in its order, then the wildcard's
+	candidates := make([]string, 0, len(supportedEncodings))
+	for _, encoding := range order {
+		if slices.Contains(supportedEncodings, encoding) {
+			candidates = append(candidates, encoding)
+		}
+	}
+	for _, encoding := range supportedEncodings {
+		if _, ok := listed[encoding]; !ok {
+			candidates = append(candidates, encoding)
+		}
+	}
+
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range candidates {
+		q, ok := listed[encoding]
+		if !ok {
+			q = wildcard
+		}
+		// candidates is in order of preference, so only a higher quality
+		// displaces an earlier encoding
+		if q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// acceptsEncoding reports whether a client sending header can decode encoding
+func acceptsEncoding(header string, encoding string) bool {
+	encoding = strings.ToLower(encoding)
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+	listed, wildcard, _ := parseAcceptEncoding(header)
+	if q, ok := listed[encoding]; ok {
+		return q > 0
+	}
+	return wildcard > 0
+}
+
+// Quality values of each listed encoding keyed by lowercase name, and of "*"
+// (0 when absent), and the listed names in the order the client gave them
+func parseAcceptEncoding(header string) (map[string]float64, float64, []string) {
+	listed := make(map[string]float64)
+	wildcard := 0.0
+	var order []string
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		if _, ok := listed[name]; !ok {
+			order = append(order, name)
+		}
+		listed[name] = q
+	}
+
+	return listed, wildcard, order
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < http.StatusOK && code != http.StatusSwitchingProtocols {
+		// Informational responses precede the real one
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if shouldCompress(code, header) {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		cw.encoder = cw.newEncoder()
+	}
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		// Sniff from the uncompressed bytes, net/http would otherwise sniff
+		// the encoded output
+		if cw.Header().Get("Content-Type") == "" && len(b) > 0 {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.encoder.Write(b)
+}
+
+// Flush pushes whatever the encoder has buffered to the client so streamed
+// upstream responses are delivered incrementally
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close flushes any buffered compressed data and returns the encoder to its pool
+func (cw *compressWriter) Close() error {
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+
+	switch enc := cw.encoder.(type) {
+	case *gzip.Writer:
+		gzipWriterPool.Put(enc)
+	case *brotli.Writer:
+		brotliWriterPool.Put(enc)
+	}
+	cw.encoder = nil
+
+	return err
+}
+
+func (cw *compressWriter) newEncoder() io.WriteCloser {
+	switch cw.encoding {
+	case "br":
+		bw := brotliWriterPool.Get().(*brotli.Writer)
+		bw.Reset(cw.ResponseWriter)
+		return bw
+	default:
+		gw := gzipWriterPool.Get().(*gzip.Writer)
+		gw.Reset(cw.ResponseWriter)
+		return gw
+	}
+}
+
+// Bodiless statuses and responses the upstream already encoded are left alone
+func shouldCompress(code int, header http.Header) bool {
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return true
+}
+
+// Decoded request bodies larger than this are rejected unless the route says
+// otherwise
+const defaultMaxDecompressedBytes = 10 << 20 // 10mb
+
+// DecompressRequests decodes gzip and deflate request bodies for upstreams
+// that don't, forwarding them with Content-Encoding removed and
+// Content-Length set to the decoded size. Bodies are decoded in full before
+// they're forwarded, up to cfg.MaxBodyBytes decoded. Bodies that don't decode
+// get 400, other encodings 415
+func DecompressRequests(cfg Decompression) Middleware {
+	maxBody := cfg.MaxBodyBytes
+	if maxBody <= 0 {
+		maxBody = defaultMaxDecompressedBytes
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			var encodings []string
+			for _, value := range request.Header.Values("Content-Encoding") {
+				for _, encoding := range strings.Split(value, ",") {
+					if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" && encoding != "identity" {
+						encodings = append(encodings, encoding)
+					}
+				}
+			}
+			if len(encodings) == 0 || request.Body == nil || request.Body == http.NoBody {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			body, err := decodeRequestBody(request.Body, encodings, maxBody)
+			request.Body.Close()
+			var unsupported unsupportedEncodingError
+			switch {
+			case errors.As(err, &unsupported):
+				writer.Header().Set("Accept-Encoding", "gzip, deflate")
+				http.Error(writer, "Unsupported request content encoding "+string(unsupported), http.StatusUnsupportedMediaType)
+				return
+			case errors.Is(err, errDecompressedTooLarge):
+				http.Error(writer, "Decompressed request body too large", http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				http.Error(writer, "Malformed compressed request body", http.StatusBadRequest)
+				return
+			}
+
+			request.Header.Del("Content-Encoding")
+			request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			request.ContentLength = int64(len(body))
+			request.Body = io.NopCloser(bytes.NewReader(body))
+			request.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+var errDecompressedTooLarge = errors.New("decompressed body too large")
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return "unsupported content encoding " + string(e)
+}
+
+// Undoes encodings, listed in the order they were applied, reading at most
+// maxBody decoded bytes
+func decodeRequestBody(body io.Reader, encodings []string, maxBody int64) ([]byte, error) {
+	reader := body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			gr, err := gzip.NewReader(reader)
+			if err != nil {
+				return nil, err
+			}
+			reader = gr
+		case "deflate":
+			zr, err := zlib.NewReader(reader)
+			if err != nil {
+				return nil, err
+			}
+			reader = zr
+		default:
+			return nil, unsupportedEncodingError(encodings[i])
+		}
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > maxBody {
+		return nil, errDecompressedTooLarge
+	}
+	return decoded, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"deflate", ""},
+		{"br;q=0.5, gzip;q=0.8", "gzip"},
+		{"gzip;q=0.8, br;q=0.5", "gzip"},
+		// Equal quality goes to the client's order
+		{"gzip, br", "gzip"},
+		{"gzip;q=0.5, br;q=0.5", "gzip"},
+		{"br, gzip", "br"},
+		{"deflate, gzip, br", "gzip"},
+		// and wildcard matches come after listed ones, in the gateway's order
+		{"*", "br"},
+		{"*;q=1, gzip", "gzip"},
+		{"gzip, *;q=1", "gzip"},
+		{"br, *", "br"},
+		{"deflate, compress, x-custom, *;q=1", "br"},
+		{"gzip;q=0.5, *", "br"},
+		{"br;q=0.5, *;q=0.8", "gzip"},
+		{"br;q=0, *", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0", ""},
+		{"identity;q=0", ""},
+		{"gzip, identity;q=0", "gzip"},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+		{"gzip;q=invalid, br;q=0.1", "br"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("lattice compresses responses. ", 100)
+	handler := Compress(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain")
+		io.WriteString(writer, body)
+	}))
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"prefers br", "gzip;q=0.5, br", "br", func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }},
+		{"prefers gzip", "br;q=0.1, gzip", "gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"accepts neither", "deflate", "", func(r io.Reader) (io.Reader, error) { return r, nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if got := recorder.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.want)
+			}
+			if got := recorder.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			reader, err := tt.decode(recorder.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != body {
+				t.Errorf("decoded body = %q, want %q", decoded, body)
+			}
+		})
+	}
+}
+
+func TestCompressLeavesEncodedResponses(t *testing.T) {
+	handler := Compress(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Encoding", "gzip")
+		io.WriteString(writer, "already encoded")
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Accept-Encoding", "br")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if got := recorder.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want the upstream's gzip", got)
+	}
+	if got := recorder.Body.String(); got != "already encoded" {
+		t.Errorf("body = %q, want it untouched", got)
+	}
+}
+
+// A chunked upstream's writes reach the client as they're flushed, compressed,
+// rather than once the upstream finishes
+func TestCompressStreamsChunkedUpstream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain")
+		io.WriteString(writer, "first chunk\n")
+		writer.(http.Flusher).Flush()
+		<-release
+		io.WriteString(writer, "second chunk\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	gateway := httptest.NewServer(buildTestRoute(t, m, testRoute("/stream", upstream.URL)))
+	defer gateway.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, gateway.URL+"/stream", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if response.ContentLength != -1 {
+		t.Errorf("ContentLength = %d, want a chunked response", response.ContentLength)
+	}
+
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upstream is still blocked on release, so this only returns if the
+	// first chunk was flushed through the compressor
+	first := make([]byte, len("first chunk\n"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(reader, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first chunk wasn't delivered before the upstream finished")
+	}
+	if string(first) != "first chunk\n" {
+		t.Errorf("first chunk = %q", first)
+	}
+
+	release <- struct{}{}
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "second chunk\n" {
+		t.Errorf("rest = %q, want the second chunk", rest)
+	}
+}
+
+func gzipped(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(body))
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressRequests(t *testing.T) {
+	// What the upstream got
+	type received struct {
+		encoding      string
+		contentLength int64
+		body          string
+	}
+	var got received
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		got = received{request.Header.Get("Content-Encoding"), request.ContentLength, string(body)}
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/upload", upstream.URL)
+	cfg.Decompression = Decompression{Enabled: true, MaxBodyBytes: 64}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+	send := func(encoding string, body []byte) int {
+		request := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+		request.Header.Set("Content-Encoding", encoding)
+		return serve(handler, request).Code
+	}
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(`{"format":"deflate"}`))
+	zw.Close()
+	for _, tc := range []struct {
+		name, encoding string
+		body           []byte
+		want           string
+	}{
+		{"gzip", "gzip", gzipped(t, `{"format":"gzip"}`), `{"format":"gzip"}`},
+		{"deflate", "deflate", deflated.Bytes(), `{"format":"deflate"}`},
+		// Listed in the order they were applied
+		{"stacked", "gzip, gzip", gzipped(t, string(gzipped(t, "twice"))), "twice"},
+	} {
+		got = received{}
+		if status := send(tc.encoding, tc.body); status != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", tc.name, status)
+		}
+		if got.body != tc.want || got.encoding != "" || got.contentLength != int64(len(tc.want)) {
+			t.Errorf("%s: upstream got %+v, want %q decoded with its Content-Length", tc.name, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, encoding string
+		body           []byte
+		want           int
+	}{
+		{"corrupt", "gzip", []byte("not gzip at all"), http.StatusBadRequest},
+		{"truncated", "gzip", gzipped(t, "cut short")[:12], http.StatusBadRequest},
+		{"unsupported", "br", []byte("brotli"), http.StatusUnsupportedMediaType},
+		{"too large", "gzip", gzipped(t, strings.Repeat("a", 65)), http.StatusRequestEntityTooLarge},
+	} {
+		got = received{}
+		if status := send(tc.encoding, tc.body); status != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.want)
+		}
+		if got != (received{}) {
+			t.Errorf("%s: upstream got %+v, want nothing forwarded", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/golang-jwt/jwt"
+)
+
+type contextKey int
+
+const requestContextKey contextKey = iota
+
+// Request-scoped state, stored once in the request's context by RequestID
+// and filled in by the middleware that works it out: the correlation ID, the
+// matched route, the chosen target, who the client is and what the cache did.
+// Read it through the accessors, all of which are safe on a nil
+// RequestContext and return zero values there
+type RequestContext struct {
+	mu       sync.Mutex
+	id       string
+	route    string // Key of the matched route
+	target   string // Upstream URL the request was proxied to
+	identity string // Authenticated client, e.g. a username
+	claims   jwt.MapClaims
+	cache    string // X-Cache value, HIT, MISS or COALESCED
+	timeout  *requestTimer
+	budget   *AttemptBudget
+}
+
+// WithRequestContext stores rc in ctx, replacing any RequestContext already
+// there
+func WithRequestContext(ctx context.Context, rc *RequestContext) context.Context {
+	return context.WithValue(ctx, requestContextKey, rc)
+}
+
+// RequestContextFrom returns the RequestContext in ctx, nil if there is none
+func RequestContextFrom(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey).(*RequestContext)
+	return rc
+}
+
+// The request's RequestContext, with one added to its context if it hasn't
+// got one yet
+func ensureRequestContext(request *http.Request) (*http.Request, *RequestContext) {
+	if rc := RequestContextFrom(request.Context()); rc != nil {
+		return request, rc
+	}
+	rc := &RequestContext{}
+	return request.WithContext(WithRequestContext(request.Context(), rc)), rc
+}
+
+func (rc *RequestContext) ID() string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.id
+}
+
+func (rc *RequestContext) Route() string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.route
+}
+
+func (rc *RequestContext) Target() string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.target
+}
+
+func (rc *RequestContext) Identity() string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.identity
+}
+
+// Claims of the request's verified bearer token, nil until one has been
+// verified
+func (rc *RequestContext) Claims() jwt.MapClaims {
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.claims
+}
+
+func (rc *RequestContext) CacheStatus() string {
+	if rc == nil {
+		return ""
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.cache
+}
+
+// Upstream attempts the request has left, nil if it isn't capped
+func (rc *RequestContext) AttemptBudget() *AttemptBudget {
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.budget
+}
+
+// Setters do nothing on a nil RequestContext, so middleware used outside the
+// server's chain needn't check
+
+func (rc *RequestContext) SetRoute(route string) {
+	rc.set(func() { rc.route = route })
+}
+
+func (rc *RequestContext) SetTarget(target string) {
+	rc.set(func() { rc.target = target })
+}
+
+func (rc *RequestContext) SetIdentity(identity string) {
+	rc.set(func() { rc.identity = identity })
+}
+
+func (rc *RequestContext) SetClaims(claims jwt.MapClaims) {
+	rc.set(func() { rc.claims = claims })
+}
+
+func (rc *RequestContext) SetCacheStatus(status string) {
+	rc.set(func() { rc.cache = status })
+}
+
+func (rc *RequestContext) SetAttemptBudget(budget *AttemptBudget) {
+	rc.set(func() { rc.budget = budget })
+}
+
+func (rc *RequestContext) set(update func()) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	update()
+}
+
+// RouteContext records the matched route in the request's RequestContext
+func RouteContext(route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			RequestContextFrom(request.Context()).SetRoute(route)
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// Claims of the request's bearer token if it verifies. They're kept in the
+// RequestContext, so whichever of rate limiting, auth or the admin API looks
+// first does the verifying
+func verifiedClaims(request *http.Request) (jwt.MapClaims, bool) {
+	rc := RequestContextFrom(request.Context())
+	if claims := rc.Claims(); claims != nil {
+		return claims, true
+	}
+
+	scheme, credentials, ok := parseAuthorization(request.Header.Get("Authorization"))
+	if !ok || scheme != "bearer" {
+		return nil, false
+	}
+	claims, err := parseToken(credentials)
+	if err != nil {
+		return nil, false
+	}
+	rc.SetClaims(claims)
+	return claims, true
+}
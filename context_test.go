@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestNilRequestContext(t *testing.T) {
+	var rc *RequestContext
+	rc.SetRoute("/api")
+	rc.SetTarget("http://upstream")
+	rc.SetIdentity("alice")
+	rc.SetClaims(jwt.MapClaims{"sub": "alice"})
+	rc.SetCacheStatus("HIT")
+	rc.SetAttemptBudget(NewAttemptBudget(1))
+	if rc.ID() != "" || rc.Route() != "" || rc.Target() != "" || rc.Identity() != "" || rc.Claims() != nil || rc.CacheStatus() != "" || rc.AttemptBudget() != nil {
+		t.Error("nil RequestContext returned non-zero values")
+	}
+	if got := RequestContextFrom(context.Background()); got != nil {
+		t.Errorf("RequestContextFrom an empty context = %v, want nil", got)
+	}
+}
+
+// What the route's middleware and proxy recorded is readable once the
+// request is done
+func TestRouteFillsRequestContext(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "ok")
+	cfg := testRoute("/api", upstream.URL)
+	cfg.Cache = Cache{Enabled: true, ExpiresIn: 60}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, r, testLogger(), nil), cfg)
+
+	for _, wantCache := range []string{"MISS", "HIT"} {
+		rc := &RequestContext{}
+		request := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+		request.Header.Set(RequestIDHeader, "req-1234")
+		request = request.WithContext(WithRequestContext(request.Context(), rc))
+		serve(handler, request)
+
+		if rc.ID() != "req-1234" {
+			t.Errorf("ID = %q, want the client's", rc.ID())
+		}
+		if rc.Route() != cfg.Key() {
+			t.Errorf("Route = %q, want %q", rc.Route(), cfg.Key())
+		}
+		if rc.CacheStatus() != wantCache {
+			t.Errorf("CacheStatus = %q, want %s", rc.CacheStatus(), wantCache)
+		}
+		// Hits never reach the proxy
+		if wantTarget := map[string]string{"MISS": upstream.URL, "HIT": ""}[wantCache]; rc.Target() != wantTarget {
+			t.Errorf("%s: Target = %q, want %q", wantCache, rc.Target(), wantTarget)
+		}
+	}
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	ctx := WithCorrelationID(context.Background(), "abc")
+	rc := RequestContextFrom(ctx)
+	if rc == nil || CorrelationID(ctx) != "abc" {
+		t.Fatalf("CorrelationID = %q, want abc in a new RequestContext", CorrelationID(ctx))
+	}
+	// An existing RequestContext is updated rather than replaced
+	if again := WithCorrelationID(ctx, "def"); RequestContextFrom(again) != rc || rc.ID() != "def" {
+		t.Errorf("ID = %q, want def set on the existing RequestContext", rc.ID())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeadlineMiddleware sets the connection's read and write deadlines for each
+// request through http.ResponseController, in place of the server-wide
+// ReadTimeout and WriteTimeout, so routes can be tighter or looser than the
+// rest. With StreamIdle set, long-lived traffic gets its deadline pushed
+// StreamIdle ahead whenever data moves instead: the write deadline once the
+// response is flushed or is an event stream, the read deadline on request
+// bodies of unknown length. Such streams stay open as long as they don't
+// stall for StreamIdle. Writers that can't set deadlines are left alone
+func DeadlineMiddleware(cfg Deadlines) Middleware {
+	read := secondsToDuration(float64(cfg.Read))
+	write := secondsToDuration(float64(cfg.Write))
+	idle := secondsToDuration(float64(cfg.StreamIdle))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			controller := http.NewResponseController(writer)
+			now := time.Now()
+			if read > 0 {
+				controller.SetReadDeadline(now.Add(read))
+			}
+			var writeDeadline time.Time
+			if write > 0 {
+				writeDeadline = now.Add(write)
+				controller.SetWriteDeadline(writeDeadline)
+			}
+			if idle <= 0 {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			if request.ContentLength < 0 && request.Body != nil && request.Body != http.NoBody {
+				request.Body = &deadlineBody{ReadCloser: request.Body, controller: controller, idle: idle}
+			}
+			next.ServeHTTP(&deadlineWriter{ResponseWriter: writer, controller: controller, idle: idle, deadline: writeDeadline}, request)
+		})
+	}
+}
+
+// Extends the write deadline on every write once the response streams
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	idle       time.Duration
+	streaming  bool
+	deadline   time.Time // The write deadline last set, zero for none
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if !w.streaming && strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.streaming = true
+	}
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.streaming = true
+	w.extend()
+	w.controller.Flush()
+}
+
+// Hijacked connections manage their own deadlines
+func (w *deadlineWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.controller.Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Writes mostly land in the connection's buffer, so the deadline is only
+// checked once it's flushed. A deadline that passed while the stream stalled
+// is left as it is so that flush fails, rather than pushed on
+func (w *deadlineWriter) extend() {
+	if !w.streaming {
+		return
+	}
+	now := time.Now()
+	if !w.deadline.IsZero() && now.After(w.deadline) {
+		return
+	}
+	w.deadline = now.Add(w.idle)
+	w.controller.SetWriteDeadline(w.deadline)
+}
+
+// Extends the read deadline ahead of every read of a streamed request body
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	idle       time.Duration
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	b.controller.SetReadDeadline(time.Now().Add(b.idle))
+	return b.ReadCloser.Read(p)
+}
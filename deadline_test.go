@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes chunks, flushing each, with pause between them
+func chunkedHandler(chunks int, pause time.Duration) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		for i := range chunks {
+			if i > 0 {
+				time.Sleep(pause)
+			}
+			writer.Write([]byte("chunk\n"))
+			http.NewResponseController(writer).Flush()
+		}
+	})
+}
+
+func getBody(t *testing.T, url string) (string, error) {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	return string(body), err
+}
+
+// The stream outlives the write deadline because every flush pushes it on
+func TestStreamExtendsDeadline(t *testing.T) {
+	cfg := Deadlines{Write: 0.1, StreamIdle: 0.2}
+	server := httptest.NewServer(DeadlineMiddleware(cfg)(chunkedHandler(8, 50*time.Millisecond)))
+	defer server.Close()
+
+	body, err := getBody(t, server.URL)
+	if err != nil {
+		t.Fatalf("stream cut off after %q: %v", body, err)
+	}
+	if got := strings.Count(body, "chunk"); got != 8 {
+		t.Errorf("got %d chunks, want 8", got)
+	}
+}
+
+func TestStalledStreamIsCutOff(t *testing.T) {
+	cfg := Deadlines{StreamIdle: 0.1}
+	server := httptest.NewServer(DeadlineMiddleware(cfg)(chunkedHandler(2, 300*time.Millisecond)))
+	defer server.Close()
+
+	body, err := getBody(t, server.URL)
+	if err == nil && strings.Count(body, "chunk") == 2 {
+		t.Error("stream survived stalling past StreamIdle")
+	}
+}
+
+// Without StreamIdle the write deadline holds however the response is sent
+func TestWriteDeadlineWithoutStreamIdle(t *testing.T) {
+	server := httptest.NewServer(DeadlineMiddleware(Deadlines{Write: 0.1})(chunkedHandler(4, 50*time.Millisecond)))
+	defer server.Close()
+
+	body, err := getBody(t, server.URL)
+	if err == nil && strings.Count(body, "chunk") == 4 {
+		t.Error("response outlived the write deadline")
+	}
+}
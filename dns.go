@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Looks up a host's addresses. net.DefaultResolver is one
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Resolves upstream hostnames itself, keeping each answer for ttl. Go looks
+// hosts up on every dial, but pooled keep-alive connections stay on whatever
+// address they were dialed to, so a backend whose DNS name moves (say, in a
+// rolling deploy) keeps getting traffic at its old address. Once a refresh
+// finds live connections to addresses the host no longer resolves to,
+// onChange is called to drop idle connections, and again on every refresh
+// while any remain
+type dnsCache struct {
+	resolver HostResolver
+	ttl      time.Duration
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	onChange func()
+
+	mu    sync.Mutex
+	hosts map[string]*dnsEntry
+	live  map[string]map[*dnsConn]struct{} // Open connections by host
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	next    int // Address the next dial starts at, spreading dials over them
+}
+
+func newDNSCache(resolver HostResolver, ttl time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *dnsCache {
+	return &dnsCache{
+		resolver: resolver,
+		ttl:      ttl,
+		dial:     dial,
+		hosts:    make(map[string]*dnsEntry),
+		live:     make(map[string]map[*dnsConn]struct{}),
+	}
+}
+
+// Addresses for host, looked up again once the cached answer is ttl old. If
+// that lookup fails the previous answer is kept for another ttl
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, int, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.hosts[host]
+	if ok && now.Before(entry.expires) {
+		addrs, start := entry.addrs, entry.next
+		entry.next++
+		c.mu.Unlock()
+		return addrs, start, nil
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+
+	c.mu.Lock()
+	if err != nil {
+		if !ok {
+			c.mu.Unlock()
+			return nil, 0, err
+		}
+		entry.expires = now.Add(c.ttl)
+		addrs = entry.addrs
+	} else {
+		if !ok {
+			entry = &dnsEntry{}
+			c.hosts[host] = entry
+		}
+		entry.addrs = addrs
+		entry.expires = now.Add(c.ttl)
+	}
+	start := entry.next
+	entry.next++
+	stale := c.hasStale(host, addrs)
+	c.mu.Unlock()
+
+	if stale && c.onChange != nil {
+		c.onChange()
+	}
+	return addrs, start, nil
+}
+
+// Whether any open connection to host is to an address not in addrs.
+// Callers hold c.mu
+func (c *dnsCache) hasStale(host string, addrs []string) bool {
+	for conn := range c.live[host] {
+		current := false
+		for _, addr := range addrs {
+			if conn.ip == addr {
+				current = true
+				break
+			}
+		}
+		if !current {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks host up again if its answer is due, so busy routes whose requests
+// all reuse pooled connections still notice an address change
+func (c *dnsCache) refresh(ctx context.Context, host string) {
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	c.lookup(ctx, host)
+}
+
+// DialContext dials the host's cached addresses in turn until one connects
+func (c *dnsCache) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return c.dial(ctx, network, address)
+	}
+
+	addrs, start, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i := range addrs {
+		ip := addrs[(start+i)%len(addrs)]
+		conn, err := c.dial(ctx, network, net.JoinHostPort(ip, port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		tracked := &dnsConn{Conn: conn, cache: c, host: host, ip: ip}
+		c.mu.Lock()
+		if c.live[host] == nil {
+			c.live[host] = make(map[*dnsConn]struct{})
+		}
+		c.live[host][tracked] = struct{}{}
+		c.mu.Unlock()
+		return tracked, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *dnsCache) forget(conn *dnsConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.live[conn.host], conn)
+	if len(c.live[conn.host]) == 0 {
+		delete(c.live, conn.host)
+	}
+}
+
+// A connection dialed by dnsCache, tracked until it's closed
+type dnsConn struct {
+	net.Conn
+	cache *dnsCache
+	host  string
+	ip    string
+	once  sync.Once
+}
+
+func (c *dnsConn) Close() error {
+	c.once.Do(func() { c.cache.forget(c) })
+	return c.Conn.Close()
+}
+
+// An http.Transport that refreshes each request's host before sending it
+type dnsRefreshTransport struct {
+	*http.Transport
+	cache *dnsCache
+}
+
+func (t *dnsRefreshTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.cache.refresh(request.Context(), request.URL.Hostname())
+	return t.Transport.RoundTrip(request)
+}
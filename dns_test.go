@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A resolver whose answer the test moves, counting lookups
+type fakeResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	lookups int
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return r.addrs, nil
+}
+
+func (r *fakeResolver) set(addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs = addrs
+}
+
+// Two backends on the same port at different loopback addresses, each
+// answering with its address
+func newMovingBackend(t *testing.T) (port string) {
+	t.Helper()
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ = net.SplitHostPort(first.Addr().String())
+	second, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		first.Close()
+		t.Skipf("can't listen on 127.0.0.2: %v", err)
+	}
+	for _, listener := range []net.Listener{first, second} {
+		ip, _, _ := net.SplitHostPort(listener.Addr().String())
+		server := &httptest.Server{
+			Listener: listener,
+			Config: &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				writer.Write([]byte(ip))
+			})},
+		}
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+	return port
+}
+
+// Once the TTL is up the proxy looks the name up again and moves its
+// traffic, pooled connection and all, to the new address
+func TestDNSRefreshFollowsNewAddress(t *testing.T) {
+	port := newMovingBackend(t)
+	resolver := &fakeResolver{}
+	resolver.set("127.0.0.1")
+
+	const ttl = 50 * time.Millisecond
+	transport := newTransport(Transport{DNSRefresh: float32(ttl.Seconds())}).(*dnsRefreshTransport)
+	transport.cache.resolver = resolver
+	target, _ := url.Parse("http://backend.internal:" + port)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	get := func() string {
+		t.Helper()
+		response := serve(proxy, httptest.NewRequest(http.MethodGet, "/", nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", response.Code)
+		}
+		return response.Body.String()
+	}
+
+	for i := range 3 {
+		if got := get(); got != "127.0.0.1" {
+			t.Fatalf("request %d went to %s, want 127.0.0.1", i+1, got)
+		}
+	}
+	resolver.set("127.0.0.2")
+	// Still cached, and still on the pooled connection
+	if got := get(); got != "127.0.0.1" {
+		t.Errorf("request within the TTL went to %s, want the cached 127.0.0.1", got)
+	}
+
+	time.Sleep(ttl + 10*time.Millisecond)
+	if got := get(); got != "127.0.0.2" {
+		t.Errorf("request after the TTL went to %s, want 127.0.0.2", got)
+	}
+	resolver.mu.Lock()
+	lookups := resolver.lookups
+	resolver.mu.Unlock()
+	if lookups != 2 {
+		t.Errorf("%d lookups, want one per TTL", lookups)
+	}
+}
+
+// A failed lookup keeps the previous answer rather than failing requests
+func TestDNSCacheKeepsAnswerOnFailure(t *testing.T) {
+	resolver := &fakeResolver{}
+	resolver.set("192.0.2.10")
+	cache := newDNSCache(resolver, time.Millisecond, nil)
+
+	if addrs, _, err := cache.lookup(context.Background(), "backend.internal"); err != nil || len(addrs) != 1 {
+		t.Fatalf("lookup = %v, %v", addrs, err)
+	}
+	resolver.set()
+	time.Sleep(2 * time.Millisecond)
+	addrs, _, err := cache.lookup(context.Background(), "backend.internal")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+		t.Errorf("lookup after a failure = %v, %v; want the previous answer", addrs, err)
+	}
+}
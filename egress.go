@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Transport.Proxy value that sends requests straight to upstreams, whatever
+// the environment says
+const ProxyDirect = "direct"
+
+// The Proxy func for an upstream transport. An empty proxy follows
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, ProxyDirect never proxies, and
+// anything else is the URL of the proxy every request goes through except
+// those to hosts in noProxy (NO_PROXY if empty). Like Go's own environment
+// handling, requests to loopback addresses are never proxied
+func egressProxy(proxy string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case ProxyDirect:
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("egress proxy %s must be http, https or socks5", proxy)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("egress proxy %s has no host", proxy)
+	}
+
+	if noProxy == "" {
+		noProxy = os.Getenv("NO_PROXY")
+	}
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	bypass := parseNoProxy(noProxy)
+
+	return func(request *http.Request) (*url.URL, error) {
+		if bypass.matches(request.URL) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// Hosts reached without the egress proxy, from a NO_PROXY style list:
+// "*" for every host, IPs, CIDRs, and domains, which match the domain and its
+// subdomains ("example.com") or only subdomains (".example.com"). Any entry
+// but a CIDR may carry a port to match only that port
+type noProxyList struct {
+	all      bool
+	networks []*net.IPNet
+	hosts    []noProxyHost
+}
+
+type noProxyHost struct {
+	host       string // Lowercase, IPs included
+	port       string // Empty matches any port
+	subdomains bool   // Only hosts under host, not host itself
+}
+
+func parseNoProxy(list string) noProxyList {
+	var parsed noProxyList
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			parsed.all = true
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			parsed.networks = append(parsed.networks, network)
+			continue
+		}
+
+		host, port := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host, port = h, p
+		}
+		host = strings.Trim(host, "[]")
+		subdomains := false
+		if trimmed, ok := strings.CutPrefix(host, "*."); ok {
+			host, subdomains = trimmed, true
+		} else if trimmed, ok := strings.CutPrefix(host, "."); ok {
+			host, subdomains = trimmed, true
+		}
+		parsed.hosts = append(parsed.hosts, noProxyHost{host: host, port: port, subdomains: subdomains})
+	}
+	return parsed
+}
+
+func (l noProxyList) matches(target *url.URL) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	if host == "localhost" || l.all {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, network := range l.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, entry := range l.hosts {
+		if entry.port != "" && entry.port != port {
+			continue
+		}
+		if ip != nil {
+			if entryIP := net.ParseIP(entry.host); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if host == entry.host && !entry.subdomains {
+			return true
+		}
+		if strings.HasSuffix(host, "."+entry.host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// A forward proxy answering every request itself, recording the host each
+// was for
+func newEgressProxy(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, request.URL.Host)
+		mu.Unlock()
+		writer.Write([]byte("proxied"))
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), hosts...)
+	}
+}
+
+func TestRouteUsesEgressProxy(t *testing.T) {
+	proxy, hosts := newEgressProxy(t)
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+
+	// Never resolved, only the proxy is dialed. A preserved Host would
+	// stand in for the upstream's in the proxy's request line
+	cfg := testRoute("/api", "http://upstream.invalid:8080")
+	cfg.PreserveHost = false
+	cfg.Transport.Proxy = proxy.URL
+	response := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, "/api/items", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "proxied" {
+		t.Errorf("got %d %q, want the proxy's answer", response.Code, response.Body.String())
+	}
+	if got := hosts(); len(got) != 1 || got[0] != "upstream.invalid:8080" {
+		t.Errorf("proxy saw %v, want one request for upstream.invalid:8080", got)
+	}
+
+	cfg = testRoute("/direct", "http://upstream.invalid:8080")
+	cfg.Transport.Proxy = proxy.URL
+	cfg.Transport.NoProxy = ".example.com, upstream.invalid"
+	if got := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, "/direct", nil)).Code; got != http.StatusBadGateway {
+		t.Errorf("NO_PROXY host: status = %d, want the 502 of dialing it directly", got)
+	}
+	if got := hosts(); len(got) != 1 {
+		t.Errorf("proxy saw %v, want the NO_PROXY host left out", got)
+	}
+}
+
+func TestHttpClientSetProxy(t *testing.T) {
+	proxy, hosts := newEgressProxy(t)
+	client := NewHttpClient(nil, testLogger())
+	if err := client.SetProxy(proxy.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	body, err := client.GetReq(context.Background(), "http://api.upstream.invalid/v1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "proxied" || len(hosts()) != 1 {
+		t.Errorf("got %q with the proxy seeing %v, want the request proxied", body, hosts())
+	}
+
+	if err := NewHttpClient(&http.Client{Transport: roundTripFunc(nil)}, testLogger()).SetProxy(proxy.URL, ""); err == nil {
+		t.Error("SetProxy on a custom RoundTripper succeeded")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) { return f(request) }
+
+func TestNoProxyMatches(t *testing.T) {
+	list := parseNoProxy("example.com, .internal, 10.0.0.0/8, 192.0.2.7, cache.local:6380")
+	for target, want := range map[string]bool{
+		"http://example.com/":        true,
+		"http://api.example.com/":    true,
+		"http://notexample.com/":     false,
+		"http://internal/":           false,
+		"http://svc.internal/":       true,
+		"http://10.1.2.3/":           true,
+		"http://11.1.2.3/":           false,
+		"http://192.0.2.7:9000/":     true,
+		"http://cache.local:6380/":   true,
+		"http://cache.local/":        false,
+		"http://localhost:8080/":     true,
+		"http://127.0.0.1:8080/":     true,
+		"https://EXAMPLE.com/search": true,
+	} {
+		target, _ := url.Parse(target)
+		if got := list.matches(target); got != want {
+			t.Errorf("%s bypasses the proxy: %v, want %v", target, got, want)
+		}
+	}
+	if target, _ := url.Parse("http://anything/"); !parseNoProxy("*").matches(target) {
+		t.Error("* didn't match every host")
+	}
+}
+
+func TestEgressProxySettings(t *testing.T) {
+	if proxy, err := egressProxy(ProxyDirect, ""); err != nil || proxy != nil {
+		t.Errorf("direct: proxy func %v, err %v, want none", proxy != nil, err)
+	}
+	for _, invalid := range []string{"ftp://proxy:21", "http://", "://bad"} {
+		if _, err := egressProxy(invalid, ""); err == nil {
+			t.Errorf("egress proxy %q accepted", invalid)
+		}
+	}
+}
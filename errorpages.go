@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrorRenderer writes the gateway's own error responses. Clients that
+// prefer HTML get the configured page for the status, if there is one;
+// clients asking for JSON get an errorResponse, everyone else plain text.
+// A nil ErrorRenderer renders JSON and plain text only
+type ErrorRenderer struct {
+	pages map[int][]byte
+}
+
+// Page paths are relative to dir unless absolute. Pages are read once, here
+func LoadErrorPages(dir string, pages map[int]string) (*ErrorRenderer, error) {
+	r := &ErrorRenderer{pages: make(map[int][]byte, len(pages))}
+	for status, name := range pages {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, name)
+		}
+		page, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading error page for %d: %w", status, err)
+		}
+		r.pages[status] = page
+	}
+	return r, nil
+}
+
+func (r *ErrorRenderer) Render(writer http.ResponseWriter, request *http.Request, status int, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	switch preferredErrorFormat(request.Header.Get("Accept")) {
+	case "html":
+		if page, ok := r.page(status); ok {
+			writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			writer.Header().Set("X-Content-Type-Options", "nosniff")
+			writer.WriteHeader(status)
+			writer.Write(page)
+			return
+		}
+	case "json":
+		writeJSONError(writer, request, status, message)
+		return
+	}
+
+	if id := CorrelationID(request.Context()); id != "" {
+		message += " (request " + id + ")"
+	}
+	http.Error(writer, message, status)
+}
+
+func (r *ErrorRenderer) page(status int) ([]byte, bool) {
+	if r == nil {
+		return nil, false
+	}
+	page, ok := r.pages[status]
+	return page, ok
+}
+
+// Middleware-style handler answering every request with status
+func (r *ErrorRenderer) Handler(status int, message string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		r.Render(writer, request, status, message)
+	})
+}
+
+// "html", "json" or "" for plain text, whichever of text/html and
+// application/json the Accept header ranks higher. Browsers send */* as well,
+// which on its own doesn't pick either
+func preferredErrorFormat(accept string) string {
+	htmlQ, jsonQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "text/html", "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+
+	switch {
+	case htmlQ > 0 && htmlQ >= jsonQ:
+		return "html"
+	case jsonQ > 0:
+		return "json"
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPagesFollowAccept(t *testing.T) {
+	dir := t.TempDir()
+	page := "<html><body>Upstream is down</body></html>"
+	if err := os.WriteFile(filepath.Join(dir, "502.html"), []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	renderer, err := LoadErrorPages(dir, map[int]string{http.StatusBadGateway: "502.html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens here any more, so proxying fails with 502
+	down := httptest.NewServer(okHandler())
+	down.Close()
+	cfg := testRoute("/svc", down.URL)
+	cfg.Retry.Attempts = 1
+	route := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), renderer), cfg)
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"application/json", "application/json"},
+		{"", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/svc", nil)
+			request.Header.Set("Accept", tt.accept)
+			response := serve(route, request)
+			if response.Code != http.StatusBadGateway {
+				t.Fatalf("status = %d, want 502", response.Code)
+			}
+			if got := response.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			switch tt.contentType {
+			case "text/html; charset=utf-8":
+				if got := response.Body.String(); got != page {
+					t.Errorf("body = %q, want the configured page", got)
+				}
+			case "application/json":
+				var body errorResponse
+				if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Error == "" {
+					t.Errorf("body %q isn't a JSON error (%v)", response.Body, err)
+				}
+			default:
+				if strings.Contains(response.Body.String(), "<html>") {
+					t.Errorf("plain text body got the HTML page: %q", response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadErrorPagesMissingFile(t *testing.T) {
+	if _, err := LoadErrorPages(t.TempDir(), map[int]string{http.StatusNotFound: "404.html"}); err == nil {
+		t.Error("loaded an error page that doesn't exist")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Answers requests that hit an open circuit breaker, see BreakerFallback.
+// Last-good responses are kept in memory per gateway instance
+type Fallback struct {
+	route string // Path of the route, see FallbackRedirect
+
+	mu       sync.Mutex
+	config   BreakerFallback
+	lastGood map[string]CacheEntry
+	order    []string // Oldest first, for eviction
+}
+
+const (
+	// Responses larger than this aren't remembered as last-good
+	maxFallbackBodyBytes = 1 << 20
+	// Last-good responses remembered per route unless MaxEntries says otherwise
+	defaultFallbackEntries = 100
+)
+
+func NewFallback(route string, cfg BreakerFallback) *Fallback {
+	f := &Fallback{route: route, lastGood: make(map[string]CacheEntry)}
+	f.configure(cfg)
+	return f
+}
+
+func (f *Fallback) configure(cfg BreakerFallback) {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultFallbackEntries
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.config = cfg
+	for len(f.order) > cfg.MaxEntries {
+		delete(f.lastGood, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+// Serve writes the fallback response, if there is one for the request.
+// Reports whether it did; a nil Fallback never does
+func (f *Fallback) Serve(writer http.ResponseWriter, request *http.Request) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	cfg := f.config
+	entry, found := f.lastGood[fallbackKey(request)]
+	f.mu.Unlock()
+
+	switch cfg.Mode {
+	case FallbackStatic:
+		if cfg.ContentType != "" {
+			writer.Header().Set("Content-Type", cfg.ContentType)
+		}
+		writer.Header().Set("X-Fallback", FallbackStatic)
+		status := cfg.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		writer.WriteHeader(status)
+		io.WriteString(writer, cfg.Body)
+		return true
+	case FallbackLastGood:
+		if !found {
+			return false
+		}
+		writer.Header().Set("X-Fallback", FallbackLastGood)
+		entry.writeTo(writer, request)
+		return true
+	case FallbackRedirect:
+		// The rest of the path carries over, /api/users to <location>/users
+		location := strings.TrimSuffix(cfg.Location, "/") + strings.TrimPrefix(request.URL.Path, strings.TrimSuffix(f.route, "/"))
+		if request.URL.RawQuery != "" {
+			location += "?" + request.URL.RawQuery
+		}
+		writer.Header().Set("X-Fallback", FallbackRedirect)
+		http.Redirect(writer, request, location, http.StatusTemporaryRedirect)
+		return true
+	}
+	return false
+}
+
+// Remembers successful GET responses as they're copied to the client, for
+// FallbackLastGood. Responses that mustn't be stored, or are too large, or
+// whose body didn't arrive in full, are left out
+func (f *Fallback) remember(resp *http.Response) error {
+	request := resp.Request
+	if request.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if !sharedCacheable(resp.Header) {
+		return nil
+	}
+	if resp.ContentLength > maxFallbackBodyBytes {
+		return nil
+	}
+
+	key := fallbackKey(request)
+	header := resp.Header.Clone()
+	resp.Body = &fallbackRecorder{ReadCloser: resp.Body, onComplete: func(body []byte) {
+		f.store(key, newCacheEntry(resp.StatusCode, header, body, 0, false))
+	}}
+	return nil
+}
+
+func (f *Fallback) store(key string, entry CacheEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.lastGood[key]; !ok {
+		f.order = append(f.order, key)
+		if len(f.order) > f.config.MaxEntries {
+			delete(f.lastGood, f.order[0])
+			f.order = f.order[1:]
+		}
+	}
+	f.lastGood[key] = entry
+}
+
+// Requests are told apart by host and request URI
+func fallbackKey(request *http.Request) string {
+	return request.Host + request.URL.RequestURI()
+}
+
+// Copies a body as it's read, handing it over once it has been read to the
+// end. Bodies over maxFallbackBodyBytes are given up on
+type fallbackRecorder struct {
+	io.ReadCloser
+	body       bytes.Buffer
+	onComplete func(body []byte)
+}
+
+func (r *fallbackRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.onComplete == nil {
+		return n, err
+	}
+	r.body.Write(p[:n])
+	switch {
+	case r.body.Len() > maxFallbackBodyBytes:
+		r.onComplete = nil
+		r.body = bytes.Buffer{}
+	case err == io.EOF:
+		r.onComplete(bytes.Clone(r.body.Bytes()))
+		r.onComplete = nil
+	}
+	return n, err
+}
+
+// Fallbacks shared by every route table, one per route. They outlive reloads
+// so remembered responses survive a config change
+type FallbackRegistry struct {
+	mu        sync.Mutex
+	fallbacks map[string]*Fallback
+}
+
+func NewFallbackRegistry() *FallbackRegistry {
+	return &FallbackRegistry{fallbacks: make(map[string]*Fallback)}
+}
+
+func (r *FallbackRegistry) Get(route RouteConfig) *Fallback {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.fallbacks[route.Key()]; ok {
+		f.configure(route.CircuitBreaker.Fallback)
+		return f
+	}
+	f := NewFallback(route.Path, route.CircuitBreaker.Fallback)
+	r.fallbacks[route.Key()] = f
+	return f
+}
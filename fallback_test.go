@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// A route whose breaker opens on the first failure, and a switch making its
+// upstream fail
+func newFallbackRoute(t *testing.T, fallback BreakerFallback) (http.Handler, *atomic.Bool) {
+	t.Helper()
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if failing.Load() {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`{"uri":"` + request.URL.RequestURI() + `"}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := testRoute("/api", upstream.URL)
+	cfg.CircuitBreaker = CircuitBreakerConfig{Enabled: true, Failures: 1, Cooldown: 60, Fallback: fallback}
+	return buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg), &failing
+}
+
+// Fails a request so the breaker opens
+func tripBreaker(t *testing.T, handler http.Handler, failing *atomic.Bool) {
+	t.Helper()
+	failing.Store(true)
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, "/api/trip", nil)).Code; got != http.StatusInternalServerError {
+		t.Fatalf("tripping request: status = %d, want the upstream's 500", got)
+	}
+}
+
+func TestStaticFallback(t *testing.T) {
+	handler, failing := newFallbackRoute(t, BreakerFallback{Mode: FallbackStatic, Status: http.StatusAccepted, ContentType: "application/json", Body: `{"degraded":true}`})
+	tripBreaker(t, handler, failing)
+
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+	if response.Code != http.StatusAccepted || response.Body.String() != `{"degraded":true}` {
+		t.Errorf("got %d %q, want the static fallback", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Content-Type") != "application/json" || response.Header().Get("X-Fallback") != FallbackStatic {
+		t.Errorf("headers %v, want the fallback's Content-Type and X-Fallback", response.Header())
+	}
+}
+
+func TestLastGoodFallback(t *testing.T) {
+	handler, failing := newFallbackRoute(t, BreakerFallback{Mode: FallbackLastGood})
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, "/api/items?page=2", nil)).Code; got != http.StatusOK {
+		t.Fatalf("status = %d, want 200", got)
+	}
+	tripBreaker(t, handler, failing)
+
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/api/items?page=2", nil))
+	if response.Code != http.StatusOK || response.Body.String() != `{"uri":"/api/items?page=2"}` {
+		t.Errorf("got %d %q, want the last good response replayed", response.Code, response.Body.String())
+	}
+	if response.Header().Get("X-Fallback") != FallbackLastGood || response.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v, want the remembered ones and X-Fallback", response.Header())
+	}
+
+	// Nothing remembered for this URL, so the usual 503
+	if got := serve(handler, httptest.NewRequest(http.MethodGet, "/api/items?page=3", nil)).Code; got != http.StatusServiceUnavailable {
+		t.Errorf("unseen URL: status = %d, want 503", got)
+	}
+}
+
+func TestRedirectFallback(t *testing.T) {
+	handler, failing := newFallbackRoute(t, BreakerFallback{Mode: FallbackRedirect, Location: "https://backup.example.com/v1/"})
+	tripBreaker(t, handler, failing)
+
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/api/users/7?fields=name", nil))
+	if response.Code != http.StatusTemporaryRedirect {
+		t.Errorf("status = %d, want 307", response.Code)
+	}
+	if got := response.Header().Get("Location"); got != "https://backup.example.com/v1/users/7?fields=name" {
+		t.Errorf("Location = %q, want the rest of the path on the backup", got)
+	}
+}
+
+func TestFallbackRemembersBoundedEntries(t *testing.T) {
+	f := NewFallback("/api", BreakerFallback{Mode: FallbackLastGood, MaxEntries: 2})
+	for _, uri := range []string{"/api/a", "/api/b", "/api/c"} {
+		f.store(fallbackKey(httptest.NewRequest(http.MethodGet, uri, nil)), newCacheEntry(http.StatusOK, http.Header{}, []byte(uri), 0, false))
+	}
+	for uri, want := range map[string]bool{"/api/a": false, "/api/b": true, "/api/c": true} {
+		if got := f.Serve(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, uri, nil)); got != want {
+			t.Errorf("%s served: %v, want %v", uri, got, want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	grpcContentType        = "application/grpc"
+
+	// Flag on the length-prefixed frame carrying the trailers
+	grpcWebTrailerFlag = 0x80
+)
+
+// GRPCWebMiddleware translates gRPC-Web requests from browsers into gRPC for
+// the upstream, and the upstream's gRPC responses back into gRPC-Web, with
+// the trailers sent as the body's last frame where browsers can read them.
+// Both the binary (application/grpc-web) and base64 (application/grpc-web-text)
+// variants are handled. Any other request passes through untouched.
+//
+// gRPC needs HTTP/2 to the upstream, which Go only negotiates over TLS, so
+// targets must be https
+func GRPCWebMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		contentType := request.Header.Get("Content-Type")
+		base, subtype, text, ok := parseGRPCWebContentType(contentType)
+		if !ok || request.Method != http.MethodPost {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		request.Header.Set("Content-Type", grpcContentType+subtype)
+		request.Header.Set("Te", "trailers")
+		request.Header.Del("X-Grpc-Web")
+		if text {
+			request.Body = struct {
+				io.Reader
+				io.Closer
+			}{base64.NewDecoder(base64.StdEncoding, request.Body), request.Body}
+			request.ContentLength = -1
+			request.Header.Del("Content-Length")
+		}
+
+		gw := &grpcWebWriter{ResponseWriter: writer, contentType: base + subtype, text: text}
+		defer gw.finish()
+
+		next.ServeHTTP(gw, request)
+	})
+}
+
+// Splits a gRPC-Web content type into its base, the message format suffix
+// ("+proto", "+json" or empty) and whether the body is base64
+func parseGRPCWebContentType(contentType string) (string, string, bool, bool) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, base := range []string{grpcWebTextContentType, grpcWebContentType} {
+		if mediaType == base {
+			return base, "", base == grpcWebTextContentType, true
+		}
+		if subtype, ok := strings.CutPrefix(mediaType, base+"+"); ok && subtype != "" {
+			return base, "+" + subtype, base == grpcWebTextContentType, true
+		}
+	}
+	return "", "", false, false
+}
+
+// Relays the upstream's gRPC response as gRPC-Web. Trailers ReverseProxy
+// would send as HTTP trailers are held back and written as a trailer frame
+// once the upstream is done
+type grpcWebWriter struct {
+	http.ResponseWriter
+	contentType string
+	text        bool
+	announced   []string // Trailers the upstream declared up front
+	pending     []byte   // Tail of a text body not yet a whole base64 group
+	wroteHeader bool
+	grpc        bool // The upstream answered with gRPC, so trailers follow
+}
+
+func (w *grpcWebWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if strings.HasPrefix(header.Get("Content-Type"), grpcContentType) {
+		w.grpc = true
+		header.Set("Content-Type", w.contentType)
+		// Trailers-only responses carry the status as headers, which
+		// cross-origin scripts can't otherwise read
+		header.Add("Access-Control-Expose-Headers", "Grpc-Status, Grpc-Message")
+		w.announced = announcedTrailers(header)
+		header.Del("Trailer")
+		header.Del("Content-Length")
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *grpcWebWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.grpc || !w.text {
+		return w.ResponseWriter.Write(b)
+	}
+
+	// Encode whole 3-byte groups only, so the stream has no padding midway
+	w.pending = append(w.pending, b...)
+	whole := len(w.pending) / 3 * 3
+	if whole > 0 {
+		if _, err := w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(w.pending[:whole]))); err != nil {
+			return 0, err
+		}
+		w.pending = append(w.pending[:0], w.pending[whole:]...)
+	}
+	return len(b), nil
+}
+
+// Flush sends any partial base64 group padded, gRPC-Web clients decode
+// padded chunks one after another
+func (w *grpcWebWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.flushPending()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *grpcWebWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *grpcWebWriter) flushPending() {
+	if len(w.pending) == 0 {
+		return
+	}
+	w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(w.pending)))
+	w.pending = w.pending[:0]
+}
+
+// Writes the trailers as the final frame: the trailer flag, a big-endian
+// length, then the trailers as lowercase HTTP/1 header lines
+func (w *grpcWebWriter) finish() {
+	if !w.grpc {
+		return
+	}
+
+	header := w.Header()
+	trailers := trailerValues(header, w.announced)
+	for _, key := range w.announced {
+		delete(header, key)
+	}
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			delete(header, key)
+		}
+	}
+
+	keys := make([]string, 0, len(trailers))
+	for key := range trailers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var block strings.Builder
+	for _, key := range keys {
+		for _, value := range trailers[key] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(key), value)
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	frame = append(frame, block.String()...)
+
+	if w.text {
+		// The trailer frame starts a fresh base64 chunk
+		w.flushPending()
+		w.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(frame)))
+		return
+	}
+	w.ResponseWriter.Write(frame)
+}
+
+// gRPC upstreams are reached over HTTP/2, which needs TLS
+func validGRPCWebTargets(targets []string) error {
+	for _, target := range targets {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			return fmt.Errorf("invalid target URL: %w", err)
+		}
+		if parsed.Scheme != "https" {
+			return fmt.Errorf("grpc-web target %s must be https, gRPC needs HTTP/2", target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A length-prefixed gRPC message frame
+func grpcFrame(flag byte, payload []byte) []byte {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// Splits a gRPC-Web body into its frames
+func readGRPCFrames(t *testing.T, body []byte) (flags []byte, payloads [][]byte) {
+	t.Helper()
+	for len(body) > 0 {
+		if len(body) < 5 {
+			t.Fatalf("%d bytes left over, not a frame", len(body))
+		}
+		length := int(binary.BigEndian.Uint32(body[1:5]))
+		if len(body) < 5+length {
+			t.Fatalf("frame of %d bytes has only %d", length, len(body)-5)
+		}
+		flags = append(flags, body[0])
+		payloads = append(payloads, body[5:5+length])
+		body = body[5+length:]
+	}
+	return flags, payloads
+}
+
+// Decodes a grpc-web-text body, a run of base64 chunks each padded on its
+// own
+func decodeGRPCWebText(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var decoded []byte
+	for len(body) > 0 {
+		end := len(body)
+		if i := bytes.IndexByte(body, '='); i >= 0 {
+			end = i
+			for end < len(body) && body[end] == '=' {
+				end++
+			}
+		}
+		part, err := base64.StdEncoding.DecodeString(string(body[:end]))
+		if err != nil {
+			t.Fatalf("decoding %q: %v", body[:end], err)
+		}
+		decoded = append(decoded, part...)
+		body = body[end:]
+	}
+	return decoded
+}
+
+// A unary gRPC upstream over HTTP/2 echoing its request message, that checks
+// it got gRPC rather than gRPC-Web
+func newGRPCUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.ProtoMajor != 2 {
+			t.Errorf("upstream got %s, want HTTP/2", request.Proto)
+		}
+		if got := request.Header.Get("Content-Type"); got != "application/grpc+proto" {
+			t.Errorf("upstream Content-Type = %q, want application/grpc+proto", got)
+		}
+		if got := request.Header.Get("Te"); got != "trailers" {
+			t.Errorf("upstream TE = %q, want trailers", got)
+		}
+		body, _ := io.ReadAll(request.Body)
+		_, payloads := readGRPCFrames(t, body)
+
+		writer.Header().Set("Content-Type", "application/grpc+proto")
+		writer.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		for _, payload := range payloads {
+			writer.Write(grpcFrame(0, append([]byte("echo:"), payload...)))
+		}
+		writer.Header().Set("Grpc-Status", "0")
+		writer.Header().Set("Grpc-Message", "OK")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestGRPCWebUnary(t *testing.T) {
+	upstream := newGRPCUpstream(t)
+	cfg := testRoute("/greeter.Greeter/SayHello", upstream.URL)
+	cfg.GRPCWeb = true
+	cfg.Transport.InsecureSkipVerify = true
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	for _, tc := range []struct {
+		contentType string
+		text        bool
+	}{
+		{"application/grpc-web+proto", false},
+		{"application/grpc-web-text+proto", true},
+	} {
+		t.Run(tc.contentType, func(t *testing.T) {
+			body := grpcFrame(0, []byte("hello"))
+			if tc.text {
+				body = []byte(base64.StdEncoding.EncodeToString(body))
+			}
+			request := httptest.NewRequest(http.MethodPost, "/greeter.Greeter/SayHello", bytes.NewReader(body))
+			request.Header.Set("Content-Type", tc.contentType)
+			request.Header.Set("X-Grpc-Web", "1")
+			response := serve(handler, request)
+
+			if response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", response.Code, response.Body)
+			}
+			if got := response.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tc.contentType)
+			}
+			if got := response.Header().Get("Trailer"); got != "" {
+				t.Errorf("Trailer = %q, want trailers in the body instead", got)
+			}
+
+			got := response.Body.Bytes()
+			if tc.text {
+				got = decodeGRPCWebText(t, got)
+			}
+
+			flags, payloads := readGRPCFrames(t, got)
+			if len(flags) != 2 {
+				t.Fatalf("got %d frames, want a message and the trailers", len(flags))
+			}
+			if flags[0] != 0 || string(payloads[0]) != "echo:hello" {
+				t.Errorf("message frame = %#x %q, want echo:hello", flags[0], payloads[0])
+			}
+			if flags[1] != grpcWebTrailerFlag {
+				t.Errorf("last frame flag = %#x, want the trailer flag", flags[1])
+			}
+			if want := "grpc-message: OK\r\ngrpc-status: 0\r\n"; string(payloads[1]) != want {
+				t.Errorf("trailers = %q, want %q", payloads[1], want)
+			}
+		})
+	}
+}
+
+func TestGRPCWebNeedsHTTPS(t *testing.T) {
+	cfg := testRoute("/greeter.Greeter/SayHello", "http://127.0.0.1:1")
+	cfg.GRPCWeb = true
+	if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+		t.Error("built a gRPC-Web route to a plain http target")
+	}
+}
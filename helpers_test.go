@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func testLogger() *zap.SugaredLogger {
+	return zap.NewNop().Sugar()
+}
+
+// A Redis backed by an in-memory server, closed when the test ends
+func newTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	r := &Redis{
+		cacheDb:  redis.NewClient(&redis.Options{Addr: server.Addr(), DB: 0, ContextTimeoutEnabled: true}),
+		configDb: redis.NewClient(&redis.Options{Addr: server.Addr(), DB: 1}),
+		ctx:      context.Background(),
+		logger:   testLogger(),
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, server
+}
+
+// A route config with the defaults a stored config unmarshals with
+func testRoute(path string, targets ...string) RouteConfig {
+	return RouteConfig{
+		SchemaVersion:     currentSchemaVersion,
+		Path:              path,
+		Targets:           targets,
+		Enabled:           true,
+		PreserveHost:      true,
+		BufferRequestBody: true,
+	}
+}
+
+// The handler the route manager builds for cfg, middleware and all
+func buildTestRoute(t *testing.T, m *RouteManager, cfg RouteConfig) http.Handler {
+	t.Helper()
+	handler, err := m.buildRoute(cfg)
+	if err != nil {
+		t.Fatalf("building route %s: %v", cfg.Key(), err)
+	}
+	return handler
+}
+
+// Stores cfg and reloads m so it's being served
+func storeRoute(t *testing.T, r *Redis, m *RouteManager, cfg RouteConfig) {
+	t.Helper()
+	if err := r.SetConf(cfg.Key(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("reloading routes: %v", err)
+	}
+}
+
+func serve(handler http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// An upstream answering every request with body
+func newTestUpstream(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// A handler answering every request with "ok"
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	})
+}
+
+// A Clock whose time only moves when it's waited on. Every wait returns
+// straight away and is recorded in waits
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	waits []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	c.now = c.now.Add(d)
+	fired := make(chan time.Time, 1)
+	fired <- c.now
+	return fired
+}
+
+func (c *fakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+// An upstream answering with body that counts the connections opened to it
+func newCountingUpstream(t *testing.T, body string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(body))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, &conns
+}
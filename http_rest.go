@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -26,11 +28,36 @@ func (e *RequestError) Error() string {
 	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
 }
 
+// The upstream closed the connection before sending the whole body
+var ErrTruncatedResponse = errors.New("response truncated")
+
+// Encoding used for JSON request payloads and DecodeJson. Defaults to
+// encoding/json
+type Marshaler func(v interface{}) ([]byte, error)
+type Unmarshaler func(data []byte, v interface{}) error
+
+// Time source for retry timing. Swappable so retry and backoff behavior can be
+// driven without real delays
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
 type HttpClient struct {
 	client      *http.Client
 	baseDelay   time.Duration
 	maxAttempts int
 	logger      *zap.SugaredLogger
+	logRequests bool
+	marshal     Marshaler
+	unmarshal   Unmarshaler
+	maxElapsed  time.Duration // Zero means retries are bounded by maxAttempts alone
+	clock       Clock
 }
 
 func NewHttpClient(client *http.Client, logger *zap.SugaredLogger) *HttpClient {
@@ -42,18 +69,144 @@ func NewHttpClient(client *http.Client, logger *zap.SugaredLogger) *HttpClient {
 		baseDelay:   time.Second,
 		maxAttempts: 3,
 		logger:      logger,
+		marshal:     json.Marshal,
+		unmarshal:   json.Unmarshal,
+		clock:       realClock{},
+	}
+}
+
+// SetClock replaces the time source used for retry backoff and budgets
+func (c *HttpClient) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+// SetMaxElapsed bounds the total time a request may spend retrying, including
+// backoff, regardless of how many attempts remain. Zero removes the bound
+func (c *HttpClient) SetMaxElapsed(d time.Duration) {
+	c.maxElapsed = d
+}
+
+// SetJsonCodec swaps the JSON encoding used by the payload methods and
+// DecodeJson. A nil marshaler or unmarshaler keeps the current one
+func (c *HttpClient) SetJsonCodec(marshal Marshaler, unmarshal Unmarshaler) {
+	if marshal != nil {
+		c.marshal = marshal
+	}
+	if unmarshal != nil {
+		c.unmarshal = unmarshal
+	}
+}
+
+// SetProxy routes the client's requests through an egress proxy, with the
+// same settings as Transport.Proxy and Transport.NoProxy. The client given to
+// NewHttpClient is copied rather than changed, and must use an
+// *http.Transport (or the default)
+func (c *HttpClient) SetProxy(proxy string, noProxy string) error {
+	proxyFunc, err := egressProxy(proxy, noProxy)
+	if err != nil {
+		return err
+	}
+
+	var transport *http.Transport
+	switch base := c.client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = base.Clone()
+	default:
+		return fmt.Errorf("can't set a proxy on a %T", base)
+	}
+	transport.Proxy = proxyFunc
+
+	client := *c.client
+	client.Transport = transport
+	c.client = &client
+	return nil
+}
+
+// DecodeJson unmarshals a response body with the client's unmarshaler. A
+// panicking unmarshaler is returned as a *PanicError
+func (c *HttpClient) DecodeJson(body []byte, v interface{}) error {
+	err := recoverCallback("unmarshaler", func() error {
+		return c.unmarshal(body, v)
+	})
+	if err != nil {
+		return fmt.Errorf("unmarshaling JSON: %w", err)
+	}
+	return nil
+}
+
+// SetRequestLogging logs every completed request at info level, in the same
+// shape as the server's access log, instead of only at debug level
+func (c *HttpClient) SetRequestLogging(enabled bool) {
+	c.logRequests = enabled
+}
+
+// Overrides one call's retry behavior without touching the shared client
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	attempts   int
+	timeout    time.Duration
+	baseDelay  time.Duration
+	maxElapsed time.Duration
+	retryable  func(error) bool
+}
+
+// WithAttempts sets how many times the call is tried, including the first.
+// 1 disables retries
+func WithAttempts(attempts int) RequestOption {
+	return func(o *requestOptions) { o.attempts = attempts }
+}
+
+// WithTimeout bounds the whole call, retries and backoff included
+func WithTimeout(timeout time.Duration) RequestOption {
+	return func(o *requestOptions) { o.timeout = timeout }
+}
+
+// WithBaseDelay sets the backoff before the second attempt, doubling after
+func WithBaseDelay(delay time.Duration) RequestOption {
+	return func(o *requestOptions) { o.baseDelay = delay }
+}
+
+// WithMaxElapsed bounds the time spent retrying, as SetMaxElapsed does for
+// every call
+func WithMaxElapsed(d time.Duration) RequestOption {
+	return func(o *requestOptions) { o.maxElapsed = d }
+}
+
+// WithRetryable decides which failures are retried. It's only asked about
+// failures the client would retry itself: non-idempotent resets and 4xx
+// responses are never retried
+func WithRetryable(retryable func(error) bool) RequestOption {
+	return func(o *requestOptions) { o.retryable = retryable }
+}
+
+// The client's settings with options applied over them
+func (c *HttpClient) requestOptions(options []RequestOption) requestOptions {
+	o := requestOptions{
+		attempts:   c.maxAttempts,
+		baseDelay:  c.baseDelay,
+		maxElapsed: c.maxElapsed,
+	}
+	for _, option := range options {
+		option(&o)
 	}
+	return o
 }
 
-func calcBackoff(attempt int, baseDelay time.Duration) time.Duration {
+// Zero maxBackoff caps at 30s
+func calcBackoff(attempt int, baseDelay time.Duration, maxBackoff time.Duration) time.Duration {
 	// use bit shifting for int exponential growth: 2^n
 	backoff := baseDelay * time.Duration(1<<time.Duration(attempt))
 
 	// add +/- 20% jitter
-	jitter := time.Duration(rand.Float64()*0.4-0.2) * backoff
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(backoff))
 	backoff += jitter
 
-	maxBackoff := 30 * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
 	if backoff > maxBackoff {
 		backoff = maxBackoff
 	}
@@ -68,72 +221,164 @@ func isRetryableStatusCode(code int) bool {
 		code >= 500
 }
 
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Safe methods don't change anything upstream, so repeating one is harmless
+// without an Idempotency-Key too
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
 func isSuccessStatus(code int) bool {
 	return code >= 200 && code < 300
 }
 
-func (c *HttpClient) execReq(req *http.Request, attempts int) ([]byte, error) {
-	var lastErr error
-	for i := 0; i < attempts; i++ {
-		start := time.Now()
+// Requests made with the context of an inbound request carry its request ID
+// upstream and in every log line, so both sides of the call correlate.
+//
+// Retries stop at whichever comes first: attempts, the client's maxElapsed
+// budget (counting time spent in backoff), or the request context's deadline.
+// Connection resets are retried without backoff the first time, but only for
+// idempotent methods or requests carrying an Idempotency-Key. Panics in the
+// clock or transport are returned as a *PanicError rather than crashing the
+// caller. options override the client's retry settings for this call
+func (c *HttpClient) execReq(req *http.Request, options ...RequestOption) ([]byte, error) {
+	opts := c.requestOptions(options)
+	if opts.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), opts.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	logger := c.logger
+	if id := CorrelationID(req.Context()); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+		logger = logger.With("request_id", id)
+	}
+
+	policy := RetryPolicy{
+		Attempts:   opts.attempts,
+		BaseDelay:  opts.baseDelay,
+		MaxElapsed: opts.maxElapsed,
+		Clock:      c.clock,
+		Retryable:  opts.retryable,
+		Immediate:  isConnectionReset,
+		Budget:     RequestContextFrom(req.Context()).AttemptBudget(),
+		OnRetry: func(attempt int, err error) {
+			logger.Warnw("retrying failed request",
+				"attempt", attempt,
+				"error", err,
+				"url", req.URL.String())
+		},
+	}
+
+	var body []byte
+	attempt := 0
+	err := Retry(req.Context(), policy, func() error {
+		if attempt > 0 && req.GetBody != nil {
+			// The previous attempt consumed the body
+			rewound, err := req.GetBody()
+			if err != nil {
+				return Permanent(fmt.Errorf("rewinding request body: %w", err))
+			}
+			req.Body = rewound
+		}
+		attempt++
+
+		start := c.clock.Now()
 
 		resp, err := c.client.Do(req)
 		if err != nil {
-			lastErr = fmt.Errorf("request failed: %w", err)
-			if i < attempts-1 {
-				c.logger.Warnw("retrying failed request",
-					"attempt", i+1,
-					"error", err,
-					"url", req.URL.String())
-				time.Sleep(calcBackoff(i, c.baseDelay))
-				continue
+			err = fmt.Errorf("request failed: %w", err)
+			// The upstream may have acted on the request before dropping
+			// the connection
+			if isConnectionReset(err) && !isIdempotent(req.Method) && req.Header.Get(IdempotencyKeyHeader) == "" {
+				return Permanent(err)
 			}
-			return nil, lastErr
+			return err
 		}
-		defer resp.Body.Close()
 
-		body, err := io.ReadAll(resp.Body)
-		duration := time.Since(start)
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		duration := c.clock.Now().Sub(start)
 
-		c.logger.Debugw("request completed",
+		clientRequestDuration.WithLabelValues(req.Method, strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
+
+		logRequest := logger.Debugw
+		if c.logRequests {
+			logRequest = logger.Infow
+		}
+		logRequest("request completed",
 			"method", req.Method,
 			"url", req.URL.String(),
 			"status", resp.StatusCode,
 			"duration", duration)
 
 		if err != nil {
-			lastErr = fmt.Errorf("reading response: %w", err)
-			if i < attempts-1 {
-				time.Sleep(calcBackoff(i, c.baseDelay))
-				continue
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("reading response: %w", err)
+			}
+
+			err = fmt.Errorf("reading response: %w: %w", ErrTruncatedResponse, err)
+			logger.Warnw("upstream closed connection mid-body",
+				"method", req.Method,
+				"url", req.URL.String(),
+				"status", resp.StatusCode)
+
+			// The upstream already acted on the request, only repeat it
+			// if doing so is harmless
+			if !isIdempotent(req.Method) {
+				return Permanent(err)
 			}
-			return nil, lastErr
+			return err
 		}
 
 		if !isSuccessStatus(resp.StatusCode) {
-			lastErr = &RequestError{
+			reqErr := &RequestError{
 				StatusCode: resp.StatusCode,
-				Body:       string(body),
+				Body:       string(respBody),
 			}
-			if i < attempts-1 && isRetryableStatusCode(resp.StatusCode) {
-				time.Sleep(calcBackoff(i, c.baseDelay))
-				continue
+			if !isRetryableStatusCode(resp.StatusCode) {
+				return Permanent(reqErr)
 			}
-			return nil, lastErr
+			return reqErr
 		}
 
-		return body, nil
+		body = respBody
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("request failed after %d attempts: %v", attempts, lastErr)
+	return body, nil
 }
 
-func (c *HttpClient) PostJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string) ([]byte, error) {
-	jsonBody, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling JSON: %w", err)
+// A nil payload sends an empty body rather than "null", still labeled as
+// JSON. Send struct{}{} or an empty map for an explicit {}
+func (c *HttpClient) newJsonReq(ctx context.Context, method string, url string, payload interface{}, headers map[string]string) (*http.Request, error) {
+	var jsonBody []byte
+	if !isNilPayload(payload) {
+		err := recoverCallback("marshaler", func() error {
+			var err error
+			jsonBody, err = c.marshal(payload)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("marshaling JSON: %w", err)
+		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %w", err)
 	}
@@ -143,10 +388,31 @@ func (c *HttpClient) PostJsonReq(ctx context.Context, url string, payload interf
 		req.Header.Set(k, v)
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return req, nil
+}
+
+// Untyped nil, or a nil pointer, map, slice or interface
+func isNilPayload(payload interface{}) bool {
+	if payload == nil {
+		return true
+	}
+	switch value := reflect.ValueOf(payload); value.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+func (c *HttpClient) PostJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string, options ...RequestOption) ([]byte, error) {
+	req, err := c.newJsonReq(ctx, http.MethodPost, url, payload, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.execReq(req, options...)
 }
 
-func (c *HttpClient) PostFormReq(ctx context.Context, url string, formData url.Values, headers map[string]string) ([]byte, error) {
+func (c *HttpClient) PostFormReq(ctx context.Context, url string, formData url.Values, headers map[string]string, options ...RequestOption) ([]byte, error) {
 	encodedData := formData.Encode()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(encodedData))
@@ -161,10 +427,10 @@ func (c *HttpClient) PostFormReq(ctx context.Context, url string, formData url.V
 		req.Header.Set(k, v)
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return c.execReq(req, options...)
 }
 
-func (c *HttpClient) GetReq(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+func (c *HttpClient) GetReq(ctx context.Context, url string, headers map[string]string, options ...RequestOption) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %w", err)
@@ -174,48 +440,28 @@ func (c *HttpClient) GetReq(ctx context.Context, url string, headers map[string]
 		req.Header.Set(k, v)
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return c.execReq(req, options...)
 }
 
-func (c *HttpClient) PutJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string) ([]byte, error) {
-	jsonBody, err := json.Marshal(payload)
+func (c *HttpClient) PutJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string, options ...RequestOption) ([]byte, error) {
+	req, err := c.newJsonReq(ctx, http.MethodPut, url, payload, headers)
 	if err != nil {
-		return nil, fmt.Errorf("marshaling JSON: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	for k, v := range headers {
-		req.Header.Set(k, v)
+		return nil, err
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return c.execReq(req, options...)
 }
 
-func (c *HttpClient) PatchJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string) ([]byte, error) {
-	jsonBody, err := json.Marshal(payload)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling JSON: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, url, bytes.NewBuffer(jsonBody))
+func (c *HttpClient) PatchJsonReq(ctx context.Context, url string, payload interface{}, headers map[string]string, options ...RequestOption) ([]byte, error) {
+	req, err := c.newJsonReq(ctx, http.MethodPatch, url, payload, headers)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	for k, v := range headers {
-		req.Header.Set(k, v)
+		return nil, err
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return c.execReq(req, options...)
 }
 
-func (c *HttpClient) DeleteReq(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+func (c *HttpClient) DeleteReq(ctx context.Context, url string, headers map[string]string, options ...RequestOption) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %w", err)
@@ -225,5 +471,5 @@ func (c *HttpClient) DeleteReq(ctx context.Context, url string, headers map[stri
 		req.Header.Set(k, v)
 	}
 
-	return c.execReq(req, c.maxAttempts)
+	return c.execReq(req, options...)
 }
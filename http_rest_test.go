@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// An inbound request's ID reaches the upstream of an HttpClient call made
+// with its context, whether the client sent the ID or the gateway made one up
+func TestHttpClientPropagatesRequestID(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received = request.Header.Get(RequestIDHeader)
+	}))
+	defer upstream.Close()
+
+	client := NewHttpClient(nil, testLogger())
+	handler := RequestID(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if _, err := client.GetReq(request.Context(), upstream.URL, nil); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	tests := []struct {
+		name    string
+		inbound string
+	}{
+		{"from client", "client-supplied-id"},
+		{"generated", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.inbound != "" {
+				request.Header.Set(RequestIDHeader, tt.inbound)
+			}
+			response := serve(handler, request)
+
+			id := response.Header().Get(RequestIDHeader)
+			if tt.inbound != "" && id != tt.inbound {
+				t.Errorf("response ID = %q, want the client's %q", id, tt.inbound)
+			}
+			if id == "" || received != id {
+				t.Errorf("upstream got ID %q, want the inbound request's %q", received, id)
+			}
+		})
+	}
+}
+
+func TestHttpClientJsonCodec(t *testing.T) {
+	var body string
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, _ := io.ReadAll(request.Body)
+		body = string(data)
+		writer.Write([]byte(`{"echo":true}`))
+	}))
+	defer upstream.Close()
+
+	var marshaled []interface{}
+	var unmarshaled []string
+	client := NewHttpClient(nil, testLogger())
+	client.SetJsonCodec(func(v interface{}) ([]byte, error) {
+		marshaled = append(marshaled, v)
+		return []byte(`{"custom":true}`), nil
+	}, func(data []byte, v interface{}) error {
+		unmarshaled = append(unmarshaled, string(data))
+		return json.Unmarshal(data, v)
+	})
+
+	payload := map[string]string{"name": "lattice"}
+	response, err := client.PostJsonReq(context.Background(), upstream.URL, payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marshaled) != 1 || !reflect.DeepEqual(marshaled[0], payload) {
+		t.Errorf("marshaler called with %v, want the payload once", marshaled)
+	}
+	if body != `{"custom":true}` {
+		t.Errorf("upstream got %q, want the custom marshaler's output", body)
+	}
+
+	var decoded struct{ Echo bool }
+	if err := client.DecodeJson(response, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(unmarshaled) != 1 || !decoded.Echo {
+		t.Errorf("unmarshaler calls = %q, decoded %+v; want one call decoding the response", unmarshaled, decoded)
+	}
+}
+
+func TestHttpClientJsonPayloads(t *testing.T) {
+	type received struct {
+		body          string
+		contentType   string
+		contentLength int64
+	}
+	got := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		got <- received{string(body), request.Header.Get("Content-Type"), request.ContentLength}
+	}))
+	defer upstream.Close()
+	client := NewHttpClient(nil, testLogger())
+
+	var nilMap map[string]int
+	var nilPointer *struct{ ID int }
+	tests := []struct {
+		name    string
+		payload interface{}
+		want    string
+	}{
+		{"untyped nil", nil, ""},
+		{"nil map", nilMap, ""},
+		{"nil pointer", nilPointer, ""},
+		{"empty struct", struct{}{}, "{}"},
+		{"empty map", map[string]int{}, "{}"},
+		{"populated", map[string]int{"id": 7}, `{"id":7}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := client.PutJsonReq(context.Background(), upstream.URL, tc.payload, nil); err != nil {
+				t.Fatal(err)
+			}
+			r := <-got
+			if r.body != tc.want {
+				t.Errorf("body = %q, want %q", r.body, tc.want)
+			}
+			if r.contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", r.contentType)
+			}
+			if r.contentLength != int64(len(tc.want)) {
+				t.Errorf("Content-Length = %d, want %d", r.contentLength, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestHttpClientMarshalerError(t *testing.T) {
+	client := NewHttpClient(nil, testLogger())
+	failure := errors.New("refusing to encode")
+	client.SetJsonCodec(func(interface{}) ([]byte, error) { return nil, failure }, nil)
+
+	_, err := client.PostJsonReq(context.Background(), "http://127.0.0.1:1", struct{}{}, nil)
+	if !errors.Is(err, failure) {
+		t.Errorf("err = %v, want the marshaler's error", err)
+	}
+}
+
+// Buggy callbacks come back as a *PanicError naming the callback, rather
+// than taking the caller down
+func TestHttpClientRecoversCallbackPanics(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(newFakeClock())
+	client.SetJsonCodec(
+		func(interface{}) ([]byte, error) { panic("marshaler bug") },
+		func([]byte, interface{}) error { panic("unmarshaler bug") },
+	)
+
+	tests := []struct {
+		name     string
+		call     func() error
+		callback string
+	}{
+		{"retry policy", func() error {
+			_, err := client.GetReq(context.Background(), upstream.URL, nil, WithRetryable(func(error) bool { panic("policy bug") }))
+			return err
+		}, "retry"},
+		{"marshaler", func() error {
+			_, err := client.PostJsonReq(context.Background(), upstream.URL, map[string]int{"item": 1}, nil)
+			return err
+		}, "marshaler"},
+		{"unmarshaler", func() error {
+			var v map[string]any
+			return client.DecodeJson([]byte("{}"), &v)
+		}, "unmarshaler"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var panicErr *PanicError
+			if err := tc.call(); !errors.As(err, &panicErr) {
+				t.Fatalf("err = %v, want a *PanicError", err)
+			}
+			if panicErr.Callback != tc.callback || !strings.HasSuffix(fmt.Sprint(panicErr.Value), "bug") {
+				t.Errorf("panic in %q with %v, want %q", panicErr.Callback, panicErr.Value, tc.callback)
+			}
+			if len(panicErr.Stack) == 0 {
+				t.Error("no stack recorded")
+			}
+		})
+	}
+	// The policy panicked after the first attempt, the marshaler before any
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream called %d times, want 1", got)
+	}
+}
+
+// An upstream that promises a longer body than it sends, then hangs up
+func newTruncatingUpstream(t *testing.T, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		writer.Header().Set("Content-Length", "100")
+		writer.Write([]byte("partial"))
+		writer.(http.Flusher).Flush()
+		conn, _, err := http.NewResponseController(writer).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestHttpClientTruncatedResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		wantCalls int32
+	}{
+		{"idempotent retried", http.MethodGet, 2},
+		{"non-idempotent not retried", http.MethodPost, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := newTruncatingUpstream(t, &calls)
+			client := NewHttpClient(nil, testLogger())
+
+			request, _ := http.NewRequest(tt.method, upstream.URL, nil)
+			_, err := client.execReq(request, WithAttempts(2), WithBaseDelay(time.Millisecond))
+			if !errors.Is(err, ErrTruncatedResponse) {
+				t.Fatalf("err = %v, want ErrTruncatedResponse", err)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("err = %v, want it to wrap the underlying io.ErrUnexpectedEOF", err)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// An upstream failing every request with status, counting them
+func newFailingUpstream(t *testing.T, status int, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls.Add(1)
+		writer.WriteHeader(status)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// An upstream that resets the connection on its first resets requests, as
+// one restarting mid-deploy would, and answers "ok" after that
+func newResettingUpstream(t *testing.T, resets int32, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if calls.Add(1) <= resets {
+			conn, _, err := http.NewResponseController(writer).Hijack()
+			if err != nil {
+				t.Errorf("hijacking: %v", err)
+				return
+			}
+			// No linger makes Close send a RST rather than a FIN
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+		writer.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestHttpClientRetriesConnectionReset(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newResettingUpstream(t, 1, &calls)
+	client := NewHttpClient(nil, testLogger())
+	clock := newFakeClock()
+	client.SetClock(clock)
+
+	body, err := client.GetReq(context.Background(), upstream.URL, nil, WithAttempts(3))
+	if err != nil {
+		t.Fatalf("GET after a reset: %v", err)
+	}
+	if string(body) != "ok" || calls.Load() != 2 {
+		t.Errorf("got %q after %d calls, want ok after 2", body, calls.Load())
+	}
+	// A pooled connection dropped by a restart is worth trying again at once
+	if waits := clock.Waits(); len(waits) != 1 || waits[0] != 0 {
+		t.Errorf("waited %v before retrying, want no backoff", waits)
+	}
+}
+
+// The upstream may have acted on a POST before dropping the connection
+func TestHttpClientDoesNotRetryResetPost(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newResettingUpstream(t, 1, &calls)
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(newFakeClock())
+
+	_, err := client.PostJsonReq(context.Background(), upstream.URL, map[string]int{"item": 1}, nil, WithAttempts(3))
+	if err == nil || !isConnectionReset(err) {
+		t.Fatalf("err = %v, want the reset", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream called %d times, want 1", got)
+	}
+
+	// With a key, sending it again is safe
+	calls.Store(0)
+	if _, err := client.PostJsonReq(context.Background(), upstream.URL, map[string]int{"item": 1}, map[string]string{IdempotencyKeyHeader: "order-1"}, WithAttempts(3)); err != nil {
+		t.Fatalf("keyed POST after a reset: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("keyed POST: upstream called %d times, want 2", got)
+	}
+}
+
+func TestHttpClientMaxElapsedStopsRetries(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	client := NewHttpClient(nil, testLogger())
+	client.SetMaxElapsed(100 * time.Millisecond)
+
+	// Backoffs of roughly 20, 40 and 80ms: the third would end past the
+	// 100ms budget, long before ten attempts are used up
+	started := time.Now()
+	_, err := client.GetReq(context.Background(), upstream.URL, nil, WithAttempts(10), WithBaseDelay(20*time.Millisecond))
+	elapsed := time.Since(started)
+
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want the last attempt's 503", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream called %d times, want 3", got)
+	}
+	if elapsed > 100*time.Millisecond {
+		t.Errorf("gave up after %v, want it to stop rather than sleep past the budget", elapsed)
+	}
+}
+
+func TestHttpClientBackoffProgression(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusBadGateway, &calls)
+	clock := newFakeClock()
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(clock)
+
+	_, err := client.GetReq(context.Background(), upstream.URL, nil, WithAttempts(5), WithBaseDelay(time.Second))
+	if err == nil {
+		t.Fatal("want the 502s to fail the call")
+	}
+	if got := calls.Load(); got != 5 {
+		t.Fatalf("upstream called %d times, want 5", got)
+	}
+
+	// Doubling from the base delay, each within the ±20% jitter
+	waits := clock.Waits()
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	if len(waits) != len(want) {
+		t.Fatalf("waited %v, want %d backoffs", waits, len(want))
+	}
+	for i, wait := range waits {
+		low, high := want[i]*8/10, want[i]*12/10
+		if wait < low || wait > high {
+			t.Errorf("backoff %d = %v, want %v ±20%%", i+1, wait, want[i])
+		}
+	}
+}
+
+func TestHttpClientBackoffObeysMaxElapsed(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusBadGateway, &calls)
+	clock := newFakeClock()
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(clock)
+	client.SetMaxElapsed(5 * time.Second)
+
+	// 1s and 2s of backoff fit the budget, the 4s after that doesn't
+	client.GetReq(context.Background(), upstream.URL, nil, WithAttempts(10), WithBaseDelay(time.Second))
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream called %d times, want 3", got)
+	}
+	if got := len(clock.Waits()); got != 2 {
+		t.Errorf("slept %d times, want 2", got)
+	}
+}
+
+// Options change one call only, the next call gets the client's settings
+func TestHttpClientPerCallOptions(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(newFakeClock())
+
+	tests := []struct {
+		name    string
+		options []RequestOption
+		want    int32
+	}{
+		{"no retries", []RequestOption{WithAttempts(1)}, 1},
+		{"client default", nil, 3},
+		{"more retries", []RequestOption{WithAttempts(5)}, 5},
+		{"default again", nil, 3},
+		{"nothing retryable", []RequestOption{WithAttempts(5), WithRetryable(func(error) bool { return false })}, 1},
+	}
+	for _, tc := range tests {
+		calls.Store(0)
+		if _, err := client.GetReq(context.Background(), upstream.URL, nil, tc.options...); err == nil {
+			t.Fatalf("%s: want the 503", tc.name)
+		}
+		if got := calls.Load(); got != tc.want {
+			t.Errorf("%s: %d calls, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHttpClientPerCallTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	client := NewHttpClient(nil, testLogger())
+
+	started := time.Now()
+	_, err := client.GetReq(context.Background(), upstream.URL, nil, WithTimeout(50*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the call's deadline", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("call took %v, want it cut off at 50ms", elapsed)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Request bodies decoded by the gateway's own handlers are small; anything
+// larger is rejected before it is read
+const maxJSONBodyBytes = 1 << 20
+
+// Error body for requests the gateway rejects itself
+type errorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(v)
+}
+
+func writeJSONError(writer http.ResponseWriter, request *http.Request, status int, message string) {
+	writeJSON(writer, status, errorResponse{Error: message, RequestID: CorrelationID(request.Context())})
+}
+
+// decodeJSONBody decodes a single JSON object from the request into dst. The
+// body must be declared application/json, fit in maxJSONBodyBytes and only
+// contain fields dst knows about. On failure the error response (415, 413 or
+// 400) has already been written and the returned error is for logging only
+func decodeJSONBody(writer http.ResponseWriter, request *http.Request, dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSONError(writer, request, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return fmt.Errorf("unsupported content type %q", request.Header.Get("Content-Type"))
+	}
+
+	request.Body = http.MaxBytesReader(writer, request.Body, maxJSONBodyBytes)
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(dst)
+	if err == nil && decoder.More() {
+		err = errors.New("body must contain a single JSON object")
+	}
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var sizeErr *http.MaxBytesError
+	status := http.StatusBadRequest
+	message := err.Error()
+	switch {
+	case errors.As(err, &sizeErr):
+		status = http.StatusRequestEntityTooLarge
+		message = fmt.Sprintf("body must not exceed %d bytes", sizeErr.Limit)
+	case errors.As(err, &syntaxErr):
+		message = fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		message = "malformed JSON"
+	case errors.As(err, &typeErr):
+		message = fmt.Sprintf("invalid value for field %q", typeErr.Field)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		message = "unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+	case errors.Is(err, io.EOF):
+		message = "body must not be empty"
+	}
+
+	writeJSONError(writer, request, status, message)
+	return fmt.Errorf("decoding JSON body: %w", err)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{"valid", "application/json", `{"username": "alice", "password": "pw"}`, http.StatusOK},
+		{"charset parameter", "application/json; charset=utf-8", `{"username": "alice"}`, http.StatusOK},
+		{"malformed", "application/json", `{"username": "alice",`, http.StatusBadRequest},
+		{"syntax error", "application/json", `{"username" "alice"}`, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"user": "alice"}`, http.StatusBadRequest},
+		{"wrong type", "application/json", `{"username": 1}`, http.StatusBadRequest},
+		{"two objects", "application/json", `{} {}`, http.StatusBadRequest},
+		{"empty", "application/json", ``, http.StatusBadRequest},
+		{"wrong content type", "text/plain", `{"username": "alice"}`, http.StatusUnsupportedMediaType},
+		{"missing content type", "", `{"username": "alice"}`, http.StatusUnsupportedMediaType},
+		{"oversized", "application/json", `{"username": "` + strings.Repeat("a", maxJSONBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				var u User
+				if decodeJSONBody(writer, request, &u) == nil {
+					writer.WriteHeader(http.StatusOK)
+				}
+			})
+			request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			response := serve(handler, request)
+			if response.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", response.Code, tt.wantStatus, response.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				return
+			}
+			var body errorResponse
+			if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("error body %q isn't a structured error (%v)", response.Body, err)
+			}
+		})
+	}
+}
+
+// Malformed credentials are a bad request, not a failed login
+func TestLoginRejectsMalformedBody(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":`))
+	request.Header.Set("Content-Type", "application/json")
+	if got := serve(http.HandlerFunc(LoginHandler), request).Code; got != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", got)
+	}
+}
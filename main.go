@@ -2,26 +2,127 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
+// Zero-valued timeouts, MaxHeaderBytes and MaxURILength are filled in from
+// defaultConfig by NewServer. To run without a timeout or URI limit, set it
+// negative
 type Config struct {
 	ListenAddr     string
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
 	IdleTimeout    time.Duration
 	MaxHeaderBytes int
+	// How long a request may take before it's canceled and answered 504, see
+	// TimeoutMiddleware. Routes can override it. Zero defaults to nine tenths
+	// of WriteTimeout, so the 504 gets out before the connection is cut
+	RequestTimeout time.Duration
+	// Upstream attempts one request may make, summed over proxy retries,
+	// failover and HttpClient calls made with its context, see AttemptBudget.
+	// Zero doesn't cap them
+	MaxUpstreamAttempts int
+	// Longest request URI (path and query) accepted, longer ones get 414
+	MaxURILength int
+	// How long a new or kept-alive connection may take to send request
+	// headers. Zero uses ReadTimeout
+	ReadHeaderTimeout time.Duration
+	// Close every connection after one response
+	DisableKeepAlives bool
+	// Path cleanup before routing: PathStrict, PathRedirect or PathRewrite.
+	// Empty leaves it to ServeMux
+	NormalizePath string
+
+	// Size of the copy buffers pooled across proxied responses. Defaults to 32kb
+	ProxyBufferSize int
+	// Cache lookups slower than this count as a miss. Defaults to 50ms
+	CacheReadTimeout time.Duration
+	// Serve a status page (version, uptime, routes, health) at / unless a
+	// route claims it
+	StatusPage bool
+	// Unlocks admin-only features. Empty disables them
+	AdminToken string
+	// Redis stream admin config changes are appended to. Empty only logs them
+	AuditStream string
+	// HTML pages served for the gateway's own errors to clients that accept
+	// HTML, by status. Paths are relative to ErrorPageDir
+	ErrorPageDir string
+	ErrorPages   map[int]string
+	// URLs POSTed a StateTransition whenever the gateway's state changes,
+	// checked every StateCheckInterval (5s if zero)
+	StateWebhooks      []string
+	StateCheckInterval time.Duration
+}
+
+var defaultConfig = Config{
+	ListenAddr:     ":8080",
+	ReadTimeout:    10 * time.Second,
+	WriteTimeout:   10 * time.Second,
+	IdleTimeout:    30 * time.Second,
+	MaxHeaderBytes: 1 << 20, // 1mb
+	MaxURILength:   8 << 10, // 8kb
+}
+
+// withDefaults returns cfg with every unset server limit replaced by its
+// default, and the names of the fields that were defaulted. A server without
+// read timeouts is open to slowloris clients holding connections forever
+func (cfg Config) withDefaults() (Config, []string) {
+	var applied []string
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultConfig.ListenAddr
+		applied = append(applied, "ListenAddr")
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultConfig.ReadTimeout
+		applied = append(applied, "ReadTimeout")
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultConfig.WriteTimeout
+		applied = append(applied, "WriteTimeout")
+	}
+	if cfg.RequestTimeout == 0 && cfg.WriteTimeout > 0 {
+		cfg.RequestTimeout = cfg.WriteTimeout * 9 / 10
+		applied = append(applied, "RequestTimeout")
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultConfig.IdleTimeout
+		applied = append(applied, "IdleTimeout")
+	}
+	if cfg.MaxHeaderBytes == 0 {
+		cfg.MaxHeaderBytes = defaultConfig.MaxHeaderBytes
+		applied = append(applied, "MaxHeaderBytes")
+	}
+	if cfg.MaxURILength == 0 {
+		cfg.MaxURILength = defaultConfig.MaxURILength
+		applied = append(applied, "MaxURILength")
+	}
+	return cfg, applied
 }
 
 type Server struct {
 	Config
-	router *http.ServeMux
-	logger *zap.SugaredLogger
+	router     *http.ServeMux
+	routes     *RouteManager
+	state      *StateMonitor
+	redis      *Redis
+	logger     *zap.SugaredLogger
+	httpServer *http.Server
+
+	transformers *TransformerRegistry
+
+	// Background workers (config watchers, health checkers, ...) run under
+	// ctx and are tracked by workers so Shutdown can wait for them
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
 }
 
 func initLogger() (*zap.SugaredLogger, error) {
@@ -36,27 +137,67 @@ func initLogger() (*zap.SugaredLogger, error) {
 	return logger.Sugar(), nil
 }
 
-func NewServer(cfg Config, logger zap.SugaredLogger) *Server {
+// redis may be nil, in which case only the default routes are served
+func NewServer(cfg Config, logger zap.SugaredLogger, redis *Redis) *Server {
+	cfg, applied := cfg.withDefaults()
+	if len(applied) > 0 {
+		logger.Infow("applied default server config", "fields", applied)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		Config: cfg,
 		router: http.NewServeMux(),
+		redis:  redis,
 		logger: &logger,
+		ctx:    ctx,
+		cancel: cancel,
+
+		transformers: NewTransformerRegistry(),
 	}
 }
 
+// Transformers is where request/response transformers are registered for
+// routes to use by name. Register them before InitializeRoutes
+func (s *Server) Transformers() *TransformerRegistry {
+	return s.transformers
+}
+
+// Go runs fn as a background worker. fn must return once ctx is canceled
+func (s *Server) Go(fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.ctx)
+	}()
+}
+
 func (s *Server) Start() error {
-	server := &http.Server{
-		Addr:           s.ListenAddr,
-		Handler:        s.router,
-		ReadTimeout:    s.ReadTimeout,
-		WriteTimeout:   s.WriteTimeout,
-		IdleTimeout:    s.IdleTimeout,
-		MaxHeaderBytes: s.MaxHeaderBytes,
+	normalize, err := NormalizePath(s.NormalizePath)
+	if err != nil {
+		return err
+	}
+
+	var errorPages *ErrorRenderer
+	if s.routes != nil {
+		errorPages = s.routes.errorPages
+	}
+	timeout := TimeoutMiddleware(s.RequestTimeout, errorPages)
+
+	s.httpServer = &http.Server{
+		Addr:              s.ListenAddr,
+		Handler:           RequestID(timeout(UpstreamAttempts(s.MaxUpstreamAttempts)(MaxURILength(s.MaxURILength)(normalize(s.router))))),
+		ReadTimeout:       s.ReadTimeout,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		MaxHeaderBytes:    s.MaxHeaderBytes,
 	}
+	s.httpServer.SetKeepAlivesEnabled(!s.DisableKeepAlives)
 
 	go func() {
 		s.logger.Info("Starting server on port ", s.ListenAddr)
-		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
 			s.logger.Fatal("Server failed: ", err)
 		}
 	}()
@@ -68,7 +209,60 @@ func (s *Server) Start() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	return server.Shutdown(ctx)
+	return s.Shutdown(ctx)
+}
+
+// SetKeepAlivesEnabled toggles keep-alives on the running server. Once
+// disabled, each connection is closed after its current response. Before
+// Start, use Config.DisableKeepAlives
+func (s *Server) SetKeepAlivesEnabled(enabled bool) {
+	s.DisableKeepAlives = !enabled
+	if s.httpServer != nil {
+		s.httpServer.SetKeepAlivesEnabled(enabled)
+	}
+}
+
+// Shutdown stops accepting connections and drains in-flight requests, then
+// stops the background workers and waits for them to exit, all within ctx,
+// and finally closes the Redis clients. Keep-alives are turned off first so
+// clients mid-conversation are told to close their connection with their
+// last response rather than having it cut. The StateMonitor reports the
+// gateway as draining from the start. Every step runs even if an earlier
+// one failed, and all their errors are returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if s.state != nil {
+		s.state.SetDraining(true)
+	}
+	if s.httpServer != nil {
+		s.httpServer.SetKeepAlivesEnabled(false)
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("draining requests: %w", err))
+		}
+	}
+
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for background workers: %w", ctx.Err()))
+	}
+
+	// Last, requests and workers may use it until they're done
+	if s.redis != nil {
+		if err := s.redis.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing redis: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func main() {
@@ -78,6 +272,12 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		IdleTimeout:    30 * time.Second,
 		MaxHeaderBytes: 1 << 20, // 1mb
+		MaxURILength:   8 << 10, // 8kb
+
+		ProxyBufferSize:  32 << 10, // 32kb
+		CacheReadTimeout: 50 * time.Millisecond,
+		AdminToken:       os.Getenv("ADMIN_TOKEN"),
+		AuditStream:      "audit:config",
 	}
 
 	logger, err := initLogger()
@@ -85,7 +285,12 @@ func main() {
 		panic("initializing logger")
 	}
 
-	server := NewServer(cfg, *logger)
+	redis, err := NewRedis(logger)
+	if err != nil {
+		logger.Warnw("redis not configured, serving default routes only", "error", err)
+	}
+
+	server := NewServer(cfg, *logger, redis)
 	server.InitializeRoutes()
 
 	if err := server.Start(); err != nil {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestShutdownStopsWorkers(t *testing.T) {
+	s := NewServer(Config{}, *testLogger(), nil)
+
+	var running atomic.Int32
+	for i := 0; i < 3; i++ {
+		started := make(chan struct{})
+		s.Go(func(ctx context.Context) {
+			running.Add(1)
+			defer running.Add(-1)
+			close(started)
+			<-ctx.Done()
+			// Cleanup after cancellation still counts as the worker running
+			time.Sleep(10 * time.Millisecond)
+		})
+		<-started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := running.Load(); got != 0 {
+		t.Errorf("%d workers still running after Shutdown returned", got)
+	}
+}
+
+func TestShutdownGivesUpOnStuckWorkers(t *testing.T) {
+	s := NewServer(Config{}, *testLogger(), nil)
+	release := make(chan struct{})
+	defer close(release)
+	s.Go(func(ctx context.Context) {
+		<-release // Ignores ctx
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the shutdown deadline", err)
+	}
+}
+
+// Redis stays usable for requests still draining and is closed once they're done
+func TestShutdownClosesRedisAfterDraining(t *testing.T) {
+	r, _ := newTestRedis(t)
+	s := NewServer(Config{}, *testLogger(), r)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var handlerErr error
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(entered)
+		<-release
+		handlerErr = r.Set("draining", "1", 0)
+	}))
+	s.httpServer = upstream.Config
+	upstream.Start()
+	defer upstream.Close()
+
+	go func() {
+		if response, err := upstream.Client().Get(upstream.URL); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	default:
+	}
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if handlerErr != nil {
+		t.Errorf("draining request's redis call failed: %v", handlerErr)
+	}
+	if err := r.Set("after", "1", 0); err == nil {
+		t.Error("redis still usable after Shutdown returned")
+	}
+}
+
+// Every failing step is reported, not just the first
+func TestShutdownJoinsErrors(t *testing.T) {
+	r, server := newTestRedis(t)
+	s := NewServer(Config{}, *testLogger(), r)
+	release := make(chan struct{})
+	defer close(release)
+	s.Go(func(ctx context.Context) {
+		<-release
+	})
+	r.Close() // Closing it a second time fails
+	server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the shutdown deadline", err)
+	}
+	if !strings.Contains(fmt.Sprint(err), "closing redis") {
+		t.Errorf("err = %v, want the redis close failure too", err)
+	}
+}
+
+func TestZeroConfigGetsDefaults(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	s := NewServer(Config{}, *zap.New(core).Sugar(), nil)
+
+	if s.ListenAddr != defaultConfig.ListenAddr {
+		t.Errorf("ListenAddr = %q, want %q", s.ListenAddr, defaultConfig.ListenAddr)
+	}
+	if s.ReadTimeout != defaultConfig.ReadTimeout || s.WriteTimeout != defaultConfig.WriteTimeout || s.IdleTimeout != defaultConfig.IdleTimeout {
+		t.Errorf("timeouts = %v/%v/%v, want the defaults", s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+	if want := defaultConfig.WriteTimeout * 9 / 10; s.RequestTimeout != want {
+		t.Errorf("RequestTimeout = %v, want %v", s.RequestTimeout, want)
+	}
+	if s.MaxHeaderBytes != defaultConfig.MaxHeaderBytes || s.MaxURILength != defaultConfig.MaxURILength {
+		t.Errorf("limits = %d/%d, want the defaults", s.MaxHeaderBytes, s.MaxURILength)
+	}
+
+	entries := logs.FilterMessage("applied default server config").All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d default config log lines, want 1", len(entries))
+	}
+	fields, _ := entries[0].ContextMap()["fields"].([]interface{})
+	if len(fields) != 7 {
+		t.Errorf("defaulted fields = %v, want all 7", fields)
+	}
+}
+
+func TestExplicitConfigKeepsValues(t *testing.T) {
+	cfg := Config{
+		ListenAddr:     ":9090",
+		ReadTimeout:    time.Second,
+		WriteTimeout:   2 * time.Second,
+		RequestTimeout: time.Second,
+		IdleTimeout:    3 * time.Second,
+		MaxHeaderBytes: 4096,
+		MaxURILength:   1024,
+	}
+	got, applied := cfg.withDefaults()
+	if len(applied) != 0 {
+		t.Errorf("applied = %v, want nothing defaulted", applied)
+	}
+	if got.ListenAddr != cfg.ListenAddr || got.ReadTimeout != cfg.ReadTimeout || got.WriteTimeout != cfg.WriteTimeout ||
+		got.RequestTimeout != cfg.RequestTimeout || got.IdleTimeout != cfg.IdleTimeout ||
+		got.MaxHeaderBytes != cfg.MaxHeaderBytes || got.MaxURILength != cfg.MaxURILength {
+		t.Errorf("withDefaults changed explicit values: %+v", got)
+	}
+}
+
+func TestSetKeepAlivesEnabled(t *testing.T) {
+	s := NewServer(Config{}, *testLogger(), nil)
+	var conns atomic.Int32
+	upstream := httptest.NewUnstartedServer(okHandler())
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	s.httpServer = upstream.Config
+	upstream.Start()
+	defer upstream.Close()
+
+	client := upstream.Client()
+	get := func() *http.Response {
+		t.Helper()
+		response, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		return response
+	}
+
+	get()
+	get()
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("%d connections with keep-alives on, want 1 reused", got)
+	}
+
+	// Idle connections are closed straight away, busy ones after their
+	// next response
+	s.SetKeepAlivesEnabled(false)
+	if !s.DisableKeepAlives {
+		t.Error("DisableKeepAlives not updated")
+	}
+	for range 3 {
+		if response := get(); !response.Close {
+			t.Error("response didn't ask the client to close the connection")
+		}
+	}
+	if got := conns.Load() - 1; got != 3 {
+		t.Errorf("%d connections after disabling keep-alives, want a new one per request", got)
+	}
+}
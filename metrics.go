@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Exposed on /metrics
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lattice",
+	Name:      "cache_lookups_total",
+	Help:      "Response cache lookups by route and result (hit, miss, coalesced, bypass, timeout, error, canceled).",
+}, []string{"route", "result"})
+
+var clientRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "lattice",
+	Name:      "client_request_duration_seconds",
+	Help:      "Outbound HttpClient request latency by method and status.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method", "status"})
+
+var routeReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lattice",
+	Name:      "route_reloads_total",
+	Help:      "Route table reloads by result (success, failure).",
+}, []string{"result"})
+
+var breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "lattice",
+	Name:      "circuit_breaker_state",
+	Help:      "Circuit breaker state by target (0 closed, 1 open, 2 half-open).",
+}, []string{"target"})
+
+var outlierEjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "lattice",
+	Name:      "outlier_ejected",
+	Help:      "Whether each target is currently ejected by outlier detection (1) or not (0).",
+}, []string{"target"})
+
+var outlierEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lattice",
+	Name:      "outlier_ejections_total",
+	Help:      "Times each target has been ejected by outlier detection.",
+}, []string{"target"})
+
+var gatewayState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "lattice",
+	Name:      "gateway_state",
+	Help:      "1 for the gateway's current state (ok, degraded, draining), 0 for the others.",
+}, []string{"state"})
+
+var sloCompliance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "lattice",
+	Name:      "slo_compliance_ratio",
+	Help:      "Share of each route's requests within its SLO target latency over the rolling window.",
+}, []string{"route"})
+
+// 64 bytes to 16mb
+var sizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+var requestSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "lattice",
+	Name:      "request_size_bytes",
+	Help:      "Request body bytes read from clients by route.",
+	Buckets:   sizeBuckets,
+}, []string{"route"})
+
+var responseSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "lattice",
+	Name:      "response_size_bytes",
+	Help:      "Response body bytes written to clients by route, after compression.",
+	Buckets:   sizeBuckets,
+}, []string{"route"})
+
+var breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "lattice",
+	Name:      "circuit_breaker_trips_total",
+	Help:      "Times each target's circuit breaker has opened.",
+}, []string{"target"})
@@ -1,9 +1,17 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,13 +30,196 @@ func Tower(h http.Handler, m ...Middleware) http.Handler {
 	return h
 }
 
+// Carries the request ID from the client, to upstreams and back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID tags every request with a correlation ID so gateway logs,
+// outbound HttpClient calls, upstream logs and error responses can be tied
+// together. A well-formed X-Request-ID from the client is kept, otherwise one
+// is generated. Requests that already carry an ID in their context (the
+// server applies RequestID ahead of the router) keep it. The ID goes in the
+// request's RequestContext, which RequestID adds to the context
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request, rc := ensureRequestContext(request)
+		id := rc.ID()
+		if id == "" {
+			id = request.Header.Get(RequestIDHeader)
+		}
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		rc.set(func() { rc.id = id })
+
+		request.Header.Set(RequestIDHeader, id)
+		writer.Header().Set(RequestIDHeader, id)
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// WithCorrelationID sets the ID in ctx's RequestContext, adding one if ctx
+// has none
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	rc := RequestContextFrom(ctx)
+	if rc == nil {
+		rc = &RequestContext{}
+		ctx = WithRequestContext(ctx, rc)
+	}
+	rc.set(func() { rc.id = id })
+	return ctx
+}
+
+// Empty if the context doesn't belong to a request that went through RequestID
+func CorrelationID(ctx context.Context) string {
+	return RequestContextFrom(ctx).ID()
+}
+
+// Logger whose lines carry the request's correlation ID, if it has one
+func requestLogger(logger *zap.SugaredLogger, ctx context.Context) *zap.SugaredLogger {
+	if id := CorrelationID(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Client supplied IDs end up in logs and headers, so keep them short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Omitted from the line unless LogQuery is set and there is a query
+func (l *LoggerMiddleware) queryField(u *url.URL) zap.Field {
+	if query := l.query(u); query != "" {
+		return zap.String("query", query)
+	}
+	return zap.Skip()
+}
+
+// Parameters keep their order and encoding, only redacted values change
+func (l *LoggerMiddleware) query(u *url.URL) string {
+	if !l.LogQuery || u.RawQuery == "" {
+		return ""
+	}
+
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		name, _, hasValue := strings.Cut(param, "=")
+		if !hasValue {
+			continue
+		}
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		for _, redact := range l.RedactParams {
+			if strings.EqualFold(name, redact) {
+				params[i] = param[:strings.Index(param, "=")] + "=***"
+				break
+			}
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// clientIP extracts the IP from a RemoteAddr, which is usually host:port but
+// may be a bracketed IPv6 address or lack the port. IPs come back in
+// canonical form (IPv4-mapped IPv6 as plain IPv4); anything that isn't an IP
+// is returned as given so it still identifies the client
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(remoteAddr, "["), "]")
+	}
+	// Zones ("fe80::1%eth0") aren't part of the address
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if addr, _, found := strings.Cut(host, "%"); found {
+			ip = net.ParseIP(addr)
+		}
+	}
+	if ip == nil {
+		return remoteAddr
+	}
+	return ip.String()
+}
+
 type LoggerMiddleware struct {
 	logger *zap.SugaredLogger
+
+	// LogQuery adds the query string to each line, with the values of
+	// RedactParams (matched case-insensitively) replaced by ***
+	LogQuery     bool
+	RedactParams []string
+
+	// Headers added to each line, with their truncation and redaction. No
+	// others are logged
+	RequestHeaders  []LogHeader
+	ResponseHeaders []LogHeader
+}
+
+// Longest header value logged unless the LogHeader says otherwise
+const defaultLogHeaderLength = 256
+
+// The listed headers present in header, omitted if there are none
+func headersField(key string, header http.Header, listed []LogHeader) zap.Field {
+	values := make(map[string]string, len(listed))
+	for _, h := range listed {
+		name := http.CanonicalHeaderKey(h.Name)
+		if vals := header.Values(name); len(vals) > 0 {
+			values[name] = logHeaderValue(strings.Join(vals, ", "), h)
+		}
+	}
+	if len(values) == 0 {
+		return zap.Skip()
+	}
+	return zap.Any(key, values)
+}
+
+func logHeaderValue(value string, h LogHeader) string {
+	if h.Redact {
+		// Only a plain leading word is kept, Cookie's "name=value; ..." is not
+		// a scheme
+		scheme, _, found := strings.Cut(value, " ")
+		if found && scheme != "" && !strings.ContainsAny(scheme, "=;,:") {
+			return scheme + " ***"
+		}
+		return "***"
+	}
+
+	maxLength := h.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultLogHeaderLength
+	}
+	if len(value) > maxLength {
+		return strings.ToValidUTF8(value[:maxLength], "") + "..."
+	}
+	return value
 }
 
 type responseWriter struct {
 	http.ResponseWriter
-	status int
+	status   int
+	bytes    int64 // Body bytes written
+	writeErr error // First failed write or flush, usually the client gone
+
+	// Called once if the response turns out to be long-lived (hijacked for
+	// an upgrade, or flushed as an event stream)
+	onStream  func(kind string)
+	streaming bool
 }
 
 func NewLoggerMiddleware() (*LoggerMiddleware, error) {
@@ -45,35 +236,248 @@ func NewLoggerMiddleware() (*LoggerMiddleware, error) {
 	}, nil
 }
 
+// LogHandler logs one line per request once it completes. Upgraded
+// (WebSocket) and event-stream connections can stay open for hours, so those
+// log an opened event as soon as they're detected and a closed event with the
+// connection's duration at the end. Requests cut short, by the client going
+// away mid-response or the handler aborting (ReverseProxy does when it can't
+// finish copying a body), log an aborted line instead, with
+// client_disconnected telling the two apart
 func (l *LoggerMiddleware) LogHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		// As the client sent them, before later middleware adds its own
+		requestHeaders := headersField("request_headers", r.Header, l.RequestHeaders)
 
 		// Wrap response writer to capture status code
-		wrw := &responseWriter{w, http.StatusOK}
+		wrw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		wrw.onStream = func(kind string) {
+			l.logger.Infow("http stream opened",
+				zap.String("request_id", CorrelationID(r.Context())),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				l.queryField(r.URL),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("client_ip", clientIP(r.RemoteAddr)),
+				zap.String("kind", kind),
+				requestHeaders,
+				zap.Int("status", wrw.status),
+				headersField("response_headers", wrw.Header(), l.ResponseHeaders),
+				zap.Duration("latency", time.Since(start)),
+			)
+		}
 
+		completed := false
+		defer func() {
+			// Panicking, ErrAbortHandler or otherwise; the panic carries on
+			if !completed {
+				l.logAborted(r, requestHeaders, wrw, start)
+			}
+		}()
 		next.ServeHTTP(wrw, r)
+		completed = true
 
-		l.logger.Info("http request",
+		if !wrw.streaming && wrw.clientDisconnected(r) {
+			l.logAborted(r, requestHeaders, wrw, start)
+			return
+		}
+
+		if wrw.streaming {
+			l.logger.Infow("http stream closed",
+				zap.String("request_id", CorrelationID(r.Context())),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				l.queryField(r.URL),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("client_ip", clientIP(r.RemoteAddr)),
+				requestHeaders,
+				zap.Int("status", wrw.status),
+				zap.Bool("client_disconnected", wrw.clientDisconnected(r)),
+				zap.Duration("duration", time.Since(start)),
+			)
+			return
+		}
+
+		l.logger.Infow("http request",
+			zap.String("request_id", CorrelationID(r.Context())),
 			zap.String("method", r.Method),
 			zap.String("path", r.URL.Path),
+			l.queryField(r.URL),
 			zap.String("remote_addr", r.RemoteAddr),
+			zap.String("client_ip", clientIP(r.RemoteAddr)),
+			requestHeaders,
 			zap.Int("status", wrw.status),
+			headersField("response_headers", wrw.Header(), l.ResponseHeaders),
+			zap.Int64("bytes", wrw.bytes),
 			zap.Duration("latency", time.Since(start)),
 		)
 	})
 }
 
+// For requests that didn't complete normally. The status is what was sent
+// before it was cut short, bytes how much of the body got out
+func (l *LoggerMiddleware) logAborted(r *http.Request, requestHeaders zap.Field, wrw *responseWriter, start time.Time) {
+	writeError := zap.Skip()
+	if wrw.writeErr != nil {
+		writeError = zap.String("write_error", wrw.writeErr.Error())
+	}
+	l.logger.Warnw("http request aborted",
+		zap.String("request_id", CorrelationID(r.Context())),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		l.queryField(r.URL),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("client_ip", clientIP(r.RemoteAddr)),
+		requestHeaders,
+		zap.Int("status", wrw.status),
+		headersField("response_headers", wrw.Header(), l.ResponseHeaders),
+		zap.Int64("bytes", wrw.bytes),
+		zap.Bool("client_disconnected", wrw.clientDisconnected(r)),
+		writeError,
+		zap.Duration("latency", time.Since(start)),
+	)
+}
+
+// Trailer names a response declared up front in its Trailer header
+func announcedTrailers(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// The trailers a handler has set once it's done: the announced names, and
+// any set with http.TrailerPrefix without being announced. Header is left as
+// it is
+func trailerValues(header http.Header, announced []string) http.Header {
+	trailers := make(http.Header)
+	for _, name := range announced {
+		if values, ok := header[name]; ok {
+			trailers[name] = append([]string(nil), values...)
+		}
+	}
+	for key, values := range header {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	return trailers
+}
+
+// SizeMetrics records each request's body size, as read from the client,
+// and its response body size in lattice_request_size_bytes and
+// lattice_response_size_bytes. Upgraded connections aren't recorded, their
+// bytes never pass through a ResponseWriter
+func SizeMetrics(route string) Middleware {
+	requestSize := requestSizes.WithLabelValues(route)
+	responseSize := responseSizes.WithLabelValues(route)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &countingBody{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+			wrw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(wrw, r)
+
+			if wrw.status == http.StatusSwitchingProtocols {
+				return
+			}
+			requestSize.Observe(float64(body.bytes))
+			responseSize.Observe(float64(wrw.bytes))
+		})
+	}
+}
+
+// Counts the bytes read through it
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
 func (rw *responseWriter) WriteHeader(code int) {
-	rw.status = code
+	// Informational responses like 103 Early Hints precede the real one
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		rw.status = code
+	}
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	if err != nil && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+// Whether the response failed to reach the client, or the client gave up on
+// the request before it was answered. Requests the gateway timed out don't
+// count
+func (rw *responseWriter) clientDisconnected(r *http.Request) bool {
+	return rw.writeErr != nil || errors.Is(r.Context().Err(), context.Canceled) && !timedOut(r.Context())
+}
+
+// Flush lets streamed (chunked, SSE) responses reach the client as they are
+// written instead of sitting in the server's buffer until the handler returns
+func (rw *responseWriter) Flush() {
+	if strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream") {
+		rw.markStreaming("event-stream")
+	}
+	err := http.NewResponseController(rw.ResponseWriter).Flush()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+}
+
+// Hijack is how ReverseProxy takes over the connection for protocol
+// upgrades. It writes the 101 to the raw connection itself, so the status is
+// recorded here
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	rw.status = http.StatusSwitchingProtocols
+	rw.markStreaming("upgrade")
+	return conn, buf, nil
+}
+
+func (rw *responseWriter) markStreaming(kind string) {
+	if rw.streaming {
+		return
+	}
+	rw.streaming = true
+	if rw.onStream != nil {
+		rw.onStream(kind)
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Access-Control-Allow-Origin", "*")
 		writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		// The X-Grpc-Web and X-User-Agent headers gRPC-Web clients send, see
+		// GRPCWebMiddleware
+		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Grpc-Web, X-User-Agent, Grpc-Timeout")
 		if request.Method == "OPTIONS" {
 			writer.WriteHeader(http.StatusOK)
 			return
@@ -82,6 +486,144 @@ func CORS(next http.Handler) http.Handler {
 	})
 }
 
+// SecurityHeadersMiddleware sets the configured security headers on every
+// response. Values are resolved once, when the route is built
+func SecurityHeadersMiddleware(cfg SecurityHeaders) Middleware {
+	headers := [][2]string{
+		{"X-Content-Type-Options", securityHeaderValue(cfg.ContentTypeOptions, "nosniff")},
+		{"X-Frame-Options", securityHeaderValue(cfg.FrameOptions, "DENY")},
+		{"Referrer-Policy", securityHeaderValue(cfg.ReferrerPolicy, "strict-origin-when-cross-origin")},
+		{"Content-Security-Policy", securityHeaderValue(cfg.ContentSecurityPolicy, "")},
+	}
+	hsts := securityHeaderValue(cfg.StrictTransport, "max-age=31536000; includeSubDomains")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			header := writer.Header()
+			for _, h := range headers {
+				if h[1] != "" {
+					header.Set(h[0], h[1])
+				}
+			}
+			// Browsers ignore HSTS over plain HTTP, and sending it there would
+			// advertise a policy the connection can't back up
+			if hsts != "" && isHTTPS(request) {
+				header.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func securityHeaderValue(configured string, fallback string) string {
+	switch configured {
+	case "":
+		return fallback
+	case "off":
+		return ""
+	default:
+		return configured
+	}
+}
+
+// TLS terminated here, or by a load balancer in front that says so
+func isHTTPS(request *http.Request) bool {
+	return request.TLS != nil || strings.EqualFold(request.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Methods are case-sensitive, so "get" is not GET
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// MaxURILength answers 414 to requests whose URI, path and query together,
+// is longer than limit bytes. Zero or negative allows any length
+func MaxURILength(limit int) Middleware {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			uri := request.RequestURI
+			if uri == "" {
+				uri = request.URL.RequestURI()
+			}
+			if len(uri) > limit {
+				http.Error(writer, "URI too long", http.StatusRequestURITooLong)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// ValidateMethod rejects requests whose method isn't a standard HTTP method,
+// lowercase spellings included, before they reach route matching or the
+// upstream
+func ValidateMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !knownMethods[request.Method] {
+			http.Error(writer, "Invalid request method", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// Methods a MethodOverride may turn a POST into
+var overridableMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+const defaultMethodOverrideHeader = "X-HTTP-Method-Override"
+
+// MethodOverrideMiddleware turns POST requests carrying the override header
+// into the method it names, before the rest of the route sees them. The
+// header is removed so the upstream doesn't apply it a second time. Methods
+// the route doesn't allow get 400; other requests pass through untouched
+func MethodOverrideMiddleware(cfg MethodOverride) (Middleware, error) {
+	header := cfg.Header
+	if header == "" {
+		header = defaultMethodOverrideHeader
+	}
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = overridableMethods
+	}
+	allowed := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		method = strings.ToUpper(method)
+		if !slices.Contains(overridableMethods, method) {
+			return nil, fmt.Errorf("method override to %s not allowed, only %s", method, strings.Join(overridableMethods, ", "))
+		}
+		allowed[method] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			override := strings.TrimSpace(request.Header.Get(header))
+			if request.Method != http.MethodPost || override == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			method := strings.ToUpper(override)
+			if !allowed[method] {
+				http.Error(writer, "Method override not allowed", http.StatusBadRequest)
+				return
+			}
+			request.Header.Del(header)
+			request.Method = method
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
+
 func MethodMiddleware(allowedMethods []string) Middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -111,6 +653,68 @@ func MethodMiddleware(allowedMethods []string) Middleware {
 	}
 }
 
+// MaintenanceMiddleware answers every request with a 503 instead of passing
+// it on, for routes that have been taken offline
+func MaintenanceMiddleware(message string, errorPages *ErrorRenderer) Middleware {
+	if message == "" {
+		message = "Service temporarily unavailable for maintenance"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			errorPages.Render(writer, request, http.StatusServiceUnavailable, message)
+		})
+	}
+}
+
+const (
+	AdminTokenHeader    = "X-Lattice-Admin-Token"
+	RouteOverrideHeader = "X-Lattice-Route-Override"
+)
+
+// RouteOverrideMiddleware sends a single request to the upstream named in
+// X-Lattice-Route-Override instead of the route's own target, for debugging
+// specific backends. The header is only honored alongside a valid admin
+// token, never when adminToken is empty, and both headers are stripped
+// before anything is proxied
+func RouteOverrideMiddleware(adminToken string, logger *zap.SugaredLogger, proxyTo func(*url.URL) http.Handler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			override := request.Header.Get(RouteOverrideHeader)
+			token := request.Header.Get(AdminTokenHeader)
+			request.Header.Del(RouteOverrideHeader)
+			request.Header.Del(AdminTokenHeader)
+
+			if override == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			if !validAdminToken(token, adminToken) {
+				logger.Warnw("ignoring route override without valid admin token",
+					"request_id", CorrelationID(request.Context()),
+					"path", request.URL.Path,
+					"override", override,
+					"remote_addr", request.RemoteAddr)
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			target, err := url.Parse(override)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				http.Error(writer, "invalid route override", http.StatusBadRequest)
+				return
+			}
+
+			logger.Warnw("routing request to override target",
+				"request_id", CorrelationID(request.Context()),
+				"path", request.URL.Path,
+				"override", target.String(),
+				"remote_addr", request.RemoteAddr)
+			proxyTo(target).ServeHTTP(writer, request)
+		})
+	}
+}
+
 type User struct {
 	Username string
 	Password string
@@ -120,11 +724,12 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	var u User
-	json.NewDecoder(r.Body).Decode(&u)
+	if err := decodeJSONBody(w, r, &u); err != nil {
+		return
+	}
 
-	// TODO: adapt to reading auth from a configurable database
-	// use repository pattern for DB access, with ENV variables for table to query
-	if u.Username == "admin" && u.Password == "123456" {
+	// TODO: use repository pattern for DB access, with ENV variables for table to query
+	if checkCredentials(u.Username, u.Password) {
 		tokenString, err := createToken(u.Username)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -140,18 +745,32 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 func ProtectedHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="lattice"`)
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, "missing authorization header")
 		return
 	}
-	tokenString = tokenString[len("Bearer "):]
 
-	err := verifyToken(tokenString)
-	if err != nil {
+	scheme, credentials, ok := parseAuthorization(header)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "malformed authorization header")
+		return
+	}
+
+	verify, ok := authVerifiers[scheme]
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="lattice"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "unsupported authorization scheme")
+		return
+	}
+
+	if err := verify(credentials); err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "invalid token")
+		fmt.Fprint(w, "invalid credentials")
 		return
 	}
 
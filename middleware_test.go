@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProtectedHandler(t *testing.T) {
+	token, err := createToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte("admin:123456"))
+	wrongPassword := base64.StdEncoding.EncodeToString([]byte("admin:wrong"))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"scheme only", "Bearer", http.StatusUnauthorized},
+		{"short", "B", http.StatusUnauthorized},
+		{"blank credentials", "Bearer   ", http.StatusUnauthorized},
+		{"wrong scheme", "Digest " + token, http.StatusUnauthorized},
+		{"invalid token", "Bearer not-a-jwt", http.StatusUnauthorized},
+		{"wrong basic password", "Basic " + wrongPassword, http.StatusUnauthorized},
+		{"valid bearer", "Bearer " + token, http.StatusOK},
+		{"lowercase scheme", "bearer " + token, http.StatusOK},
+		{"valid basic", "Basic " + basic, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			response := httptest.NewRecorder()
+			ProtectedHandler(response, request)
+
+			if response.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %q)", response.Code, tt.want, response.Body.String())
+			}
+		})
+	}
+}
+
+func newObservedLogger() (*LoggerMiddleware, *observer.ObservedLogs) {
+	core, logs := observer.New(zap.InfoLevel)
+	return &LoggerMiddleware{logger: zap.New(core).Sugar()}, logs
+}
+
+// Waits for a line with message to be logged, the closed event can land just
+// after the client sees the connection end
+func waitForLog(t *testing.T, logs *observer.ObservedLogs, message string) observer.LoggedEntry {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries := logs.FilterMessage(message).All(); len(entries) > 0 {
+			return entries[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%q was never logged, got %v", message, logs.All())
+	return observer.LoggedEntry{}
+}
+
+func TestLogHandlerUpgradedConnection(t *testing.T) {
+	logger, logs := newObservedLogger()
+	server := httptest.NewServer(logger.LogHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, buf, err := http.NewResponseController(writer).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		buf.Flush()
+		// Echo one line, then hang up
+		line, _ := buf.ReadString('\n')
+		buf.WriteString(line)
+		buf.Flush()
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: lattice\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", response.StatusCode)
+	}
+
+	opened := waitForLog(t, logs, "http stream opened")
+	if got := opened.ContextMap()["kind"]; got != "upgrade" {
+		t.Errorf("opened kind = %v, want upgrade", got)
+	}
+	if got := opened.ContextMap()["status"]; got != int64(http.StatusSwitchingProtocols) {
+		t.Errorf("opened status = %v, want 101", got)
+	}
+	if logs.FilterMessage("http stream closed").Len() != 0 {
+		t.Error("closed was logged while the connection was still open")
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	if line, _ := reader.ReadString('\n'); line != "ping\n" {
+		t.Errorf("echoed %q, want ping", line)
+	}
+	closed := waitForLog(t, logs, "http stream closed")
+	if got := closed.ContextMap()["path"]; got != "/ws" {
+		t.Errorf("closed path = %v, want /ws", got)
+	}
+	if _, ok := closed.ContextMap()["duration"]; !ok {
+		t.Error("closed event has no duration")
+	}
+	if logs.FilterMessage("http request").Len() != 0 {
+		t.Error("upgraded connection was also logged as a plain request")
+	}
+}
+
+func TestLogHandlerEventStream(t *testing.T) {
+	logger, logs := newObservedLogger()
+	handler := logger.LogHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(writer, "data: one\n\n")
+		writer.(http.Flusher).Flush()
+		if logs.FilterMessage("http stream opened").Len() != 1 {
+			t.Error("opened wasn't logged on the first flush")
+		}
+		fmt.Fprint(writer, "data: two\n\n")
+		writer.(http.Flusher).Flush()
+	}))
+	serve(handler, httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	if got := logs.FilterMessage("http stream opened").Len(); got != 1 {
+		t.Errorf("opened logged %d times, want once", got)
+	}
+	if got := logs.FilterMessage("http stream opened").All()[0].ContextMap()["kind"]; got != "event-stream" {
+		t.Errorf("opened kind = %v, want event-stream", got)
+	}
+	if got := logs.FilterMessage("http stream closed").Len(); got != 1 {
+		t.Errorf("closed logged %d times, want once", got)
+	}
+}
+
+func TestLogHandlerClientDisconnect(t *testing.T) {
+	logger, logs := newObservedLogger()
+	firstChunk := make(chan struct{})
+	server := httptest.NewServer(logger.LogHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		chunk := []byte(strings.Repeat("x", 1024) + "\n")
+		writer.Write(chunk)
+		writer.(http.Flusher).Flush()
+		close(firstChunk)
+		// Keep writing until the write fails with the client gone
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := writer.Write(chunk); err != nil {
+				return
+			}
+			writer.(http.Flusher).Flush()
+		}
+		t.Error("writes never failed after the client hung up")
+	})))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /download HTTP/1.1\r\nHost: lattice\r\n\r\n")
+	<-firstChunk
+	conn.Close()
+
+	aborted := waitForLog(t, logs, "http request aborted")
+	fields := aborted.ContextMap()
+	if fields["client_disconnected"] != true {
+		t.Errorf("client_disconnected = %v, want true", fields["client_disconnected"])
+	}
+	if fields["status"] != int64(http.StatusOK) {
+		t.Errorf("status = %v, want the 200 that was sent", fields["status"])
+	}
+	if bytes, _ := fields["bytes"].(int64); bytes < 1025 {
+		t.Errorf("bytes = %v, want at least the first chunk", fields["bytes"])
+	}
+	if _, ok := fields["write_error"]; !ok {
+		t.Error("aborted line has no write_error")
+	}
+	if logs.FilterMessage("http request").Len() != 0 {
+		t.Error("disconnected request was also logged as completed")
+	}
+}
+
+// The handler giving up isn't the client's doing
+func TestLogHandlerAbortedHandler(t *testing.T) {
+	logger, logs := newObservedLogger()
+	handler := logger.LogHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	}))
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want the panic to carry on", recovered)
+			}
+		}()
+		serve(handler, httptest.NewRequest(http.MethodGet, "/download", nil))
+	}()
+
+	if logs.FilterMessage("http request aborted").Len() != 1 {
+		t.Fatalf("got %v, want one aborted line", logs.All())
+	}
+	fields := logs.FilterMessage("http request aborted").All()[0].ContextMap()
+	if fields["client_disconnected"] != false || fields["bytes"] != int64(len("partial")) {
+		t.Errorf("client_disconnected %v, bytes %v, want false and 7", fields["client_disconnected"], fields["bytes"])
+	}
+
+	serve(logger.LogHandler(okHandler()), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	if logs.FilterMessage("http request").Len() != 1 || logs.FilterMessage("http request aborted").Len() != 1 {
+		t.Errorf("a completed request logged %v, want one http request line", logs.All())
+	}
+}
+
+func TestLogHeaders(t *testing.T) {
+	logger, logs := newObservedLogger()
+	logger.RequestHeaders = []LogHeader{
+		{Name: "authorization", Redact: true},
+		{Name: "Cookie", Redact: true},
+		{Name: "X-Trace", MaxLength: 8},
+		{Name: "X-Absent"},
+	}
+	logger.ResponseHeaders = []LogHeader{{Name: "X-Upstream"}}
+	handler := logger.LogHandler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Upstream", "orders-2")
+		writer.Header().Set("X-Internal", "secret")
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	request.Header.Set("Authorization", "Bearer "+strings.Repeat("e", 600))
+	request.Header.Set("Cookie", "session=abc; theme=dark")
+	request.Header.Add("X-Trace", "0123456789abcdef")
+	request.Header.Set("X-Api-Key", "not listed")
+	serve(handler, request)
+
+	fields := waitForLog(t, logs, "http request").ContextMap()
+	wantRequest := map[string]string{
+		"Authorization": "Bearer ***",
+		"Cookie":        "***",
+		"X-Trace":       "01234567...",
+	}
+	if got := fields["request_headers"]; !reflect.DeepEqual(got, wantRequest) {
+		t.Errorf("request_headers = %v, want %v", got, wantRequest)
+	}
+	if got := fields["response_headers"]; !reflect.DeepEqual(got, map[string]string{"X-Upstream": "orders-2"}) {
+		t.Errorf("response_headers = %v, want only X-Upstream", got)
+	}
+}
+
+func TestLogHeaderValue(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		header LogHeader
+		want   string
+	}{
+		{"Basic dXNlcjpwYXNz", LogHeader{Redact: true}, "Basic ***"},
+		{"rawtoken", LogHeader{Redact: true}, "***"},
+		{"a=b; c=d", LogHeader{Redact: true}, "***"},
+		{strings.Repeat("x", 300), LogHeader{}, strings.Repeat("x", 256) + "..."},
+		{"short", LogHeader{MaxLength: 5}, "short"},
+		// A cut through a multi-byte character drops what's left of it
+		{"héllo", LogHeader{MaxLength: 2}, "h..."},
+	} {
+		if got := logHeaderValue(tc.value, tc.header); got != tc.want {
+			t.Errorf("logHeaderValue(%q, %+v) = %q, want %q", tc.value, tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestLoggedHeadersNeedNames(t *testing.T) {
+	cfg := testRoute("/api", "http://localhost")
+	cfg.LogRequestHeaders = []LogHeader{{Redact: true}}
+	if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+		t.Error("route logging a header without a name was built")
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(writer, "%s %s", request.Method, request.Header.Get("X-HTTP-Method-Override"))
+	}))
+	defer upstream.Close()
+
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	for _, tc := range []struct {
+		name     string
+		override MethodOverride
+		method   string
+		header   string
+		want     string // What the upstream saw
+		status   int
+	}{
+		{"post becomes delete", MethodOverride{Enabled: true}, http.MethodPost, "delete", "DELETE ", http.StatusOK},
+		{"disabled", MethodOverride{}, http.MethodPost, "DELETE", "POST DELETE", http.StatusOK},
+		{"only posts", MethodOverride{Enabled: true}, http.MethodGet, "DELETE", "GET DELETE", http.StatusOK},
+		{"not in methods", MethodOverride{Enabled: true, Methods: []string{"DELETE"}}, http.MethodPost, "PUT", "", http.StatusBadRequest},
+		{"default header ignored", MethodOverride{Enabled: true, Header: "X-Method"}, http.MethodPost, "PATCH", "POST PATCH", http.StatusOK},
+	} {
+		cfg := testRoute("/items", upstream.URL)
+		cfg.MethodOverride = tc.override
+		request := httptest.NewRequest(tc.method, "/items/1", nil)
+		request.Header.Set("X-HTTP-Method-Override", tc.header)
+		response := serve(buildTestRoute(t, m, cfg), request)
+		if response.Code != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, response.Code, tc.status)
+			continue
+		}
+		if tc.status == http.StatusOK && response.Body.String() != tc.want {
+			t.Errorf("%s: upstream saw %q, want %q", tc.name, response.Body.String(), tc.want)
+		}
+	}
+
+	cfg := testRoute("/items", upstream.URL)
+	cfg.MethodOverride = MethodOverride{Enabled: true, Methods: []string{"GET"}}
+	if _, err := m.buildRoute(cfg); err == nil {
+		t.Error("route allowing an override to GET was built")
+	}
+}
+
+func TestRouteOverride(t *testing.T) {
+	routed := newTestUpstream(t, "route target")
+	var leaked atomic.Bool
+	override := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get(AdminTokenHeader) != "" || request.Header.Get(RouteOverrideHeader) != "" {
+			leaked.Store(true)
+		}
+		writer.Write([]byte("override target"))
+	}))
+	defer override.Close()
+
+	tests := []struct {
+		name       string
+		adminToken string // Configured on the gateway
+		token      string
+		override   string
+		wantStatus int
+		wantBody   string
+	}{
+		{"honored with token", "admin-secret", "admin-secret", override.URL, http.StatusOK, "override target"},
+		{"ignored without token", "admin-secret", "", override.URL, http.StatusOK, "route target"},
+		{"ignored with wrong token", "admin-secret", "guess", override.URL, http.StatusOK, "route target"},
+		{"ignored when no admin token is configured", "", "", override.URL, http.StatusOK, "route target"},
+		{"invalid target rejected", "admin-secret", "admin-secret", "ftp://example.com", http.StatusBadRequest, "invalid route override\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewRouteManager(Config{AdminToken: tt.adminToken}, nil, testLogger(), nil)
+			handler := buildTestRoute(t, m, testRoute("/svc", routed.URL))
+
+			request := httptest.NewRequest(http.MethodGet, "/svc", nil)
+			request.Header.Set(RouteOverrideHeader, tt.override)
+			if tt.token != "" {
+				request.Header.Set(AdminTokenHeader, tt.token)
+			}
+			response := serve(handler, request)
+
+			if response.Code != tt.wantStatus || response.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", response.Code, response.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+	if leaked.Load() {
+		t.Error("override target received the override or admin token headers")
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	configured := SecurityHeaders{
+		Enabled:               true,
+		StrictTransport:       "max-age=600",
+		FrameOptions:          "SAMEORIGIN",
+		ReferrerPolicy:        "off",
+		ContentSecurityPolicy: "default-src 'self'",
+	}
+	tests := []struct {
+		name  string
+		cfg   SecurityHeaders
+		https func(*http.Request)
+		want  map[string]string // Empty values must be absent
+	}{
+		{"defaults over HTTPS", SecurityHeaders{Enabled: true}, func(r *http.Request) { r.TLS = &tls.ConnectionState{} }, map[string]string{
+			"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "DENY",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+			"Content-Security-Policy":   "",
+		}},
+		{"configured behind a TLS-terminating proxy", configured, func(r *http.Request) { r.Header.Set("X-Forwarded-Proto", "https") }, map[string]string{
+			"Strict-Transport-Security": "max-age=600",
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "SAMEORIGIN",
+			"Referrer-Policy":           "",
+			"Content-Security-Policy":   "default-src 'self'",
+		}},
+		{"no HSTS over plaintext", configured, func(*http.Request) {}, map[string]string{
+			"Strict-Transport-Security": "",
+			"X-Frame-Options":           "SAMEORIGIN",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.https(request)
+			response := serve(SecurityHeadersMiddleware(tt.cfg)(okHandler()), request)
+
+			for name, want := range tt.want {
+				values := response.Header().Values(name)
+				switch {
+				case want == "" && len(values) > 0:
+					t.Errorf("%s = %q, want it unset", name, values)
+				case want != "" && (len(values) != 1 || values[0] != want):
+					t.Errorf("%s = %q, want %q", name, values, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"[::1]:1234", "::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:DB8:0:0::1]:443", "2001:db8::1"},
+		{"[::1]", "::1"},
+		{"::1", "::1"},
+		{"[fe80::1%eth0]:1234", "fe80::1"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		// Not IPs, passed through so they still identify the client
+		{"", ""},
+		{"@", "@"},
+		{"localhost:1234", "localhost:1234"},
+		{"192.0.2.1:80:80", "192.0.2.1:80:80"},
+		{"not an address", "not an address"},
+	}
+	for _, tt := range tests {
+		if got := clientIP(tt.remoteAddr); got != tt.want {
+			t.Errorf("clientIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+// One ID ties together the access log, the proxy's error log, the header the
+// upstream received and the error the client got
+func TestCorrelationIDEndToEnd(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received <- request.Header.Get(RequestIDHeader)
+		conn, _, _ := http.NewResponseController(writer).Hijack()
+		conn.Close()
+	}))
+	defer upstream.Close()
+
+	core, logs := observer.New(zap.InfoLevel)
+	m := NewRouteManager(Config{}, nil, zap.New(core).Sugar(), nil)
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.Retry.Attempts = 1
+	handler := RequestID(buildTestRoute(t, m, cfg))
+
+	request := httptest.NewRequest(http.MethodGet, "/svc", nil)
+	request.Header.Set("Accept", "application/json")
+	response := serve(handler, request)
+	if response.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", response.Code)
+	}
+
+	id := response.Header().Get(RequestIDHeader)
+	if id == "" {
+		t.Fatal("response has no X-Request-ID")
+	}
+	if got := <-received; got != id {
+		t.Errorf("upstream received ID %q, want %q", got, id)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body.RequestID != id {
+		t.Errorf("error body %q (%v), want request_id %q", response.Body, err, id)
+	}
+	for _, message := range []string{"http request", "proxy request failed"} {
+		entries := logs.FilterMessage(message).All()
+		if len(entries) != 1 || entries[0].ContextMap()["request_id"] != id {
+			t.Errorf("%q log lines = %v, want one with request_id %q", message, entries, id)
+		}
+	}
+}
+
+func TestValidateMethod(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantStatus int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodPatch, http.StatusOK},
+		{http.MethodOptions, http.StatusOK},
+		// Methods are case-sensitive, lowercase isn't normalized
+		{"get", http.StatusBadRequest},
+		{"Post", http.StatusBadRequest},
+		{"FROBNICATE", http.StatusBadRequest},
+		{"G3T!", http.StatusBadRequest},
+	}
+	handler := ValidateMethod(okHandler())
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Method = tt.method
+		if got := serve(handler, request).Code; got != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.method, got, tt.wantStatus)
+		}
+	}
+}
+
+// Invalid methods are turned away before the route sends anything upstream
+func TestInvalidMethodNotProxied(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusOK, &calls)
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.Methods = []string{http.MethodGet, http.MethodPost}
+	route := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	request := httptest.NewRequest(http.MethodGet, "/svc", nil)
+	request.Method = "get"
+	if got := serve(route, request).Code; got != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", got)
+	}
+	if calls.Load() != 0 {
+		t.Error("lowercase method reached the upstream")
+	}
+}
+
+func TestLogQueryRedaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		logQuery  bool
+		uri       string
+		wantQuery interface{} // nil when the line has no query field
+	}{
+		{"redacted", true, "/svc?user=alice&token=s3cret&page=2", "user=alice&token=***&page=2"},
+		{"case-insensitive", true, "/svc?API_KEY=abc&q=x", "API_KEY=***&q=x"},
+		{"encoded name", true, "/svc?api%5Fkey=abc", "api%5Fkey=***"},
+		{"repeated", true, "/svc?token=a&token=b", "token=***&token=***"},
+		{"kept encoding", true, "/svc?q=a%20b&token=x", "q=a%20b&token=***"},
+		{"no value", true, "/svc?token&debug", "token&debug"},
+		{"no query", true, "/svc", nil},
+		{"disabled", false, "/svc?token=s3cret", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, logs := newObservedLogger()
+			logger.LogQuery = tt.logQuery
+			logger.RedactParams = []string{"token", "api_key"}
+			serve(logger.LogHandler(okHandler()), httptest.NewRequest(http.MethodGet, tt.uri, nil))
+
+			entries := logs.FilterMessage("http request").All()
+			if len(entries) != 1 {
+				t.Fatalf("logged %d lines, want 1", len(entries))
+			}
+			fields := entries[0].ContextMap()
+			if got := fields["query"]; got != tt.wantQuery {
+				t.Errorf("query = %v, want %v", got, tt.wantQuery)
+			}
+			if fields["path"] != "/svc" {
+				t.Errorf("path = %v, want it without the query", fields["path"])
+			}
+		})
+	}
+}
+
+func TestMaxURILength(t *testing.T) {
+	handler := MaxURILength(32)(okHandler())
+	tests := []struct {
+		name string
+		uri  string
+		want int
+	}{
+		{"short", "/api/users?page=2", http.StatusOK},
+		{"at the limit", "/api/users?q=" + strings.Repeat("a", 32-len("/api/users?q=")), http.StatusOK},
+		{"long path", "/api/" + strings.Repeat("a", 40), http.StatusRequestURITooLong},
+		// The query counts towards the length
+		{"long query", "/api?q=" + strings.Repeat("a", 30), http.StatusRequestURITooLong},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := serve(handler, httptest.NewRequest(http.MethodGet, tc.uri, nil)).Code; got != tc.want {
+				t.Errorf("%d byte URI: status = %d, want %d", len(tc.uri), got, tc.want)
+			}
+		})
+	}
+
+	// No limit lets anything through
+	long := httptest.NewRequest(http.MethodGet, "/api?q="+strings.Repeat("a", 10000), nil)
+	if got := serve(MaxURILength(0)(okHandler()), long).Code; got != http.StatusOK {
+		t.Errorf("without a limit: status = %d, want 200", got)
+	}
+}
+
+// Exposition text for a size histogram of route holding one observation
+func sizeHistogramText(name string, help string, route string, observed float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, bound := range sizeBuckets {
+		count := 0
+		if observed <= bound {
+			count = 1
+		}
+		fmt.Fprintf(&b, "%s_bucket{route=%q,le=%q} %d\n", name, route, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(&b, "%s_bucket{route=%q,le=\"+Inf\"} 1\n", name, route)
+	fmt.Fprintf(&b, "%s_sum{route=%q} %g\n%s_count{route=%q} 1\n", name, route, observed, name, route)
+	return b.String()
+}
+
+func TestSizeMetrics(t *testing.T) {
+	// Histograms only add up, a fresh route keeps reruns from seeing old
+	// observations
+	route := fmt.Sprintf("/size-metrics-%d", time.Now().UnixNano())
+	upstream := newTestUpstream(t, strings.Repeat("r", 5000))
+	cfg := testRoute(route, upstream.URL)
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	response := serve(handler, httptest.NewRequest(http.MethodPost, route, strings.NewReader(strings.Repeat("q", 300))))
+	if response.Code != http.StatusOK || response.Body.Len() != 5000 {
+		t.Fatalf("got %d with %d bytes, want 200 with 5000", response.Code, response.Body.Len())
+	}
+
+	for _, tc := range []struct {
+		histogram *prometheus.HistogramVec
+		name      string
+		help      string
+		observed  float64
+	}{
+		{requestSizes, "lattice_request_size_bytes", "Request body bytes read from clients by route.", 300},
+		{responseSizes, "lattice_response_size_bytes", "Response body bytes written to clients by route, after compression.", 5000},
+	} {
+		series := tc.histogram.WithLabelValues(route).(prometheus.Histogram)
+		if err := testutil.CollectAndCompare(series, strings.NewReader(sizeHistogramText(tc.name, tc.help, route, tc.observed))); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
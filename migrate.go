@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Shape of RouteConfig written by this build. Bump it and register a
+// migration from the previous version whenever a stored field is renamed or
+// gets a default that its zero value can't express
+const currentSchemaVersion = 2
+
+// Upgrades a raw config document from the keyed version to the next one
+type configMigration func(doc map[string]interface{}) error
+
+var routeConfigMigrations = map[int]configMigration{
+	1: migrateV1ToV2,
+}
+
+// v1 configs predate the enable toggle and json tags on Cache
+func migrateV1ToV2(doc map[string]interface{}) error {
+	if _, ok := doc["enabled"]; !ok {
+		doc["enabled"] = true
+	}
+
+	if cache, ok := doc["cache"].(map[string]interface{}); ok {
+		if expiresIn, ok := cache["ExpiresIn"]; ok {
+			cache["expires_in"] = expiresIn
+			delete(cache, "ExpiresIn")
+		}
+	}
+
+	return nil
+}
+
+// Applies every migration between the document's schema_version and the
+// current one. Documents without a version are v1. Returns the version the
+// document started at
+func migrateRouteConfig(doc map[string]interface{}) (int, error) {
+	version := 1
+	if v, ok := doc["schema_version"].(float64); ok && v > 0 {
+		version = int(v)
+	}
+	from := version
+
+	if version > currentSchemaVersion {
+		return from, fmt.Errorf("schema version %d is newer than supported version %d", version, currentSchemaVersion)
+	}
+
+	for ; version < currentSchemaVersion; version++ {
+		migrate, ok := routeConfigMigrations[version]
+		if !ok {
+			return from, fmt.Errorf("no migration from schema version %d", version)
+		}
+		if err := migrate(doc); err != nil {
+			return from, fmt.Errorf("migrating from schema version %d: %w", version, err)
+		}
+	}
+	doc["schema_version"] = currentSchemaVersion
+
+	return from, nil
+}
+
+// Unmarshals a stored config, upgrading it to the current schema first. The
+// upgrade is only held in memory; the stored document changes the next time
+// the config is written
+func (r *Redis) decodeRouteConfig(key string, data []byte) (RouteConfig, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return RouteConfig{}, err
+	}
+
+	from, err := migrateRouteConfig(doc)
+	if err != nil {
+		return RouteConfig{}, err
+	}
+	if from != currentSchemaVersion {
+		r.logger.Infow("migrated route config", "key", key, "from", from, "to", currentSchemaVersion)
+	}
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return RouteConfig{}, err
+	}
+
+	var config RouteConfig
+	if err := json.Unmarshal(migrated, &config); err != nil {
+		return RouteConfig{}, err
+	}
+	return config, nil
+}
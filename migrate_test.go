@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetRouteConfigMigratesV1(t *testing.T) {
+	r, server := newTestRedis(t)
+	// As a v1 build stored it: no schema_version or enabled, and Cache
+	// fields without json tags
+	v1 := `{"path":"/legacy","targets":["http://localhost:8081"],"cache":{"Enabled":true,"ExpiresIn":60}}`
+	server.DB(1).Set("/legacy", v1)
+
+	cfg, err := r.GetRouteConfig("/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SchemaVersion != currentSchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", cfg.SchemaVersion, currentSchemaVersion)
+	}
+	if !cfg.Enabled {
+		t.Error("v1 route came back disabled, v1 routes were always enabled")
+	}
+	if !cfg.Cache.Enabled || cfg.Cache.ExpiresIn != 60 {
+		t.Errorf("Cache = %+v, want it enabled for 60s", cfg.Cache)
+	}
+	// Fields added since v1 take their defaults
+	if !cfg.PreserveHost || !cfg.BufferRequestBody {
+		t.Errorf("PreserveHost=%v BufferRequestBody=%v, want the defaults", cfg.PreserveHost, cfg.BufferRequestBody)
+	}
+
+	// The stored document is left alone until the config is next written
+	if stored, _ := server.DB(1).Get("/legacy"); stored != v1 {
+		t.Errorf("stored config = %s, want it untouched", stored)
+	}
+}
+
+func TestMigrateRouteConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		doc         map[string]interface{}
+		wantFrom    int
+		wantEnabled interface{}
+		wantErr     string
+	}{
+		{"unversioned is v1", map[string]interface{}{}, 1, true, ""},
+		{"v1 keeps an explicit enabled", map[string]interface{}{"schema_version": 1.0, "enabled": false}, 1, false, ""},
+		{"current untouched", map[string]interface{}{"schema_version": float64(currentSchemaVersion)}, currentSchemaVersion, nil, ""},
+		{"newer rejected", map[string]interface{}{"schema_version": float64(currentSchemaVersion + 1)}, currentSchemaVersion + 1, nil, "newer than supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, err := migrateRouteConfig(tt.doc)
+			if from != tt.wantFrom {
+				t.Errorf("from = %d, want %d", from, tt.wantFrom)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.doc["schema_version"]; got != currentSchemaVersion {
+				t.Errorf("schema_version = %v, want %d", got, currentSchemaVersion)
+			}
+			if got := tt.doc["enabled"]; got != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", got, tt.wantEnabled)
+			}
+		})
+	}
+}
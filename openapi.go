@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"go.uber.org/zap"
+)
+
+// Validates requests against an OpenAPI 3 spec before they reach the upstream
+type OpenAPIValidator struct {
+	router         routers.Router
+	validateBodies bool
+	logger         *zap.SugaredLogger
+}
+
+// Spec paths are matched against the full request path the gateway receives.
+// Servers are ignored so the spec matches whichever host the route serves.
+// Validating bodies means reading them into memory first; without
+// validateBodies only the path, method and parameters are checked
+func NewOpenAPIValidator(specPath string, validateBodies bool, logger *zap.SugaredLogger) (*OpenAPIValidator, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading openapi spec %q: %w", specPath, err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid openapi spec %q: %w", specPath, err)
+	}
+	doc.Servers = nil
+
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("building openapi router: %w", err)
+	}
+
+	return &OpenAPIValidator{router: router, validateBodies: validateBodies, logger: logger}, nil
+}
+
+// OpenAPIValidationMiddleware rejects requests the spec doesn't describe:
+// unknown paths get 404, undeclared methods 405, and missing or malformed
+// parameters and bodies 400. Security schemes are left to the gateway's own
+// auth rather than checked here
+func (v *OpenAPIValidator) OpenAPIValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route, pathParams, err := v.router.FindRoute(request)
+		switch {
+		case isMethodNotAllowed(err):
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		case err != nil:
+			http.Error(writer, "Not found", http.StatusNotFound)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    request,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				MultiError:         true,
+				ExcludeRequestBody: !v.validateBodies,
+			},
+		}
+		// Reads the body and replaces it with a copy, so the upstream still
+		// receives it
+		if err := openapi3filter.ValidateRequest(request.Context(), input); err != nil {
+			requestLogger(v.logger, request.Context()).Debugw("request failed openapi validation", "path", request.URL.Path, "error", err)
+			http.Error(writer, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// The legacy router returns a fresh RouteError rather than
+// routers.ErrMethodNotAllowed itself, so errors.Is never matches it
+func isMethodNotAllowed(err error) bool {
+	var routeErr *routers.RouteError
+	return errors.As(err, &routeErr) && routeErr.Reason == routers.ErrMethodNotAllowed.Error()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const petsSpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "pets", "version": "1"},
+  "paths": {
+    "/pets": {
+      "post": {
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {
+            "type": "object",
+            "required": ["name"],
+            "properties": {"name": {"type": "string"}, "age": {"type": "integer", "minimum": 0}}
+          }}}
+        },
+        "responses": {"201": {"description": "created"}}
+      }
+    }
+  }
+}`
+
+func newPetsValidator(t *testing.T) *OpenAPIValidator {
+	t.Helper()
+	spec := filepath.Join(t.TempDir(), "pets.json")
+	if err := os.WriteFile(spec, []byte(petsSpec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	validator, err := NewOpenAPIValidator(spec, true, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validator
+}
+
+func TestOpenAPIValidation(t *testing.T) {
+	var received string
+	handler := newPetsValidator(t).OpenAPIValidationMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		received = string(body)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"conforming", http.MethodPost, "/pets", `{"name": "rex", "age": 3}`, http.StatusOK},
+		{"wrong type", http.MethodPost, "/pets", `{"name": 5}`, http.StatusBadRequest},
+		{"missing required", http.MethodPost, "/pets", `{"age": 3}`, http.StatusBadRequest},
+		{"out of range", http.MethodPost, "/pets", `{"name": "rex", "age": -1}`, http.StatusBadRequest},
+		{"malformed", http.MethodPost, "/pets", `{"name":`, http.StatusBadRequest},
+		{"undeclared method", http.MethodDelete, "/pets", "", http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodPost, "/owners", `{}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			request := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			request.Header.Set("Content-Type", "application/json")
+			response := serve(handler, request)
+
+			if response.Code != tt.want {
+				t.Fatalf("status %d (%s), want %d", response.Code, strings.TrimSpace(response.Body.String()), tt.want)
+			}
+			if tt.want == http.StatusOK && received != tt.body {
+				t.Errorf("upstream got body %q, want it unchanged", received)
+			}
+			if tt.want != http.StatusOK && received != "" {
+				t.Error("rejected request reached the upstream")
+			}
+		})
+	}
+}
+
+func TestOpenAPIValidatorRejectsBadSpec(t *testing.T) {
+	spec := filepath.Join(t.TempDir(), "broken.json")
+	os.WriteFile(spec, []byte(`{"openapi": "3.0.3", "paths": {}}`), 0o644)
+	if _, err := NewOpenAPIValidator(spec, true, testLogger()); err == nil {
+		t.Error("spec without info accepted, want an error")
+	}
+	if _, err := NewOpenAPIValidator(filepath.Join(t.TempDir(), "missing.json"), true, testLogger()); err == nil {
+		t.Error("missing spec file accepted, want an error")
+	}
+}
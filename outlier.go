@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const outlierBuckets = 10
+
+// OutlierDetector ejects a target whose error rate over a rolling window
+// crosses a threshold, catching upstreams that fail intermittently rather
+// than consecutively. Each ejection in a row lasts longer (ejectionTime
+// multiplied by the number of recent ejections); a target that stays healthy
+// for a full window after re-admission has its count reset
+type OutlierDetector struct {
+	target string
+
+	mu           sync.Mutex
+	window       time.Duration
+	errorPercent float64
+	minRequests  int
+	ejectionTime time.Duration
+
+	buckets     [outlierBuckets]outlierBucket
+	current     int
+	bucketStart time.Time
+
+	ejectedUntil time.Time
+	ejections    int
+	admittedAt   time.Time
+}
+
+type outlierBucket struct {
+	successes int
+	failures  int
+}
+
+func NewOutlierDetector(target string, cfg OutlierDetection) *OutlierDetector {
+	d := &OutlierDetector{target: target, bucketStart: time.Now()}
+	d.configure(cfg)
+	outlierEjected.WithLabelValues(target).Set(0)
+	return d
+}
+
+func (d *OutlierDetector) configure(cfg OutlierDetection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.window = secondsToDuration(float64(cfg.Window))
+	if d.window <= 0 {
+		d.window = 30 * time.Second
+	}
+	d.errorPercent = float64(cfg.ErrorPercent)
+	if d.errorPercent <= 0 {
+		d.errorPercent = 50
+	}
+	d.minRequests = cfg.MinRequests
+	if d.minRequests <= 0 {
+		d.minRequests = 10
+	}
+	d.ejectionTime = secondsToDuration(float64(cfg.EjectionTime))
+	if d.ejectionTime <= 0 {
+		d.ejectionTime = 30 * time.Second
+	}
+}
+
+// Available reports whether the target is currently in rotation
+func (d *OutlierDetector) Available() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.availableLocked(time.Now())
+}
+
+// When the target was last re-admitted after an ejection, zero if it never
+// has been ejected
+func (d *OutlierDetector) AdmittedAt() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.availableLocked(time.Now())
+	return d.admittedAt
+}
+
+func (d *OutlierDetector) Record(success bool) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.advance(now)
+	if success {
+		d.buckets[d.current].successes++
+	} else {
+		d.buckets[d.current].failures++
+	}
+
+	if !d.availableLocked(now) {
+		return
+	}
+	if d.ejections > 0 && now.Sub(d.admittedAt) >= d.window {
+		d.ejections = 0
+	}
+
+	successes, failures := d.totals()
+	total := successes + failures
+	if total >= d.minRequests && float64(failures)*100 >= d.errorPercent*float64(total) {
+		d.eject(now)
+	}
+}
+
+// Callers hold mu
+func (d *OutlierDetector) availableLocked(now time.Time) bool {
+	if d.ejectedUntil.IsZero() {
+		return true
+	}
+	if now.Before(d.ejectedUntil) {
+		return false
+	}
+	// Re-admitted with a clean window, so the failures that got it ejected
+	// don't eject it again straight away
+	d.ejectedUntil = time.Time{}
+	d.admittedAt = now
+	d.buckets = [outlierBuckets]outlierBucket{}
+	outlierEjected.WithLabelValues(d.target).Set(0)
+	return true
+}
+
+func (d *OutlierDetector) eject(now time.Time) {
+	d.ejections++
+	d.ejectedUntil = now.Add(d.ejectionTime * time.Duration(d.ejections))
+	outlierEjected.WithLabelValues(d.target).Set(1)
+	outlierEjections.WithLabelValues(d.target).Inc()
+}
+
+// Rotates out buckets older than the window
+func (d *OutlierDetector) advance(now time.Time) {
+	width := d.window / outlierBuckets
+	for elapsed := now.Sub(d.bucketStart); elapsed >= width; elapsed -= width {
+		d.current = (d.current + 1) % outlierBuckets
+		d.buckets[d.current] = outlierBucket{}
+		d.bucketStart = d.bucketStart.Add(width)
+		if elapsed >= d.window+width {
+			// Idle for longer than the window, everything has expired
+			d.buckets = [outlierBuckets]outlierBucket{}
+			d.bucketStart = now
+			break
+		}
+	}
+}
+
+func (d *OutlierDetector) totals() (successes int, failures int) {
+	for _, b := range d.buckets {
+		successes += b.successes
+		failures += b.failures
+	}
+	return successes, failures
+}
+
+// Detectors shared by every route, one per target URL, kept across reloads
+type OutlierRegistry struct {
+	mu        sync.Mutex
+	detectors map[string]*OutlierDetector
+}
+
+func NewOutlierRegistry() *OutlierRegistry {
+	return &OutlierRegistry{detectors: make(map[string]*OutlierDetector)}
+}
+
+func (r *OutlierRegistry) Get(target string, cfg OutlierDetection) *OutlierDetector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d, ok := r.detectors[target]; ok {
+		d.configure(cfg)
+		return d
+	}
+	d := NewOutlierDetector(target, cfg)
+	r.detectors[target] = d
+	return d
+}
+
+// Targets currently ejected, sorted
+func (r *OutlierRegistry) Ejected() []string {
+	r.mu.Lock()
+	var ejected []string
+	for target, d := range r.detectors {
+		if !d.Available() {
+			ejected = append(ejected, target)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Strings(ejected)
+	return ejected
+}
+
+// Counts transport errors and 5xx responses against the detector. Requests
+// the client canceled aren't counted
+type outlierTransport struct {
+	next     http.RoundTripper
+	detector *OutlierDetector
+}
+
+func (t *outlierTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.next.RoundTrip(request)
+	if err != nil && request.Context().Err() != nil {
+		return response, err
+	}
+	t.detector.Record(err == nil && response.StatusCode < 500)
+	return response, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectsIntermittentFailures(t *testing.T) {
+	const ejection = 50 * time.Millisecond
+	d := NewOutlierDetector("http://flaky.internal", OutlierDetection{
+		Enabled:      true,
+		ErrorPercent: 50,
+		MinRequests:  10,
+		EjectionTime: float32(ejection.Seconds()),
+	})
+
+	// Every other request fails: never two in a row, but half of them
+	for i := 0; i < 9; i++ {
+		d.Record(i%2 == 0)
+	}
+	if !d.Available() {
+		t.Fatal("ejected before seeing MinRequests requests")
+	}
+	d.Record(false)
+	if d.Available() {
+		t.Fatal("target failing half its requests wasn't ejected")
+	}
+
+	time.Sleep(ejection + 10*time.Millisecond)
+	if !d.Available() {
+		t.Fatal("target wasn't re-admitted after its ejection time")
+	}
+	if d.AdmittedAt().IsZero() {
+		t.Error("AdmittedAt not set on re-admission")
+	}
+	// The window starts over, so one failure isn't enough to eject again
+	d.Record(false)
+	if !d.Available() {
+		t.Error("re-admitted target ejected by its old failures")
+	}
+
+	// A repeat ejection lasts twice as long
+	for i := 0; i < 10; i++ {
+		d.Record(false)
+	}
+	time.Sleep(ejection + 10*time.Millisecond)
+	if d.Available() {
+		t.Error("second ejection was no longer than the first")
+	}
+	time.Sleep(ejection)
+	if !d.Available() {
+		t.Error("target wasn't re-admitted after its second ejection")
+	}
+}
+
+func TestOutlierToleratesLowErrorRate(t *testing.T) {
+	d := NewOutlierDetector("http://mostly-fine.internal", OutlierDetection{Enabled: true, ErrorPercent: 50, MinRequests: 10})
+	for i := 0; i < 50; i++ {
+		d.Record(i%5 != 0)
+	}
+	if !d.Available() {
+		t.Error("target failing 20% of requests was ejected at a 50% threshold")
+	}
+}
+
+func TestOutlierRegistryListsEjected(t *testing.T) {
+	r := NewOutlierRegistry()
+	cfg := OutlierDetection{Enabled: true, MinRequests: 2}
+	r.Get("http://a.internal", cfg).Record(true)
+	bad := r.Get("http://b.internal", cfg)
+	bad.Record(false)
+	bad.Record(false)
+
+	if got := r.Ejected(); len(got) != 1 || got[0] != "http://b.internal" {
+		t.Errorf("Ejected() = %v, want only b", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// How NormalizePath treats request paths before routing. Every mode collapses
+// repeated slashes, /api//users is /api/users. PathStrict leaves trailing
+// slashes alone, so /api/users/ and /api/users stay distinct routes.
+// PathRedirect answers /api/users/ with a 308 to /api/users, and PathRewrite
+// routes it as /api/users without telling the client
+const (
+	PathStrict   = "strict"
+	PathRedirect = "redirect"
+	PathRewrite  = "rewrite"
+)
+
+// NormalizePath cleans up request paths ahead of the router. An empty mode
+// leaves paths to ServeMux, which redirects unclean paths itself
+func NormalizePath(mode string) (Middleware, error) {
+	switch mode {
+	case "":
+		return func(next http.Handler) http.Handler { return next }, nil
+	case PathStrict, PathRedirect, PathRewrite:
+	default:
+		return nil, fmt.Errorf("unknown path normalization mode %q", mode)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			path := collapseSlashes(request.URL.Path)
+			rawPath := collapseSlashes(request.URL.RawPath)
+
+			if mode != PathStrict && len(path) > 1 && strings.HasSuffix(path, "/") {
+				path = strings.TrimRight(path, "/")
+				rawPath = strings.TrimRight(rawPath, "/")
+
+				if mode == PathRedirect {
+					target := *request.URL
+					target.Path, target.RawPath = path, rawPath
+					// 308 rather than 301 so the method and body are kept
+					http.Redirect(writer, request, target.RequestURI(), http.StatusPermanentRedirect)
+					return
+				}
+			}
+
+			if path != request.URL.Path || rawPath != request.URL.RawPath {
+				request = request.Clone(request.Context())
+				request.URL.Path, request.URL.RawPath = path, rawPath
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
+
+func collapseSlashes(path string) string {
+	if !strings.Contains(path, "//") {
+		return path
+	}
+
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
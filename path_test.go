@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Records the path the router got
+func pathEcho() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.URL.Path))
+	})
+}
+
+func TestNormalizePathCollapsesSlashes(t *testing.T) {
+	for _, mode := range []string{PathStrict, PathRedirect, PathRewrite} {
+		t.Run(mode, func(t *testing.T) {
+			normalize, err := NormalizePath(mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := serve(normalize(pathEcho()), httptest.NewRequest(http.MethodGet, "//api///users?page=2", nil))
+			if response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", response.Code)
+			}
+			if got := response.Body.String(); got != "/api/users" {
+				t.Errorf("routed path = %q, want /api/users", got)
+			}
+		})
+	}
+}
+
+func TestNormalizePathTrailingSlash(t *testing.T) {
+	tests := []struct {
+		mode     string
+		status   int
+		location string
+		path     string
+	}{
+		{PathStrict, http.StatusOK, "", "/api/users/"},
+		{PathRedirect, http.StatusPermanentRedirect, "/api/users?page=2", ""},
+		{PathRewrite, http.StatusOK, "", "/api/users"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.mode, func(t *testing.T) {
+			normalize, err := NormalizePath(tc.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := serve(normalize(pathEcho()), httptest.NewRequest(http.MethodPost, "/api//users/?page=2", nil))
+			if response.Code != tc.status {
+				t.Fatalf("status = %d, want %d", response.Code, tc.status)
+			}
+			if got := response.Header().Get("Location"); got != tc.location {
+				t.Errorf("Location = %q, want %q", got, tc.location)
+			}
+			if tc.path != "" && response.Body.String() != tc.path {
+				t.Errorf("routed path = %q, want %q", response.Body.String(), tc.path)
+			}
+		})
+	}
+
+	// The root path's slash is the path itself
+	normalize, _ := NormalizePath(PathRedirect)
+	if response := serve(normalize(pathEcho()), httptest.NewRequest(http.MethodGet, "/", nil)); response.Code != http.StatusOK {
+		t.Errorf("/: status = %d, want 200", response.Code)
+	}
+}
+
+func TestNormalizePathUnknownMode(t *testing.T) {
+	if _, err := NormalizePath("loose"); err == nil {
+		t.Error("want an error for an unknown mode")
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The Host to send upstream in place of the client's, empty to forward it
+// as is
+func upstreamHost(cfg RouteConfig, target *url.URL) string {
+	if cfg.UpstreamHost != "" {
+		return cfg.UpstreamHost
+	}
+	if !cfg.PreserveHost {
+		return target.Host
+	}
+	return ""
+}
+
+// A bare host, optionally with a port
+func validUpstreamHost(host string) bool {
+	parsed, err := url.Parse("http://" + host)
+	return err == nil && parsed.Host == host && parsed.User == nil
+}
+
+// Transport failures, before anything has been written to the client.
+// Requests turned away by an open breaker get fallback's response where it
+// has one (fallback may be nil)
+func proxyErrorHandler(logger *zap.SugaredLogger, route string, errorPages *ErrorRenderer, fallback *Fallback) func(http.ResponseWriter, *http.Request, error) {
+	return func(writer http.ResponseWriter, request *http.Request, err error) {
+		// TimeoutMiddleware answers these with a 504
+		if timedOut(request.Context()) {
+			logger.Warnw("proxied request timed out", "route", route, "request_id", CorrelationID(request.Context()))
+			return
+		}
+		if errors.Is(err, context.Canceled) {
+			logger.Debugw("client canceled proxied request", "route", route, "request_id", CorrelationID(request.Context()))
+			return
+		}
+		// Failing over would get nowhere either
+		if errors.Is(err, ErrAttemptBudgetExhausted) {
+			logger.Warnw("upstream attempt budget exhausted", "route", route, "request_id", CorrelationID(request.Context()))
+			errorPages.Render(writer, request, http.StatusBadGateway, "")
+			return
+		}
+		// The balancer has another target to try, nothing is written so the
+		// client never sees this attempt
+		if f, ok := request.Context().Value(failoverKey{}).(*failover); ok {
+			f.err = err
+			return
+		}
+
+		if errors.Is(err, ErrCircuitOpen) {
+			logger.Debugw("circuit open, rejecting proxied request", "route", route, "request_id", CorrelationID(request.Context()))
+			if fallback.Serve(writer, request) {
+				return
+			}
+			errorPages.Render(writer, request, http.StatusServiceUnavailable, "")
+			return
+		}
+
+		logger.Errorw("proxy request failed",
+			"route", route,
+			"request_id", CorrelationID(request.Context()),
+			"error", err)
+		errorPages.Render(writer, request, http.StatusBadGateway, "")
+	}
+}
+
+// Logs upstreams that close the connection partway through the body. The
+// status line has already gone out by then, so nothing can be retried;
+// ReverseProxy aborts the client connection so the truncated body isn't
+// mistaken for a complete response
+func detectTruncation(logger *zap.SugaredLogger, route string) responseModifier {
+	return func(resp *http.Response) error {
+		// An upgraded connection's body is the connection itself, ReverseProxy
+		// needs it writable
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		resp.Body = &truncationReader{
+			ReadCloser: resp.Body,
+			onTruncate: func(read int64) {
+				logger.Warnw("upstream closed connection mid-body, response truncated",
+					"route", route,
+					"request_id", CorrelationID(resp.Request.Context()),
+					"status", resp.StatusCode,
+					"content_length", resp.ContentLength,
+					"bytes_read", read)
+			},
+		}
+		return nil
+	}
+}
+
+type truncationReader struct {
+	io.ReadCloser
+	read       int64
+	onTruncate func(read int64)
+}
+
+func (t *truncationReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.read += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) && t.onTruncate != nil {
+		t.onTruncate(t.read)
+		t.onTruncate = nil
+	}
+	return n, err
+}
+
+// Upstream auth challenges the client has to see for its auth flow to work.
+// ReverseProxy treats Proxy-Authenticate as hop-by-hop and drops it, as it does
+// any header the upstream names in Connection, so challengeTransport tucks
+// them away under internal names before that happens and restoreChallenges
+// puts them back
+var challengeHeaders = map[string]string{
+	"Www-Authenticate":   "X-Lattice-Upstream-Www-Authenticate",
+	"Proxy-Authenticate": "X-Lattice-Upstream-Proxy-Authenticate",
+}
+
+type challengeTransport struct {
+	next http.RoundTripper
+}
+
+func (t *challengeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		return response, err
+	}
+	for header, internal := range challengeHeaders {
+		response.Header.Del(internal)
+		if values, ok := response.Header[header]; ok {
+			response.Header[internal] = values
+		}
+	}
+	return response, nil
+}
+
+// Undoes challengeTransport, values and order intact
+func restoreChallenges(resp *http.Response) error {
+	for header, internal := range challengeHeaders {
+		if values, ok := resp.Header[internal]; ok {
+			resp.Header[header] = values
+			delete(resp.Header, internal)
+		}
+	}
+	return nil
+}
+
+// When the proxy was handed the request, for upstreamDuration
+type upstreamStartKey struct{}
+
+// Sets X-Upstream-Duration, the milliseconds from handing the request to the
+// proxy to the upstream's response headers, retries included
+func upstreamDuration(resp *http.Response) error {
+	if started, ok := resp.Request.Context().Value(upstreamStartKey{}).(time.Time); ok {
+		elapsed := float64(time.Since(started)) / float64(time.Millisecond)
+		resp.Header.Set("X-Upstream-Duration", strconv.FormatFloat(elapsed, 'f', 1, 64))
+	}
+	return nil
+}
+
+// Applied in order to every upstream response before it is copied to the client
+type responseModifier func(*http.Response) error
+
+func chainModifiers(modifiers []responseModifier) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Rewrites the attributes of every upstream Set-Cookie header so cookies set
+// for the upstream's domain/path work for clients on the gateway's
+func rewriteCookies(rewrite CookieRewrite) responseModifier {
+	return func(resp *http.Response) error {
+		lines := resp.Header.Values("Set-Cookie")
+		if len(lines) == 0 {
+			return nil
+		}
+
+		resp.Header.Del("Set-Cookie")
+		for _, line := range lines {
+			// Parse one header at a time so each keeps its own attributes
+			parsed := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+			if len(parsed) == 0 {
+				resp.Header.Add("Set-Cookie", line) // Leave what we can't parse alone
+				continue
+			}
+
+			cookie := parsed[0]
+			if rewrite.Domain != "" {
+				cookie.Domain = rewrite.Domain
+			}
+			if rewrite.Path != "" {
+				cookie.Path = rewrite.Path
+			}
+			if rewrite.Secure {
+				cookie.Secure = true
+			}
+			switch strings.ToLower(rewrite.SameSite) {
+			case "lax":
+				cookie.SameSite = http.SameSiteLaxMode
+			case "strict":
+				cookie.SameSite = http.SameSiteStrictMode
+			case "none":
+				cookie.SameSite = http.SameSiteNoneMode
+			}
+
+			resp.Header.Add("Set-Cookie", cookie.String())
+		}
+
+		return nil
+	}
+}
+
+// Appends the gateway to Via, as "<protocol version> <pseudonym>", and
+// overrides or strips Server
+func rewriteServerHeaders(via string, server ServerHeader) responseModifier {
+	return func(resp *http.Response) error {
+		if via != "" {
+			// The protocol the gateway received the response with
+			version := fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor)
+			if resp.ProtoMajor >= 2 {
+				version = strconv.Itoa(resp.ProtoMajor)
+			}
+			resp.Header.Add("Via", version+" "+via)
+		}
+
+		switch server.Mode {
+		case ServerOverride:
+			resp.Header.Set("Server", server.Value)
+		case ServerStrip:
+			resp.Header.Del("Server")
+		}
+		return nil
+	}
+}
+
+// Rewrites upstream statuses found in remap. The upstream's body and headers
+// are passed on as they are unless replaceBody is set, in which case the
+// client gets the gateway's own error response for the new status instead.
+// Statuses that can't carry a body always lose it
+func remapStatus(remap map[int]int, replaceBody bool, errorPages *ErrorRenderer) responseModifier {
+	return func(resp *http.Response) error {
+		status, ok := remap[resp.StatusCode]
+		if !ok {
+			return nil
+		}
+		resp.StatusCode = status
+		resp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+
+		bodyless := status == http.StatusNoContent || status == http.StatusNotModified
+		if !replaceBody && !bodyless {
+			return nil
+		}
+
+		// Entity headers describing the upstream's body
+		for _, header := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "Etag", "Last-Modified", "Trailer"} {
+			resp.Header.Del(header)
+		}
+		resp.Body.Close()
+		resp.Trailer = nil
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		if bodyless {
+			return nil
+		}
+
+		rendered := &renderedResponse{header: make(http.Header)}
+		errorPages.Render(rendered, resp.Request, status, "")
+		for key, values := range rendered.header {
+			resp.Header[key] = values
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(rendered.body.Bytes()))
+		resp.ContentLength = int64(rendered.body.Len())
+		resp.Header.Set("Content-Length", strconv.Itoa(rendered.body.Len()))
+		return nil
+	}
+}
+
+// Collects an ErrorRenderer response so it can stand in for an upstream body
+type renderedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *renderedResponse) Header() http.Header         { return r.header }
+func (r *renderedResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *renderedResponse) WriteHeader(int)             {}
+
+// Forwards the upstream's informational responses, 103 Early Hints say, with
+// only their own headers. ReverseProxy writes each one with whatever is in
+// the header map and clears the map afterwards, which would leak the
+// gateway's headers into the hint and drop them (X-Request-Id, CORS...) from
+// the final response. So the proxy gets a header map of its own, merged into
+// the real one once the final response starts
+type informationalWriter struct {
+	http.ResponseWriter
+	header http.Header
+	merged bool
+}
+
+func (w *informationalWriter) Header() http.Header {
+	if w.merged {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *informationalWriter) WriteHeader(code int) {
+	if w.merged || code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.merge()
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	saved := header.Clone()
+	clear(header)
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.ResponseWriter.WriteHeader(code)
+	clear(header)
+	for key, values := range saved {
+		header[key] = values
+	}
+}
+
+func (w *informationalWriter) Write(b []byte) (int, error) {
+	w.merge()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *informationalWriter) Flush() {
+	w.merge()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *informationalWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.merge()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *informationalWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Adds the proxy's headers to the gateway's, as ReverseProxy would have
+func (w *informationalWriter) merge() {
+	if w.merged {
+		return
+	}
+	w.merged = true
+	header := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		header[key] = append(header[key], values...)
+	}
+}
+
+// Bodies larger than this are proxied without retries rather than being held
+// in memory for replay
+const maxRetryBodyBytes = 1 << 20
+
+// IdempotencyKeyHeader marks a mutation as safe to send more than once
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Retries proxied requests that carry an Idempotency-Key when the upstream
+// fails or answers 5xx, backing off exponentially between attempts. The key
+// is what makes replaying a POST safe. Requests without one are only retried
+// if their method is safe and the upstream reset the connection, other
+// failures and 5xx answers are passed on. The first reset is retried without
+// backoff, it's usually a pooled connection the upstream closed while
+// restarting. Without bufferBodies only bodiless requests are retried, the
+// rest stream straight to the upstream. Every attempt comes out of the
+// request's AttemptBudget, if it has one
+type retryTransport struct {
+	next         http.RoundTripper
+	attempts     int
+	baseDelay    time.Duration
+	bufferBodies bool
+	logger       *zap.SugaredLogger
+	route        string
+}
+
+func newRetryTransport(next http.RoundTripper, cfg RetryConfig, bufferBodies bool, logger *zap.SugaredLogger, route string) *retryTransport {
+	baseDelay := secondsToDuration(float64(cfg.BaseDelay))
+	if baseDelay <= 0 {
+		baseDelay = 100 * time.Millisecond
+	}
+	return &retryTransport{
+		next:         next,
+		attempts:     cfg.attempts(),
+		baseDelay:    baseDelay,
+		bufferBodies: bufferBodies,
+		logger:       logger,
+		route:        route,
+	}
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	budget := RequestContextFrom(request.Context()).AttemptBudget()
+	if !budget.Take() {
+		return nil, ErrAttemptBudgetExhausted
+	}
+	keyed := request.Header.Get(IdempotencyKeyHeader) != ""
+	if t.attempts < 2 || (!keyed && !isSafeMethod(request.Method)) {
+		return t.next.RoundTrip(request)
+	}
+	if !t.bufferBodies && request.Body != nil && request.Body != http.NoBody {
+		return t.next.RoundTrip(request)
+	}
+
+	body, replayable, err := bufferBody(request)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		return t.next.RoundTrip(request)
+	}
+
+	retriedReset := false
+	for attempt := 0; ; attempt++ {
+		attemptRequest := request
+		if body != nil {
+			attemptRequest = request.Clone(request.Context())
+			attemptRequest.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		response, err := t.next.RoundTrip(attemptRequest)
+		reset := err != nil && isConnectionReset(err)
+		retryable := reset || (keyed && (err != nil || response.StatusCode >= 500))
+		if attempt == t.attempts-1 || !retryable || errors.Is(err, ErrCircuitOpen) {
+			return response, err
+		}
+		// While the balancer has another target left, it picks where a
+		// keyed request's 5xx is retried so the retry avoids this one. It
+		// takes the attempt from the budget itself
+		if err == nil && failingOver(request.Context()) {
+			io.Copy(io.Discard, io.LimitReader(response.Body, maxRetryBodyBytes))
+			response.Body.Close()
+			return nil, &upstreamStatusError{status: response.StatusCode}
+		}
+		if !budget.Take() {
+			return response, err
+		}
+
+		status := 0
+		if err == nil {
+			status = response.StatusCode
+			io.Copy(io.Discard, io.LimitReader(response.Body, maxRetryBodyBytes))
+			response.Body.Close()
+		}
+		t.logger.Debugw("retrying idempotent proxy request",
+			"route", t.route,
+			"request_id", CorrelationID(request.Context()),
+			"attempt", attempt+1,
+			"status", status,
+			"connection_reset", reset,
+			"error", err)
+
+		backoff := calcBackoff(attempt, t.baseDelay, 0)
+		if reset && !retriedReset {
+			retriedReset = true
+			backoff = 0
+		}
+		select {
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// A keyed request's 5xx, handed to the balancer to retry on another target
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream answered %d", e.status)
+}
+
+// Reads the request body into memory so it can be sent again. Bodies over
+// maxRetryBodyBytes are stitched back together and reported as not replayable
+func bufferBody(request *http.Request) ([]byte, bool, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxRetryBodyBytes+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("buffering request body: %w", err)
+	}
+	if len(body) > maxRetryBodyBytes {
+		request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), request.Body), request.Body}
+		return nil, false, nil
+	}
+
+	request.Body.Close()
+	return body, true, nil
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRewriteCookies(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {
+		"session=abc; Domain=upstream.internal; Path=/app; HttpOnly",
+		"theme=dark; Path=/app/settings; Max-Age=3600",
+		"tracking=1; Domain=.upstream.internal",
+		"=not a cookie",
+	}}}
+	modify := rewriteCookies(CookieRewrite{Domain: "example.com", Path: "/", Secure: true, SameSite: "Lax"})
+	if err := modify(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := resp.Header.Values("Set-Cookie")
+	if len(lines) != 4 {
+		t.Fatalf("got %d Set-Cookie headers, want 4: %q", len(lines), lines)
+	}
+	if lines[3] != "=not a cookie" {
+		t.Errorf("unparseable cookie = %q, want it left alone", lines[3])
+	}
+
+	cookies := resp.Cookies()
+	if len(cookies) != 3 {
+		t.Fatalf("parsed %d cookies, want 3", len(cookies))
+	}
+	for i, name := range []string{"session", "theme", "tracking"} {
+		cookie := cookies[i]
+		if cookie.Name != name {
+			t.Errorf("cookie %d = %q, want %q; order changed", i, cookie.Name, name)
+		}
+		if cookie.Domain != "example.com" || cookie.Path != "/" {
+			t.Errorf("%s: Domain=%q Path=%q, want example.com and /", name, cookie.Domain, cookie.Path)
+		}
+		if !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("%s: Secure=%v SameSite=%v, want Secure and Lax", name, cookie.Secure, cookie.SameSite)
+		}
+	}
+	// Attributes the rewrite doesn't touch survive
+	if !cookies[0].HttpOnly {
+		t.Error("session lost HttpOnly")
+	}
+	if cookies[1].MaxAge != 3600 {
+		t.Errorf("theme Max-Age = %d, want 3600", cookies[1].MaxAge)
+	}
+}
+
+func TestRewriteCookiesKeepsUnsetFields(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Set-Cookie": {"session=abc; Domain=upstream.internal; Path=/app"}}}
+	if err := rewriteCookies(CookieRewrite{Path: "/"})(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := resp.Cookies()[0]
+	if cookie.Domain != "upstream.internal" {
+		t.Errorf("Domain = %q, want the upstream's", cookie.Domain)
+	}
+	if cookie.Path != "/" {
+		t.Errorf("Path = %q, want /", cookie.Path)
+	}
+}
+
+func postWithKey(t *testing.T, handler http.Handler, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"item":1}`))
+	if key != "" {
+		request.Header.Set(IdempotencyKeyHeader, key)
+	}
+	return serve(handler, request)
+}
+
+// A keyed POST answered 503 is retried on the other target rather than in
+// place, and succeeds there
+func TestKeyedRetryMovesToAnotherTarget(t *testing.T) {
+	var failing, healthy atomic.Int32
+	down := newFailingUpstream(t, http.StatusServiceUnavailable, &failing)
+	up := newFailingUpstream(t, http.StatusOK, &healthy)
+
+	cfg := testRoute("/orders", down.URL, up.URL)
+	cfg.Methods = []string{http.MethodPost}
+	cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	// Round robin starts one of the two requests on each target
+	for i := range 2 {
+		if response := postWithKey(t, handler, fmt.Sprintf("order-%d", i)); response.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, response.Code)
+		}
+	}
+	if got := failing.Load(); got != 1 {
+		t.Errorf("failing target got %d calls, want 1", got)
+	}
+	if got := healthy.Load(); got != 2 {
+		t.Errorf("healthy target got %d calls, want 2", got)
+	}
+}
+
+// With nowhere else to go, a keyed POST is retried on its only target
+func TestKeyedRetrySingleTarget(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+
+	cfg := testRoute("/orders", upstream.URL)
+	cfg.Methods = []string{http.MethodPost}
+	cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	if response := postWithKey(t, handler, "order-1"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the upstream's 503", response.Code)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream got %d calls, want 3", got)
+	}
+}
+
+// Without an Idempotency-Key only safe methods are retried or failed over
+func TestUnkeyedUnsafeMethodsAreNotRetried(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		t.Run(method, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				calls.Add(1)
+				// Drop the connection so the attempt fails outright
+				conn, _, _ := http.NewResponseController(writer).Hijack()
+				conn.Close()
+			})
+			first := httptest.NewServer(handler)
+			defer first.Close()
+			second := httptest.NewServer(handler)
+			defer second.Close()
+
+			cfg := testRoute("/orders", first.URL, second.URL)
+			cfg.Methods = []string{method}
+			cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001, Targets: 2}
+			route := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+			response := serve(route, httptest.NewRequest(method, "/orders", strings.NewReader("{}")))
+			if response.Code != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", response.Code)
+			}
+			if got := calls.Load(); got != 1 {
+				t.Errorf("upstreams got %d calls, want 1", got)
+			}
+		})
+	}
+}
+
+func TestServerHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Server", "nginx/1.25")
+		writer.Header().Set("Via", "1.1 edge")
+		writer.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name   string
+		server ServerHeader
+		want   string
+	}{
+		{"preserve", ServerHeader{}, "nginx/1.25"},
+		{"override", ServerHeader{Mode: ServerOverride, Value: "lattice"}, "lattice"},
+		{"strip", ServerHeader{Mode: ServerStrip}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testRoute("/api", upstream.URL)
+			cfg.Via = "lattice"
+			cfg.Server = tc.server
+			handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+			response := serve(handler, httptest.NewRequest(http.MethodGet, "/api", nil))
+			if got := response.Header().Get("Server"); got != tc.want {
+				t.Errorf("Server = %q, want %q", got, tc.want)
+			}
+			// The upstream's hop stays first, the gateway's is appended
+			via := response.Header().Values("Via")
+			if len(via) != 2 || via[0] != "1.1 edge" || via[1] != "1.1 lattice" {
+				t.Errorf("Via = %q, want [1.1 edge 1.1 lattice]", via)
+			}
+		})
+	}
+}
+
+func TestViaUsesResponseProtocol(t *testing.T) {
+	resp := &http.Response{ProtoMajor: 2, Header: http.Header{}}
+	if err := rewriteServerHeaders("lattice", ServerHeader{})(resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Header.Get("Via"); got != "2 lattice" {
+		t.Errorf("Via = %q, want %q", got, "2 lattice")
+	}
+}
+
+// A GET whose connection is reset is tried again straight away and succeeds
+func TestProxyRetriesConnectionReset(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newResettingUpstream(t, 1, &calls)
+	cfg := testRoute("/api", upstream.URL)
+	cfg.Retry = RetryConfig{BaseDelay: 10}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	started := time.Now()
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want the retry's 200", response.Code, response.Body)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream called %d times, want 2", got)
+	}
+	// A 10s base delay would show if the reset had been backed off
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %v, want the reset retried without backoff", elapsed)
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	received := make(chan [2]string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		received <- [2]string{request.Host, request.Header.Get("X-Forwarded-Host")}
+	}))
+	defer upstream.Close()
+	target := strings.TrimPrefix(upstream.URL, "http://")
+
+	tests := []struct {
+		name          string
+		preserve      bool
+		upstreamHost  string
+		host          string
+		forwardedHost string
+	}{
+		{"client host preserved", true, "", "client.example", ""},
+		{"target host", false, "", target, "client.example"},
+		{"custom host", false, "api.internal:8443", "api.internal:8443", "client.example"},
+		{"custom host over preserve", true, "api.internal", "api.internal", "client.example"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testRoute("/api", upstream.URL)
+			cfg.PreserveHost = tc.preserve
+			cfg.UpstreamHost = tc.upstreamHost
+			handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+			request := httptest.NewRequest(http.MethodGet, "/api", nil)
+			request.Host = "client.example"
+			if response := serve(handler, request); response.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", response.Code)
+			}
+			got := <-received
+			if got[0] != tc.host {
+				t.Errorf("upstream Host = %q, want %q", got[0], tc.host)
+			}
+			if tc.forwardedHost != "" && got[1] != tc.forwardedHost {
+				t.Errorf("X-Forwarded-Host = %q, want %q", got[1], tc.forwardedHost)
+			}
+		})
+	}
+}
+
+func TestInvalidUpstreamHostRejected(t *testing.T) {
+	for _, host := range []string{"api.internal/path", "user@api.internal", "http://api.internal"} {
+		cfg := testRoute("/api", "http://127.0.0.1:1")
+		cfg.UpstreamHost = host
+		if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+			t.Errorf("upstream host %q accepted", host)
+		}
+	}
+}
+
+// A reset is a blip: it's retried where it happened, and failover isn't
+// needed
+func TestResetRetriedOnSameTarget(t *testing.T) {
+	var resetting, other atomic.Int32
+	first := newResettingUpstream(t, 1, &resetting)
+	second := newFailingUpstream(t, http.StatusOK, &other)
+
+	cfg := testRoute("/api", first.URL, second.URL)
+	cfg.Retry = RetryConfig{Attempts: 2, BaseDelay: 0.001, Targets: 2}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want the first target's retry", response.Code, response.Body)
+	}
+	if got := resetting.Load(); got != 2 {
+		t.Errorf("first target got %d calls, want 2", got)
+	}
+	if got := other.Load(); got != 0 {
+		t.Errorf("second target got %d calls, want none", got)
+	}
+}
+
+// Without a key, only a reset is retried in place, a 5xx is passed on
+func TestUnkeyedStatusNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	cfg := testRoute("/api", upstream.URL)
+	cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	if response := serve(handler, httptest.NewRequest(http.MethodGet, "/api", nil)); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the upstream's 503", response.Code)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream got %d calls, want 1", got)
+	}
+}
+
+// An upstream's auth challenges reach the client as it sent them, even
+// those ReverseProxy would otherwise drop as hop-by-hop
+func TestAuthChallengesPassThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		header := writer.Header()
+		header.Add("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+		header.Add("WWW-Authenticate", `Basic realm="api"`)
+		header.Set("Proxy-Authenticate", `Basic realm="corp-proxy"`)
+		// Forged internal names mustn't come through as challenges
+		header.Set("X-Lattice-Upstream-Www-Authenticate", `Basic realm="forged"`)
+		if request.URL.Query().Has("hop") {
+			header.Set("Connection", "WWW-Authenticate")
+		}
+		writer.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/api", upstream.URL)
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	for _, uri := range []string{"/api", "/api?hop"} {
+		response := serve(handler, httptest.NewRequest(http.MethodGet, uri, nil))
+		if response.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: status = %d, want the upstream's 401", uri, response.Code)
+		}
+		want := []string{`Bearer realm="api", error="invalid_token"`, `Basic realm="api"`}
+		if got := response.Header().Values("WWW-Authenticate"); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("%s: WWW-Authenticate = %q, want %q", uri, got, want)
+		}
+		if got := response.Header().Get("Proxy-Authenticate"); got != `Basic realm="corp-proxy"` {
+			t.Errorf("%s: Proxy-Authenticate = %q, want the upstream's", uri, got)
+		}
+		for _, internal := range challengeHeaders {
+			if got := response.Header().Get(internal); got != "" {
+				t.Errorf("%s: %s leaked with %q", uri, internal, got)
+			}
+		}
+	}
+}
+
+// Trailers survive the proxy and the route's writer wrappers, declared up
+// front or not
+func TestResponseTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Trailer", "X-Checksum")
+		writer.Write([]byte("streamed body"))
+		http.NewResponseController(writer).Flush()
+		writer.Header().Set("X-Checksum", "abc123")
+		writer.Header().Set(http.TrailerPrefix+"X-Row-Count", "42")
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/export", upstream.URL)
+	gateway := httptest.NewServer(buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg))
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "streamed body" {
+		t.Errorf("body = %q, want the upstream's", body)
+	}
+	if got := response.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("declared trailer X-Checksum = %q, want abc123", got)
+	}
+	if got := response.Trailer.Get("X-Row-Count"); got != "42" {
+		t.Errorf("undeclared trailer X-Row-Count = %q, want 42", got)
+	}
+	if got := response.Header.Get("X-Checksum"); got != "" {
+		t.Errorf("trailer sent as a header too: %q", got)
+	}
+}
+
+func TestStatusRemap(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/x-teapot")
+		writer.Header().Set("Etag", `"pot"`)
+		status := http.StatusTeapot
+		if request.URL.Query().Has("ok") {
+			status = http.StatusOK
+		}
+		writer.WriteHeader(status)
+		writer.Write([]byte("short and stout"))
+	}))
+	defer upstream.Close()
+
+	for _, tc := range []struct {
+		name        string
+		to          int
+		replaceBody bool
+		query       string
+		wantStatus  int
+		wantBody    bool // The upstream's body reaches the client
+	}{
+		{"status only", http.StatusServiceUnavailable, false, "", http.StatusServiceUnavailable, true},
+		{"replaced body", http.StatusServiceUnavailable, true, "", http.StatusServiceUnavailable, false},
+		{"to 204", http.StatusNoContent, false, "", http.StatusNoContent, false},
+		{"to 304", http.StatusNotModified, false, "", http.StatusNotModified, false},
+		{"unmapped", http.StatusServiceUnavailable, true, "?ok", http.StatusOK, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testRoute("/api", upstream.URL)
+			cfg.StatusRemap = map[int]int{http.StatusTeapot: tc.to}
+			cfg.StatusRemapBody = tc.replaceBody
+			gateway := httptest.NewServer(buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg))
+			defer gateway.Close()
+
+			// Uncompressed, so Content-Length is the one on the wire
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+			defer client.CloseIdleConnections()
+			response, err := client.Get(gateway.URL + "/api" + tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode, tc.wantStatus)
+			}
+			if got := string(body) == "short and stout"; got != tc.wantBody {
+				t.Errorf("body = %q, want the upstream's passed on: %v", body, tc.wantBody)
+			}
+			if tc.wantBody {
+				return
+			}
+			// Nothing describing the upstream's body is left behind
+			if got := response.Header.Get("Etag"); got != "" {
+				t.Errorf("Etag = %q, want the upstream's dropped", got)
+			}
+			if got := response.Header.Get("Content-Type"); got == "text/x-teapot" {
+				t.Error("upstream's Content-Type kept for a replaced body")
+			}
+			if tc.to == http.StatusNoContent || tc.to == http.StatusNotModified {
+				if len(body) != 0 || response.Header.Get("Content-Length") != "" {
+					t.Errorf("body %q with Content-Length %q, want neither", body, response.Header.Get("Content-Length"))
+				}
+				return
+			}
+			if len(body) == 0 {
+				t.Error("replaced body is empty, want the gateway's error response")
+			}
+			if got := response.Header.Get("Content-Length"); got != fmt.Sprint(len(body)) {
+				t.Errorf("Content-Length = %q for a %d byte body", got, len(body))
+			}
+		})
+	}
+}
+
+func TestInvalidStatusRemapRejected(t *testing.T) {
+	for _, remap := range []map[int]int{{418: 103}, {418: 600}, {99: 503}} {
+		cfg := testRoute("/api", "http://localhost")
+		cfg.StatusRemap = remap
+		if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+			t.Errorf("remap %v accepted", remap)
+		}
+	}
+}
+
+func TestEarlyHintsKeepGatewayHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		writer.WriteHeader(http.StatusEarlyHints)
+		writer.Header().Del("Link")
+		writer.Write([]byte("page"))
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/page", upstream.URL)
+	gateway := httptest.NewServer(buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg))
+	defer gateway.Close()
+
+	var hints []textproto.MIMEHeader
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		if code == http.StatusEarlyHints {
+			hints = append(hints, header)
+		}
+		return nil
+	}}
+	request, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, gateway.URL+"/page", nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+
+	if len(hints) != 1 {
+		t.Fatalf("got %d early hints, want 1", len(hints))
+	}
+	if got := hints[0].Get("Link"); got != "</style.css>; rel=preload; as=style" {
+		t.Errorf("hint Link = %q, want the upstream's", got)
+	}
+	for _, header := range []string{RequestIDHeader, "Access-Control-Allow-Origin"} {
+		if got := hints[0].Get(header); got != "" {
+			t.Errorf("gateway header %s leaked into the hint: %q", header, got)
+		}
+	}
+
+	if response.StatusCode != http.StatusOK || string(body) != "page" {
+		t.Errorf("final response %d %q, want 200 page", response.StatusCode, body)
+	}
+	if response.Header.Get(RequestIDHeader) == "" {
+		t.Error("final response lost X-Request-Id")
+	}
+	if got := response.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("final response Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
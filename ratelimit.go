@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Quota state for a key after a request has been counted against it
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Until the quota is fully restored
+	RetryAfter time.Duration // Until the next request would be allowed, if denied
+}
+
+// Allow counts a request costing cost units of quota against key
+type RateLimiter interface {
+	Allow(key string, cost int) (RateLimitResult, error)
+}
+
+// Scales limits up linearly from floor (a fraction of the configured limit)
+// to the full limit over duration, starting at start. The zero value applies
+// the full limit straight away
+type RateLimitWarmup struct {
+	start    time.Time
+	duration time.Duration
+	floor    float64
+}
+
+func NewRateLimitWarmup(start time.Time, duration time.Duration, floor float64) RateLimitWarmup {
+	if floor <= 0 || floor > 1 {
+		floor = 0.1
+	}
+	return RateLimitWarmup{start: start, duration: duration, floor: floor}
+}
+
+// Fraction of the configured limit in effect at now
+func (w RateLimitWarmup) factor(now time.Time) float64 {
+	if w.duration <= 0 {
+		return 1
+	}
+	progress := float64(now.Sub(w.start)) / float64(w.duration)
+	if progress >= 1 {
+		return 1
+	}
+	return w.floor + (1-w.floor)*max(progress, 0)
+}
+
+// Limit in effect at now, never below one request
+func (w RateLimitWarmup) limit(limit int, now time.Time) float64 {
+	return math.Max(float64(limit)*w.factor(now), 1)
+}
+
+// Token bucket per key, local to this gateway instance. Each bucket holds up
+// to limit tokens and refills continuously at limit per window
+type MemoryRateLimiter struct {
+	limit     int
+	window    time.Duration
+	warmup    RateLimitWarmup
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemoryRateLimiter(limit int, window time.Duration) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		limit:     limit,
+		window:    window,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetWarmup ramps the limit up after startup. During the warm-up buckets
+// hold and refill at the reduced limit
+func (l *MemoryRateLimiter) SetWarmup(warmup RateLimitWarmup) {
+	l.warmup = warmup
+}
+
+// Requests are only let through, and charged, if the bucket holds their
+// whole cost
+func (l *MemoryRateLimiter) Allow(key string, cost int) (RateLimitResult, error) {
+	now := time.Now()
+	limit := l.warmup.limit(l.limit, now)
+	rate := limit / l.window.Seconds() // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(limit, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	result := RateLimitResult{Limit: int(limit)}
+	if b.tokens >= float64(cost) {
+		b.tokens -= float64(cost)
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((float64(cost) - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((limit - b.tokens) / rate)
+
+	return result, nil
+}
+
+// Drop buckets that have had time to refill completely, they're
+// indistinguishable from new ones. Runs at most once per window
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Fixed window counter per key, shared by every gateway instance using the
+// same Redis
+type RedisRateLimiter struct {
+	redis  *Redis
+	prefix string
+	limit  int
+	window time.Duration
+	warmup RateLimitWarmup
+}
+
+func NewRedisRateLimiter(redis *Redis, prefix string, limit int, window time.Duration) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		redis:  redis,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// SetWarmup ramps the limit up after startup, by this instance's start time
+func (l *RedisRateLimiter) SetWarmup(warmup RateLimitWarmup) {
+	l.warmup = warmup
+}
+
+// Requests are only let through, and charged, if the window has room for
+// their whole cost
+func (l *RedisRateLimiter) Allow(key string, cost int) (RateLimitResult, error) {
+	limit := int(l.warmup.limit(l.limit, time.Now()))
+	count, ttl, allowed, err := l.redis.IncrWindow(l.prefix+key, cost, limit, l.window)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("incrementing rate limit window: %w", err)
+	}
+
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: max(limit-int(count), 0),
+		Reset:     ttl,
+	}
+	if !result.Allowed {
+		result.RetryAfter = ttl
+	}
+
+	return result, nil
+}
+
+// Trusted clients that skip rate limiting entirely, so health checks and
+// internal traffic don't eat into client quotas
+type RateLimitBypass struct {
+	networks []*net.IPNet
+	header   string
+	token    string
+}
+
+// Allowlist entries are IPs or CIDRs. Requests carrying header set to token
+// are also exempt; an empty header or token disables that check
+func NewRateLimitBypass(allowlist []string, header string, token string) (*RateLimitBypass, error) {
+	bypass := &RateLimitBypass{header: header, token: token}
+
+	for _, entry := range allowlist {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowlist IP %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			bypass.networks = append(bypass.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist CIDR %q: %w", entry, err)
+		}
+		bypass.networks = append(bypass.networks, network)
+	}
+
+	return bypass, nil
+}
+
+func (b *RateLimitBypass) matches(request *http.Request, clientIP string) bool {
+	if b == nil {
+		return false
+	}
+
+	if b.header != "" && b.token != "" {
+		given := request.Header.Get(b.header)
+		if given != "" && subtle.ConstantTimeCompare([]byte(given), []byte(b.token)) == 1 {
+			return true
+		}
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifies whose quota a request counts against. An empty key means the
+// request doesn't carry that identity
+type KeyExtractor func(*http.Request) string
+
+func ClientIPKey(request *http.Request) string {
+	return clientIP(request.RemoteAddr)
+}
+
+// Keyed by the value of header, e.g. an API key
+func HeaderKey(header string) KeyExtractor {
+	return func(request *http.Request) string {
+		return request.Header.Get(header)
+	}
+}
+
+// Keyed by a claim of the request's verified bearer token, e.g. the username
+func ClaimKey(claim string) KeyExtractor {
+	return func(request *http.Request) string {
+		claims, ok := verifiedClaims(request)
+		if !ok {
+			return ""
+		}
+		if value, ok := claims[claim]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+}
+
+// One quota shared by every request
+func GlobalKey(*http.Request) string {
+	return "*"
+}
+
+// ParseKeyExtractor reads a RateLimit.Key: "ip" (or empty), "global",
+// "header:<name>" or "claim:<name>"
+func ParseKeyExtractor(spec string) (KeyExtractor, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch {
+	case spec == "" || spec == "ip":
+		return ClientIPKey, nil
+	case spec == "global":
+		return GlobalKey, nil
+	case kind == "header" && name != "":
+		return HeaderKey(name), nil
+	case kind == "claim" && name != "":
+		return ClaimKey(name), nil
+	}
+	return nil, fmt.Errorf("invalid rate limit key %q", spec)
+}
+
+// How many units of quota a request uses up
+type CostFunc func(*http.Request) int
+
+// Requests cost MethodCosts[method], or Cost (1 if unset) for other methods.
+// A positive integer in CostHeader raises that, never lowers it, so clients
+// can't make their own requests cheaper. It's capped at the route's Requests,
+// a whole window, so no client can ask for more than that
+func RequestCost(cfg RateLimit) CostFunc {
+	base := max(cfg.Cost, 1)
+	return func(request *http.Request) int {
+		cost := base
+		if methodCost, ok := cfg.MethodCosts[request.Method]; ok && methodCost > 0 {
+			cost = methodCost
+		}
+		if cfg.CostHeader != "" {
+			if given, err := strconv.Atoi(request.Header.Get(cfg.CostHeader)); err == nil && given > cost {
+				cost = given
+				// Configured costs above Requests fail validation, so this
+				// never lowers them
+				if cfg.Requests > 0 {
+					cost = min(given, cfg.Requests)
+				}
+			}
+		}
+		return cost
+	}
+}
+
+// RateLimitMiddleware limits requests per key, as given by extractKey, and
+// reports the quota in X-RateLimit-* headers. Requests extractKey finds no
+// key for are limited by client IP, sharing nothing with keyed quotas. A nil
+// extractKey limits by client IP. Each request uses up cost(request) units of
+// quota, or one if cost is nil. Clients matching bypass (which may be nil) are
+// never limited. If the limiter itself fails the request is let through
+// rather than turning a Redis outage into a gateway outage
+func RateLimitMiddleware(limiter RateLimiter, bypass *RateLimitBypass, extractKey KeyExtractor, cost CostFunc, logger *zap.SugaredLogger) Middleware {
+	return TieredRateLimitMiddleware([]LimitTier{{Limiter: limiter, Key: extractKey}}, bypass, cost, logger)
+}
+
+// One level of a tiered rate limit, e.g. per API key or global
+type LimitTier struct {
+	Name    string
+	Limiter RateLimiter
+	Key     KeyExtractor // Client IP if nil
+}
+
+// TieredRateLimitMiddleware is RateLimitMiddleware with several limits a
+// request has to pass, checked in order. The first one exceeded rejects the
+// request and is named in X-RateLimit-Tier; tiers checked before it have
+// still counted it. The X-RateLimit-* headers describe the tier that
+// tripped, or the one with the least quota left
+func TieredRateLimitMiddleware(tiers []LimitTier, bypass *RateLimitBypass, cost CostFunc, logger *zap.SugaredLogger) Middleware {
+	if cost == nil {
+		cost = func(*http.Request) int { return 1 }
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ip := clientIP(request.RemoteAddr)
+			if bypass.matches(request, ip) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			units := cost(request)
+			var reported *RateLimitResult
+			for _, tier := range tiers {
+				extractKey := tier.Key
+				if extractKey == nil {
+					extractKey = ClientIPKey
+				}
+				key := "ip:" + ip
+				if id := extractKey(request); id != "" {
+					key = "key:" + id
+				}
+
+				result, err := tier.Limiter.Allow(key, units)
+				if err != nil {
+					requestLogger(logger, request.Context()).Warnw("rate limiter unavailable, allowing request", "tier", tier.Name, "error", err)
+					continue
+				}
+
+				if !result.Allowed {
+					writeRateLimitHeaders(writer.Header(), result)
+					if tier.Name != "" {
+						writer.Header().Set("X-RateLimit-Tier", tier.Name)
+					}
+					writer.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+					http.Error(writer, "Too many requests", http.StatusTooManyRequests)
+					return
+				}
+				if reported == nil || result.Remaining < reported.Remaining {
+					reported = &result
+				}
+			}
+
+			if reported != nil {
+				writeRateLimitHeaders(writer.Header(), *reported)
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func writeRateLimitHeaders(header http.Header, result RateLimitResult) {
+	header.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Headers carry whole seconds. Round up so clients never retry early
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Sends requests until one is limited, returning the X-RateLimit-Remaining of
+// each allowed one and the limited response
+func exhaust(t *testing.T, handler http.Handler, limit int) ([]int, *httptest.ResponseRecorder) {
+	t.Helper()
+	var remaining []int
+	for i := 0; i <= limit; i++ {
+		response := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+		if response.Code == http.StatusTooManyRequests {
+			return remaining, response
+		}
+		if got := response.Header().Get("X-RateLimit-Limit"); got != strconv.Itoa(limit) {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want %d", i+1, got, limit)
+		}
+		left, err := strconv.Atoi(response.Header().Get("X-RateLimit-Remaining"))
+		if err != nil {
+			t.Fatalf("request %d: X-RateLimit-Remaining: %v", i+1, err)
+		}
+		remaining = append(remaining, left)
+	}
+	t.Fatalf("%d requests were never limited", limit+1)
+	return nil, nil
+}
+
+func assertCountdown(t *testing.T, remaining []int, limit int) {
+	t.Helper()
+	if len(remaining) != limit {
+		t.Fatalf("%d requests allowed, want %d", len(remaining), limit)
+	}
+	for i, left := range remaining {
+		if want := limit - i - 1; left != want {
+			t.Errorf("request %d: X-RateLimit-Remaining = %d, want %d", i+1, left, want)
+		}
+	}
+}
+
+func assertLimited(t *testing.T, response *httptest.ResponseRecorder) {
+	t.Helper()
+	if got := response.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("limited X-RateLimit-Remaining = %q, want 0", got)
+	}
+	if retryAfter, err := strconv.Atoi(response.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", response.Header().Get("Retry-After"))
+	}
+	if reset, err := strconv.Atoi(response.Header().Get("X-RateLimit-Reset")); err != nil || reset < 1 {
+		t.Errorf("X-RateLimit-Reset = %q, want a positive number of seconds", response.Header().Get("X-RateLimit-Reset"))
+	}
+}
+
+func TestMemoryRateLimitHeaders(t *testing.T) {
+	const limit = 3
+	window := 300 * time.Millisecond
+	handler := RateLimitMiddleware(NewMemoryRateLimiter(limit, window), nil, nil, nil, testLogger())(okHandler())
+
+	remaining, limited := exhaust(t, handler, limit)
+	assertCountdown(t, remaining, limit)
+	assertLimited(t, limited)
+
+	// The bucket refills completely within a window
+	time.Sleep(window + 50*time.Millisecond)
+	remaining, _ = exhaust(t, handler, limit)
+	assertCountdown(t, remaining, limit)
+}
+
+func TestRedisRateLimitHeaders(t *testing.T) {
+	const limit = 3
+	r, server := newTestRedis(t)
+	handler := RateLimitMiddleware(NewRedisRateLimiter(r, "ratelimit:test:", limit, time.Minute), nil, nil, nil, testLogger())(okHandler())
+
+	remaining, limited := exhaust(t, handler, limit)
+	assertCountdown(t, remaining, limit)
+	assertLimited(t, limited)
+	if got := limited.Header().Get("X-RateLimit-Reset"); got != "60" {
+		t.Errorf("X-RateLimit-Reset = %q, want the window's 60 seconds", got)
+	}
+
+	server.FastForward(time.Minute)
+	remaining, _ = exhaust(t, handler, limit)
+	assertCountdown(t, remaining, limit)
+}
+
+func TestRateLimitBypass(t *testing.T) {
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	cfg := testRoute("/limited", newTestUpstream(t, "ok").URL)
+	cfg.RateLimit = RateLimit{
+		Enabled:      true,
+		Requests:     1,
+		Window:       60,
+		Allowlist:    []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32"},
+		BypassHeader: "X-Internal-Token",
+		BypassToken:  "s3cret",
+	}
+	handler := buildTestRoute(t, m, cfg)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		token      string
+		limited    bool
+	}{
+		{"allowlisted CIDR", "10.20.30.40:5000", "", false},
+		{"allowlisted IP", "192.0.2.7:5000", "", false},
+		{"allowlisted IPv6", "[2001:db8::1]:5000", "", false},
+		{"bypass token", "198.51.100.1:5000", "s3cret", false},
+		{"other client", "192.0.2.8:5000", "", true},
+		{"wrong token", "198.51.100.2:5000", "guess", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				request := httptest.NewRequest(http.MethodGet, "/limited", nil)
+				request.RemoteAddr = tt.remoteAddr
+				if tt.token != "" {
+					request.Header.Set("X-Internal-Token", tt.token)
+				}
+				response := serve(handler, request)
+
+				want := http.StatusOK
+				if tt.limited && i > 0 {
+					want = http.StatusTooManyRequests
+				}
+				if response.Code != want {
+					t.Fatalf("request %d: status %d, want %d", i+1, response.Code, want)
+				}
+				// Exempt clients aren't counted at all
+				if !tt.limited && response.Header().Get("X-RateLimit-Limit") != "" {
+					t.Errorf("request %d: exempt client got X-RateLimit headers", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitBypassInvalidAllowlist(t *testing.T) {
+	for _, entry := range []string{"10.0.0.300", "10.0.0.0/33", "example.com"} {
+		if _, err := NewRateLimitBypass([]string{entry}, "", ""); err == nil {
+			t.Errorf("allowlist entry %q accepted, want an error", entry)
+		}
+	}
+}
+
+// Connections from one IPv6 client on different ports share a quota
+func TestClientIPKeyIgnoresPort(t *testing.T) {
+	handler := RateLimitMiddleware(NewMemoryRateLimiter(1, time.Minute), nil, ClientIPKey, nil, testLogger())(okHandler())
+	from := func(remoteAddr string) int {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = remoteAddr
+		return serve(handler, request).Code
+	}
+
+	if got := from("[2001:db8::1]:1000"); got != http.StatusOK {
+		t.Fatalf("first request status %d, want 200", got)
+	}
+	if got := from("[2001:db8::1]:2000"); got != http.StatusTooManyRequests {
+		t.Errorf("same client on another port: status %d, want 429", got)
+	}
+	if got := from("[2001:db8::2]:1000"); got != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", got)
+	}
+}
+
+func TestRateLimitKeyExtractors(t *testing.T) {
+	r, _ := newTestRedis(t)
+	limiters := map[string]func(prefix string) RateLimiter{
+		"memory": func(string) RateLimiter { return NewMemoryRateLimiter(1, time.Minute) },
+		"redis":  func(prefix string) RateLimiter { return NewRedisRateLimiter(r, prefix, 1, time.Minute) },
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			send := func(handler http.Handler, remoteAddr, apiKey string) int {
+				request := httptest.NewRequest(http.MethodGet, "/", nil)
+				request.RemoteAddr = remoteAddr
+				if apiKey != "" {
+					request.Header.Set("X-API-Key", apiKey)
+				}
+				return serve(handler, request).Code
+			}
+
+			byHeader := RateLimitMiddleware(newLimiter("ratelimit:header:"), nil, HeaderKey("X-API-Key"), nil, testLogger())(okHandler())
+			if got := send(byHeader, "192.0.2.1:1000", "key-a"); got != http.StatusOK {
+				t.Fatalf("first key-a request: status %d", got)
+			}
+			if got := send(byHeader, "192.0.2.2:1000", "key-a"); got != http.StatusTooManyRequests {
+				t.Errorf("key-a from another IP: status %d, want 429", got)
+			}
+			if got := send(byHeader, "192.0.2.1:1000", "key-b"); got != http.StatusOK {
+				t.Errorf("key-b from the same IP: status %d, want 200", got)
+			}
+			// No key falls back to the IP, apart from the keyed quotas
+			if got := send(byHeader, "192.0.2.1:1000", ""); got != http.StatusOK {
+				t.Errorf("unkeyed request: status %d, want 200", got)
+			}
+
+			byIP := RateLimitMiddleware(newLimiter("ratelimit:ip:"), nil, ClientIPKey, nil, testLogger())(okHandler())
+			if got := send(byIP, "192.0.2.1:1000", "key-a"); got != http.StatusOK {
+				t.Fatalf("first request: status %d", got)
+			}
+			if got := send(byIP, "192.0.2.1:2000", "key-b"); got != http.StatusTooManyRequests {
+				t.Errorf("same IP with another key: status %d, want 429", got)
+			}
+			if got := send(byIP, "192.0.2.2:1000", "key-a"); got != http.StatusOK {
+				t.Errorf("another IP: status %d, want 200", got)
+			}
+		})
+	}
+}
+
+func TestParseKeyExtractor(t *testing.T) {
+	for _, spec := range []string{"", "ip", "global", "header:X-API-Key", "claim:sub"} {
+		if _, err := ParseKeyExtractor(spec); err != nil {
+			t.Errorf("ParseKeyExtractor(%q): %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"header:", "claim:", "cookie:session", "IP"} {
+		if _, err := ParseKeyExtractor(spec); err == nil {
+			t.Errorf("ParseKeyExtractor(%q) accepted an invalid key", spec)
+		}
+	}
+}
+
+func TestRateLimitWarmupRamps(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	warmup := NewRateLimitWarmup(start, 100*time.Second, 0.1)
+
+	previous := 0.0
+	for _, tc := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{-time.Second, 10},
+		{0, 10},
+		{25 * time.Second, 32.5},
+		{50 * time.Second, 55},
+		{100 * time.Second, 100},
+		{time.Hour, 100},
+	} {
+		got := warmup.limit(100, start.Add(tc.at))
+		if math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("limit %v in = %v, want %v", tc.at, got, tc.want)
+		}
+		if got < previous {
+			t.Errorf("limit %v in = %v, fell from %v", tc.at, got, previous)
+		}
+		previous = got
+	}
+
+	// Tiny limits still let a request through
+	if got := warmup.limit(2, start); got != 1 {
+		t.Errorf("floor of a limit of 2 = %v, want 1", got)
+	}
+	// No warm-up is the full limit from the start
+	if got := (RateLimitWarmup{}).limit(100, start); got != 100 {
+		t.Errorf("zero warm-up limit = %v, want 100", got)
+	}
+	// An out of range floor falls back to 10%
+	if got := NewRateLimitWarmup(start, time.Minute, 2).limit(100, start); got != 10 {
+		t.Errorf("limit with floor 2 = %v, want 10", got)
+	}
+}
+
+// Buckets are sized by the limit in effect when they're used
+func TestMemoryRateLimiterWarmup(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		started time.Time
+		want    int
+	}{
+		{"just started", now, 10},
+		{"half way", now.Add(-50 * time.Second), 55},
+		{"warmed up", now.Add(-time.Hour), 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := NewMemoryRateLimiter(100, time.Hour)
+			limiter.SetWarmup(NewRateLimitWarmup(tc.started, 100*time.Second, 0.1))
+
+			allowed := 0
+			for range 150 {
+				result, err := limiter.Allow("client", 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Allowed {
+					allowed++
+				}
+			}
+			if allowed != tc.want {
+				t.Errorf("allowed %d requests, want %d", allowed, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	cost := RequestCost(RateLimit{Requests: 10, Cost: 2, MethodCosts: map[string]int{http.MethodPost: 5}, CostHeader: "X-Cost"})
+	tests := []struct {
+		name   string
+		method string
+		header string
+		want   int
+	}{
+		{"base", http.MethodGet, "", 2},
+		{"method", http.MethodPost, "", 5},
+		{"header raises", http.MethodGet, "8", 8},
+		{"header can't lower", http.MethodPost, "1", 5},
+		{"unparseable header", http.MethodGet, "lots", 2},
+		{"header capped at the window", http.MethodGet, "11", 10},
+		{"huge header", http.MethodGet, strconv.Itoa(math.MaxInt), 10},
+	}
+	for _, tc := range tests {
+		request := httptest.NewRequest(tc.method, "/", nil)
+		if tc.header != "" {
+			request.Header.Set("X-Cost", tc.header)
+		}
+		if got := cost(request); got != tc.want {
+			t.Errorf("%s: cost = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if got := RequestCost(RateLimit{})(httptest.NewRequest(http.MethodGet, "/", nil)); got != 1 {
+		t.Errorf("unset cost = %d, want 1", got)
+	}
+}
+
+// A denied cost, however large, leaves the window as it was
+func TestDeniedCostsArentCharged(t *testing.T) {
+	r, _ := newTestRedis(t)
+	for _, limiter := range []RateLimiter{NewMemoryRateLimiter(10, time.Hour), NewRedisRateLimiter(r, "huge", 10, time.Hour)} {
+		for i := range 3 {
+			result, err := limiter.Allow("shared", math.MaxInt64)
+			if err != nil || result.Allowed {
+				t.Fatalf("%T: huge cost %d allowed %v, err %v, want denied", limiter, i+1, result.Allowed, err)
+			}
+		}
+		result, err := limiter.Allow("shared", 10)
+		if err != nil || !result.Allowed || result.Remaining != 0 {
+			t.Errorf("%T: whole window after huge costs: allowed %v with %d left, err %v, want it all still there", limiter, result.Allowed, result.Remaining, err)
+		}
+		// A full window doesn't overflow either, it keeps denying
+		if result, err := limiter.Allow("shared", math.MaxInt64); err != nil || result.Allowed {
+			t.Errorf("%T: huge cost on a full window allowed %v, err %v, want denied", limiter, result.Allowed, err)
+		}
+	}
+}
+
+// One client's cost header can't use up more than a window of a shared quota,
+// nor overflow the counter so the limit fails open
+func TestCostHeaderCappedAtWindow(t *testing.T) {
+	r, _ := newTestRedis(t)
+	cfg := RateLimit{Requests: 10, CostHeader: "X-Cost"}
+	handler := RateLimitMiddleware(NewRedisRateLimiter(r, "capped", 10, time.Hour), nil, GlobalKey, RequestCost(cfg), testLogger())(okHandler())
+	send := func(cost string) int {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-Cost", cost)
+		return serve(handler, request).Code
+	}
+
+	huge := strconv.Itoa(math.MaxInt)
+	if got := send(huge); got != http.StatusOK {
+		t.Fatalf("huge cost on an empty window: status = %d, want it charged as a whole window", got)
+	}
+	for i := range 3 {
+		if got := send(huge); got != http.StatusTooManyRequests {
+			t.Errorf("huge cost %d on a full window: status = %d, want 429", i+2, got)
+		}
+	}
+	if got := send("1"); got != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want the window still full, not failing open", got)
+	}
+}
+
+// POSTs costing 5 of a 10 request quota use it up five times as fast as GETs
+func TestRateLimitCosts(t *testing.T) {
+	r, _ := newTestRedis(t)
+	tests := []struct {
+		name    string
+		limiter RateLimiter
+	}{
+		{"memory", NewMemoryRateLimiter(10, time.Hour)},
+		{"redis", NewRedisRateLimiter(r, "cost", 10, time.Hour)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cost := RequestCost(RateLimit{MethodCosts: map[string]int{http.MethodPost: 5}})
+			handler := RateLimitMiddleware(tc.limiter, nil, nil, cost, testLogger())(okHandler())
+			send := func(method string, remoteAddr string) int {
+				request := httptest.NewRequest(method, "/", nil)
+				request.RemoteAddr = remoteAddr
+				return serve(handler, request).Code
+			}
+
+			for i := range 2 {
+				if got := send(http.MethodPost, "192.0.2.1:1000"); got != http.StatusOK {
+					t.Fatalf("POST %d: status = %d, want 200", i+1, got)
+				}
+			}
+			if got := send(http.MethodPost, "192.0.2.1:1000"); got != http.StatusTooManyRequests {
+				t.Errorf("third POST: status = %d, want 429", got)
+			}
+
+			// Another client, spending on GETs until too little is left for a POST
+			for i := range 6 {
+				if got := send(http.MethodGet, "192.0.2.2:1000"); got != http.StatusOK {
+					t.Fatalf("GET %d: status = %d, want 200", i+1, got)
+				}
+			}
+			if got := send(http.MethodPost, "192.0.2.2:1000"); got != http.StatusTooManyRequests {
+				t.Errorf("POST with 4 left: status = %d, want 429", got)
+			}
+			// The denied POST wasn't charged
+			if got := send(http.MethodGet, "192.0.2.2:1000"); got != http.StatusOK {
+				t.Errorf("GET after the denied POST: status = %d, want 200", got)
+			}
+		})
+	}
+}
+
+// A per-tenant limit of 2 under a global one of 3. Requests the tenant tier
+// rejects never reach the global tier, so don't count against it
+func TestRateLimitTiers(t *testing.T) {
+	for _, distributed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("distributed %v", distributed), func(t *testing.T) {
+			r, _ := newTestRedis(t)
+			cfg := testRoute("/api", newTestUpstream(t, "ok").URL)
+			cfg.RateLimit = RateLimit{
+				Enabled:     true,
+				Requests:    2,
+				Window:      3600,
+				Distributed: distributed,
+				Key:         "header:X-Tenant",
+				Tiers:       []RateLimitTier{{Name: "global", Key: "global", Requests: 3, Window: 3600}},
+			}
+			handler := buildTestRoute(t, NewRouteManager(Config{}, r, testLogger(), nil), cfg)
+			send := func(tenant string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(http.MethodGet, "/api", nil)
+				request.Header.Set("X-Tenant", tenant)
+				return serve(handler, request)
+			}
+			expect := func(tenant string, status int, tier string) {
+				t.Helper()
+				response := send(tenant)
+				if response.Code != status || response.Header().Get("X-RateLimit-Tier") != tier {
+					t.Errorf("tenant %s: status %d from tier %q, want %d from %q", tenant, response.Code, response.Header().Get("X-RateLimit-Tier"), status, tier)
+				}
+			}
+
+			expect("a", http.StatusOK, "")
+			// Headers describe the tier with the least quota left
+			if got := send("a").Header().Get("X-RateLimit-Remaining"); got != "0" {
+				t.Errorf("X-RateLimit-Remaining = %q, want the tenant tier's 0", got)
+			}
+			// Tenant limit trips while the global one has room
+			expect("a", http.StatusTooManyRequests, "route")
+			// Tenant limit passes, then the global one trips
+			expect("b", http.StatusOK, "")
+			expect("b", http.StatusTooManyRequests, "global")
+		})
+	}
+}
+
+func TestRateLimitTierNames(t *testing.T) {
+	for _, tiers := range [][]RateLimitTier{
+		{{Requests: 1, Window: 1}},
+		{{Name: "route", Requests: 1, Window: 1}},
+		{{Name: "ip", Requests: 1, Window: 1}, {Name: "ip", Requests: 1, Window: 1}},
+	} {
+		cfg := testRoute("/api", "http://localhost")
+		cfg.RateLimit = RateLimit{Enabled: true, Requests: 1, Window: 1, Tiers: tiers}
+		if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+			t.Errorf("tiers %+v accepted, want unique names", tiers)
+		}
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -26,6 +29,9 @@ func NewRedis(logger *zap.SugaredLogger) (*Redis, error) {
 
 	cacheOpts := *opts
 	cacheOpts.DB = 0
+	// Cache reads sit on the request path, let callers bound them with a
+	// context deadline
+	cacheOpts.ContextTimeoutEnabled = true
 
 	configOpts := *opts
 	configOpts.DB = 1
@@ -46,12 +52,63 @@ func NewRedis(logger *zap.SugaredLogger) (*Redis, error) {
 //     "age": 100
 // }
 
+// Both DBs share a server, pinging one checks it
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.configDb.Ping(ctx).Err()
+}
+
+// Close closes both clients, returning the errors of either
+func (r *Redis) Close() error {
+	var errs []error
+	if err := r.cacheDb.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing cache client: %w", err))
+	}
+	if err := r.configDb.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing config client: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
 // Cache DB
 func (r *Redis) Set(key string, value interface{}, expiration time.Duration) error {
 	r.logger.Debugw("setting redis key", "key", key, "expiration", expiration)
 	return r.cacheDb.Set(r.ctx, key, value, expiration).Err()
 }
 
+// Cache DB.
+// Sets key only if it doesn't exist yet. Reports whether it was set
+func (r *Redis) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	r.logger.Debugw("setting redis key if absent", "key", key, "expiration", expiration)
+	return r.cacheDb.SetNX(r.ctx, key, value, expiration).Result()
+}
+
+// Sets the value and its version, unless the stored version is already at
+// least as new. Both keys expire together
+var setNewerScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[2])
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+	redis.call("SET", KEYS[2], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+	redis.call("SET", KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// Cache DB.
+// Sets key unless a write with a version at or above version got there
+// first. The version is kept under "cachever:"+key, out of the cache's own
+// keyspace so no request URI can name it. Reports whether it was set
+func (r *Redis) SetNewer(key string, value interface{}, version int64, expiration time.Duration) (bool, error) {
+	r.logger.Debugw("setting redis key if newer", "key", key, "version", version, "expiration", expiration)
+	set, err := setNewerScript.Run(r.ctx, r.cacheDb, []string{key, "cachever:" + key}, value, version, expiration.Milliseconds()).Int()
+	return set == 1, err
+}
+
 // Cache DB
 func (r *Redis) Get(key string) (string, error) {
 	val, err := r.cacheDb.Get(r.ctx, key).Result()
@@ -61,21 +118,133 @@ func (r *Redis) Get(key string) (string, error) {
 	return val, err
 }
 
+// Cache DB.
+// Same as Get, but bounded by ctx instead of the client's own timeouts
+func (r *Redis) GetContext(ctx context.Context, key string) (string, error) {
+	val, err := r.cacheDb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil // Key doesn't exist
+	}
+	return val, err
+}
+
+// Cache DB.
+// Values of many keys, pipelined into one round-trip. Keys that don't exist
+// are left out of the result
+func (r *Redis) MGet(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.cacheDb.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(r.ctx, key)
+		}
+		return nil
+	})
+	// Exec reports the first failed command, which for a miss is just redis.Nil
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		switch {
+		case err == redis.Nil:
+			continue
+		case err != nil:
+			return nil, fmt.Errorf("getting %s: %w", keys[i], err)
+		}
+		values[keys[i]] = val
+	}
+	return values, nil
+}
+
+// Cache DB.
+// Sets many keys, all expiring after expiration, pipelined into one
+// round-trip. Every key is attempted; failures come back joined
+func (r *Redis) MSet(values map[string]interface{}, expiration time.Duration) error {
+	if len(values) == 0 {
+		return nil
+	}
+	r.logger.Debugw("setting redis keys", "count", len(values), "expiration", expiration)
+
+	cmds := make(map[string]*redis.StatusCmd, len(values))
+	_, err := r.cacheDb.Pipelined(r.ctx, func(pipe redis.Pipeliner) error {
+		for key, value := range values {
+			cmds[key] = pipe.Set(r.ctx, key, value, expiration)
+		}
+		return nil
+	})
+
+	var errs []error
+	for key, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("setting %s: %w", key, err))
+		}
+	}
+	// A pipeline that never got sent, say with no connection, may leave its
+	// commands without an error of their own
+	if len(errs) == 0 && err != nil {
+		errs = append(errs, fmt.Errorf("setting %d keys: %w", len(values), err))
+	}
+	return errors.Join(errs...)
+}
+
 // Cache DB
 func (r *Redis) Delete(key string) error {
 	return r.cacheDb.Del(r.ctx, key).Err()
 }
 
-// db 1: configuration for routes/upstreams and auth methods
+// Increments the counter for key unless that would take it past the limit,
+// and starts its expiry on the first hit, so the counter resets window after
+// the first request in it
+var incrWindowScript = redis.NewScript(`
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+if count + tonumber(ARGV[2]) > tonumber(ARGV[3]) then
+	return {count, redis.call("PTTL", KEYS[1]), 0}
+end
+count = redis.call("INCRBY", KEYS[1], ARGV[2])
+if count == tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1]), 1}
+`)
+
+// Cache DB.
+// Appends an entry to a stream. Kept out of the config DB so writing it
+// doesn't trigger a route reload
+func (r *Redis) AppendStream(stream string, fields map[string]interface{}) error {
+	return r.cacheDb.XAdd(r.ctx, &redis.XAddArgs{Stream: stream, Values: fields}).Err()
+}
+
+// Cache DB.
+// Fixed window counter, incremented by n if that keeps it within limit.
+// Returns the count, including this hit if it was counted, the time left
+// until the window resets, and whether it was counted
+func (r *Redis) IncrWindow(key string, n int, limit int, window time.Duration) (int64, time.Duration, bool, error) {
+	res, err := incrWindowScript.Run(r.ctx, r.cacheDb, []string{key}, window.Milliseconds(), n, limit).Int64Slice()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	ttl := time.Duration(res[1]) * time.Millisecond
+	// Nothing counted yet, so no window has started
+	if res[1] < 0 {
+		ttl = window
+	}
+	return res[0], ttl, res[2] == 1, nil
+}
+
+// db 1: configuration for routes/upstreams and auth methods. Middleware gets
+// injected in by the RouteManager, we just need methods
 // {
-//	    Path:      "/api/example",
-//		TargetURL: "http://localhost:8081/hello",
-//	    Middleware: []Middleware{ // Middleware gets injected in, we just need methods
-//	        logConfig.LogHandler,
-//			CORS,
-//			MethodMiddleware([]string{"GET", "POST"}),
-//		},
-// },
+//     "path": "/api/example",
+//     "targets": ["http://localhost:8081/hello"],
+//     "methods": ["GET", "POST"],
+//     "enabled": true
+// }
 
 // Header key and value used for auth. e.g: "authorization": "Bearer eyJ0...",
 // "authorization": "Basic 290j...", "X-API-KEY": "1029ja...", etc.
@@ -84,10 +253,297 @@ type Auth struct {
 	HeaderValue string
 }
 
-// If Cache.Enabled, cache upstream GET response for Cache.ExpiresIn seconds
+// One way clients may authenticate to a route: AuthJWT (a bearer token from
+// /login), AuthBasic (Basic credentials) or AuthAPIKey (Header, X-API-Key by
+// default, set to one of Keys). Realm appears in the 401 challenge
+type AuthConfig struct {
+	Type   string   `json:"type"`
+	Header string   `json:"header,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+	Realm  string   `json:"realm,omitempty"`
+}
+
+// If Cache.Enabled, cache upstream GET response for Cache.ExpiresIn seconds.
+// Responses without a Content-Length are only cached with AllowUnknownLength
 type Cache struct {
-	Enabled   bool
-	ExpiresIn float32 // Time until cached item expires, in seconds
+	Enabled            bool    `json:"enabled"`
+	ExpiresIn          float32 `json:"expires_in"` // Time until cached item expires, in seconds
+	AllowUnknownLength bool    `json:"allow_unknown_length"`
+	// Randomizes each entry's lifetime by up to this percentage either way,
+	// so entries stored together don't all expire together
+	TTLJitter float32 `json:"ttl_jitter,omitempty"`
+	// Replay the upstream's Set-Cookie headers on hits. Only for cookies
+	// that are the same for every client, anything per-user would be
+	// handed to everyone
+	StoreSetCookie bool `json:"store_set_cookie,omitempty"`
+	// Concurrent misses for the same key share one upstream fetch. Requests
+	// arriving up to CoalesceWindow seconds after the fetch started still
+	// get its response, even once it's done
+	Coalesce       bool    `json:"coalesce,omitempty"`
+	CoalesceWindow float32 `json:"coalesce_window,omitempty"`
+	// What happens when responses for the same key are stored concurrently,
+	// CacheWriteOverwrite if empty
+	WritePolicy string `json:"write_policy,omitempty"`
+	// Cache requests carrying Authorization or Cookie, keyed by those
+	// credentials so each client only gets its own responses. Otherwise such
+	// requests bypass the cache
+	PerIdentity bool `json:"per_identity,omitempty"`
+}
+
+// CacheWriteOverwrite stores every cacheable response, the last one written
+// wins. CacheWriteFirst keeps whichever was stored first until it expires.
+// CacheWriteNewest keeps the one whose upstream request was sent last, so a
+// slow, older response can't replace a fresher one
+const (
+	CacheWriteOverwrite = "overwrite"
+	CacheWriteFirst     = "first"
+	CacheWriteNewest    = "newest"
+)
+
+// If RateLimit.Enabled, allow each client RateLimit.Requests per
+// RateLimit.Window seconds. Distributed limits are counted in Redis and
+// shared by every gateway instance, otherwise each instance counts its own
+type RateLimit struct {
+	Enabled     bool    `json:"enabled"`
+	Requests    int     `json:"requests"`
+	Window      float32 `json:"window"`
+	Distributed bool    `json:"distributed"`
+
+	// Exempt clients: IPs or CIDRs, or requests sending BypassHeader set to
+	// BypassToken
+	Allowlist    []string `json:"allowlist,omitempty"`
+	BypassHeader string   `json:"bypass_header,omitempty"`
+	BypassToken  string   `json:"bypass_token,omitempty"`
+
+	// What quotas are keyed by: "ip" (default), "header:<name>" or
+	// "claim:<jwt claim>"
+	Key string `json:"key,omitempty"`
+
+	// For WarmupDuration seconds after the gateway starts, limits ramp
+	// linearly from WarmupFloor (a fraction of Requests, 0.1 if zero) up to
+	// Requests, so cold upstreams aren't hit with the full rate at once
+	WarmupDuration float32 `json:"warmup_duration,omitempty"`
+	WarmupFloor    float32 `json:"warmup_floor,omitempty"`
+
+	// Units of quota each request uses up: Cost (1 if unset), or
+	// MethodCosts for the request's method. A CostHeader on the request,
+	// e.g. set by an auth layer in front, can raise it
+	Cost        int            `json:"cost,omitempty"`
+	MethodCosts map[string]int `json:"method_costs,omitempty"`
+	CostHeader  string         `json:"cost_header,omitempty"`
+
+	// Further limits every request has to pass as well, checked in order
+	// after this one, e.g. per IP and global on top of per API key
+	Tiers []RateLimitTier `json:"tiers,omitempty"`
+}
+
+// A limit in RateLimit.Tiers. Distribution, bypass, warm-up and costs are
+// the route limit's
+type RateLimitTier struct {
+	Name     string  `json:"name"`
+	Key      string  `json:"key,omitempty"` // As RateLimit.Key
+	Requests int     `json:"requests"`
+	Window   float32 `json:"window"`
+}
+
+// Attributes to overwrite on upstream Set-Cookie headers. Empty fields keep
+// whatever the upstream sent. SameSite is one of "lax", "strict" or "none"
+type CookieRewrite struct {
+	Domain   string `json:"domain"`
+	Path     string `json:"path"`
+	Secure   bool   `json:"secure"`
+	SameSite string `json:"same_site"`
+}
+
+// What happens to the upstream's Server header: ServerPreserve (the default)
+// passes it through, ServerOverride replaces it with Value and ServerStrip
+// removes it
+type ServerHeader struct {
+	Mode  string `json:"mode,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+const (
+	ServerPreserve = "preserve"
+	ServerOverride = "override"
+	ServerStrip    = "strip"
+)
+
+// Client connection deadlines for a route's requests, in seconds, see
+// DeadlineMiddleware. Zero keeps the server's ReadTimeout/WriteTimeout
+type Deadlines struct {
+	Read  float32 `json:"read,omitempty"`
+	Write float32 `json:"write,omitempty"`
+	// Streams may go this long without data before they're cut off
+	StreamIdle float32 `json:"stream_idle,omitempty"`
+}
+
+// Upstream connection settings. Durations are in seconds, zero keeps the
+// http.DefaultTransport value. Routes with equal settings share one transport
+// and its connection pool
+type Transport struct {
+	DialTimeout           float32 `json:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout   float32 `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout float32 `json:"response_header_timeout,omitempty"`
+	IdleConnTimeout       float32 `json:"idle_conn_timeout,omitempty"`
+	MaxIdleConnsPerHost   int     `json:"max_idle_conns_per_host,omitempty"`
+	MaxIdleConns          int     `json:"max_idle_conns,omitempty"`
+	// Upstream responses with larger headers fail with a 502. Defaults to 1mb
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes,omitempty"`
+	InsecureSkipVerify     bool  `json:"insecure_skip_verify,omitempty"`
+	// Host name sent as SNI and checked against HTTPS targets' certificates,
+	// for targets given by IP. Empty uses the target's host
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// A fresh connection per request, for upstreams that mishandle reuse
+	DisableKeepAlives bool `json:"disable_keep_alives,omitempty"`
+	// Seconds between lookups of a target's hostname, see dnsCache. Zero
+	// leaves pooled connections on the address they were dialed to
+	DNSRefresh float32 `json:"dns_refresh,omitempty"`
+	// Egress proxy URL upstream requests go through, except to NoProxy hosts
+	// (NO_PROXY syntax). Empty follows HTTP_PROXY/HTTPS_PROXY/NO_PROXY,
+	// ProxyDirect never uses one. See egressProxy
+	Proxy   string `json:"proxy,omitempty"`
+	NoProxy string `json:"no_proxy,omitempty"`
+}
+
+// Retries for proxied requests, see retryTransport. Requests carrying an
+// Idempotency-Key are retried on errors and 5xx answers, GET, HEAD and
+// OPTIONS without one only when the upstream resets the connection. A keyed
+// 5xx moves to another target while one is left. Attempts counts the first
+// try and defaults to 3; 1 disables retries. BaseDelay is in seconds. Targets
+// is how many distinct targets a request that keeps failing is tried on,
+// Attempts times each; 0 or 1 disables failover
+type RetryConfig struct {
+	Attempts  int     `json:"attempts,omitempty"`
+	BaseDelay float32 `json:"base_delay,omitempty"`
+	Targets   int     `json:"targets,omitempty"`
+}
+
+// Attempts with the default applied
+func (c RetryConfig) attempts() int {
+	if c.Attempts <= 0 {
+		return 3
+	}
+	return c.Attempts
+}
+
+// Stops proxying to a target after Failures consecutive errors or 5xx
+// responses (default 5), probing again after Cooldown seconds (default 30)
+type CircuitBreakerConfig struct {
+	Enabled  bool            `json:"enabled"`
+	Failures int             `json:"failures,omitempty"`
+	Cooldown float32         `json:"cooldown,omitempty"`
+	Fallback BreakerFallback `json:"fallback"`
+}
+
+// What requests hitting an open breaker get instead of a 503. Mode is one of
+// FallbackStatic, FallbackLastGood or FallbackRedirect; empty keeps the 503
+type BreakerFallback struct {
+	Mode string `json:"mode,omitempty"`
+
+	// FallbackStatic: the response, 200 if Status is zero
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+
+	// FallbackLastGood: how many URLs' responses are remembered, 100 if zero
+	MaxEntries int `json:"max_entries,omitempty"`
+
+	// FallbackRedirect: the backup route's path or URL, the part of the
+	// request path after the route's is appended
+	Location string `json:"location,omitempty"`
+}
+
+// FallbackStatic answers with a fixed response. FallbackLastGood replays the
+// last successful GET response for the URL, or the 503 if there isn't one.
+// FallbackRedirect sends clients to a backup route with a 307
+const (
+	FallbackStatic   = "static"
+	FallbackLastGood = "last_good"
+	FallbackRedirect = "redirect"
+)
+
+// Request body integrity checks. Headers maps checksum header names to
+// algorithms (md5, sha1, sha256, sha512), Content-MD5 and X-Checksum-SHA256
+// if empty. Required rejects requests carrying none of them
+type Checksum struct {
+	Enabled      bool              `json:"enabled"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Required     bool              `json:"required,omitempty"`
+	MaxBodyBytes int64             `json:"max_body_bytes,omitempty"`
+}
+
+// A header the access log includes. Values over MaxLength bytes (256 if
+// zero) are truncated. Redact replaces the value with ***, keeping only a
+// leading auth scheme, so Authorization logs as "Bearer ***"
+type LogHeader struct {
+	Name      string `json:"name"`
+	Redact    bool   `json:"redact,omitempty"`
+	MaxLength int    `json:"max_length,omitempty"`
+}
+
+// Decodes compressed request bodies before they're forwarded, see
+// DecompressRequests. MaxBodyBytes caps the decoded size, 10mb if zero
+type Decompression struct {
+	Enabled      bool  `json:"enabled"`
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+}
+
+// Lets POST requests carry their real method in Header
+// (X-HTTP-Method-Override by default), for clients that can only send GET and
+// POST. Methods are those it may name, out of PUT, PATCH and DELETE, all
+// three if empty
+type MethodOverride struct {
+	Enabled bool     `json:"enabled"`
+	Header  string   `json:"header,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+// Forwards the mTLS client certificate to the upstream. Header names default
+// to X-Client-Cert-Subject and X-Client-Cert-Fingerprint
+type ClientCert struct {
+	Enabled           bool   `json:"enabled"`
+	SubjectHeader     string `json:"subject_header,omitempty"`
+	FingerprintHeader string `json:"fingerprint_header,omitempty"`
+}
+
+// Ejects a target for EjectionTime seconds (default 30, growing with repeat
+// ejections) when at least ErrorPercent (default 50) of its requests over the
+// last Window seconds (default 30) failed, once it has seen MinRequests
+// (default 10)
+type OutlierDetection struct {
+	Enabled      bool    `json:"enabled"`
+	Window       float32 `json:"window,omitempty"`
+	ErrorPercent float32 `json:"error_percent,omitempty"`
+	MinRequests  int     `json:"min_requests,omitempty"`
+	EjectionTime float32 `json:"ejection_time,omitempty"`
+}
+
+// Samples requests into Redis for replaying from the admin API. SampleRate
+// is the share captured, 0 to 1. TTL is in seconds, an hour by default
+type Capture struct {
+	Enabled      bool    `json:"enabled"`
+	SampleRate   float32 `json:"sample_rate"`
+	TTL          float32 `json:"ttl,omitempty"`
+	MaxBodyBytes int64   `json:"max_body_bytes,omitempty"`
+}
+
+// Response security headers. Each field holds the header's value: empty uses
+// the default and "off" leaves the header unset. HSTS is only sent over HTTPS
+type SecurityHeaders struct {
+	Enabled               bool   `json:"enabled"`
+	StrictTransport       string `json:"strict_transport_security,omitempty"`
+	ContentTypeOptions    string `json:"content_type_options,omitempty"`
+	FrameOptions          string `json:"frame_options,omitempty"`
+	ReferrerPolicy        string `json:"referrer_policy,omitempty"`
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"` // No default
+}
+
+// Aggregate routes GET every upstream and merge the JSON responses under their
+// keys instead of proxying. Timeout is the overall deadline in seconds
+type Aggregate struct {
+	Upstreams map[string]string `json:"upstreams"`
+	Timeout   float32           `json:"timeout"`
 }
 
 type Target struct {
@@ -95,16 +551,152 @@ type Target struct {
 	Cache Cache
 }
 
+// PathModePreserve appends the full incoming path to the target's path, so
+// /api/users?id=1 sent to http://users/v1 goes to /v1/api/users?id=1.
+// PathModeReplace sends every request to the target's path as is, /v1?id=1.
+// Either way the incoming query is merged with the target's
+const (
+	PathModePreserve = "preserve"
+	PathModeReplace  = "replace"
+)
+
 type RouteConfig struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// Host restricts the route to requests for that Host. "*.example.com"
+	// matches any subdomain of example.com. Empty matches every host
+	Host    string   `json:"host,omitempty"`
 	Path    string   `json:"path"`
 	Targets []string `json:"targets"`
-	Methods []string `json:"methods"`
-	Auth    Auth     `json:"auth"`
+	// One of the LoadBalanceStrategy values, round_robin if empty. Weights
+	// are keyed by target and default to 1
+	LoadBalance string         `json:"load_balance,omitempty"`
+	Weights     map[string]int `json:"weights,omitempty"`
+	// Seconds over which a new or recovered target's weight ramps up from
+	// a tenth to its full weight. Zero sends it full traffic at once
+	SlowStart float32 `json:"slow_start,omitempty"`
+	// Seeds weighted_random and p2c so they pick the same sequence of targets
+	// on every reload, for reproducible tests. Zero picks at random
+	SelectionSeed int64 `json:"selection_seed,omitempty"`
+	// How the upstream path is built, PathModePreserve if empty
+	PathMode string   `json:"path_mode,omitempty"`
+	Methods  []string `json:"methods"`
+	Auth     Auth     `json:"auth"`
+	// When set, requests must pass at least one of these, tried in order
+	AuthMethods []AuthConfig `json:"auth_methods,omitempty"`
+
+	// Host header sent upstream. By default the client's Host is forwarded
+	// untouched; with PreserveHost off it's the target's host instead.
+	// UpstreamHost, when set, is sent whatever PreserveHost says. Rewritten
+	// requests carry the client's Host in X-Forwarded-Host
+	PreserveHost bool   `json:"preserve_host"`
+	UpstreamHost string `json:"upstream_host,omitempty"`
+
+	// Path to an OpenAPI 3 spec file. When set, requests are validated
+	// against it before being proxied
+	OpenAPISpec string   `json:"openapi_spec,omitempty"`
+	Checksum    Checksum `json:"checksum"`
+
+	RateLimit RateLimit `json:"rate_limit"`
+	Cache     Cache     `json:"cache"`
+
+	CookieRewrite CookieRewrite `json:"cookie_rewrite"`
+
+	// Pseudonym added to upstream responses' Via header, e.g. "lattice".
+	// Empty adds nothing
+	Via    string       `json:"via,omitempty"`
+	Server ServerHeader `json:"server"`
+
+	// Upstream statuses rewritten before they reach clients, e.g. 418 to 503.
+	// With StatusRemapBody the upstream's body is replaced by the gateway's
+	// error response for the new status
+	StatusRemap     map[int]int `json:"status_remap,omitempty"`
+	StatusRemapBody bool        `json:"status_remap_body,omitempty"`
+
+	// Checks on WebSocket upgrades, see WebSocketMiddleware
+	WSAllowedOrigins []string `json:"ws_allowed_origins,omitempty"`
+	WSSubprotocols   []string `json:"ws_subprotocols,omitempty"`
+
+	// Translates gRPC-Web from browsers to gRPC, see GRPCWebMiddleware
+	GRPCWeb bool `json:"grpc_web,omitempty"`
+
+	// Names of registered Transformers applied to the route's traffic, in
+	// order, see TransformerRegistry
+	Transformers []string `json:"transformers,omitempty"`
+
+	// Seconds the route's requests may take before they're answered 504, in
+	// place of the server's RequestTimeout. Negative lifts the limit, which
+	// long-lived streams need, see TimeoutMiddleware
+	RequestTimeout float32 `json:"request_timeout,omitempty"`
+
+	Transport Transport   `json:"transport"`
+	Deadlines Deadlines   `json:"deadlines"`
+	Aggregate Aggregate   `json:"aggregate"`
+	Retry     RetryConfig `json:"retry"`
+
+	CircuitBreaker   CircuitBreakerConfig `json:"circuit_breaker"`
+	OutlierDetection OutlierDetection     `json:"outlier_detection"`
+
+	SecurityHeaders SecurityHeaders `json:"security_headers"`
+	ClientCert      ClientCert      `json:"client_cert"`
+	Capture         Capture         `json:"capture"`
+	Decompression   Decompression   `json:"decompression"`
+	MethodOverride  MethodOverride  `json:"method_override"`
+
+	// LogDisabled drops the route's access log lines. LogFields are static
+	// fields (team, service, ...) added to each of them
+	LogDisabled bool              `json:"log_disabled,omitempty"`
+	LogFields   map[string]string `json:"log_fields,omitempty"`
+	// LogQuery adds query strings to the access log, masking RedactParams
+	LogQuery     bool     `json:"log_query,omitempty"`
+	RedactParams []string `json:"redact_params,omitempty"`
+	// Headers added to the access log. Only these are logged
+	LogRequestHeaders  []LogHeader `json:"log_request_headers,omitempty"`
+	LogResponseHeaders []LogHeader `json:"log_response_headers,omitempty"`
+	// Debug logs which target each request was sent to and why
+	LogSelection bool `json:"log_selection,omitempty"`
+	// Adds X-Cache-Key, X-Cache-TTL-Remaining and X-Upstream-Duration to
+	// responses. They show how the gateway and its cache work, so only turn it
+	// on while diagnosing
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+
+	// Latency objective in seconds. When set, the share of requests answered
+	// within it over the last SLOWindow seconds (5 minutes if zero) is tracked
+	SLOTargetLatency float32 `json:"slo_target_latency,omitempty"`
+	SLOWindow        float32 `json:"slo_window,omitempty"`
+
+	// Disabled routes answer 503 with MaintenanceMessage instead of proxying
+	Enabled            bool   `json:"enabled"`
+	MaintenanceMessage string `json:"maintenance_message,omitempty"`
+
+	// Whether request bodies may be held in memory. Turning it off streams
+	// uploads straight through: bodies aren't retried, captured or checked
+	// against the OpenAPI spec, and checksums can't be enabled
+	BufferRequestBody bool `json:"buffer_request_body"`
+}
+
+// Key identifies the route in the config DB: its path, prefixed with the
+// host for host-bound routes
+func (c RouteConfig) Key() string {
+	return c.Host + c.Path
+}
+
+// Enabled, PreserveHost and BufferRequestBody default to true when a stored
+// config doesn't mention them
+func (c *RouteConfig) UnmarshalJSON(data []byte) error {
+	type routeConfig RouteConfig
+	cfg := routeConfig{Enabled: true, PreserveHost: true, BufferRequestBody: true}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	*c = RouteConfig(cfg)
+	return nil
 }
 
 // Config DB.
-// Key should be the RouteConfig.path
+// Key should be RouteConfig.Key()
 func (r *Redis) SetConf(key string, config RouteConfig) error {
+	config.SchemaVersion = currentSchemaVersion
 	data, err := json.Marshal(config)
 	if err != nil {
 		return err
@@ -113,7 +705,13 @@ func (r *Redis) SetConf(key string, config RouteConfig) error {
 }
 
 // Config DB.
-// Key should be the RouteConfig.path. Onus is on calling function to deserialize
+// Key should be RouteConfig.Key()
+func (r *Redis) DeleteConf(key string) error {
+	return r.configDb.Del(r.ctx, key).Err()
+}
+
+// Config DB.
+// Key should be RouteConfig.Key(). Onus is on calling function to deserialize
 // (unmarshal) into the correct struct type
 func (r *Redis) GetConf(key string) (string, error) {
 	val, err := r.configDb.Get(r.ctx, key).Result()
@@ -122,3 +720,73 @@ func (r *Redis) GetConf(key string) (string, error) {
 	}
 	return val, err
 }
+
+// Config DB.
+// Key should be RouteConfig.Key(). Configs stored by older versions are
+// upgraded to the current schema
+func (r *Redis) GetRouteConfig(key string) (RouteConfig, error) {
+	val, err := r.configDb.Get(r.ctx, key).Result()
+	if err != nil {
+		return RouteConfig{}, err
+	}
+	return r.decodeRouteConfig(key, []byte(val))
+}
+
+// Config DB.
+// Every stored RouteConfig. Values that don't unmarshal are logged and skipped
+func (r *Redis) ListConfs() ([]RouteConfig, error) {
+	var configs []RouteConfig
+
+	iter := r.configDb.Scan(r.ctx, 0, "*", 0).Iterator()
+	for iter.Next(r.ctx) {
+		key := iter.Val()
+		val, err := r.configDb.Get(r.ctx, key).Result()
+		if err == redis.Nil {
+			continue // Deleted mid-scan
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		config, err := r.decodeRouteConfig(key, []byte(val))
+		if err != nil {
+			r.logger.Warnw("skipping malformed route config", "key", key, "error", err)
+			continue
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, iter.Err()
+}
+
+// Config DB.
+// Calls onChange with the affected key whenever a config is set, deleted or
+// expires, until ctx is canceled. Relies on keyspace notifications, which
+// are turned on here if the server has them disabled entirely
+func (r *Redis) WatchConfs(ctx context.Context, onChange func(key string)) error {
+	events, err := r.configDb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		r.logger.Warnw("reading keyspace notification config", "error", err)
+	} else if events["notify-keyspace-events"] == "" {
+		if err := r.configDb.ConfigSet(ctx, "notify-keyspace-events", "Kg$x").Err(); err != nil {
+			r.logger.Warnw("enabling keyspace notifications", "error", err)
+		}
+	}
+
+	prefix := fmt.Sprintf("__keyspace@%d__:", r.configDb.Options().DB)
+	sub := r.configDb.PSubscribe(ctx, prefix+"*")
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			onChange(strings.TrimPrefix(msg.Channel, prefix))
+		}
+	}
+}
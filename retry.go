@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how Retry repeats an operation. The zero value makes
+// a single attempt
+type RetryPolicy struct {
+	Attempts   int           // Including the first. Less than 1 means 1
+	BaseDelay  time.Duration // Backoff before the second attempt, doubling after
+	MaxBackoff time.Duration // Cap on a single backoff. Zero means 30s
+	MaxElapsed time.Duration // Cap on total time including backoff. Zero means none
+
+	// Reports whether a failure is worth retrying. Nil retries every error
+	// not wrapped with Permanent
+	Retryable func(error) bool
+	// Reports failures worth retrying straight away, such as a reset on a
+	// connection the upstream just closed. Only the first of them skips the
+	// backoff, a second means the upstream really is failing
+	Immediate func(error) bool
+	// Called before sleeping off the backoff ahead of attempt+1
+	OnRetry func(attempt int, err error)
+	// Time source for backoff, so retries can be driven without real delays.
+	// Nil uses the real clock
+	Clock Clock
+	// Shared with the other retry layers serving the same inbound request.
+	// Every attempt takes one from it, and retries stop once it's spent. Nil
+	// never runs out
+	Budget *AttemptBudget
+}
+
+// No upstream attempts are left in the inbound request's AttemptBudget
+var ErrAttemptBudgetExhausted = errors.New("upstream attempt budget exhausted")
+
+// AttemptBudget caps the upstream attempts one inbound request may cause,
+// counted across every layer that retries: the proxy's retries, failover to
+// other targets, and HttpClient calls made with the request's context. It
+// lives in the request's RequestContext, see UpstreamAttempts
+type AttemptBudget struct {
+	left atomic.Int64
+}
+
+func NewAttemptBudget(attempts int) *AttemptBudget {
+	b := &AttemptBudget{}
+	b.left.Store(int64(attempts))
+	return b
+}
+
+// Take counts one attempt, reporting false, and counting nothing, once the
+// budget is spent. A nil AttemptBudget never is
+func (b *AttemptBudget) Take() bool {
+	if b == nil {
+		return true
+	}
+	for {
+		left := b.left.Load()
+		if left <= 0 {
+			return false
+		}
+		if b.left.CompareAndSwap(left, left-1) {
+			return true
+		}
+	}
+}
+
+// Attempts left, -1 for a nil AttemptBudget
+func (b *AttemptBudget) Remaining() int {
+	if b == nil {
+		return -1
+	}
+	return int(b.left.Load())
+}
+
+// UpstreamAttempts gives each request an AttemptBudget of attempts in its
+// RequestContext, unless it already has one. Zero or less sets none
+func UpstreamAttempts(attempts int) Middleware {
+	return func(next http.Handler) http.Handler {
+		if attempts <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request, rc := ensureRequestContext(request)
+			if rc.AttemptBudget() == nil {
+				rc.SetAttemptBudget(NewAttemptBudget(attempts))
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not worth retrying whatever the policy's
+// Retryable says. Retry returns the wrapped error
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// A panic recovered from a caller-supplied callback: a retry policy hook, a
+// clock, a JSON codec or the operation being retried
+type PanicError struct {
+	Callback string
+	Value    interface{}
+	Stack    []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked: %v", e.Callback, e.Value)
+}
+
+// Runs fn, returning a *PanicError if it panics
+func recoverCallback(callback string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Callback: callback, Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// isConnectionReset reports whether err is the peer dropping the connection
+// before a response arrived: a reset, a write to a closed connection or an
+// unexpected EOF. Typical of upstreams restarting during a deploy
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// Retry calls fn until it succeeds, returns a permanent or non-retryable
+// error, or the policy runs out. Backoff is exponential with jitter. Retries
+// also stop, without sleeping, if the next backoff would overrun MaxElapsed
+// or ctx's deadline, when the policy's Budget is spent, or when ctx ends
+// while waiting. ErrAttemptBudgetExhausted is returned if the Budget has
+// nothing left for the first attempt. Otherwise the last error from fn
+// is returned. A panic in fn or any of the policy's callbacks ends the
+// retries and is returned as a *PanicError
+func Retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	return recoverCallback("retry", func() error {
+		return retry(ctx, policy, fn)
+	})
+}
+
+func retry(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	clock := policy.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	attempts := max(policy.Attempts, 1)
+	began := clock.Now()
+	retriedImmediately := false
+	if !policy.Budget.Take() {
+		return ErrAttemptBudgetExhausted
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt == attempts-1 || (policy.Retryable != nil && !policy.Retryable(err)) {
+			return err
+		}
+
+		backoff := calcBackoff(attempt, policy.BaseDelay, policy.MaxBackoff)
+		if !retriedImmediately && policy.Immediate != nil && policy.Immediate(err) {
+			retriedImmediately = true
+			backoff = 0
+		}
+		resumeAt := clock.Now().Add(backoff)
+		if policy.MaxElapsed > 0 && resumeAt.Sub(began) > policy.MaxElapsed {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && resumeAt.After(deadline) {
+			return err
+		}
+		if !policy.Budget.Take() {
+			return err
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt+1, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(backoff):
+		}
+	}
+}
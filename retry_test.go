@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errFlaky = errors.New("flaky")
+
+// An operation failing with errFlaky until it has been called succeedOn times
+func failUntil(succeedOn int, calls *int) func() error {
+	return func() error {
+		*calls++
+		if *calls < succeedOn {
+			return errFlaky
+		}
+		return nil
+	}
+}
+
+func TestRetrySucceedsAfterRetries(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	err := Retry(context.Background(), RetryPolicy{Attempts: 5, BaseDelay: 100 * time.Millisecond, Clock: clock}, failUntil(3, &calls))
+	if err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("called %d times, want 3", calls)
+	}
+	waits := clock.Waits()
+	if len(waits) != 2 {
+		t.Fatalf("backed off %d times, want 2", len(waits))
+	}
+	// 100ms then 200ms, each within the 20% jitter
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if waits[i] < want*8/10 || waits[i] > want*12/10 {
+			t.Errorf("backoff %d = %v, want about %v", i+1, waits[i], want)
+		}
+	}
+}
+
+func TestRetryExhaustion(t *testing.T) {
+	calls := 0
+	retries := 0
+	policy := RetryPolicy{
+		Attempts:  3,
+		BaseDelay: time.Millisecond,
+		Clock:     newFakeClock(),
+		OnRetry:   func(int, error) { retries++ },
+	}
+	err := Retry(context.Background(), policy, failUntil(10, &calls))
+	if !errors.Is(err, errFlaky) {
+		t.Errorf("err = %v, want the last failure", err)
+	}
+	if calls != 3 || retries != 2 {
+		t.Errorf("%d calls and %d retries, want 3 and 2", calls, retries)
+	}
+}
+
+func TestRetryStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	calls := 0
+	started := time.Now()
+	err := Retry(ctx, RetryPolicy{Attempts: 5, BaseDelay: time.Hour, MaxBackoff: time.Hour}, failUntil(10, &calls))
+	if !errors.Is(err, errFlaky) {
+		t.Errorf("err = %v, want the failure before the cancel", err)
+	}
+	if calls != 1 {
+		t.Errorf("called %d times, want no attempt after the cancel", calls)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("took %v, want the backoff cut short by the cancel", elapsed)
+	}
+}
+
+// A backoff that would overrun the deadline isn't slept at all
+func TestRetryStopsBeforeDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	calls := 0
+	started := time.Now()
+	Retry(ctx, RetryPolicy{Attempts: 3, BaseDelay: time.Hour, MaxBackoff: time.Hour}, failUntil(10, &calls))
+	if calls != 1 || time.Since(started) > time.Second {
+		t.Errorf("%d calls in %v, want 1 without waiting", calls, time.Since(started))
+	}
+}
+
+func TestRetryPermanentAndRetryable(t *testing.T) {
+	calls := 0
+	err := Retry(context.Background(), RetryPolicy{Attempts: 3, Clock: newFakeClock()}, func() error {
+		calls++
+		return Permanent(errFlaky)
+	})
+	if err != errFlaky || calls != 1 {
+		t.Errorf("permanent: err %v after %d calls, want the unwrapped error after 1", err, calls)
+	}
+
+	calls = 0
+	policy := RetryPolicy{Attempts: 3, Clock: newFakeClock(), Retryable: func(err error) bool { return !errors.Is(err, errFlaky) }}
+	if err := Retry(context.Background(), policy, failUntil(10, &calls)); !errors.Is(err, errFlaky) || calls != 1 {
+		t.Errorf("non-retryable: err %v after %d calls, want errFlaky after 1", err, calls)
+	}
+}
+
+// Only the first immediate failure skips the backoff
+func TestRetryImmediate(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	policy := RetryPolicy{Attempts: 3, BaseDelay: time.Second, Clock: clock, Immediate: func(err error) bool { return errors.Is(err, io.EOF) }}
+	Retry(context.Background(), policy, func() error {
+		calls++
+		return io.EOF
+	})
+	waits := clock.Waits()
+	if calls != 3 || len(waits) != 2 || waits[0] != 0 || waits[1] == 0 {
+		t.Errorf("%d calls, waits %v, want 3 calls with only the first retry immediate", calls, waits)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewAttemptBudget(2)
+	calls := 0
+	err := Retry(context.Background(), RetryPolicy{Attempts: 5, Clock: newFakeClock(), Budget: budget}, failUntil(10, &calls))
+	if !errors.Is(err, errFlaky) || calls != 2 {
+		t.Errorf("err %v after %d calls, want errFlaky after the budget's 2", err, calls)
+	}
+	if err := Retry(context.Background(), RetryPolicy{Attempts: 5, Budget: budget}, failUntil(1, &calls)); !errors.Is(err, ErrAttemptBudgetExhausted) {
+		t.Errorf("with the budget spent err = %v, want ErrAttemptBudgetExhausted", err)
+	}
+}
+
+func TestRetryRecoversPanics(t *testing.T) {
+	boom := func(error) bool { panic("bug") }
+	for name, policy := range map[string]RetryPolicy{
+		"retryable": {Attempts: 3, Clock: newFakeClock(), Retryable: boom},
+		"immediate": {Attempts: 3, Clock: newFakeClock(), Immediate: boom},
+		"on retry":  {Attempts: 3, Clock: newFakeClock(), OnRetry: func(int, error) { panic("bug") }},
+	} {
+		calls := 0
+		err := Retry(context.Background(), policy, failUntil(3, &calls))
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "bug" {
+			t.Errorf("%s: err = %v, want a *PanicError", name, err)
+		}
+		if calls != 1 {
+			t.Errorf("%s: %d calls, want retries to stop at the panic", name, calls)
+		}
+	}
+
+	calls := 0
+	err := Retry(context.Background(), RetryPolicy{Attempts: 3}, func() error {
+		calls++
+		panic("operation bug")
+	})
+	if !errors.As(err, new(*PanicError)) || calls != 1 {
+		t.Errorf("panicking operation: err = %v after %d calls, want a *PanicError after 1", err, calls)
+	}
+}
+
+// One inbound request whose route retries and fails over between two failing
+// targets, then calls out through an HttpClient that retries too. Every
+// layer draws on the same budget
+func TestAttemptBudgetAcrossLayers(t *testing.T) {
+	var calls atomic.Int32
+	first := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	second := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+	external := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+
+	cfg := testRoute("/orders", first.URL, second.URL)
+	cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001}
+	route := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+	client := NewHttpClient(nil, testLogger())
+	client.SetClock(newFakeClock())
+
+	var clientErr error
+	inbound := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route.ServeHTTP(httptest.NewRecorder(), request)
+		_, clientErr = client.GetReq(request.Context(), external.URL, nil)
+	})
+	send := func(handler http.Handler) {
+		request := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		request.Header.Set(IdempotencyKeyHeader, "order-1")
+		serve(handler, request)
+	}
+
+	const maxAttempts = 4
+	send(inbound)
+	uncapped := calls.Load()
+	if uncapped <= maxAttempts {
+		t.Fatalf("uncapped request made %d upstream calls, want more than %d for the cap to matter", uncapped, maxAttempts)
+	}
+
+	calls.Store(0)
+	send(UpstreamAttempts(maxAttempts)(inbound))
+	if got := calls.Load(); got != maxAttempts {
+		t.Errorf("capped request made %d upstream calls, want %d (%d uncapped)", got, maxAttempts, uncapped)
+	}
+	if !errors.Is(clientErr, ErrAttemptBudgetExhausted) {
+		t.Errorf("HttpClient err = %v, want the budget spent by the proxy", clientErr)
+	}
+}
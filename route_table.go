@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Routes grouped by the Host they are bound to. A request is matched against
+// the most specific host tier first: an exact host, then wildcard hosts from
+// the longest suffix down, then routes without a host. Within a tier the
+// usual ServeMux path precedence applies, and a tier with no matching path
+// falls through to the next one
+type routeTable struct {
+	exact    map[string]*http.ServeMux
+	wildcard []wildcardRoutes
+	anyHost  *http.ServeMux
+	routes   int // Routes registered from configs
+}
+
+// Routes for "*.suffix", matching any subdomain of suffix but not suffix itself
+type wildcardRoutes struct {
+	suffix string // Including the leading dot
+	mux    *http.ServeMux
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		exact:   make(map[string]*http.ServeMux),
+		anyHost: http.NewServeMux(),
+	}
+}
+
+// Handle registers a route. ServeMux panics on conflicting patterns, that is
+// reported as an error instead
+func (t *routeTable) Handle(host string, path string, handler http.Handler) (err error) {
+	mux := t.muxFor(normalizeHost(host))
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("registering route: %v", r)
+		}
+	}()
+	mux.Handle(path, handler)
+
+	return nil
+}
+
+func (t *routeTable) muxFor(host string) *http.ServeMux {
+	switch {
+	case host == "":
+		return t.anyHost
+	case strings.HasPrefix(host, "*."):
+		suffix := host[1:]
+		for _, w := range t.wildcard {
+			if w.suffix == suffix {
+				return w.mux
+			}
+		}
+		w := wildcardRoutes{suffix: suffix, mux: http.NewServeMux()}
+		t.wildcard = append(t.wildcard, w)
+		sort.Slice(t.wildcard, func(i, j int) bool {
+			return len(t.wildcard[i].suffix) > len(t.wildcard[j].suffix)
+		})
+		return w.mux
+	default:
+		mux, ok := t.exact[host]
+		if !ok {
+			mux = http.NewServeMux()
+			t.exact[host] = mux
+		}
+		return mux
+	}
+}
+
+func (t *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := normalizeHost(r.Host)
+
+	if mux, ok := t.exact[host]; ok && serveIfMatched(mux, w, r) {
+		return
+	}
+	for _, wildcard := range t.wildcard {
+		if strings.HasSuffix(host, wildcard.suffix) && serveIfMatched(wildcard.mux, w, r) {
+			return
+		}
+	}
+
+	t.anyHost.ServeHTTP(w, r)
+}
+
+func serveIfMatched(mux *http.ServeMux, w http.ResponseWriter, r *http.Request) bool {
+	if _, pattern := mux.Handler(r); pattern == "" {
+		return false
+	}
+	mux.ServeHTTP(w, r)
+	return true
+}
+
+// Host headers are case-insensitive and may carry a port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(name))
+	})
+}
+
+func TestRouteTableHostRouting(t *testing.T) {
+	table := newRouteTable()
+	for _, route := range []struct{ host, path, name string }{
+		{"api.example.com", "/v1/", "exact v1"},
+		{"API.example.com", "/v2/", "exact v2"},
+		{"*.example.com", "/v1/", "wildcard"},
+		{"*.eu.example.com", "/v1/", "eu wildcard"},
+		{"", "/v1/", "any host"},
+	} {
+		if err := table.Handle(route.host, route.path, named(route.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host, path string
+		want       string
+	}{
+		{"api.example.com", "/v1/users", "exact v1"},
+		{"API.Example.com:8443", "/v1/users", "exact v1"},
+		{"api.example.com.", "/v1/users", "exact v1"},
+		{"api.example.com", "/v2/users", "exact v2"},
+		// An exact host without the path falls through to the wildcard
+		{"www.example.com", "/v1/users", "wildcard"},
+		{"a.b.example.com", "/v1/users", "wildcard"},
+		// The longest wildcard suffix wins
+		{"fr.eu.example.com", "/v1/users", "eu wildcard"},
+		// Wildcards don't match the bare domain
+		{"example.com", "/v1/users", "any host"},
+		{"other.test", "/v1/users", "any host"},
+		// Host+path combinations that nothing covers
+		{"www.example.com", "/v2/users", "404 page not found\n"},
+		{"other.test", "/v2/users", "404 page not found\n"},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		request.Host = tt.host
+		if got := serve(table, request).Body.String(); got != tt.want {
+			t.Errorf("%s%s routed to %q, want %q", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableConflict(t *testing.T) {
+	table := newRouteTable()
+	if err := table.Handle("api.example.com", "/v1/", named("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Handle("api.example.com", "/v1/", named("second")); err == nil {
+		t.Error("registering the same host and path twice, want an error")
+	}
+	// The same path on another host is a different route
+	if err := table.Handle("*.example.com", "/v1/", named("wildcard")); err != nil {
+		t.Errorf("same path on a wildcard host: %v", err)
+	}
+}
+
+// 1000 routes spread over exact hosts, wildcard hosts and no host, each with
+// a few paths
+func largeRouteTable(b *testing.B) (*routeTable, []*http.Request) {
+	table := newRouteTable()
+	var requests []*http.Request
+	for i := 0; i < 250; i++ {
+		for _, host := range []string{fmt.Sprintf("svc%d.example.com", i), fmt.Sprintf("*.tenant%d.example.com", i)} {
+			for j := 0; j < 2; j++ {
+				path := fmt.Sprintf("/api/v%d/", j)
+				if err := table.Handle(host, path, named(host+path)); err != nil {
+					b.Fatal(err)
+				}
+				request := httptest.NewRequest(http.MethodGet, path+"items", nil)
+				request.Host = strings.Replace(host, "*", "acme", 1)
+				requests = append(requests, request)
+			}
+		}
+	}
+	if len(requests) != 1000 {
+		b.Fatalf("built %d routes, want 1000", len(requests))
+	}
+	// Misses fall through every tier to the catch-all
+	table.Handle("", "/", named("catch-all"))
+	miss := httptest.NewRequest(http.MethodGet, "/unrouted", nil)
+	miss.Host = "unknown.example.org"
+	return table, append(requests, miss)
+}
+
+func BenchmarkRouteTableLookup(b *testing.B) {
+	table, requests := largeRouteTable(b)
+	writer := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.ServeHTTP(writer, requests[i%len(requests)])
+	}
+}
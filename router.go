@@ -1,46 +1,800 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
 )
 
-type Route struct {
-	Path       string
-	TargetURL  string
-	Methods    []string
-	Middleware []Middleware
+// Routes always served, whether or not Redis is reachable. Configs stored in
+// Redis are layered on top and replace a default with the same path
+var defaultRoutes = []RouteConfig{
+	{
+		SchemaVersion: currentSchemaVersion,
+		Path:          "/api/example",
+		Targets:       []string{"http://localhost:8081/hello"},
+		Methods:       []string{"GET", "POST"},
+		Enabled:       true,
+
+		PreserveHost:      true,
+		BufferRequestBody: true,
+	},
 }
 
-func (s *Server) InitializeRoutes() {
-	logConfig := LoggerMiddleware{logger: s.logger}
-	// TODO: Make routes configurable via Redis for live reloading
-	routes := []Route{
-		{
-			Path:      "/api/example",
-			TargetURL: "http://localhost:8081/hello",
-			Middleware: []Middleware{
-				logConfig.LogHandler,
-				CORS,
-				MethodMiddleware([]string{"GET", "POST"}),
-			},
-		},
+// RouteManager owns the proxied route table. The table is rebuilt from
+// RouteConfigs on every reload and swapped in atomically, so in-flight
+// requests finish against the table they started on. Nothing is reference
+// counted: a request holds its route's handlers, proxies and transports until
+// it completes, and the old table is garbage collected after its last request
+// finishes
+type RouteManager struct {
+	config     Config
+	redis      *Redis
+	logger     *zap.SugaredLogger
+	bufferPool httputil.BufferPool
+	transports *transportPool
+	breakers   *BreakerRegistry
+	fallbacks  *FallbackRegistry
+	outliers   *OutlierRegistry
+	slos       *SLORegistry
+	targets    *targetRegistry
+	started    time.Time
+	capture    *RequestCapture // nil without redis
+	errorPages *ErrorRenderer
+	state      atomic.Pointer[StateMonitor] // For the status page, see SetStateMonitor
+
+	transformers *TransformerRegistry // Shared with the Server, kept across reloads
+
+	table atomic.Pointer[routeTable]
+
+	// One rebuild runs at a time. Reloads requested while another is running
+	// share a single pending rebuild, see Reload
+	rebuildMu sync.Mutex
+	pendingMu sync.Mutex
+	pending   *pendingReload
+	loaded    bool // A table has been swapped in, guarded by rebuildMu
+
+	statusMu sync.Mutex
+	status   ReloadStatus
+}
+
+// A rebuild callers are waiting on that hasn't read the configs yet
+type pendingReload struct {
+	done chan struct{}
+	err  error
+}
+
+// Watch reloads once config changes have been quiet for reloadDebounce, and
+// at most reloadMaxDelay after the first change of a burst
+const (
+	reloadDebounce = 100 * time.Millisecond
+	reloadMaxDelay = time.Second
+)
+
+// errorPages may be nil, see ErrorRenderer
+func NewRouteManager(cfg Config, redis *Redis, logger *zap.SugaredLogger, errorPages *ErrorRenderer) *RouteManager {
+	m := &RouteManager{
+		config:     cfg,
+		redis:      redis,
+		logger:     logger,
+		bufferPool: newBufferPool(cfg.ProxyBufferSize),
+		transports: newTransportPool(),
+		breakers:   NewBreakerRegistry(),
+		fallbacks:  NewFallbackRegistry(),
+		outliers:   NewOutlierRegistry(),
+		slos:       NewSLORegistry(),
+		targets:    newTargetRegistry(),
+		started:    time.Now(),
+		errorPages: errorPages,
+
+		transformers: NewTransformerRegistry(),
+	}
+	if redis != nil {
+		m.capture = NewRequestCapture(redis, logger)
+	}
+	m.table.Store(newRouteTable())
+	return m
+}
+
+func (m *RouteManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.table.Load().ServeHTTP(w, r)
+}
+
+// Outcome of the most recent reload, plus running totals
+type ReloadStatus struct {
+	LastReload time.Time `json:"last_reload"`
+	Routes     int       `json:"routes"`
+	LastError  string    `json:"last_error,omitempty"`
+	// Routes left out of the table, by key, with the reason. Only the first
+	// load skips routes, later ones are rejected whole
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// Routes that failed to build in the last rejected reload, by key
+	Invalid   map[string]string `json:"invalid,omitempty"`
+	Succeeded int64             `json:"succeeded"`
+	Failed    int64             `json:"failed"`
+}
+
+// Reload reads every route config from Redis, merges them over the defaults
+// and swaps in the rebuilt table. The whole set is built before anything is
+// swapped: if any route fails, the reload is rejected and the current table
+// keeps serving. Only the first load, with nothing to fall back on, swaps in
+// the routes that did build and leaves the rest out.
+// Rebuilds are serialized. Callers arriving while one is running join the
+// next, which starts reading only once they've all asked, so each caller's
+// change is in the table when it returns without a rebuild per caller
+func (m *RouteManager) Reload() error {
+	m.pendingMu.Lock()
+	if p := m.pending; p != nil {
+		m.pendingMu.Unlock()
+		<-p.done
+		return p.err
 	}
+	p := &pendingReload{done: make(chan struct{})}
+	m.pending = p
+	m.pendingMu.Unlock()
+
+	m.rebuildMu.Lock()
+	defer m.rebuildMu.Unlock()
+
+	// From here on the configs may already have been read, later callers
+	// need a rebuild of their own
+	m.pendingMu.Lock()
+	m.pending = nil
+	m.pendingMu.Unlock()
+
+	p.err = m.rebuild()
+	close(p.done)
+	return p.err
+}
 
-	for _, route := range routes {
-		targetURL, err := url.Parse(route.TargetURL)
+func (m *RouteManager) rebuild() error {
+	routes, invalid, err := m.reload()
+
+	m.statusMu.Lock()
+	m.status.LastReload = time.Now()
+	if err != nil {
+		m.status.LastError = err.Error()
+		m.status.Invalid = invalid
+		m.status.Failed++
+	} else {
+		m.status.Routes = routes
+		m.status.Skipped = invalid
+		m.status.Invalid = nil
+		m.status.LastError = ""
+		m.status.Succeeded++
+	}
+	m.statusMu.Unlock()
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	routeReloads.WithLabelValues(result).Inc()
+
+	return err
+}
+
+// SetTransformers replaces the registry routes' transformers are looked up
+// in. Takes effect from the next reload
+func (m *RouteManager) SetTransformers(transformers *TransformerRegistry) {
+	m.transformers = transformers
+}
+
+func (m *RouteManager) Breakers() []BreakerSnapshot {
+	return m.breakers.Snapshots()
+}
+
+func (m *RouteManager) SLOs() []SLOSnapshot {
+	return m.slos.Snapshots()
+}
+
+func (m *RouteManager) Ejected() []string {
+	return m.outliers.Ejected()
+}
+
+func (m *RouteManager) ReloadStatus() ReloadStatus {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.status
+}
+
+// Number of routes in the new table, and the errors of those that failed to
+// build: left out on the first load, the reason for rejecting later ones
+func (m *RouteManager) reload() (int, map[string]string, error) {
+	configs := make(map[string]RouteConfig, len(defaultRoutes))
+	for _, cfg := range defaultRoutes {
+		configs[cfg.Key()] = cfg
+	}
+
+	if m.redis != nil {
+		stored, err := m.redis.ListConfs()
 		if err != nil {
-			s.logger.Fatal("invalid target URL: ", err)
+			return 0, nil, fmt.Errorf("listing route configs: %w", err)
+		}
+		for _, cfg := range stored {
+			configs[cfg.Key()] = cfg
 		}
+	}
 
-		proxy := httputil.NewSingleHostReverseProxy(targetURL)
-		handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			proxy.ServeHTTP(writer, request)
-		})
+	generation := m.transports.nextGeneration()
 
-		// Add middleware Tower
-		towerHandler := Tower(handler, route.Middleware...)
-		s.router.Handle(route.Path, towerHandler)
+	table := newRouteTable()
+	routes := 0
+	invalid := make(map[string]string)
+	for key, cfg := range configs {
+		handler, err := m.buildRoute(cfg)
+		if err == nil {
+			err = table.Handle(cfg.Host, cfg.Path, handler)
+		}
+		if err != nil {
+			invalid[key] = err.Error()
+			continue
+		}
+		routes++
+	}
+
+	if len(invalid) > 0 && m.loaded {
+		// Not pruning: the current table still uses transports this build
+		// didn't fetch. The next successful reload prunes them
+		keys := make([]string, 0, len(invalid))
+		for key, reason := range invalid {
+			m.logger.Errorw("invalid route config, keeping current routes", "route", key, "error", reason)
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return 0, invalid, fmt.Errorf("%d invalid route configs: %s", len(invalid), strings.Join(keys, ", "))
 	}
+	for key, reason := range invalid {
+		m.logger.Errorw("skipping route", "route", key, "error", reason)
+	}
+	defer m.transports.prune(generation)
+	// Unmatched requests get the 404 page (or the status page), unless a
+	// route already claims "/"
+	table.Handle("", "/", m.unmatchedHandler())
+	table.routes = routes
+
+	m.table.Store(table)
+	m.loaded = true
+	m.logger.Infow("routes loaded", "count", routes, "skipped", len(invalid), "transports", m.transports.size())
+	return routes, invalid, nil
+}
+
+// Watch reloads the route table whenever a config in Redis changes, until
+// ctx is canceled
+func (m *RouteManager) Watch(ctx context.Context) {
+	if m.redis == nil {
+		return
+	}
+
+	watchCtx, stop := context.WithCancel(ctx)
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.reloadOnChange(watchCtx, changed)
+	}()
+
+	err := m.redis.WatchConfs(watchCtx, func(key string) {
+		m.logger.Debugw("route config changed", "key", key)
+		select {
+		case changed <- struct{}{}:
+		default: // A reload is already due
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		m.logger.Errorw("watching route configs", "error", err)
+	}
+
+	stop()
+	<-done
+}
+
+// Debounces bursts of changes, e.g. a script rewriting every route, into one
+// reload
+func (m *RouteManager) reloadOnChange(ctx context.Context, changed <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+
+		quiet := time.NewTimer(reloadDebounce)
+		deadline := time.NewTimer(reloadMaxDelay)
+	burst:
+		for {
+			select {
+			case <-ctx.Done():
+				quiet.Stop()
+				deadline.Stop()
+				return
+			case <-changed:
+				if !quiet.Stop() {
+					<-quiet.C
+				}
+				quiet.Reset(reloadDebounce)
+			case <-quiet.C:
+				break burst
+			case <-deadline.C:
+				break burst
+			}
+		}
+		quiet.Stop()
+		deadline.Stop()
+
+		if err := m.Reload(); err != nil {
+			m.logger.Errorw("reloading routes", "error", err)
+		}
+	}
+}
+
+func (m *RouteManager) buildRoute(cfg RouteConfig) (http.Handler, error) {
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	if strings.Contains(strings.TrimPrefix(cfg.Host, "*."), "*") {
+		return nil, fmt.Errorf("host wildcard is only allowed as a leading *.")
+	}
+	transformers, err := m.transformers.resolve(cfg.Transformers)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := m.buildUpstream(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, header := range append(cfg.LogRequestHeaders, cfg.LogResponseHeaders...) {
+		if header.Name == "" {
+			return nil, fmt.Errorf("logged headers need a name")
+		}
+	}
+
+	middleware := []Middleware{RequestID, RouteContext(cfg.Key())}
+	// Ahead of everything else, logging included, so the whole route sees
+	// the same method
+	if cfg.MethodOverride.Enabled {
+		override, err := MethodOverrideMiddleware(cfg.MethodOverride)
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, override)
+	}
+	if !cfg.LogDisabled {
+		logConfig := LoggerMiddleware{
+			logger:       m.logger.With(logFields(cfg.LogFields)...),
+			LogQuery:     cfg.LogQuery,
+			RedactParams: cfg.RedactParams,
+
+			RequestHeaders:  cfg.LogRequestHeaders,
+			ResponseHeaders: cfg.LogResponseHeaders,
+		}
+		middleware = append(middleware, logConfig.LogHandler)
+	}
+	middleware = append(middleware, SizeMetrics(cfg.Key()))
+	// Applied again inside the logging so the 504 is logged and counted
+	timeout := m.config.RequestTimeout
+	if cfg.RequestTimeout != 0 {
+		timeout = secondsToDuration(float64(cfg.RequestTimeout))
+	}
+	middleware = append(middleware, TimeoutMiddleware(timeout, m.errorPages))
+	if cfg.Deadlines != (Deadlines{}) {
+		middleware = append(middleware, DeadlineMiddleware(cfg.Deadlines))
+	}
+	middleware = append(middleware, ValidateMethod, CORS)
+	if cfg.Capture.Enabled {
+		if m.capture == nil {
+			return nil, fmt.Errorf("request capture requires redis")
+		}
+		middleware = append(middleware, m.capture.Middleware(cfg.Path, cfg.Capture, cfg.BufferRequestBody))
+	}
+	if cfg.SecurityHeaders.Enabled {
+		middleware = append(middleware, SecurityHeadersMiddleware(cfg.SecurityHeaders))
+	}
+	if len(cfg.WSAllowedOrigins) > 0 || len(cfg.WSSubprotocols) > 0 {
+		middleware = append(middleware, WebSocketMiddleware(cfg.WSAllowedOrigins, cfg.WSSubprotocols, m.logger))
+	}
+	if cfg.ClientCert.Enabled {
+		middleware = append(middleware, ClientCertMiddleware(cfg.ClientCert))
+	}
+	if !cfg.Enabled {
+		middleware = append(middleware, MaintenanceMiddleware(cfg.MaintenanceMessage, m.errorPages))
+	}
+	if cfg.RateLimit.Enabled {
+		tiers, err := m.buildRateLimitTiers(cfg)
+		if err != nil {
+			return nil, err
+		}
+		bypass, err := NewRateLimitBypass(cfg.RateLimit.Allowlist, cfg.RateLimit.BypassHeader, cfg.RateLimit.BypassToken)
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, TieredRateLimitMiddleware(tiers, bypass, RequestCost(cfg.RateLimit), m.logger))
+	}
+	if len(cfg.AuthMethods) > 0 {
+		// Behind the rate limit, so unauthenticated floods are limited too
+		auth, err := AuthMiddleware(cfg.AuthMethods, m.errorPages)
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, auth)
+	}
+	if len(cfg.Methods) > 0 {
+		middleware = append(middleware, MethodMiddleware(cfg.Methods))
+	}
+	// Checksums cover the body as the client sent it, validation the decoded
+	// one
+	if cfg.Checksum.Enabled {
+		if !cfg.BufferRequestBody {
+			return nil, fmt.Errorf("checksums need buffer_request_body")
+		}
+		checksum, err := ChecksumMiddleware(cfg.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, checksum)
+	}
+	if cfg.Decompression.Enabled {
+		middleware = append(middleware, DecompressRequests(cfg.Decompression))
+	}
+	if cfg.OpenAPISpec != "" {
+		validator, err := NewOpenAPIValidator(cfg.OpenAPISpec, cfg.BufferRequestBody, m.logger)
+		if err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, validator.OpenAPIValidationMiddleware)
+	}
+	if cfg.SLOTargetLatency > 0 {
+		// Past the gateway's own rejections, which are quick and say nothing
+		// about the upstream
+		tracker := m.slos.Get(cfg.Key(), secondsToDuration(float64(cfg.SLOTargetLatency)), secondsToDuration(float64(cfg.SLOWindow)))
+		middleware = append(middleware, SLOMiddleware(tracker))
+	}
+	middleware = append(middleware, Compress)
+	if cfg.GRPCWeb {
+		if err := validGRPCWebTargets(cfg.Targets); err != nil {
+			return nil, err
+		}
+		middleware = append(middleware, GRPCWebMiddleware)
+	}
+
+	// Ahead of the cache, so overridden requests never read or fill it
+	override := RouteOverrideMiddleware(m.config.AdminToken, m.logger, func(target *url.URL) http.Handler {
+		return m.newProxy(cfg, target)
+	})
+	middleware = append(middleware, override)
+
+	// Inside Compress, so the cache always holds the uncompressed upstream body
+	if cfg.Cache.Enabled {
+		if m.redis == nil {
+			return nil, fmt.Errorf("caching requires redis")
+		}
+		// Redis would keep entries without an expiration forever
+		if cfg.Cache.ExpiresIn <= 0 {
+			return nil, fmt.Errorf("cache expires_in must be positive, got %v", cfg.Cache.ExpiresIn)
+		}
+		switch cfg.Cache.WritePolicy {
+		case "", CacheWriteOverwrite, CacheWriteFirst, CacheWriteNewest:
+		default:
+			return nil, fmt.Errorf("unknown cache write policy %q", cfg.Cache.WritePolicy)
+		}
+		cache := NewCacheMiddleware(m.redis, m.logger, cfg.Key(), cfg.Cache, m.config.CacheReadTimeout)
+		cache.SetDebugHeaders(cfg.DebugHeaders)
+		middleware = append(middleware, cache.CacheHandler)
+	}
+
+	// Inside the cache, so entries are keyed by the request as the client sent it
+	if len(transformers) > 0 {
+		middleware = append(middleware, TransformRequests(transformers, m.errorPages, m.logger))
+	}
+
+	// Add middleware Tower
+	return Tower(handler, middleware...), nil
+}
+
+// The innermost handler: a proxy to the route's target, or an Aggregator
+func (m *RouteManager) buildUpstream(cfg RouteConfig) (http.Handler, error) {
+	if len(cfg.Aggregate.Upstreams) > 0 {
+		for key, target := range cfg.Aggregate.Upstreams {
+			if _, err := url.Parse(target); err != nil {
+				return nil, fmt.Errorf("invalid aggregate upstream %q: %w", key, err)
+			}
+		}
+		return NewAggregator(cfg.Aggregate, m.transports.get(cfg.Transport), m.logger), nil
+	}
+
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("no targets configured")
+	}
+	if cfg.PathMode != "" && cfg.PathMode != PathModePreserve && cfg.PathMode != PathModeReplace {
+		return nil, fmt.Errorf("unknown path mode %q", cfg.PathMode)
+	}
+	if cfg.UpstreamHost != "" && !validUpstreamHost(cfg.UpstreamHost) {
+		return nil, fmt.Errorf("invalid upstream host %q", cfg.UpstreamHost)
+	}
+	if _, err := egressProxy(cfg.Transport.Proxy, cfg.Transport.NoProxy); err != nil {
+		return nil, err
+	}
+	if name := cfg.Transport.TLSServerName; name != "" && !validTLSServerName(name) {
+		return nil, fmt.Errorf("invalid TLS server name %q", name)
+	}
+	switch cfg.Server.Mode {
+	case "", ServerPreserve, ServerStrip:
+	case ServerOverride:
+		if cfg.Server.Value == "" {
+			return nil, fmt.Errorf("server override needs a value")
+		}
+	default:
+		return nil, fmt.Errorf("unknown server header mode %q", cfg.Server.Mode)
+	}
+	switch fallback := cfg.CircuitBreaker.Fallback; fallback.Mode {
+	case "", FallbackLastGood:
+	case FallbackStatic:
+		if fallback.Status != 0 && (fallback.Status < 200 || fallback.Status > 599) {
+			return nil, fmt.Errorf("invalid fallback status %d", fallback.Status)
+		}
+	case FallbackRedirect:
+		if fallback.Location == "" {
+			return nil, fmt.Errorf("redirect fallback needs a location")
+		}
+	default:
+		return nil, fmt.Errorf("unknown breaker fallback mode %q", fallback.Mode)
+	}
+	for from, to := range cfg.StatusRemap {
+		// Informational statuses aren't final responses, so can't be mapped to
+		if from < 100 || from > 599 || to < 200 || to > 599 {
+			return nil, fmt.Errorf("invalid status remap %d to %d", from, to)
+		}
+	}
+
+	strategy := LoadBalanceStrategy(cfg.LoadBalance)
+	if strategy != "" && !strategy.valid() {
+		return nil, fmt.Errorf("unknown load balance strategy %q", cfg.LoadBalance)
+	}
+
+	upstreams, err := parseUpstreams(cfg.Targets, cfg.Weights)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range upstreams {
+		u.slowStart = secondsToDuration(float64(cfg.SlowStart))
+		u.addedAt = m.targets.seen(u.url.String())
+		if cfg.CircuitBreaker.Enabled {
+			u.breaker = m.breakers.Get(u.url.String(), cfg.CircuitBreaker)
+		}
+		if cfg.OutlierDetection.Enabled {
+			u.outlier = m.outliers.Get(u.url.String(), cfg.OutlierDetection)
+		}
+		u.proxy = m.newProxy(cfg, u.url)
+	}
+
+	balancer := NewBalancer(strategy, upstreams)
+	balancer.SetFailover(cfg.Retry, cfg.BufferRequestBody)
+	if cfg.SelectionSeed != 0 {
+		balancer.SetSelectionSource(NewSeededSource(cfg.SelectionSeed))
+	}
+	if cfg.LogSelection {
+		balancer.SetSelectionLogger(m.logger.With("route", cfg.Path))
+	}
+	return balancer, nil
+}
+
+// ReverseProxy flushes every write for responses without a Content-Length
+// (chunked, SSE), provided each writer in the middleware Tower supports
+// flushing
+func (m *RouteManager) newProxy(cfg RouteConfig, target *url.URL) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if cfg.PathMode == PathModeReplace {
+		director := proxy.Director
+		proxy.Director = func(request *http.Request) {
+			director(request)
+			request.URL.Path, request.URL.RawPath = target.Path, target.RawPath
+			if request.URL.Path == "" {
+				request.URL.Path = "/"
+			}
+		}
+	}
+	if host := upstreamHost(cfg, target); host != "" {
+		director := proxy.Director
+		proxy.Director = func(request *http.Request) {
+			director(request)
+			if request.Header.Get("X-Forwarded-Host") == "" {
+				request.Header.Set("X-Forwarded-Host", request.Host)
+			}
+			request.Host = host
+		}
+	}
+	proxy.BufferPool = m.bufferPool
+	var transport http.RoundTripper = m.transports.get(cfg.Transport)
+	if cfg.CircuitBreaker.Enabled {
+		// Under the retries, so each attempt is counted and an open breaker
+		// ends the retries early
+		transport = &breakerTransport{next: transport, breaker: m.breakers.Get(target.String(), cfg.CircuitBreaker)}
+	}
+	if cfg.OutlierDetection.Enabled {
+		transport = &outlierTransport{next: transport, detector: m.outliers.Get(target.String(), cfg.OutlierDetection)}
+	}
+	proxy.Transport = &challengeTransport{next: newRetryTransport(transport, cfg.Retry, cfg.BufferRequestBody, m.logger, cfg.Path)}
+	var fallback *Fallback
+	if cfg.CircuitBreaker.Enabled && cfg.CircuitBreaker.Fallback.Mode != "" {
+		fallback = m.fallbacks.Get(cfg)
+	}
+	proxy.ErrorHandler = proxyErrorHandler(m.logger, cfg.Path, m.errorPages, fallback)
+	proxy.ErrorLog = zap.NewStdLog(m.logger.Desugar())
+
+	modifiers := []responseModifier{restoreChallenges, detectTruncation(m.logger, cfg.Path)}
+	if cfg.CookieRewrite != (CookieRewrite{}) {
+		modifiers = append(modifiers, rewriteCookies(cfg.CookieRewrite))
+	}
+	if cfg.Via != "" || cfg.Server.Mode == ServerOverride || cfg.Server.Mode == ServerStrip {
+		modifiers = append(modifiers, rewriteServerHeaders(cfg.Via, cfg.Server))
+	}
+	if len(cfg.StatusRemap) > 0 {
+		modifiers = append(modifiers, remapStatus(cfg.StatusRemap, cfg.StatusRemapBody, m.errorPages))
+	}
+	// Already checked by buildRoute
+	if transformers, err := m.transformers.resolve(cfg.Transformers); err == nil && len(transformers) > 0 {
+		modifiers = append(modifiers, transformResponses(transformers))
+	}
+	// Last, so what's remembered is what the client got
+	if fallback != nil && cfg.CircuitBreaker.Fallback.Mode == FallbackLastGood {
+		modifiers = append(modifiers, fallback.remember)
+	}
+	if cfg.DebugHeaders {
+		modifiers = append(modifiers, upstreamDuration)
+	}
+	proxy.ModifyResponse = chainModifiers(modifiers)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		RequestContextFrom(request.Context()).SetTarget(target.String())
+		if cfg.DebugHeaders {
+			request = request.WithContext(context.WithValue(request.Context(), upstreamStartKey{}, time.Now()))
+		}
+		proxy.ServeHTTP(&informationalWriter{ResponseWriter: writer, header: make(http.Header)}, request)
+	})
+}
+
+// Static per-route fields for the access log, in a stable order
+func logFields(fields map[string]string) []interface{} {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return args
+}
+
+// The route's own limit, named "route", followed by RateLimit.Tiers
+func (m *RouteManager) buildRateLimitTiers(cfg RouteConfig) ([]LimitTier, error) {
+	tiers := make([]LimitTier, 0, 1+len(cfg.RateLimit.Tiers))
+	names := map[string]bool{"route": true}
+	configs := append([]RateLimitTier{{Name: "route", Key: cfg.RateLimit.Key, Requests: cfg.RateLimit.Requests, Window: cfg.RateLimit.Window}}, cfg.RateLimit.Tiers...)
+	for i, tierConfig := range configs {
+		if i > 0 {
+			if tierConfig.Name == "" || names[tierConfig.Name] {
+				return nil, fmt.Errorf("rate limit tiers need unique names, got %q", tierConfig.Name)
+			}
+			names[tierConfig.Name] = true
+		}
+		limiter, err := m.buildRateLimiter(cfg, tierConfig)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit tier %s: %w", tierConfig.Name, err)
+		}
+		extractKey, err := ParseKeyExtractor(tierConfig.Key)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, LimitTier{Name: tierConfig.Name, Limiter: limiter, Key: extractKey})
+	}
+	return tiers, nil
+}
+
+// In-memory buckets live as long as the route table, so they start full again
+// after a reload
+func (m *RouteManager) buildRateLimiter(cfg RouteConfig, tier RateLimitTier) (RateLimiter, error) {
+	limit := cfg.RateLimit
+	if tier.Requests <= 0 || tier.Window <= 0 {
+		return nil, fmt.Errorf("rate limit needs positive requests and window")
+	}
+	// A request costing more than the whole quota could never be let through
+	if limit.Cost > tier.Requests {
+		return nil, fmt.Errorf("rate limit cost %d exceeds requests %d", limit.Cost, tier.Requests)
+	}
+	for method, cost := range limit.MethodCosts {
+		if cost > tier.Requests {
+			return nil, fmt.Errorf("rate limit cost %d for %s exceeds requests %d", cost, method, tier.Requests)
+		}
+	}
+	window := time.Duration(float64(tier.Window) * float64(time.Second))
+	// Measured from when the gateway started, so reloads don't restart it
+	warmup := NewRateLimitWarmup(m.started, secondsToDuration(float64(limit.WarmupDuration)), float64(limit.WarmupFloor))
+
+	if !limit.Distributed {
+		limiter := NewMemoryRateLimiter(tier.Requests, window)
+		limiter.SetWarmup(warmup)
+		return limiter, nil
+	}
+	if m.redis == nil {
+		return nil, fmt.Errorf("distributed rate limit requires redis")
+	}
+	// Namespaced by host and path so same-path routes on different hosts
+	// count separately. Tiers count next to the route's own counters
+	prefix := "ratelimit:" + cfg.Key() + ":"
+	if tier.Name != "route" {
+		prefix += tier.Name + ":"
+	}
+	limiter := NewRedisRateLimiter(m.redis, prefix, tier.Requests, window)
+	limiter.SetWarmup(warmup)
+	return limiter, nil
+}
+
+// Copy buffers shared by every proxy, so proxied responses reuse buffers
+// instead of allocating new ones per request
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = 32 * 1024 // Same as ReverseProxy's own buffers
+	}
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	p.pool.Put(&buf)
+}
+
+func (s *Server) InitializeRoutes() {
+	errorPages, err := LoadErrorPages(s.ErrorPageDir, s.ErrorPages)
+	if err != nil {
+		s.logger.Fatal("loading error pages: ", err)
+	}
+
+	s.routes = NewRouteManager(s.Config, s.redis, s.logger, errorPages)
+	s.routes.SetTransformers(s.transformers)
+	if err := s.routes.Reload(); err != nil {
+		s.logger.Fatal("loading routes: ", err)
+	}
+	s.Go(s.routes.Watch)
+
+	s.state = NewStateMonitor(s.redis, s.routes, NewHttpClient(nil, s.logger), s.StateWebhooks, s.StateCheckInterval, s.logger)
+	s.routes.SetStateMonitor(s.state)
+	s.Go(s.state.Run)
+
+	// An empty admin token disables the admin API
+	if s.redis != nil && s.AdminToken != "" {
+		audit := NewAuditLogger(s.logger, s.redis, s.AuditStream)
+		NewAdminAPI(s.redis, s.routes, audit, s.routes.capture, s.state, s.logger, s.AdminToken).Register(s.router)
+	}
+
+	s.router.Handle("/metrics", promhttp.Handler())
+	s.router.Handle("/", s.routes)
 }
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRouteToggle(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "proxied")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.Enabled = false
+	cfg.MaintenanceMessage = "Back in five minutes"
+	storeRoute(t, r, m, cfg)
+
+	response := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("disabled route: status = %d, want 503", response.Code)
+	}
+	if !strings.Contains(response.Body.String(), "Back in five minutes") {
+		t.Errorf("disabled route: body = %q, want the maintenance message", response.Body.String())
+	}
+
+	cfg.Enabled = true
+	storeRoute(t, r, m, cfg)
+
+	response = serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "proxied" {
+		t.Errorf("re-enabled route: got %d %q, want 200 from the upstream", response.Code, response.Body.String())
+	}
+}
+
+// A ResponseWriter that throws the body away, so the benchmark measures the
+// proxy's allocations rather than a recorder's buffer growing
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// Compare B/op between the two: without a pool every response allocates its
+// own 32kb copy buffer
+func BenchmarkBufferPool(b *testing.B) {
+	body := []byte(strings.Repeat("x", 256<<10))
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write(body)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	for _, bench := range []struct {
+		name string
+		pool httputil.BufferPool
+	}{
+		{"pooled", newBufferPool(0)},
+		{"unpooled", nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.BufferPool = bench.pool
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				proxy.ServeHTTP(&discardWriter{header: make(http.Header)}, request)
+			}
+		})
+	}
+}
+
+// Routes for the same path on different hosts keep their own cache entries
+// and rate-limit counters
+func TestSamePathRoutesOnDifferentHosts(t *testing.T) {
+	r, server := newTestRedis(t)
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	for _, host := range []string{"a.test", "b.test"} {
+		cfg := testRoute("/data", newTestUpstream(t, "from "+host).URL)
+		cfg.Host = host
+		cfg.Cache = Cache{Enabled: true, ExpiresIn: 60}
+		cfg.RateLimit = RateLimit{Enabled: true, Requests: 2, Window: 60, Distributed: true}
+		storeRoute(t, r, m, cfg)
+	}
+
+	request := func(host string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/data", nil)
+		request.Host = host
+		return serve(m, request)
+	}
+	for _, want := range []string{"MISS", "HIT"} {
+		for _, host := range []string{"a.test", "b.test"} {
+			response := request(host)
+			if response.Code != http.StatusOK {
+				t.Fatalf("%s: status %d, want 200", host, response.Code)
+			}
+			if got := response.Body.String(); got != "from "+host {
+				t.Errorf("%s: body %q, want its own upstream's", host, got)
+			}
+			if got := response.Header().Get("X-Cache"); got != want {
+				t.Errorf("%s: X-Cache = %q, want %s", host, got, want)
+			}
+		}
+	}
+	// Each host has used its two requests, not four between them
+	for _, host := range []string{"a.test", "b.test"} {
+		if got := request(host).Code; got != http.StatusTooManyRequests {
+			t.Errorf("%s: third request got %d, want 429", host, got)
+		}
+	}
+
+	var cached, counters []string
+	for _, key := range server.DB(0).Keys() {
+		switch {
+		case strings.HasPrefix(key, "cache:"):
+			cached = append(cached, key)
+		case strings.HasPrefix(key, "ratelimit:"):
+			counters = append(counters, key)
+		}
+	}
+	if len(cached) != 2 || len(counters) != 2 {
+		t.Errorf("cache keys %q and rate-limit keys %q, want two of each", cached, counters)
+	}
+}
+
+// A wildcard route serves every subdomain from one config, but the upstream
+// sees each request's Host, so entries aren't shared between subdomains
+func TestWildcardRouteCachesPerHost(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("for " + request.Host))
+	}))
+	defer upstream.Close()
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	cfg := testRoute("/page", upstream.URL)
+	cfg.Host = "*.tenants.test"
+	cfg.Cache = Cache{Enabled: true, ExpiresIn: 60}
+	storeRoute(t, r, m, cfg)
+
+	for _, want := range []string{"MISS", "HIT"} {
+		for _, host := range []string{"one.tenants.test", "two.tenants.test"} {
+			request := httptest.NewRequest(http.MethodGet, "/page", nil)
+			request.Host = host
+			response := serve(m, request)
+			if got := response.Body.String(); got != "for "+host {
+				t.Errorf("%s: body %q, want its own", host, got)
+			}
+			if got := response.Header().Get("X-Cache"); got != want {
+				t.Errorf("%s: X-Cache = %q, want %s", host, got, want)
+			}
+		}
+	}
+}
+
+// A thousand routes with two distinct transport settings share two
+// transports, across reloads, and so share their upstream connections
+func TestManyRoutesShareTransports(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream, conns := newCountingUpstream(t, "ok")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	for i := 0; i < 1000; i++ {
+		cfg := testRoute(fmt.Sprintf("/svc%d", i), upstream.URL)
+		cfg.Host = fmt.Sprintf("tenant%d.example.com", i%10)
+		if i%2 == 1 {
+			cfg.Transport.MaxIdleConnsPerHost = 4
+		}
+		if err := r.SetConf(cfg.Key(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for reload := 0; reload < 2; reload++ {
+		if err := m.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.transports.size(); got != 2 {
+			t.Fatalf("reload %d: %d transports for 1000 routes, want 2", reload+1, got)
+		}
+	}
+
+	// Sequential requests to different routes with the same settings
+	for _, route := range []struct{ host, path string }{
+		{"tenant0.example.com", "/svc0"},
+		{"tenant2.example.com", "/svc2"},
+		{"tenant4.example.com", "/svc994"},
+	} {
+		request := httptest.NewRequest(http.MethodGet, route.path, nil)
+		request.Host = route.host
+		if got := serve(m, request); got.Code != http.StatusOK {
+			t.Fatalf("%s%s: status %d", route.host, route.path, got.Code)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("opened %d upstream connections, want the routes to reuse one", got)
+	}
+}
+
+func TestReloadStatus(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "proxied")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	defaults := m.ReloadStatus().Routes
+
+	storeRoute(t, r, m, testRoute("/svc", upstream.URL))
+	status := m.ReloadStatus()
+	if status.Routes != defaults+1 || status.Succeeded != 2 || status.Failed != 0 || status.LastError != "" {
+		t.Fatalf("after a good reload: %+v, want %d routes and 2 successes", status, defaults+1)
+	}
+	succeededAt := status.LastReload
+
+	if err := r.SetConf("/broken", testRoute("/broken")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("reload with a route without targets succeeded")
+	}
+	status = m.ReloadStatus()
+	if status.Failed != 1 || status.Succeeded != 2 {
+		t.Errorf("counts = %d succeeded, %d failed, want 2 and 1", status.Succeeded, status.Failed)
+	}
+	if status.LastError == "" || status.Invalid["/broken"] == "" {
+		t.Errorf("last error %q, invalid %v, want /broken reported", status.LastError, status.Invalid)
+	}
+	if status.Routes != defaults+1 {
+		t.Errorf("routes = %d, want the %d still being served", status.Routes, defaults+1)
+	}
+	if !status.LastReload.After(succeededAt) {
+		t.Error("LastReload wasn't moved by the failed reload")
+	}
+}
+
+func TestRouteAccessLogSettings(t *testing.T) {
+	upstream := newTestUpstream(t, "proxied")
+	core, logs := observer.New(zap.InfoLevel)
+	m := NewRouteManager(Config{}, nil, zap.New(core).Sugar(), nil)
+
+	quiet := testRoute("/quiet", upstream.URL)
+	quiet.LogDisabled = true
+	serve(buildTestRoute(t, m, quiet), httptest.NewRequest(http.MethodGet, "/quiet", nil))
+	if got := logs.FilterMessage("http request").Len(); got != 0 {
+		t.Errorf("log-disabled route logged %d lines, want none", got)
+	}
+
+	tagged := testRoute("/tagged", upstream.URL)
+	tagged.LogFields = map[string]string{"team": "payments", "service": "ledger"}
+	serve(buildTestRoute(t, m, tagged), httptest.NewRequest(http.MethodGet, "/tagged", nil))
+	entries := logs.FilterMessage("http request").All()
+	if len(entries) != 1 {
+		t.Fatalf("route logged %d lines, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["team"] != "payments" || fields["service"] != "ledger" {
+		t.Errorf("log fields team=%v service=%v, want the route's static fields", fields["team"], fields["service"])
+	}
+}
+
+func TestPathModes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		mode       string
+		targetPath string
+		incoming   string
+		want       string
+	}{
+		{"", "/v1", "/api/users?id=1", "/v1/api/users?id=1"},
+		{PathModePreserve, "/v1", "/api/users?id=1", "/v1/api/users?id=1"},
+		{PathModePreserve, "", "/api/users", "/api/users"},
+		{PathModePreserve, "/v1/", "/api/users/", "/v1/api/users/"},
+		{PathModePreserve, "/v1?key=abc", "/api?id=1", "/v1/api?key=abc&id=1"},
+		{PathModeReplace, "/v1", "/api/users?id=1", "/v1?id=1"},
+		{PathModeReplace, "/v1", "/api/users/42", "/v1"},
+		{PathModeReplace, "", "/api/users", "/"},
+		{PathModeReplace, "/v1?key=abc", "/api?id=1", "/v1?key=abc&id=1"},
+	}
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.targetPath+" "+tt.incoming, func(t *testing.T) {
+			cfg := testRoute("/api", upstream.URL+tt.targetPath)
+			cfg.PathMode = tt.mode
+			response := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, tt.incoming, nil))
+			if got := response.Body.String(); got != tt.want {
+				t.Errorf("upstream saw %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownPathModeRejected(t *testing.T) {
+	cfg := testRoute("/api", "http://upstream.internal")
+	cfg.PathMode = "append"
+	if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+		t.Error("built a route with an unknown path mode")
+	}
+}
+
+// A request still running when its route is reloaded onto another upstream
+// and transport finishes against the old ones
+func TestInFlightRequestSurvivesReload(t *testing.T) {
+	r, _ := newTestRedis(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		close(started)
+		<-release
+		writer.Write([]byte("old upstream"))
+	}))
+	defer old.Close()
+	replacement := newTestUpstream(t, "new upstream")
+
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	oldCfg := testRoute("/svc", old.URL)
+	// Not shared with the default routes, so the reload prunes it
+	oldCfg.Transport.MaxIdleConns = 7
+	storeRoute(t, r, m, oldCfg)
+	gateway := httptest.NewServer(m)
+	defer gateway.Close()
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := http.Get(gateway.URL + "/svc")
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		done <- result{string(body), err}
+	}()
+	<-started
+
+	storeRoute(t, r, m, testRoute("/svc", replacement.URL))
+	m.transports.mu.Lock()
+	_, kept := m.transports.transports[oldCfg.Transport]
+	m.transports.mu.Unlock()
+	if kept {
+		t.Fatal("old transport wasn't pruned by the reload")
+	}
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil)).Body.String(); got != "new upstream" {
+		t.Fatalf("request after reload got %q, want the new upstream", got)
+	}
+
+	close(release)
+	select {
+	case res := <-done:
+		if res.err != nil || res.body != "old upstream" {
+			t.Errorf("in-flight request got %q (%v), want the old upstream's answer", res.body, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request never finished")
+	}
+}
+
+// Reloads asked for while a rebuild runs share the next one, which reads the
+// config each of them wrote
+func TestConcurrentReloadsCoalesce(t *testing.T) {
+	r, _ := newTestRedis(t)
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	cfg := testRoute("/svc", "http://127.0.0.1:1")
+	cfg.Enabled = false
+	cfg.MaintenanceMessage = "version 0"
+	storeRoute(t, r, m, cfg)
+	before := m.ReloadStatus().Succeeded
+
+	// Hold the running rebuild's place so every caller queues up behind it
+	m.rebuildMu.Lock()
+	const callers = 20
+	var started, wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 1; i <= callers; i++ {
+		cfg.MaintenanceMessage = fmt.Sprintf("version %d", i)
+		if err := r.SetConf(cfg.Key(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		started.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			errs <- m.Reload()
+		}()
+	}
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+	m.rebuildMu.Unlock()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	}
+	if got := m.ReloadStatus().Succeeded - before; got != 1 {
+		t.Errorf("%d callers ran %d rebuilds, want them to share 1", callers, got)
+	}
+	response := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil))
+	if want := fmt.Sprintf("version %d", callers); !strings.Contains(response.Body.String(), want) {
+		t.Errorf("body = %q, want the last config's %q", response.Body.String(), want)
+	}
+}
+
+// A burst of change notifications ends in one reload, once they go quiet
+func TestReloadOnChangeDebounces(t *testing.T) {
+	r, _ := newTestRedis(t)
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.reloadOnChange(ctx, changed)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for range 10 {
+		changed <- struct{}{}
+		time.Sleep(reloadDebounce / 10)
+	}
+	if got := m.ReloadStatus().Succeeded; got != 1 {
+		t.Fatalf("reloaded %d times during the burst, want none", got-1)
+	}
+
+	deadline := time.Now().Add(5 * reloadDebounce)
+	for m.ReloadStatus().Succeeded == 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(2 * reloadDebounce)
+	if got := m.ReloadStatus().Succeeded - 1; got != 1 {
+		t.Errorf("burst caused %d reloads, want 1", got)
+	}
+}
+
+// With buffering off an upload reaches the upstream while the client is still
+// sending it
+func TestUnbufferedRouteStreamsBody(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		chunk := make([]byte, 5)
+		if _, err := io.ReadFull(request.Body, chunk); err != nil {
+			t.Errorf("reading first chunk: %v", err)
+			return
+		}
+		firstChunk <- string(chunk)
+		rest, _ := io.ReadAll(request.Body)
+		writer.Write(append(chunk, rest...))
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/upload", upstream.URL)
+	cfg.BufferRequestBody = false
+	cfg.Retry = RetryConfig{Attempts: 3}
+	gateway := httptest.NewServer(buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg))
+	defer gateway.Close()
+
+	body, upload := io.Pipe()
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		response, err := http.Post(gateway.URL+"/upload", "application/octet-stream", body)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		got, err := io.ReadAll(response.Body)
+		done <- result{string(got), err}
+	}()
+
+	upload.Write([]byte("hello"))
+	select {
+	case chunk := <-firstChunk:
+		if chunk != "hello" {
+			t.Errorf("first chunk = %q, want hello", chunk)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream didn't see the body before the upload finished")
+	}
+	upload.Write([]byte(" world"))
+	upload.Close()
+
+	got := <-done
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	if got.body != "hello world" {
+		t.Errorf("body = %q, want hello world", got.body)
+	}
+}
+
+func TestUnbufferedRouteRejectsChecksums(t *testing.T) {
+	cfg := testRoute("/upload", "http://127.0.0.1:1")
+	cfg.BufferRequestBody = false
+	cfg.Checksum.Enabled = true
+	if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+		t.Error("built a route checking checksums without buffering")
+	}
+}
+
+// Bodies that weren't kept can't be sent again, even with a key
+func TestUnbufferedRouteDoesNotRetryBodies(t *testing.T) {
+	var calls atomic.Int32
+	upstream := newFailingUpstream(t, http.StatusServiceUnavailable, &calls)
+
+	cfg := testRoute("/orders", upstream.URL)
+	cfg.BufferRequestBody = false
+	cfg.Retry = RetryConfig{Attempts: 3, BaseDelay: 0.001}
+	handler := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	if response := postWithKey(t, handler, "order-1"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the upstream's 503", response.Code)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream got %d calls, want 1", got)
+	}
+}
+
+// A reload with any invalid route is rejected whole: the routes that were
+// working keep serving as they were, and none of the new set goes live
+func TestInvalidReloadKeepsCurrentRoutes(t *testing.T) {
+	r, _ := newTestRedis(t)
+	before := newTestUpstream(t, "before")
+	after := newTestUpstream(t, "after")
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	storeRoute(t, r, m, testRoute("/svc", before.URL))
+
+	// A valid change and a new route, alongside one that can't be built
+	for _, cfg := range []RouteConfig{testRoute("/svc", after.URL), testRoute("/new", after.URL), testRoute("/broken")} {
+		if err := r.SetConf(cfg.Key(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("reload with an invalid route succeeded")
+	}
+
+	if response := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil)); response.Body.String() != "before" {
+		t.Errorf("/svc answered %d %q, want the running route's upstream", response.Code, response.Body)
+	}
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/new", nil)).Code; got != http.StatusNotFound {
+		t.Errorf("/new status = %d, want 404 until a valid reload", got)
+	}
+
+	// Fixing the bad route lets the whole set through
+	if err := r.SetConf("/broken", testRoute("/broken", after.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/svc", "/new", "/broken"} {
+		if response := serve(m, httptest.NewRequest(http.MethodGet, path, nil)); response.Body.String() != "after" {
+			t.Errorf("%s answered %d %q, want the new config", path, response.Code, response.Body)
+		}
+	}
+}
+
+// With nothing to fall back on, the first load serves the routes that built
+func TestFirstLoadSkipsInvalidRoutes(t *testing.T) {
+	r, _ := newTestRedis(t)
+	upstream := newTestUpstream(t, "proxied")
+	for _, cfg := range []RouteConfig{testRoute("/svc", upstream.URL), testRoute("/broken")} {
+		if err := r.SetConf(cfg.Key(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := NewRouteManager(Config{}, r, testLogger(), nil)
+	if err := m.Reload(); err != nil {
+		t.Fatalf("first load: %v", err)
+	}
+
+	if response := serve(m, httptest.NewRequest(http.MethodGet, "/svc", nil)); response.Body.String() != "proxied" {
+		t.Errorf("/svc answered %d %q, want it served", response.Code, response.Body)
+	}
+	if reason := m.ReloadStatus().Skipped["/broken"]; reason == "" {
+		t.Error("/broken wasn't reported as skipped")
+	}
+}
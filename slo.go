@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const sloBuckets = 10
+
+// SLOTracker measures the share of a route's requests answered within a
+// target latency over a rolling window
+type SLOTracker struct {
+	route string
+
+	mu     sync.Mutex
+	target time.Duration
+	window time.Duration
+
+	buckets     [sloBuckets]sloBucket
+	current     int
+	bucketStart time.Time
+}
+
+type sloBucket struct {
+	met   int
+	total int
+}
+
+// Compliance is the percentage of Requests that Met the target, 100 when
+// there have been none
+type SLOSnapshot struct {
+	Route         string  `json:"route"`
+	TargetLatency float64 `json:"target_latency"` // Seconds
+	Window        float64 `json:"window"`         // Seconds
+	Requests      int     `json:"requests"`
+	Met           int     `json:"met"`
+	Compliance    float64 `json:"compliance"`
+}
+
+// A window of zero is 5 minutes
+func NewSLOTracker(route string, target time.Duration, window time.Duration) *SLOTracker {
+	t := &SLOTracker{route: route, bucketStart: time.Now()}
+	t.configure(target, window)
+	return t
+}
+
+func (t *SLOTracker) configure(target time.Duration, window time.Duration) {
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.target = target
+	t.window = window
+}
+
+func (t *SLOTracker) Record(latency time.Duration) {
+	now := time.Now()
+
+	t.mu.Lock()
+	t.advance(now)
+	t.buckets[t.current].total++
+	if latency <= t.target {
+		t.buckets[t.current].met++
+	}
+	met, total := t.totals()
+	t.mu.Unlock()
+
+	sloCompliance.WithLabelValues(t.route).Set(compliance(met, total) / 100)
+}
+
+func (t *SLOTracker) Snapshot() SLOSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.advance(time.Now())
+	met, total := t.totals()
+	return SLOSnapshot{
+		Route:         t.route,
+		TargetLatency: t.target.Seconds(),
+		Window:        t.window.Seconds(),
+		Requests:      total,
+		Met:           met,
+		Compliance:    compliance(met, total),
+	}
+}
+
+func compliance(met int, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(met) * 100 / float64(total)
+}
+
+// Callers hold mu
+func (t *SLOTracker) totals() (met int, total int) {
+	for _, b := range t.buckets {
+		met += b.met
+		total += b.total
+	}
+	return met, total
+}
+
+// Rotates out buckets older than the window. Callers hold mu
+func (t *SLOTracker) advance(now time.Time) {
+	width := t.window / sloBuckets
+	for elapsed := now.Sub(t.bucketStart); elapsed >= width; elapsed -= width {
+		t.current = (t.current + 1) % sloBuckets
+		t.buckets[t.current] = sloBucket{}
+		t.bucketStart = t.bucketStart.Add(width)
+		if elapsed >= t.window+width {
+			// Idle for longer than the window, everything has expired
+			t.buckets = [sloBuckets]sloBucket{}
+			t.bucketStart = now
+			break
+		}
+	}
+}
+
+// Trackers by route key, kept across reloads so a config change doesn't
+// reset a route's compliance
+type SLORegistry struct {
+	mu       sync.Mutex
+	trackers map[string]*SLOTracker
+}
+
+func NewSLORegistry() *SLORegistry {
+	return &SLORegistry{trackers: make(map[string]*SLOTracker)}
+}
+
+func (r *SLORegistry) Get(route string, target time.Duration, window time.Duration) *SLOTracker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.trackers[route]; ok {
+		t.configure(target, window)
+		return t
+	}
+	t := NewSLOTracker(route, target, window)
+	r.trackers[route] = t
+	return t
+}
+
+// Sorted by route
+func (r *SLORegistry) Snapshots() []SLOSnapshot {
+	r.mu.Lock()
+	snapshots := make([]SLOSnapshot, 0, len(r.trackers))
+	for _, t := range r.trackers {
+		snapshots = append(snapshots, t.Snapshot())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Route < snapshots[j].Route })
+	return snapshots
+}
+
+// SLOMiddleware records how long each request takes to be answered in full.
+// WebSocket upgrades stay open for as long as the client likes, so they
+// aren't counted
+func SLOMiddleware(tracker *SLOTracker) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if isWebSocketUpgrade(request) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			start := time.Now()
+			next.ServeHTTP(writer, request)
+			tracker.Record(time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSLOCompliance(t *testing.T) {
+	tracker := NewSLOTracker("/slo-unit", 50*time.Millisecond, time.Minute)
+	if got := tracker.Snapshot().Compliance; got != 100 {
+		t.Errorf("compliance without requests = %v, want 100", got)
+	}
+
+	for _, latency := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 20 * time.Millisecond, 200 * time.Millisecond} {
+		tracker.Record(latency)
+	}
+	snapshot := tracker.Snapshot()
+	if snapshot.Requests != 4 || snapshot.Met != 3 || snapshot.Compliance != 75 {
+		t.Errorf("snapshot = %+v, want 3 of 4 met, 75%%", snapshot)
+	}
+	if got := testutil.ToFloat64(sloCompliance.WithLabelValues("/slo-unit")); got != 0.75 {
+		t.Errorf("compliance gauge = %v, want 0.75", got)
+	}
+}
+
+func TestSLOWindowExpires(t *testing.T) {
+	tracker := NewSLOTracker("/slo-window", time.Millisecond, 100*time.Millisecond)
+	tracker.Record(time.Second)
+	time.Sleep(150 * time.Millisecond)
+	tracker.Record(0)
+
+	if snapshot := tracker.Snapshot(); snapshot.Requests != 1 || snapshot.Compliance != 100 {
+		t.Errorf("snapshot = %+v, want only the recent request counted", snapshot)
+	}
+}
+
+// Requests through a route count against its target, as seen by the admin
+// stats
+func TestRouteSLOTracking(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Query().Has("slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.SLOTargetLatency = 0.05
+	handler := buildTestRoute(t, m, cfg)
+
+	for _, uri := range []string{"/svc", "/svc", "/svc", "/svc?slow", "/svc?slow"} {
+		serve(handler, httptest.NewRequest(http.MethodGet, uri, nil))
+	}
+
+	slos := m.SLOs()
+	if len(slos) != 1 {
+		t.Fatalf("got %d SLOs, want the route's", len(slos))
+	}
+	if slo := slos[0]; slo.Route != "/svc" || slo.Requests != 5 || slo.Met != 3 || slo.Compliance != 60 {
+		t.Errorf("SLO = %+v, want 3 of 5 requests met, 60%%", slo)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Overall health, from best to worst
+const (
+	StateOK       = "ok"
+	StateDegraded = "degraded"
+	StateDraining = "draining"
+)
+
+// Redis connectivity as seen by the gateway
+const (
+	RedisUp       = "up"
+	RedisDown     = "down"
+	RedisDisabled = "disabled" // Not configured, only default routes are served
+)
+
+// GatewayState summarizes every degraded condition the gateway knows about.
+// Status is StateDraining during shutdown, StateDegraded while Redis is down
+// or any breaker is open or target ejected, and StateOK otherwise
+type GatewayState struct {
+	Status         string    `json:"status"`
+	Redis          string    `json:"redis"`
+	OpenBreakers   []string  `json:"open_breakers,omitempty"` // Open and half-open
+	EjectedTargets []string  `json:"ejected_targets,omitempty"`
+	Draining       bool      `json:"draining"`
+	Since          time.Time `json:"since"` // When the state last changed
+	CheckedAt      time.Time `json:"checked_at"`
+}
+
+// Whether the conditions differ, ignoring when they were observed
+func (s GatewayState) changedFrom(previous GatewayState) bool {
+	return s.Status != previous.Status ||
+		s.Redis != previous.Redis ||
+		s.Draining != previous.Draining ||
+		!slices.Equal(s.OpenBreakers, previous.OpenBreakers) ||
+		!slices.Equal(s.EjectedTargets, previous.EjectedTargets)
+}
+
+// Body POSTed to every webhook on a state change
+type StateTransition struct {
+	Previous GatewayState `json:"previous"`
+	Current  GatewayState `json:"current"`
+}
+
+// StateMonitor polls the gateway's degradation signals, exports the result as
+// lattice_gateway_state and POSTs a StateTransition to each webhook whenever
+// it changes
+type StateMonitor struct {
+	redis    *Redis // nil when not configured
+	routes   *RouteManager
+	client   *HttpClient
+	webhooks []string
+	interval time.Duration
+	logger   *zap.SugaredLogger
+
+	mu       sync.Mutex
+	state    GatewayState
+	draining bool
+	recheck  chan struct{}
+}
+
+// An interval of zero checks every 5 seconds
+func NewStateMonitor(redis *Redis, routes *RouteManager, client *HttpClient, webhooks []string, interval time.Duration, logger *zap.SugaredLogger) *StateMonitor {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &StateMonitor{
+		redis:    redis,
+		routes:   routes,
+		client:   client,
+		webhooks: webhooks,
+		interval: interval,
+		logger:   logger,
+		state:    GatewayState{Status: StateOK, Redis: RedisDisabled, Since: time.Now()},
+		recheck:  make(chan struct{}, 1),
+	}
+}
+
+func (m *StateMonitor) State() GatewayState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// SetDraining marks the gateway as shutting down and checks straight away,
+// rather than at the next interval
+func (m *StateMonitor) SetDraining(draining bool) {
+	m.mu.Lock()
+	m.draining = draining
+	m.mu.Unlock()
+
+	select {
+	case m.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// Run checks the state every interval until ctx is canceled
+func (m *StateMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.recheck:
+		}
+	}
+}
+
+// Check samples every signal, records the result and notifies the webhooks
+// if anything changed
+func (m *StateMonitor) Check(ctx context.Context) GatewayState {
+	current := m.sample(ctx)
+
+	m.mu.Lock()
+	previous := m.state
+	changed := current.changedFrom(previous)
+	if !changed {
+		current.Since = previous.Since
+	}
+	m.state = current
+	m.mu.Unlock()
+
+	for _, status := range []string{StateOK, StateDegraded, StateDraining} {
+		value := 0.0
+		if status == current.Status {
+			value = 1
+		}
+		gatewayState.WithLabelValues(status).Set(value)
+	}
+
+	if changed {
+		m.logger.Infow("gateway state changed",
+			"from", previous.Status,
+			"to", current.Status,
+			"redis", current.Redis,
+			"open_breakers", current.OpenBreakers,
+			"ejected_targets", current.EjectedTargets)
+		m.notify(ctx, StateTransition{Previous: previous, Current: current})
+	}
+	return current
+}
+
+func (m *StateMonitor) sample(ctx context.Context) GatewayState {
+	now := time.Now()
+	state := GatewayState{Redis: RedisDisabled, Since: now, CheckedAt: now}
+
+	m.mu.Lock()
+	state.Draining = m.draining
+	m.mu.Unlock()
+
+	if m.redis != nil {
+		pingCtx, cancel := context.WithTimeout(ctx, m.interval)
+		err := m.redis.Ping(pingCtx)
+		cancel()
+		state.Redis = RedisUp
+		if err != nil {
+			state.Redis = RedisDown
+		}
+	}
+
+	if m.routes != nil {
+		for _, breaker := range m.routes.Breakers() {
+			if breaker.State != BreakerClosed {
+				state.OpenBreakers = append(state.OpenBreakers, breaker.Target)
+			}
+		}
+		state.EjectedTargets = m.routes.Ejected()
+	}
+
+	switch {
+	case state.Draining:
+		state.Status = StateDraining
+	case state.Redis == RedisDown || len(state.OpenBreakers) > 0 || len(state.EjectedTargets) > 0:
+		state.Status = StateDegraded
+	default:
+		state.Status = StateOK
+	}
+	return state
+}
+
+// Webhooks are called one after another, each with its own deadline so a
+// slow receiver can't hold up the next check indefinitely
+func (m *StateMonitor) notify(ctx context.Context, transition StateTransition) {
+	if m.client == nil {
+		return
+	}
+	for _, webhook := range m.webhooks {
+		callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if _, err := m.client.PostJsonReq(callCtx, webhook, transition, nil); err != nil {
+			m.logger.Warnw("calling state webhook", "url", webhook, "error", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Redis going down is a transition: the webhook hears about it, the gauge
+// and the admin endpoint show the gateway degraded
+func TestStateMonitorRedisDown(t *testing.T) {
+	r, server := newTestRedis(t)
+	transitions := make(chan StateTransition, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var transition StateTransition
+		if err := json.NewDecoder(request.Body).Decode(&transition); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		transitions <- transition
+	}))
+	defer webhook.Close()
+
+	monitor := NewStateMonitor(r, nil, NewHttpClient(nil, testLogger()), []string{webhook.URL}, 200*time.Millisecond, testLogger())
+	mux := http.NewServeMux()
+	NewAdminAPI(r, nil, NewAuditLogger(testLogger(), nil, ""), nil, monitor, testLogger(), "admin-secret").Register(mux)
+	adminState := func() GatewayState {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/admin/state", nil)
+		request.Header.Set(AdminTokenHeader, "admin-secret")
+		response := serve(mux, request)
+		var state GatewayState
+		if err := json.Unmarshal(response.Body.Bytes(), &state); err != nil {
+			t.Fatalf("state endpoint answered %d %q: %v", response.Code, response.Body, err)
+		}
+		return state
+	}
+
+	// Disabled to up is a change of its own
+	if state := monitor.Check(context.Background()); state.Status != StateOK || state.Redis != RedisUp {
+		t.Fatalf("first check = %+v, want ok with Redis up", state)
+	}
+	<-transitions
+	since := monitor.State().Since
+	monitor.Check(context.Background())
+	if len(transitions) != 0 || !monitor.State().Since.Equal(since) {
+		t.Error("an unchanged check fired the webhook or moved Since")
+	}
+
+	server.Close()
+	if state := monitor.Check(context.Background()); state.Status != StateDegraded || state.Redis != RedisDown {
+		t.Fatalf("check with Redis gone = %+v, want degraded with Redis down", state)
+	}
+	select {
+	case transition := <-transitions:
+		if transition.Previous.Status != StateOK || transition.Current.Status != StateDegraded || transition.Current.Redis != RedisDown {
+			t.Errorf("transition = %s to %s (redis %s), want ok to degraded with Redis down",
+				transition.Previous.Status, transition.Current.Status, transition.Current.Redis)
+		}
+	default:
+		t.Fatal("webhook wasn't called on the transition")
+	}
+
+	if state := adminState(); state.Status != StateDegraded || state.Redis != RedisDown {
+		t.Errorf("/admin/state = %+v, want degraded with Redis down", state)
+	}
+	if got := testutil.ToFloat64(gatewayState.WithLabelValues(StateDegraded)); got != 1 {
+		t.Errorf("degraded gauge = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(gatewayState.WithLabelValues(StateOK)); got != 0 {
+		t.Errorf("ok gauge = %v, want 0", got)
+	}
+}
+
+func TestStateMonitorDrainingWins(t *testing.T) {
+	monitor := NewStateMonitor(nil, nil, nil, nil, 0, testLogger())
+	monitor.SetDraining(true)
+	if state := monitor.Check(context.Background()); state.Status != StateDraining || !state.Draining {
+		t.Errorf("state = %+v, want draining", state)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// Set at build time with -ldflags "-X main.Version=v1.2.3"
+var Version = "dev"
+
+// What the status page at / reports, see Config.StatusPage
+type StatusPage struct {
+	Version       string        `json:"version"`
+	Started       time.Time     `json:"started"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Routes        int           `json:"routes"`
+	Health        *StatusHealth `json:"health,omitempty"` // nil without a StateMonitor
+}
+
+// A GatewayState summary. The page is public, so breakers and ejections are
+// counted rather than naming targets
+type StatusHealth struct {
+	Status         string `json:"status"`
+	Redis          string `json:"redis"`
+	OpenBreakers   int    `json:"open_breakers"`
+	EjectedTargets int    `json:"ejected_targets"`
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>lattice</title>
+</head>
+<body>
+<h1>lattice {{.Version}}</h1>
+<dl>
+<dt>Up since</dt><dd>{{.Started.Format "2006-01-02 15:04:05 MST"}} ({{.UptimeSeconds}}s)</dd>
+<dt>Routes</dt><dd>{{.Routes}}</dd>
+{{with .Health}}<dt>Status</dt><dd>{{.Status}}</dd>
+<dt>Redis</dt><dd>{{.Redis}}</dd>
+<dt>Open breakers</dt><dd>{{.OpenBreakers}}</dd>
+<dt>Ejected targets</dt><dd>{{.EjectedTargets}}</dd>
+{{end}}</dl>
+</body>
+</html>
+`))
+
+// SetStateMonitor adds the gateway's health to the status page
+func (m *RouteManager) SetStateMonitor(state *StateMonitor) {
+	m.state.Store(state)
+}
+
+func (m *RouteManager) statusPage() StatusPage {
+	page := StatusPage{
+		Version:       Version,
+		Started:       m.started,
+		UptimeSeconds: int64(time.Since(m.started).Seconds()),
+	}
+	if table := m.table.Load(); table != nil {
+		page.Routes = table.routes
+	}
+	if state := m.state.Load(); state != nil {
+		current := state.State()
+		page.Health = &StatusHealth{
+			Status:         current.Status,
+			Redis:          current.Redis,
+			OpenBreakers:   len(current.OpenBreakers),
+			EjectedTargets: len(current.EjectedTargets),
+		}
+	}
+	return page
+}
+
+// Answers requests no route matched: the status page for / itself, when it's
+// enabled, and 404 for everything else. Browsers get the page as HTML,
+// everyone else as JSON
+func (m *RouteManager) unmatchedHandler() http.Handler {
+	notFound := m.errorPages.Handler(http.StatusNotFound, "")
+	if !m.config.StatusPage {
+		return notFound
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/" {
+			notFound.ServeHTTP(writer, request)
+			return
+		}
+
+		page := m.statusPage()
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.Header().Add("Vary", "Accept")
+		if preferredErrorFormat(request.Header.Get("Accept")) == "html" {
+			writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := statusPageTemplate.Execute(writer, page); err != nil {
+				m.logger.Warnw("rendering status page", "error", err)
+			}
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(page)
+	})
+}
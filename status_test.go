@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newStatusPageRoutes(t *testing.T, statusPage bool) (*RouteManager, *Redis) {
+	t.Helper()
+	r, _ := newTestRedis(t)
+	m := NewRouteManager(Config{StatusPage: statusPage}, r, testLogger(), nil)
+	upstream := newTestUpstream(t, "proxied")
+	storeRoute(t, r, m, testRoute("/orders", upstream.URL))
+	storeRoute(t, r, m, testRoute("/users", upstream.URL))
+	return m, r
+}
+
+func TestStatusPageJSON(t *testing.T) {
+	m, r := newStatusPageRoutes(t, true)
+	m.SetStateMonitor(NewStateMonitor(r, m, NewHttpClient(nil, testLogger()), nil, 0, testLogger()))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Accept", "application/json")
+	response := serve(m, request)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s, want a 200 JSON page", response.Code, response.Header().Get("Content-Type"))
+	}
+	var page StatusPage
+	if err := json.Unmarshal(response.Body.Bytes(), &page); err != nil {
+		t.Fatalf("decoding %q: %v", response.Body, err)
+	}
+	// The built-in routes count too
+	if want := len(defaultRoutes) + 2; page.Version != Version || page.Routes != want || page.Started.IsZero() {
+		t.Errorf("page = %+v, want the version, start time and %d routes", page, want)
+	}
+	if page.Health == nil {
+		t.Error("page has no health summary with a StateMonitor set")
+	}
+	if got := response.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+
+	// Only / itself, everything else unmatched still 404s
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/missing", nil)).Code; got != http.StatusNotFound {
+		t.Errorf("unmatched path: status = %d, want 404", got)
+	}
+}
+
+func TestStatusPageHTML(t *testing.T) {
+	m, _ := newStatusPageRoutes(t, true)
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	response := serve(m, request)
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Content-Type = %q, want HTML for a browser", response.Header().Get("Content-Type"))
+	}
+	body := response.Body.String()
+	if !strings.Contains(body, "lattice "+Version) || !strings.Contains(body, fmt.Sprintf("<dd>%d</dd>", len(defaultRoutes)+2)) {
+		t.Errorf("page %q doesn't show the version and route count", body)
+	}
+	// No StateMonitor, no health section
+	if strings.Contains(body, "Open breakers") {
+		t.Error("page shows health without a StateMonitor")
+	}
+}
+
+func TestStatusPageYieldsToRootRoute(t *testing.T) {
+	m, r := newStatusPageRoutes(t, true)
+	storeRoute(t, r, m, testRoute("/", newTestUpstream(t, "root route").URL))
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/", nil)).Body.String(); got != "root route" {
+		t.Errorf("body = %q, want the configured / route's", got)
+	}
+}
+
+func TestStatusPageOff(t *testing.T) {
+	m, _ := newStatusPageRoutes(t, false)
+	if got := serve(m, httptest.NewRequest(http.MethodGet, "/", nil)).Code; got != http.StatusNotFound {
+		t.Errorf("status = %d, want the 404 with the page off", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrRequestTimeout is the cause of request contexts canceled by
+// TimeoutMiddleware, see context.Cause
+var ErrRequestTimeout = errors.New("request timed out")
+
+// TimeoutMiddleware cancels the request's context once it has run for
+// timeout, so the upstream call is abandoned, and answers 504 if nothing has
+// been written yet. Responses already under way are cut off. The server
+// applies it to every request with Config.RequestTimeout; applying it again
+// further in, as routes do, replaces that timeout, still counted from when
+// the request arrived. A timeout of zero or less lifts it. Upgraded
+// (WebSocket) connections stop the clock once they're hijacked, event
+// streams have to opt out
+func TimeoutMiddleware(timeout time.Duration, errorPages *ErrorRenderer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			request, rc := ensureRequestContext(request)
+
+			rc.mu.Lock()
+			timer := rc.timeout
+			rc.mu.Unlock()
+			if timer == nil {
+				var ctx context.Context
+				timer = &requestTimer{start: time.Now()}
+				ctx, timer.cancel = context.WithCancelCause(request.Context())
+				defer timer.cancel(nil)
+				request = request.WithContext(ctx)
+				rc.set(func() { rc.timeout = timer })
+			}
+			timer.reset(timeout)
+
+			tw := &timeoutWriter{ResponseWriter: writer, timer: timer}
+			next.ServeHTTP(tw, request)
+
+			if !tw.wrote && timedOut(request.Context()) {
+				errorPages.Render(tw, request, http.StatusGatewayTimeout, "")
+			}
+		})
+	}
+}
+
+// Whether ctx was canceled by TimeoutMiddleware
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrRequestTimeout)
+}
+
+// The clock TimeoutMiddleware starts for a request, kept in its
+// RequestContext so routes can reset it
+type requestTimer struct {
+	start  time.Time
+	cancel context.CancelCauseFunc
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// Times out the request timeout after it started, never with zero or less
+func (t *requestTimer) reset(timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if timeout <= 0 {
+		return
+	}
+	t.timer = time.AfterFunc(max(time.Until(t.start.Add(timeout)), 0), func() {
+		t.cancel(ErrRequestTimeout)
+	})
+}
+
+// Tracks whether the response has started, in which case it's too late for
+// the 504
+type timeoutWriter struct {
+	http.ResponseWriter
+	timer *requestTimer
+	wrote bool
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.wrote = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Flush() {
+	w.wrote = true
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// The request is over once the connection has been upgraded
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.wrote = true
+		w.timer.reset(0)
+	}
+	return conn, buf, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// An upstream taking delay to answer, or until the request is abandoned.
+// canceled receives once for each abandoned request
+func newSlowUpstream(t *testing.T, delay time.Duration) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	canceled := make(chan struct{}, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-time.After(delay):
+			writer.Write([]byte("slow"))
+		case <-request.Context().Done():
+			canceled <- struct{}{}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, canceled
+}
+
+func TestDefaultRequestTimeout(t *testing.T) {
+	upstream, canceled := newSlowUpstream(t, 5*time.Second)
+	m := NewRouteManager(Config{RequestTimeout: 50 * time.Millisecond}, nil, testLogger(), nil)
+	handler := buildTestRoute(t, m, testRoute("/slow", upstream.URL))
+
+	started := time.Now()
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if response.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want 504", response.Code)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("took %v, want the timeout to cut the request short", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("upstream request wasn't canceled")
+	}
+}
+
+func TestRouteOverridesRequestTimeout(t *testing.T) {
+	upstream, _ := newSlowUpstream(t, 100*time.Millisecond)
+	m := NewRouteManager(Config{RequestTimeout: 20 * time.Millisecond}, nil, testLogger(), nil)
+	for _, tc := range []struct {
+		name    string
+		timeout float32
+		want    int
+	}{
+		{"server default", 0, http.StatusGatewayTimeout},
+		{"longer", 2, http.StatusOK},
+		{"lifted", -1, http.StatusOK},
+	} {
+		cfg := testRoute("/slow", upstream.URL)
+		cfg.RequestTimeout = tc.timeout
+		if got := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, "/slow", nil)).Code; got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The route's timeout replaces the server's, counted from when the request
+// arrived at the outer one
+func TestNestedTimeoutsReplaceEachOther(t *testing.T) {
+	slow := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			writer.Write([]byte("done"))
+		case <-request.Context().Done():
+		}
+	})
+	for _, tc := range []struct {
+		name         string
+		outer, inner time.Duration
+		want         int
+	}{
+		{"tighter route", time.Hour, 20 * time.Millisecond, http.StatusGatewayTimeout},
+		{"looser route", 20 * time.Millisecond, time.Hour, http.StatusOK},
+		{"lifted by the route", 20 * time.Millisecond, 0, http.StatusOK},
+	} {
+		handler := TimeoutMiddleware(tc.outer, nil)(TimeoutMiddleware(tc.inner, nil)(slow))
+		if got := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil)).Code; got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// Time spent before the route's middleware counts against its timeout
+	handler := TimeoutMiddleware(time.Hour, nil)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+		TimeoutMiddleware(50*time.Millisecond, nil)(slow).ServeHTTP(writer, request)
+	}))
+	started := time.Now()
+	serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	if elapsed := time.Since(started); elapsed >= 100*time.Millisecond {
+		t.Errorf("took %v, want the route's timeout already spent on arrival", elapsed)
+	}
+}
+
+// Once the response has started it's too late for a 504, the response is
+// cut off instead
+func TestTimeoutAfterResponseStarted(t *testing.T) {
+	handler := TimeoutMiddleware(20*time.Millisecond, nil)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("partial"))
+		<-request.Context().Done()
+	}))
+	response := serve(handler, httptest.NewRequest(http.MethodGet, "/", nil))
+	if response.Code != http.StatusOK || response.Body.String() != "partial" {
+		t.Errorf("got %d %q, want the partial 200 left alone", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Adapts a route's traffic in code: Request runs on the incoming request
+// before it's proxied (path, headers, query...), Response on the upstream's
+// response before it's copied to the client. Either may be nil
+type Transformer struct {
+	Request  func(*http.Request) error
+	Response func(*http.Response) error
+}
+
+// Transformers routes can refer to by name, see RouteConfig.Transformers.
+// Registered once at startup and kept across reloads
+type TransformerRegistry struct {
+	mu           sync.RWMutex
+	transformers map[string]Transformer
+}
+
+func NewTransformerRegistry() *TransformerRegistry {
+	return &TransformerRegistry{transformers: make(map[string]Transformer)}
+}
+
+// Register adds a transformer under name. Names can't be reused
+func (r *TransformerRegistry) Register(name string, transformer Transformer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == "" {
+		return fmt.Errorf("transformer needs a name")
+	}
+	if _, ok := r.transformers[name]; ok {
+		return fmt.Errorf("transformer %q already registered", name)
+	}
+	r.transformers[name] = transformer
+	return nil
+}
+
+// Names of the registered transformers, sorted
+func (r *TransformerRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.transformers))
+	for name := range r.transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The transformers called names, in order. Any unregistered name is an error
+func (r *TransformerRegistry) resolve(names []string) ([]Transformer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	transformers := make([]Transformer, 0, len(names))
+	for _, name := range names {
+		transformer, ok := r.transformers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q", name)
+		}
+		transformers = append(transformers, transformer)
+	}
+	return transformers, nil
+}
+
+// TransformRequests runs each transformer's Request hook, in order, on
+// requests before they go upstream. A failing hook ends the request with a
+// 500, it's the gateway's own adaptation that broke
+func TransformRequests(transformers []Transformer, errorPages *ErrorRenderer, logger *zap.SugaredLogger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			for _, transformer := range transformers {
+				if transformer.Request == nil {
+					continue
+				}
+				if err := transformer.Request(request); err != nil {
+					requestLogger(logger, request.Context()).Errorw("request transformer failed", "error", err)
+					errorPages.Render(writer, request, http.StatusInternalServerError, "")
+					return
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// Runs each transformer's Response hook, in order. An error is handled like
+// a failed upstream request
+func transformResponses(transformers []Transformer) responseModifier {
+	return func(resp *http.Response) error {
+		for _, transformer := range transformers {
+			if transformer.Response == nil {
+				continue
+			}
+			if err := transformer.Response(resp); err != nil {
+				return fmt.Errorf("transforming response: %w", err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransformersRewriteHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("X-Internal", "secret")
+		writer.Write([]byte(request.Header.Get("X-Tenant")))
+	}))
+	defer upstream.Close()
+
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	registry := NewTransformerRegistry()
+	err := registry.Register("tenant", Transformer{
+		Request: func(request *http.Request) error {
+			request.Header.Set("X-Tenant", "acme")
+			return nil
+		},
+		Response: func(response *http.Response) error {
+			response.Header.Del("X-Internal")
+			response.Header.Set("X-Transformed", "yes")
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetTransformers(registry)
+
+	cfg := testRoute("/api", upstream.URL)
+	cfg.Transformers = []string{"tenant"}
+	response := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, "/api", nil))
+	if got := response.Body.String(); got != "acme" {
+		t.Errorf("upstream saw X-Tenant %q, want acme", got)
+	}
+	if response.Header().Get("X-Internal") != "" || response.Header().Get("X-Transformed") != "yes" {
+		t.Errorf("response headers %v, want X-Internal removed and X-Transformed set", response.Header())
+	}
+}
+
+func TestFailingRequestTransformer(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { calls++ }))
+	defer upstream.Close()
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	registry := NewTransformerRegistry()
+	registry.Register("broken", Transformer{Request: func(*http.Request) error { return errors.New("bug") }})
+	m.SetTransformers(registry)
+
+	cfg := testRoute("/api", upstream.URL)
+	cfg.Transformers = []string{"broken"}
+	response := serve(buildTestRoute(t, m, cfg), httptest.NewRequest(http.MethodGet, "/api", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", response.Code)
+	}
+	if calls != 0 {
+		t.Errorf("upstream called %d times, want none", calls)
+	}
+}
+
+func TestTransformerRegistry(t *testing.T) {
+	registry := NewTransformerRegistry()
+	if err := registry.Register("a", Transformer{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("a", Transformer{}); err == nil {
+		t.Error("registering a name twice succeeded")
+	}
+	if err := registry.Register("", Transformer{}); err == nil {
+		t.Error("registering without a name succeeded")
+	}
+
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	m.SetTransformers(registry)
+	cfg := testRoute("/api", "http://localhost")
+	cfg.Transformers = []string{"a", "missing"}
+	if _, err := m.buildRoute(cfg); err == nil {
+		t.Error("route referring to an unregistered transformer was built")
+	}
+}
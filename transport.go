@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transports shared between routes, keyed by their settings. A gateway with
+// hundreds of routes typically has a handful of distinct configs, so this
+// keeps connection pools (and their idle-conn goroutines) per config rather
+// than per route. The pool outlives reloads, so rebuilding the route table
+// doesn't throw away warm connections.
+//
+// Transports no route uses after a reload are dropped by prune. Only their
+// idle connections are closed: requests still in flight on the old table hold
+// the transport themselves and finish normally, and the connections they
+// release are closed once IdleConnTimeout passes
+type transportPool struct {
+	mu         sync.Mutex
+	generation int
+	transports map[Transport]*pooledTransport
+}
+
+type pooledTransport struct {
+	transport upstreamTransport
+	lastUsed  int // Generation of the last reload that used it
+}
+
+// An *http.Transport, possibly wrapped
+type upstreamTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+func newTransportPool() *transportPool {
+	return &transportPool{transports: make(map[Transport]*pooledTransport)}
+}
+
+func (p *transportPool) get(cfg Transport) http.RoundTripper {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.transports[cfg]; ok {
+		t.lastUsed = p.generation
+		return t.transport
+	}
+	t := &pooledTransport{transport: newTransport(cfg), lastUsed: p.generation}
+	p.transports[cfg] = t
+	return t.transport
+}
+
+// Starts a new generation. Transports fetched with get from here on are kept
+// by the matching prune
+func (p *transportPool) nextGeneration() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generation++
+	return p.generation
+}
+
+// Drops transports not fetched since generation started
+func (p *transportPool) prune(generation int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for cfg, t := range p.transports {
+		if t.lastUsed < generation {
+			t.transport.CloseIdleConnections()
+			delete(p.transports, cfg)
+		}
+	}
+}
+
+// Number of distinct transports built so far
+func (p *transportPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.transports)
+}
+
+// A bare host name or IP, without a port
+func validTLSServerName(name string) bool {
+	if net.ParseIP(name) != nil {
+		return true
+	}
+	return !strings.Contains(name, ":") && validUpstreamHost(name)
+}
+
+func newTransport(cfg Transport) upstreamTransport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   secondsToDuration(float64(cfg.DialTimeout)),
+			KeepAlive: 30 * time.Second,
+		}
+		t.DialContext = dialer.DialContext
+	}
+	if cfg.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = secondsToDuration(float64(cfg.TLSHandshakeTimeout))
+	}
+	if cfg.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = secondsToDuration(float64(cfg.ResponseHeaderTimeout))
+	}
+	if cfg.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = secondsToDuration(float64(cfg.IdleConnTimeout))
+	}
+	if cfg.MaxIdleConns > 0 {
+		t.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		// The overall cap would otherwise undercut a generous per-host pool
+		if t.MaxIdleConns != 0 {
+			t.MaxIdleConns = max(t.MaxIdleConns, cfg.MaxIdleConnsPerHost)
+		}
+	}
+	t.DisableKeepAlives = cfg.DisableKeepAlives
+	// Go's default allows 10mb of headers per response
+	t.MaxResponseHeaderBytes = 1 << 20
+	if cfg.MaxResponseHeaderBytes > 0 {
+		t.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	}
+	// Checked when the route was built
+	if proxy, err := egressProxy(cfg.Proxy, cfg.NoProxy); err == nil {
+		t.Proxy = proxy
+	}
+	if cfg.InsecureSkipVerify || cfg.TLSServerName != "" {
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			ServerName:         cfg.TLSServerName,
+		}
+	}
+
+	if cfg.DNSRefresh > 0 {
+		cache := newDNSCache(net.DefaultResolver, secondsToDuration(float64(cfg.DNSRefresh)), t.DialContext)
+		cache.onChange = t.CloseIdleConnections
+		t.DialContext = cache.DialContext
+		return &dnsRefreshTransport{Transport: t, cache: cache}
+	}
+	return t
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOversizedUpstreamHeadersGet502(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Query().Get("huge") != "" {
+			writer.Header().Set("X-Padding", strings.Repeat("a", 64<<10))
+		}
+		writer.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/svc", upstream.URL)
+	cfg.Retry.Attempts = 1
+	cfg.Transport.MaxResponseHeaderBytes = 16 << 10
+	route := buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg)
+
+	if got := serve(route, httptest.NewRequest(http.MethodGet, "/svc", nil)); got.Code != http.StatusOK {
+		t.Fatalf("small headers: status %d, want 200", got.Code)
+	}
+	response := serve(route, httptest.NewRequest(http.MethodGet, "/svc?huge=1", nil))
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("oversized headers: status %d, want 502", response.Code)
+	}
+	if response.Header().Get("X-Padding") != "" {
+		t.Error("oversized header was passed on")
+	}
+}
+
+func TestDefaultMaxResponseHeaderBytes(t *testing.T) {
+	transport := newTransport(Transport{}).(*http.Transport)
+	if transport.MaxResponseHeaderBytes != 1<<20 {
+		t.Errorf("MaxResponseHeaderBytes = %d, want the 1mb default", transport.MaxResponseHeaderBytes)
+	}
+}
+
+func TestDisableKeepAlivesPerRoute(t *testing.T) {
+	m := NewRouteManager(Config{}, nil, testLogger(), nil)
+	for _, tc := range []struct {
+		name      string
+		disable   bool
+		wantConns int32
+	}{
+		{"reused", false, 1},
+		{"fresh per request", true, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, conns := newCountingUpstream(t, "ok")
+			cfg := testRoute("/svc", upstream.URL)
+			cfg.Transport.DisableKeepAlives = tc.disable
+			route := buildTestRoute(t, m, cfg)
+
+			for i := range 5 {
+				if got := serve(route, httptest.NewRequest(http.MethodGet, "/svc", nil)); got.Code != http.StatusOK {
+					t.Fatalf("request %d: status %d", i+1, got.Code)
+				}
+			}
+			if got := conns.Load(); got != tc.wantConns {
+				t.Errorf("5 requests opened %d connections, want %d", got, tc.wantConns)
+			}
+		})
+	}
+}
+
+// A per-host pool bigger than the overall cap raises the cap with it
+func TestGenerousIdlePools(t *testing.T) {
+	transport := newTransport(Transport{MaxIdleConnsPerHost: 500}).(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 500 || transport.MaxIdleConns < 500 {
+		t.Errorf("idle pools = %d per host, %d overall, want 500 and at least 500", transport.MaxIdleConnsPerHost, transport.MaxIdleConns)
+	}
+	transport = newTransport(Transport{MaxIdleConns: 50, MaxIdleConnsPerHost: 20}).(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 20 || transport.MaxIdleConns != 50 {
+		t.Errorf("idle pools = %d per host, %d overall, want 20 and 50", transport.MaxIdleConnsPerHost, transport.MaxIdleConns)
+	}
+}
+
+// An HTTPS upstream whose certificate names only host, no IPs, and a pool
+// trusting it
+func newNamedTLSUpstream(t *testing.T, host string) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.TLS.ServerName))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	// Rejected handshakes are the point, not worth logging
+	upstream.Config.ErrorLog = log.New(io.Discard, "", 0)
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream, pool
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	upstream, pool := newNamedTLSUpstream(t, "backend.internal")
+	// Dialed by IP, which the certificate doesn't name
+	if !strings.HasPrefix(upstream.URL, "https://127.0.0.1:") {
+		t.Fatalf("upstream at %s, want an IP", upstream.URL)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		serverName string
+		wantErr    bool
+	}{
+		{"without override", "", true},
+		{"with override", "backend.internal", false},
+		{"wrong name", "other.internal", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := newTransport(Transport{TLSServerName: tc.serverName}).(*http.Transport)
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			// Trust the test certificate, keeping everything else the route set
+			transport.TLSClientConfig.RootCAs = pool
+			defer transport.CloseIdleConnections()
+
+			response, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+			if tc.wantErr {
+				if err == nil {
+					response.Body.Close()
+					t.Fatal("handshake succeeded, want the certificate rejected")
+				}
+				if !strings.Contains(err.Error(), "certificate") {
+					t.Errorf("err = %v, want a certificate error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if sni, _ := io.ReadAll(response.Body); string(sni) != tc.serverName {
+				t.Errorf("upstream saw SNI %q, want %q", sni, tc.serverName)
+			}
+		})
+	}
+
+	// A port or an invalid host is no server name
+	for _, invalid := range []string{"backend.internal:443", "bad host"} {
+		cfg := testRoute("/svc", upstream.URL)
+		cfg.Transport.TLSServerName = invalid
+		if _, err := NewRouteManager(Config{}, nil, testLogger(), nil).buildRoute(cfg); err == nil {
+			t.Errorf("TLS server name %q accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+func isWebSocketUpgrade(request *http.Request) bool {
+	return headerHasToken(request.Header, "Connection", "upgrade") &&
+		strings.EqualFold(request.Header.Get("Upgrade"), "websocket")
+}
+
+// Whether a comma-separated header lists token, case-insensitively
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketMiddleware checks WebSocket upgrades before they are proxied.
+// Browsers send an Origin with every upgrade, so requests from origins not in
+// allowedOrigins get 403; an empty list allows any, "*" does too, and
+// "https://*.example.com" allows subdomains. Clients without an Origin aren't
+// browsers and aren't subject to cross-site hijacking, so they pass. When
+// subprotocols is set, only those are offered to the upstream and clients
+// offering none of them get 400. Other requests pass through untouched
+func WebSocketMiddleware(allowedOrigins []string, subprotocols []string, logger *zap.SugaredLogger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if !isWebSocketUpgrade(request) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			origin := request.Header.Get("Origin")
+			if origin != "" && !originAllowed(origin, allowedOrigins) {
+				requestLogger(logger, request.Context()).Warnw("rejecting websocket upgrade from disallowed origin",
+					"path", request.URL.Path,
+					"origin", origin)
+				http.Error(writer, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+
+			if len(subprotocols) > 0 {
+				offered := negotiableSubprotocols(request.Header, subprotocols)
+				if len(offered) == 0 {
+					http.Error(writer, "No supported WebSocket subprotocol", http.StatusBadRequest)
+					return
+				}
+				request.Header.Set("Sec-WebSocket-Protocol", strings.Join(offered, ", "))
+			}
+
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func originAllowed(origin string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		// "https://*.example.com" matches "https://api.example.com"
+		if scheme, host, ok := strings.Cut(pattern, "://*."); ok {
+			prefix := scheme + "://"
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The client's offered subprotocols that are supported, in the client's
+// order of preference
+func negotiableSubprotocols(header http.Header, supported []string) []string {
+	var offered []string
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			for _, s := range supported {
+				if protocol == s {
+					offered = append(offered, protocol)
+					break
+				}
+			}
+		}
+	}
+	return offered
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends a WebSocket upgrade to the server at addr, returning its response
+func sendUpgrade(t *testing.T, addr string, origin string, protocols string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := "GET /ws HTTP/1.1\r\nHost: lattice\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if origin != "" {
+		request += "Origin: " + origin + "\r\n"
+	}
+	if protocols != "" {
+		request += "Sec-WebSocket-Protocol: " + protocols + "\r\n"
+	}
+	fmt.Fprint(conn, request+"\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestWebSocketOriginsAndSubprotocols(t *testing.T) {
+	// Accepts every upgrade, picking the first subprotocol it was offered
+	offered := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		protocols := request.Header.Get("Sec-WebSocket-Protocol")
+		offered <- protocols
+		conn, buf, err := http.NewResponseController(writer).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		chosen, _, _ := strings.Cut(protocols, ",")
+		fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: %s\r\n\r\n", chosen)
+		buf.Flush()
+	}))
+	defer upstream.Close()
+
+	cfg := testRoute("/ws", upstream.URL)
+	cfg.WSAllowedOrigins = []string{"https://app.example.com", "https://*.trusted.com"}
+	cfg.WSSubprotocols = []string{"graphql-ws", "json.v1"}
+	gateway := httptest.NewServer(buildTestRoute(t, NewRouteManager(Config{}, nil, testLogger(), nil), cfg))
+	defer gateway.Close()
+	addr := gateway.Listener.Addr().String()
+
+	tests := []struct {
+		name         string
+		origin       string
+		protocols    string
+		wantStatus   int
+		wantOffered  string // What the upstream was offered, when it's reached
+		wantProtocol string
+	}{
+		{"allowed origin", "https://app.example.com", "json.v1", http.StatusSwitchingProtocols, "json.v1", "json.v1"},
+		{"allowed subdomain", "https://eu.trusted.com", "graphql-ws", http.StatusSwitchingProtocols, "graphql-ws", "graphql-ws"},
+		{"unsupported protocols filtered", "https://app.example.com", "mqtt, json.v1, graphql-ws", http.StatusSwitchingProtocols, "json.v1, graphql-ws", "json.v1"},
+		{"no origin", "", "json.v1", http.StatusSwitchingProtocols, "json.v1", "json.v1"},
+		{"disallowed origin", "https://evil.example.net", "json.v1", http.StatusForbidden, "", ""},
+		{"lookalike subdomain", "https://eviltrusted.com", "json.v1", http.StatusForbidden, "", ""},
+		{"no supported protocol", "https://app.example.com", "mqtt", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := sendUpgrade(t, addr, tt.origin, tt.protocols)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusSwitchingProtocols {
+				select {
+				case got := <-offered:
+					t.Errorf("rejected upgrade reached the upstream offering %q", got)
+				default:
+				}
+				return
+			}
+			if got := <-offered; got != tt.wantOffered {
+				t.Errorf("upstream offered %q, want %q", got, tt.wantOffered)
+			}
+			if got := response.Header.Get("Sec-WebSocket-Protocol"); got != tt.wantProtocol {
+				t.Errorf("negotiated %q, want %q", got, tt.wantProtocol)
+			}
+		})
+	}
+}